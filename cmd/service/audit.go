@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/audit"
+	"appcenter-agent/internal/config"
+
+	"gopkg.in/yaml.v3"
+)
+
+const auditShipInterval = 5 * time.Minute
+
+func auditPath(cfg *config.Config) string {
+	if cfg != nil && cfg.Audit.File != "" {
+		return cfg.Audit.File
+	}
+	return audit.DefaultPath()
+}
+
+// openAuditLog never fails the service: without an audit log the agent keeps
+// working and the reason is logged.
+func openAuditLog(cfg *config.Config, logger *log.Logger) *audit.Log {
+	l, err := audit.Open(auditPath(cfg))
+	if err != nil {
+		logger.Printf("audit: log disabled: %v", err)
+		return nil
+	}
+	return l
+}
+
+func recordAudit(l *audit.Log, logger *log.Logger, event string, fields audit.Fields) {
+	if err := l.Record(event, fields); err != nil {
+		logger.Printf("audit: record %s failed: %v", event, err)
+	}
+}
+
+// runAuditShipper periodically forwards new audit records to the server.
+func runAuditShipper(ctx context.Context, l *audit.Log, client *api.Client, creds api.CredentialProvider, logger *log.Logger) {
+	shipper := audit.NewShipper(l.Path(), func(ctx context.Context, records []audit.Envelope) error {
+		agentUUID, secret := creds.Current()
+		return client.SubmitAuditRecords(ctx, agentUUID, secret, records)
+	})
+	shipper.OnBadLines = func(lines []int) {
+		logger.Printf("audit: skipped %d malformed line(s) while shipping: %v", len(lines), lines)
+	}
+	ticker := time.NewTicker(auditShipInterval)
+	defer ticker.Stop()
+	for {
+		sctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		if err := shipper.Flush(sctx); err != nil {
+			logger.Printf("audit: ship failed: %v", err)
+		}
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runAuditCLI implements `appcenter-service audit verify [--file path]`.
+func runAuditCLI(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(stderr, "usage: appcenter-service audit verify [--file path]")
+		return 2
+	}
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("file", "", "audit log path (default: audit.file from config)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	path := *file
+	if path == "" {
+		path = auditPath(peekConfig(resolveConfigPath()))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "audit verify: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	res, verr := audit.Verify(f)
+	out := map[string]any{
+		"file":      path,
+		"records":   res.Records,
+		"last_seq":  res.LastSeq,
+		"head_hash": res.HeadHash,
+		"status":    "ok",
+	}
+	if verr != nil {
+		out["status"] = "error"
+		out["error"] = verr.Error()
+	}
+	b, _ := json.MarshalIndent(out, "", "  ")
+	fmt.Fprintln(stdout, string(b))
+	if verr != nil {
+		return 2
+	}
+	return 0
+}
+
+// peekConfig reads config.yaml without defaults, overrides or secret
+// migration; the CLI only needs a few paths from it.
+func peekConfig(path string) *config.Config {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var cfg config.Config
+	if yaml.Unmarshal(b, &cfg) != nil {
+		return nil
+	}
+	return &cfg
+}
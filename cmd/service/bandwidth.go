@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"appcenter-agent/internal/bandwidth"
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/remotesupport"
+)
+
+const pauseRemoteSupport = "remote_support"
+
+// bandwidthControl keeps the shared download limiter in line with the local
+// download.* settings and the server's overrides of them.
+type bandwidthControl struct {
+	limiter *bandwidth.Limiter
+	logger  *log.Logger
+
+	mu       sync.Mutex
+	baseKBps int
+	profile  []config.BandwidthWindow
+	pauseRS  bool
+	rsActive bool
+}
+
+func newBandwidthControl(cfg config.Config, logger *log.Logger) *bandwidthControl {
+	b := &bandwidthControl{
+		limiter:  bandwidth.FromConfig(cfg),
+		logger:   logger,
+		baseKBps: cfg.Download.BandwidthLimitKBs,
+		profile:  cfg.Download.BandwidthProfile,
+		pauseRS:  cfg.Download.PauseDuringRemoteSupport,
+	}
+	return b
+}
+
+// applyServerConfig takes "bandwidth_limit_kbps", "bandwidth_profile" and
+// "pause_during_remote_support" from a heartbeat config or WS patch. Keys
+// that are absent leave the current value alone.
+func (b *bandwidthControl) applyServerConfig(serverConfig map[string]any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	changed := false
+	if _, ok := serverConfig["bandwidth_limit_kbps"]; ok {
+		if kbps := configInt(serverConfig, "bandwidth_limit_kbps", b.baseKBps); kbps >= 0 && kbps != b.baseKBps {
+			b.baseKBps = kbps
+			changed = true
+		}
+	}
+	if raw, ok := serverConfig["bandwidth_profile"]; ok {
+		profile, err := parseBandwidthProfile(raw)
+		if err != nil {
+			b.logger.Printf("bandwidth: server profile ignored: %v", err)
+		} else if !sameProfile(profile, b.profile) {
+			b.profile = profile
+			changed = true
+		}
+	}
+	if changed {
+		b.limiter.Configure(b.baseKBps, b.profile)
+		b.logger.Printf("bandwidth: limit %d KB/s, %d profile window(s) via server config", b.baseKBps, len(b.profile))
+	}
+	if v, ok := serverConfig["pause_during_remote_support"].(bool); ok && v != b.pauseRS {
+		b.pauseRS = v
+		b.logger.Printf("bandwidth: pause_during_remote_support=%t", v)
+		b.syncPauseLocked()
+	}
+}
+
+// remoteSupportState is the session manager's state observer.
+func (b *bandwidthControl) remoteSupportState(state remotesupport.SessionState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rsActive = state == remotesupport.StateActive
+	b.syncPauseLocked()
+}
+
+func (b *bandwidthControl) syncPauseLocked() {
+	if b.pauseRS && b.rsActive {
+		b.limiter.Pause(pauseRemoteSupport)
+		b.logger.Printf("bandwidth: downloads paused during remote support")
+		return
+	}
+	if len(b.limiter.Status().Paused) > 0 {
+		b.logger.Printf("bandwidth: downloads resumed")
+	}
+	b.limiter.Resume(pauseRemoteSupport)
+}
+
+func parseBandwidthProfile(raw any) ([]config.BandwidthWindow, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var profile []config.BandwidthWindow
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, err
+	}
+	for _, w := range profile {
+		if err := w.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return profile, nil
+}
+
+func sameProfile(a, b []config.BandwidthWindow) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/inventory"
+	"appcenter-agent/internal/queue"
+)
+
+// openCatalog opens the catalog mapping; without it only apps installed by
+// tasks are reported, as before.
+func openCatalog(logger *log.Logger) *inventory.Catalog {
+	c, err := inventory.OpenCatalog(inventory.DefaultCatalogPath())
+	if err != nil {
+		logger.Printf("catalog map disabled: %v", err)
+		return nil
+	}
+	return c
+}
+
+// installedApps reports the catalog apps found in the inventory, plus the
+// apps installed by tasks that no catalog rule covers.
+type installedApps struct {
+	queue   *queue.TaskQueue
+	catalog *inventory.Catalog
+}
+
+func (p installedApps) ConsumeAppsChanged() (bool, []api.InstalledApp) {
+	queueChanged, _ := p.queue.ConsumeAppsChanged()
+	catalogChanged := p.catalog.ConsumeChanged()
+	if !queueChanged && !catalogChanged {
+		return false, []api.InstalledApp{}
+	}
+	return true, p.merge()
+}
+
+func (p installedApps) CatalogRulesVersion() string {
+	return p.catalog.RulesVersion()
+}
+
+func (p installedApps) merge() []api.InstalledApp {
+	var apps []api.InstalledApp
+	for _, m := range p.catalog.Apps() {
+		apps = append(apps, api.InstalledApp{AppID: m.AppID, Version: m.Version, Source: api.InstalledSourceInventory})
+	}
+	for _, app := range p.queue.InstalledApps() {
+		// For covered apps the inventory is authoritative, also when it
+		// no longer finds an app a task installed.
+		if p.catalog.Covers(app.AppID) {
+			continue
+		}
+		app.Source = api.InstalledSourceTask
+		apps = append(apps, app)
+	}
+	if apps == nil {
+		return []api.InstalledApp{}
+	}
+	return apps
+}
+
+// catalogRulesSync fetches the catalog rules whenever the server announces a
+// new catalog_rules_version in its config.
+type catalogRulesSync struct {
+	mu         sync.Mutex
+	catalog    *inventory.Catalog
+	invManager *inventory.Manager
+	client     *api.Client
+	creds      api.CredentialProvider
+	logger     *log.Logger
+
+	// unsupported is the version a server without the endpoint announced;
+	// it is not fetched again.
+	unsupported string
+}
+
+func (s *catalogRulesSync) apply(ctx context.Context, serverConfig map[string]any) {
+	if s.catalog == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version, _ := serverConfig["catalog_rules_version"].(string)
+	if version == "" || version == s.catalog.RulesVersion() || version == s.unsupported {
+		return
+	}
+	fctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	agentUUID, secret := s.creds.Current()
+	rules, err := s.client.GetCatalogRules(fctx, agentUUID, secret)
+	var httpErr *api.HTTPError
+	switch {
+	case errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound:
+		s.logger.Printf("catalog rules: server does not serve rules (version %s)", version)
+		s.unsupported = version
+		return
+	case err != nil:
+		s.logger.Printf("catalog rules: fetch failed: %v", err)
+		return
+	}
+	if rules.Version == "" {
+		rules.Version = version
+	}
+	if err := s.catalog.SetRules(*rules); err != nil {
+		s.logger.Printf("catalog rules: %v", err)
+	}
+	s.logger.Printf("catalog rules: version %s, %d rule(s)", rules.Version, len(rules.Rules))
+	s.invManager.RemapCatalog()
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"appcenter-agent/internal/audit"
+	"appcenter-agent/internal/clock"
+)
+
+// clockSkewEvent is sent over WS when the skew estimate crosses
+// clock.skew_threshold_sec in either direction.
+const clockSkewEvent = "agent.clock.skew"
+
+// logClockSkew records a threshold crossing and returns the event payload.
+func logClockSkew(st clock.Status, threshold time.Duration, auditLog *audit.Log, logger *log.Logger) map[string]any {
+	offset := time.Duration(st.OffsetMS) * time.Millisecond
+	if st.Skewed {
+		logger.Printf("clock: local clock is %v off the server (±%dms, threshold %v); using server time", offset, st.ErrorMS, threshold)
+	} else {
+		logger.Printf("clock: offset back to %v (±%dms)", offset, st.ErrorMS)
+	}
+	fields := audit.Fields{
+		"offset_ms":     st.OffsetMS,
+		"error_ms":      st.ErrorMS,
+		"skewed":        st.Skewed,
+		"threshold_sec": int(threshold / time.Second),
+	}
+	recordAudit(auditLog, logger, audit.EventClockSkew, fields)
+	return fields
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -17,34 +18,47 @@ import (
 
 	"appcenter-agent/internal/announcement"
 	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/audit"
+	"appcenter-agent/internal/bandwidth"
+	"appcenter-agent/internal/clock"
 	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/dlcache"
 	"appcenter-agent/internal/downloader"
+	"appcenter-agent/internal/endpoint"
+	"appcenter-agent/internal/enrollment"
 	"appcenter-agent/internal/heartbeat"
 	"appcenter-agent/internal/installer"
 	"appcenter-agent/internal/inventory"
 	"appcenter-agent/internal/ipc"
+	"appcenter-agent/internal/p2p"
+	"appcenter-agent/internal/policy"
 	"appcenter-agent/internal/queue"
 	"appcenter-agent/internal/remotesupport"
+	"appcenter-agent/internal/reqsign"
+	"appcenter-agent/internal/resilience"
 	"appcenter-agent/internal/runtimeupdate"
 	"appcenter-agent/internal/system"
 	"appcenter-agent/internal/updater"
+	"appcenter-agent/internal/urlguard"
 	"appcenter-agent/internal/wsconn"
 	"appcenter-agent/pkg/utils"
 )
 
 const serviceName = "AppCenterAgent"
 
-func runAgent(ctx context.Context, cfgPath string) error {
+func runAgent(ctx context.Context, cfgPath string, opts cliOptions) error {
 	// MSI upgrades/uninstalls and manual tampering can leave config.yaml missing.
 	// The service should be able to recover by re-creating a sane default config.
 	if err := config.EnsureExists(cfgPath); err != nil {
 		return fmt.Errorf("failed to ensure config exists: %w", err)
 	}
 
+	migrated, migrateErr := config.MigrateSecret(cfgPath)
 	cfg, err := config.Load(cfgPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
+	opts.apply(cfg)
 
 	logger, logCloser, err := utils.NewLogger(
 		logPathOrFallback(cfg.Logging.File),
@@ -55,27 +69,95 @@ func runAgent(ctx context.Context, cfgPath string) error {
 		return fmt.Errorf("failed to init logger: %w", err)
 	}
 	defer logCloser.Close()
+	if err := cfg.SecretWarning(); err != nil {
+		logger.Printf("config secret warning: %v", err)
+	}
+	if migrateErr != nil {
+		logger.Printf("config secret warning: %v", migrateErr)
+	}
+	if migrated {
+		logger.Printf("config: plaintext agent.secret_key migrated to %s storage", config.SecretStorage())
+	}
 
+	if err := waitRestartDelay(ctx, logger); err != nil {
+		return nil
+	}
+	resilience.Default().Configure(resilience.OptionsFromConfig(*cfg))
+	skewThreshold := time.Duration(cfg.Clock.SkewThresholdSec) * time.Second
+	clock.Default().SetThreshold(skewThreshold)
+	configureProxy(*cfg, logger)
+	discoverRelay(ctx, cfg, logger)
 	client := api.NewClient(cfg.Server)
-	if err := bootstrapAgent(client, cfg, logger); err != nil {
+	client.SetRequestEncodings(cfg.Network.Encoding.Request)
+	endpoints := endpoint.FromConfig(cfg, logger)
+	endpoints.OnChange(func(ep config.ServerEndpoint) {
+		client.SetBaseURL(ep.URL)
+		client.Breakers().Reset()
+	})
+	client.SetUnreachableObserver(endpoints.ReportFailure)
+	go endpoints.Run(ctx)
+	creds := enrollment.NewManager(client, cfg, resolveWritableConfigPath(), logger)
+	client.SetAuthObserver(creds.ObserveAuthStatus)
+	auditLog := openAuditLog(cfg, logger)
+	if auditLog != nil && cfg.Audit.ShipToServer {
+		go runAuditShipper(ctx, auditLog, client, creds, logger)
+	}
+	pol := loadPolicy(cfg, logger)
+	policyReports := newPolicyReporter(client, creds, auditLog, logger)
+	bootstrapCtx, bootstrapCancel := context.WithTimeout(ctx, 30*time.Second)
+	err = creds.Bootstrap(bootstrapCtx)
+	bootstrapCancel()
+	if err != nil {
 		// Do not fail service start just because server is unreachable or registration fails.
 		// If we exit here, Windows SCM shows "Error 1: Incorrect function" which is misleading.
 		// Keep the agent running and let heartbeat retry; tray can show orange (server offline).
 		logger.Printf("bootstrap warning (service will continue): %v", err)
 	}
 
+	// signedAuth is set once the agent runs with auth_mode signed, from the
+	// config or after the server advertised it (see applyServerConfig).
+	var signedAuth atomic.Bool
+	signedAuth.Store(reqsign.NormalizeMode(cfg.Server.AuthMode) == reqsign.ModeSigned)
+
+	// currentConfig returns a config snapshot carrying the credentials, the
+	// auth mode and the server endpoint in effect. The enrollment manager and
+	// the endpoint set own them; cfg only holds what was loaded at start and
+	// is never mutated.
+	currentConfig := func() config.Config {
+		c := *cfg
+		c.Agent.UUID, c.Agent.SecretKey = creds.Current()
+		if signedAuth.Load() {
+			c.Server.AuthMode = reqsign.ModeSigned
+		}
+		if ep := endpoints.Active(); ep.URL != "" && ep.URL != c.Server.URL {
+			c.OverrideServerURL(ep.URL)
+		}
+		return c
+	}
+
+	bw := newBandwidthControl(*cfg, logger)
 	serviceExe, _ := os.Executable()
 	ensureRemoteSupportFirewallRules(filepath.Dir(serviceExe), logger)
 	traySup := newTraySupervisor(serviceExe, logger)
 	var storeTrayEnabled atomic.Bool
 	var remoteSupportEnabled atomic.Bool
+	var wsEnabled atomic.Bool
+	wsEnabled.Store(cfg.WebSocket.Enabled)
 
 	runtimeMgr := runtimeupdate.NewManager(filepath.Dir(serviceExe), logger, func() {
 		if storeTrayEnabled.Load() {
 			traySup.SetEnabled(true)
 		}
 	})
+	endpoints.OnChange(func(ep config.ServerEndpoint) {
+		runtimeMgr.SetServer(runtimeUpdateBaseURL(ep.URL), urlguard.FromConfig(currentConfig()))
+	})
 	go runtimeMgr.Start(ctx)
+	if cfg.Install.EnableAutoCleanup {
+		go cleanupDownloads(*cfg, logger)
+	}
+	peers := startP2P(ctx, currentConfig(), serviceExe, logger)
+	startRelay(ctx, *cfg, serviceExe, client, creds, logger)
 
 	taskQueue := queue.NewTaskQueue(3)
 	pollResults := make(chan heartbeat.PollResult, 8)
@@ -83,17 +165,41 @@ func runAgent(ctx context.Context, cfgPath string) error {
 
 	// Initialize inventory manager and perform initial scan.
 	invManager := inventory.NewManager(logger)
+	invManager.LoadSnapshot(inventory.DefaultSnapshotPath())
+	journal := openSoftwareJournal(logger)
+	journalKick := make(chan struct{}, 1)
+	invManager.SetJournal(journal, func([]inventory.JournalEvent) {
+		select {
+		case journalKick <- struct{}{}:
+		default:
+		}
+	})
+	catalog := openCatalog(logger)
+	invManager.SetCatalog(catalog)
+	updates := &updateChecker{catalog: catalog, client: client, creds: creds, logger: logger}
+	updatesKick := make(chan struct{}, 1)
+	catalog.OnChange(func() {
+		select {
+		case updatesKick <- struct{}{}:
+		default:
+		}
+	})
+	go updates.run(ctx, updatesKick)
 	invManager.ForceScan()
+	if journal != nil {
+		go runJournalShipper(ctx, journal, client, creds, journalKick, logger)
+	}
 
 	// Remote support session manager stays available regardless of local config flag.
 	// The server controls whether requests are sent; if no request arrives, manager is idle.
 	sessionMgr := remotesupport.NewSessionManager(
 		client,
-		cfg.Agent.UUID,
-		cfg.Agent.SecretKey,
+		creds,
 		cfg.RemoteSupport.ApprovalTimeoutSec,
 		logger,
 	)
+	sessionMgr.SetAuditLog(auditLog)
+	sessionMgr.SetStateObserver(bw.remoteSupportState)
 	logger.Printf("remote support: manager ready")
 	remoteSupportEnabled.Store(cfg.RemoteSupport.Enabled)
 	logger.Printf("remote support: enabled=%t (initial)", remoteSupportEnabled.Load())
@@ -102,7 +208,7 @@ func runAgent(ctx context.Context, cfgPath string) error {
 		remoteProvider = sessionMgr
 	}
 
-	pipeServer, pipeErr := ipc.StartPipeServer(buildIPCHandler(client, cfg, taskQueue, logger, serviceStarted, sessionMgr, &remoteSupportEnabled))
+	pipeServer, pipeErr := ipc.StartPipeServer(buildIPCHandler(client, cfg, creds, taskQueue, logger, serviceStarted, sessionMgr, &remoteSupportEnabled, pol, endpoints, journal, updates))
 	if pipeErr != nil {
 		logger.Printf("named pipe server not started: %v", pipeErr)
 	} else {
@@ -110,10 +216,12 @@ func runAgent(ctx context.Context, cfgPath string) error {
 		logger.Printf("named pipe server started: %s", ipc.PipeName)
 	}
 
-	sender := heartbeat.NewSender(client, cfg, logger, pollResults, taskQueue, invManager, remoteProvider)
+	sender := heartbeat.NewSender(client, cfg, logger, pollResults, installedApps{queue: taskQueue, catalog: catalog}, invManager, remoteProvider, creds)
+	catalogSync := &catalogRulesSync{catalog: catalog, invManager: invManager, client: client, creds: creds, logger: logger}
 	var wsActive atomic.Bool
 	sender.SetWSActive(false)
 	go sender.Start(ctx)
+	endpoints.OnChange(func(config.ServerEndpoint) { sender.TriggerNow() })
 	wsInventoryKickCh := make(chan struct{}, 1)
 	wsInventoryTicker := time.NewTicker(1 * time.Minute)
 	defer wsInventoryTicker.Stop()
@@ -121,30 +229,68 @@ func runAgent(ctx context.Context, cfgPath string) error {
 	var lastWSInventoryHashSent string
 	var lastWSInventoryHashAt time.Time
 
-	signalListener := heartbeat.NewSignalListener(client, cfg.Agent.UUID, cfg.Agent.SecretKey, logger, sender.TriggerNow, &wsActive)
+	signalListener := heartbeat.NewSignalListener(client, creds, logger, sender.TriggerNow, &wsActive)
 	go signalListener.Start(ctx)
 
 	reportFn := func(ctx context.Context, taskID int, req api.TaskStatusRequest) error {
 		var lastErr error
 		for attempt := 1; attempt <= 3; attempt++ {
-			_, err := client.ReportTaskStatus(ctx, cfg.Agent.UUID, cfg.Agent.SecretKey, taskID, req)
+			agentUUID, secret := creds.Current()
+			_, err := client.ReportTaskStatus(ctx, agentUUID, secret, taskID, req)
 			if err == nil {
 				return nil
 			}
 			lastErr = err
 			logger.Printf("task status report failed for task=%d attempt=%d: %v", taskID, attempt, err)
+			// A final status is worth waiting for, but only a bounded time
+			// while the server asks agents to back off.
+			wait := max(time.Duration(attempt)*time.Second, min(client.Breakers().Wait(resilience.ClassTasks), 5*time.Minute))
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
-			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-time.After(wait):
 			}
 		}
 		return lastErr
 	}
 
 	executeFn := func(ctx context.Context, cmd api.Command) (queue.ExecutionResult, error) {
-		result, err := executeCommand(ctx, *cfg, cmd, logger)
-		if err == nil {
+		c := currentConfig()
+		if err := checkCommandPolicy(pol, c, cmd); err != nil {
+			policyReports.Report(err, cmd.TaskID, 0)
+			return queue.ExecutionResult{ExitCode: -1}, err
+		}
+		c.Install.TimeoutSec = pol.CapInstallTimeout(c.Install.TimeoutSec)
+		cmd.Mirrors = allowedMirrors(pol, c, cmd, logger)
+		recordAudit(auditLog, logger, audit.EventCommand, audit.Fields{
+			"phase":        "start",
+			"task_id":      cmd.TaskID,
+			"app_id":       cmd.AppID,
+			"action":       cmd.Action,
+			"app_version":  cmd.AppVersion,
+			"download_url": cmd.DownloadURL,
+			"mirrors":      cmd.Mirrors,
+			"file_hash":    cmd.FileHash,
+			"install_args": cmd.InstallArgs,
+		})
+		result, err := executeCommand(ctx, c, cmd, peers, logger)
+		finish := audit.Fields{
+			"phase":     "finish",
+			"task_id":   cmd.TaskID,
+			"app_id":    cmd.AppID,
+			"action":    cmd.Action,
+			"exit_code": result.ExitCode,
+			"success":   err == nil,
+		}
+		if err != nil {
+			finish["error"] = err.Error()
+		}
+		recordAudit(auditLog, logger, audit.EventCommand, finish)
+		if result.InstallerRan {
+			// Even a failed installer may have changed something.
+			journal.NoteTask(cmd.TaskID, cmd.AppName)
+		}
+		if err == nil && result.Status == "" {
 			// Rescan installed software immediately after a successful
 			// installation so the inventory reflects the change before
 			// the next scheduled scan interval.
@@ -160,10 +306,20 @@ func runAgent(ctx context.Context, cfgPath string) error {
 	}
 
 	var wsStartOnce sync.Once
-	var wsClient *wsconn.Client
+	var wsClient atomic.Pointer[wsconn.Client]
 	announcementTracker := announcement.NewTracker()
 	var stateMu sync.Mutex
 	restartRequestCh := make(chan string, 1)
+	recordSelfUpdateApply := func() {
+		fields := audit.Fields{"from_version": cfg.Agent.Version}
+		if meta, err := updater.PendingUpdate(currentConfig()); err == nil {
+			fields["to_version"] = meta.Version
+			fields["hash"] = meta.Hash
+			fields["force"] = meta.Force
+			fields["source_url"] = meta.SourceURL
+		}
+		recordAudit(auditLog, logger, audit.EventSelfUpdateApply, fields)
+	}
 	requestRestart := func(reason string) {
 		select {
 		case restartRequestCh <- reason:
@@ -212,8 +368,8 @@ func runAgent(ctx context.Context, cfgPath string) error {
 		announcementTracker.Add(id, title, message, priority)
 		go func(announcementID int, annTitle, annMessage, annPriority string) {
 			announcement.ShowMessageBox(annTitle, annMessage, annPriority)
-			if wsClient != nil {
-				if ok := wsClient.SendEvent(ctx, "agent.announcement.ack", map[string]any{
+			if ws := wsClient.Load(); ws != nil {
+				if ok := ws.SendEvent(ctx, "agent.announcement.ack", map[string]any{
 					"announcement_id": announcementID,
 				}); !ok {
 					logger.Printf("announcement: failed to send ack for id=%d", announcementID)
@@ -272,8 +428,9 @@ func runAgent(ctx context.Context, cfgPath string) error {
 			return
 		}
 		if taskQueue.PendingCount() == 0 {
-			if err := updater.ApplyIfPending(ctx, *cfg, cfgPath, serviceExe, logger); err != nil {
+			if err := updater.ApplyIfPending(ctx, currentConfig(), cfgPath, serviceExe, logger); err != nil {
 				if errors.Is(err, updater.ErrUpdateRestart) {
+					recordSelfUpdateApply()
 					logger.Println("ws: self-update restart triggered")
 					requestRestart("self-update apply")
 					return
@@ -281,13 +438,16 @@ func runAgent(ctx context.Context, cfgPath string) error {
 				logger.Printf("ws: self-update apply failed: %v", err)
 			}
 		}
-		if err := updater.StageIfNeeded(ctx, *cfg, changes, logger); err != nil {
-			logger.Printf("ws: self-update stage failed: %v", err)
+		if err := updater.StageIfNeeded(ctx, currentConfig(), changes, pol, logger); err != nil {
+			if !policyReports.Report(err, 0, 0) {
+				logger.Printf("ws: self-update stage failed: %v", err)
+			}
 			return
 		}
 		if taskQueue.PendingCount() == 0 {
-			if err := updater.ApplyIfPending(ctx, *cfg, cfgPath, serviceExe, logger); err != nil {
+			if err := updater.ApplyIfPending(ctx, currentConfig(), cfgPath, serviceExe, logger); err != nil {
 				if errors.Is(err, updater.ErrUpdateRestart) {
+					recordSelfUpdateApply()
 					logger.Println("ws: self-update restart triggered")
 					requestRestart("self-update apply")
 					return
@@ -297,7 +457,8 @@ func runAgent(ctx context.Context, cfgPath string) error {
 		}
 	}
 	sendWSInventoryHash := func(force bool, reason string) {
-		if !wsActive.Load() || wsClient == nil {
+		ws := wsClient.Load()
+		if !wsActive.Load() || ws == nil {
 			return
 		}
 		hash := strings.TrimSpace(invManager.GetCurrentHash())
@@ -308,21 +469,66 @@ func runAgent(ctx context.Context, cfgPath string) error {
 		if !force && strings.EqualFold(hash, lastWSInventoryHashSent) && now.Sub(lastWSInventoryHashAt) < wsInventoryHashInterval {
 			return
 		}
-		if wsClient.SendEvent(ctx, "agent.inventory.hash", map[string]any{"hash": hash}) {
+		if ws.SendEvent(ctx, "agent.inventory.hash", map[string]any{"hash": hash}) {
 			lastWSInventoryHashSent = hash
 			lastWSInventoryHashAt = now
 			logger.Printf("ws: inventory hash sent (%s): %s", reason, hash)
 		}
 	}
+	handleCredentialRotate := func(payload map[string]any) {
+		secret, _ := payload["secret_key"].(string)
+		rotationID := fmt.Sprintf("%v", payload["rotation_id"])
+		err := creds.Rotate(secret)
+		if err != nil {
+			logger.Printf("credentials: rotation %s rejected: %v", rotationID, err)
+		}
+		ws := wsClient.Load()
+		if ws == nil {
+			return
+		}
+		ack := map[string]any{"rotation_id": payload["rotation_id"], "ok": err == nil}
+		if err != nil {
+			ack["error"] = err.Error()
+		}
+		if !ws.SendEvent(ctx, "agent.credential.rotate.ack", ack) {
+			logger.Printf("credentials: failed to send rotation ack for %s", rotationID)
+		}
+	}
+	creds.OnChange(func() {
+		if ws := wsClient.Load(); ws != nil {
+			ws.Reconnect()
+		}
+	})
+	endpoints.OnChange(func(ep config.ServerEndpoint) {
+		if ws := wsClient.Load(); ws != nil {
+			ws.SetEndpoint(ep.URL, ep.WSURL)
+		}
+	})
+	clock.Default().OnSkew(func(st clock.Status) {
+		payload := logClockSkew(st, skewThreshold, auditLog, logger)
+		if ws := wsClient.Load(); wsActive.Load() && ws != nil {
+			ws.SendEvent(ctx, clockSkewEvent, payload)
+		}
+	})
+	useSignedAuth := func() {
+		client.SetAuthMode(reqsign.ModeSigned)
+		if ws := wsClient.Load(); ws != nil {
+			ws.SetAuthMode(reqsign.ModeSigned)
+		}
+	}
 	var startWSClient func()
 	startWSClient = func() {
 		wsStartOnce.Do(func() {
 			hostInfo := system.CollectHostInfo()
-			wsClient = wsconn.NewClient(wsconn.Config{
-				ServerURL:       cfg.Server.URL,
-				WSURL:           cfg.WebSocket.URL,
-				AgentUUID:       cfg.Agent.UUID,
-				SecretKey:       cfg.Agent.SecretKey,
+			active := endpoints.Active()
+			agentUUID, secret := creds.Current()
+			ws := wsconn.NewClient(wsconn.Config{
+				ServerURL:       active.URL,
+				WSURL:           active.WSURL,
+				AgentUUID:       agentUUID,
+				SecretKey:       secret,
+				Credentials:     creds.Current,
+				AuthMode:        currentConfig().Server.AuthMode,
 				Version:         cfg.Agent.Version,
 				Platform:        runtime.GOOS,
 				Arch:            runtime.GOARCH,
@@ -332,6 +538,8 @@ func runAgent(ctx context.Context, cfgPath string) error {
 				FullIP:          hostInfo.IPAddresses,
 				ReconnectMinSec: cfg.WebSocket.ReconnectMinSec,
 				ReconnectMaxSec: cfg.WebSocket.ReconnectMaxSec,
+				Deflate:         cfg.Network.Encoding.WSDeflate,
+				MsgPack:         cfg.Network.Encoding.WSMsgPack,
 				Callbacks: wsconn.Callbacks{
 					OnConnected: func() {
 						wsActive.Store(true)
@@ -356,18 +564,19 @@ func runAgent(ctx context.Context, cfgPath string) error {
 						if serverConfig, ok := payload["config"].(map[string]any); ok {
 							applySelfUpdateChanges(serverConfig)
 							stateMu.Lock()
-							applyServerConfig(serverConfig, logger, invManager, traySup, &storeTrayEnabled, &remoteSupportEnabled, runtimeMgr, cfg, cfgPath, startWSClient)
+							applyServerConfig(serverConfig, logger, invManager, traySup, &storeTrayEnabled, &remoteSupportEnabled, runtimeMgr, bw, pol, currentConfig(), creds, cfgPath, &wsEnabled, startWSClient, &signedAuth, useSignedAuth)
 							stateMu.Unlock()
+							go catalogSync.apply(ctx, serverConfig)
 						}
 						processPendingAnnouncements(payload["pending_announcements"])
 						commands := parseCommandsFromPayload(payload)
 						if len(commands) > 0 {
 							stateMu.Lock()
-							processCommands(ctx, commands, taskQueue, time.Now().UTC(), *cfg, executeFn, reportFn, logger)
+							processCommands(ctx, commands, taskQueue, clock.Now().UTC(), currentConfig(), executeFn, reportFn, logger)
 							stateMu.Unlock()
 						}
 						stateMu.Lock()
-						handleRSRequest(ctx, parseRSRequestFromPayload(payload), sessionMgr, &remoteSupportEnabled, logger)
+						handleRSRequest(ctx, parseRSRequestFromPayload(payload), sessionMgr, &remoteSupportEnabled, pol, policyReports, logger)
 						stateMu.Unlock()
 						stateMu.Lock()
 						handleRSEnd(ctx, parseRSEndFromPayload(payload), sessionMgr)
@@ -379,12 +588,12 @@ func runAgent(ctx context.Context, cfgPath string) error {
 							return
 						}
 						stateMu.Lock()
-						processCommands(ctx, commands, taskQueue, time.Now().UTC(), *cfg, executeFn, reportFn, logger)
+						processCommands(ctx, commands, taskQueue, clock.Now().UTC(), currentConfig(), executeFn, reportFn, logger)
 						stateMu.Unlock()
 					},
 					OnRSRequest: func(payload map[string]any) {
 						stateMu.Lock()
-						handleRSRequest(ctx, parseRSRequestFromPayload(payload), sessionMgr, &remoteSupportEnabled, logger)
+						handleRSRequest(ctx, parseRSRequestFromPayload(payload), sessionMgr, &remoteSupportEnabled, pol, policyReports, logger)
 						stateMu.Unlock()
 					},
 					OnRSEnd: func(payload map[string]any) {
@@ -399,8 +608,9 @@ func runAgent(ctx context.Context, cfgPath string) error {
 						}
 						applySelfUpdateChanges(changes)
 						stateMu.Lock()
-						applyServerConfig(changes, logger, invManager, traySup, &storeTrayEnabled, &remoteSupportEnabled, runtimeMgr, cfg, cfgPath, startWSClient)
+						applyServerConfig(changes, logger, invManager, traySup, &storeTrayEnabled, &remoteSupportEnabled, runtimeMgr, bw, pol, currentConfig(), creds, cfgPath, &wsEnabled, startWSClient, &signedAuth, useSignedAuth)
 						stateMu.Unlock()
+						go catalogSync.apply(ctx, changes)
 					},
 					OnBroadcastRestart: func(payload map[string]any) {
 						reason, _ := payload["reason"].(string)
@@ -408,7 +618,13 @@ func runAgent(ctx context.Context, cfgPath string) error {
 						if reason == "" {
 							reason = "ws-broadcast"
 						}
+						if err := pol.CheckAction(policy.ActionRestart); err != nil {
+							policyReports.Report(err, 0, 0)
+							return
+						}
 						logger.Printf("ws: restart requested by server (%s)", reason)
+						recordAudit(auditLog, logger, audit.EventRestart, audit.Fields{"reason": reason, "source": "server"})
+						scheduleRestartDelay(*cfg, payload, logger)
 						requestRestart(reason)
 					},
 					OnBroadcastSelfUpdate: func(payload map[string]any) {
@@ -431,15 +647,31 @@ func runAgent(ctx context.Context, cfgPath string) error {
 					OnAnnouncementPush: func(payload map[string]any) {
 						handleAnnouncementPush(payload)
 					},
+					OnCredentialRotate: func(payload map[string]any) {
+						handleCredentialRotate(payload)
+					},
 				},
 				Logger: logger,
 			})
-			go wsClient.Run(ctx)
+			wsClient.Store(ws)
+			// An upgrade that raced with the start has not reached ws yet.
+			if signedAuth.Load() {
+				ws.SetAuthMode(reqsign.ModeSigned)
+			}
+			go ws.Run(ctx)
 			logger.Println("ws: client started")
 		})
 	}
 
-	if cfg.WebSocket.Enabled {
+	// Initial config/policy returned by registration is applied before the first
+	// heartbeat so a freshly enrolled agent starts with its group policy.
+	if initial := creds.TakeInitialConfig(); len(initial) > 0 {
+		stateMu.Lock()
+		applyServerConfig(initial, logger, invManager, traySup, &storeTrayEnabled, &remoteSupportEnabled, runtimeMgr, bw, pol, currentConfig(), creds, cfgPath, &wsEnabled, startWSClient, &signedAuth, useSignedAuth)
+		stateMu.Unlock()
+	}
+
+	if wsEnabled.Load() {
 		startWSClient()
 	}
 
@@ -471,22 +703,29 @@ func runAgent(ctx context.Context, cfgPath string) error {
 			}
 		case result := <-pollResults:
 			if taskQueue.PendingCount() == 0 {
-				if err := updater.ApplyIfPending(ctx, *cfg, cfgPath, serviceExe, logger); err != nil {
+				if err := updater.ApplyIfPending(ctx, currentConfig(), cfgPath, serviceExe, logger); err != nil {
 					if errors.Is(err, updater.ErrUpdateRestart) {
+						recordSelfUpdateApply()
 						return err
 					}
 					logger.Printf("self-update apply failed: %v", err)
 				}
 			}
-			if err := updater.StageIfNeeded(ctx, *cfg, result.Config, logger); err != nil {
-				logger.Printf("self-update stage failed: %v", err)
+			if err := updater.StageIfNeeded(ctx, currentConfig(), result.Config, pol, logger); err != nil {
+				if !policyReports.Report(err, 0, 0) {
+					logger.Printf("self-update stage failed: %v", err)
+				}
+			}
+
+			if rotate, ok := result.Config["credential_rotate"].(map[string]any); ok {
+				handleCredentialRotate(rotate)
 			}
 
 			stateMu.Lock()
-			applyServerConfig(result.Config, logger, invManager, traySup, &storeTrayEnabled, &remoteSupportEnabled, runtimeMgr, cfg, cfgPath, startWSClient)
+			applyServerConfig(result.Config, logger, invManager, traySup, &storeTrayEnabled, &remoteSupportEnabled, runtimeMgr, bw, pol, currentConfig(), creds, cfgPath, &wsEnabled, startWSClient, &signedAuth, useSignedAuth)
 			stateMu.Unlock()
 			stateMu.Lock()
-			handleRSRequest(ctx, result.RemoteSupportRequest, sessionMgr, &remoteSupportEnabled, logger)
+			handleRSRequest(ctx, result.RemoteSupportRequest, sessionMgr, &remoteSupportEnabled, pol, policyReports, logger)
 			stateMu.Unlock()
 			stateMu.Lock()
 			handleRSEnd(ctx, result.RemoteSupportEnd, sessionMgr)
@@ -495,14 +734,21 @@ func runAgent(ctx context.Context, cfgPath string) error {
 				handleAnnouncementPush(pending)
 			}
 
+			catalogSync.apply(ctx, result.Config)
+
 			// Periodic inventory scan.
 			invManager.ScanIfNeeded()
 
 			// Submit inventory if server requests sync.
 			if result.InventorySyncRequired {
 				submitFn := func(sctx context.Context, payload inventory.SubmitRequest) (*inventory.SubmitResponse, error) {
-					raw, err := client.SubmitInventory(sctx, cfg.Agent.UUID, cfg.Agent.SecretKey, payload)
+					agentUUID, secret := creds.Current()
+					raw, err := client.SubmitInventory(sctx, agentUUID, secret, payload)
 					if err != nil {
+						var httpErr *api.HTTPError
+						if errors.As(err, &httpErr) && (httpErr.StatusCode == http.StatusConflict || httpErr.Code == "inventory_base_mismatch") {
+							return nil, fmt.Errorf("%w: %v", inventory.ErrBaseMismatch, err)
+						}
 						return nil, err
 					}
 					resp := &inventory.SubmitResponse{
@@ -510,6 +756,8 @@ func runAgent(ctx context.Context, cfgPath string) error {
 						Message: fmt.Sprintf("%v", raw["message"]),
 						Changes: make(map[string]int),
 					}
+					resp.InventoryHash, _ = raw["inventory_hash"].(string)
+					resp.AcceptsDelta, _ = raw["accepts_delta"].(bool)
 					if ch, ok := raw["changes"].(map[string]any); ok {
 						for k, v := range ch {
 							if f, ok := v.(float64); ok {
@@ -523,7 +771,7 @@ func runAgent(ctx context.Context, cfgPath string) error {
 			}
 
 			stateMu.Lock()
-			processCommands(ctx, result.Commands, taskQueue, result.ServerTime, *cfg, executeFn, reportFn, logger)
+			processCommands(ctx, result.Commands, taskQueue, result.ServerTime, currentConfig(), executeFn, reportFn, logger)
 			stateMu.Unlock()
 		}
 	}
@@ -537,13 +785,20 @@ func applyServerConfig(
 	storeTrayEnabled *atomic.Bool,
 	remoteSupportEnabled *atomic.Bool,
 	runtimeMgr *runtimeupdate.Manager,
-	cfg *config.Config,
+	bw *bandwidthControl,
+	pol *policy.Policy,
+	cfg config.Config,
+	creds *enrollment.Manager,
 	cfgPath string,
+	wsEnabled *atomic.Bool,
 	onWSEnabled func(),
+	signedAuth *atomic.Bool,
+	onSignedAuth func(),
 ) {
 	if serverConfig == nil {
 		return
 	}
+	bw.applyServerConfig(serverConfig)
 	if v, ok := serverConfig["inventory_scan_interval_min"]; ok {
 		if f, ok := v.(float64); ok {
 			invManager.SetScanInterval(int(f))
@@ -575,29 +830,44 @@ func applyServerConfig(
 	}
 	if v, ok := serverConfig["websocket_enabled"]; ok {
 		if b, ok := v.(bool); ok {
-			if b && !cfg.WebSocket.Enabled {
-				cfg.WebSocket.Enabled = true
+			if b && !wsEnabled.Swap(true) {
 				logger.Printf("ws: enabled via server config")
 				// Persist so the next restart starts WS client automatically.
-				if err := config.Save(cfgPath, cfg); err != nil {
+				if err := creds.SaveConfig(cfgPath, func(c *config.Config) { c.WebSocket.Enabled = true }); err != nil {
 					logger.Printf("ws: failed to persist websocket.enabled=true: %v", err)
 				}
 				if onWSEnabled != nil {
 					onWSEnabled()
 				}
-			} else if !b && cfg.WebSocket.Enabled {
-				cfg.WebSocket.Enabled = false
+			} else if !b && wsEnabled.Swap(false) {
 				logger.Printf("ws: disabled via server config (restart required to stop active connection)")
-				if err := config.Save(cfgPath, cfg); err != nil {
+				if err := creds.SaveConfig(cfgPath, func(c *config.Config) { c.WebSocket.Enabled = false }); err != nil {
 					logger.Printf("ws: failed to persist websocket.enabled=false: %v", err)
 				}
 			}
 		}
 	}
+	if v, ok := serverConfig["auth_mode"]; ok {
+		// Only ever an upgrade: a server asking for a weaker mode would be
+		// handed the replayable secret again.
+		if mode, ok := v.(string); ok && reqsign.NormalizeMode(mode) == reqsign.ModeSigned && !signedAuth.Swap(true) {
+			logger.Printf("auth: server verifies signatures, switching to auth_mode=signed")
+			if err := creds.SaveConfig(cfgPath, func(c *config.Config) { c.Server.AuthMode = reqsign.ModeSigned }); err != nil {
+				logger.Printf("auth: failed to persist server.auth_mode=signed: %v", err)
+			}
+			if onSignedAuth != nil {
+				onSignedAuth()
+			}
+		}
+	}
 	runtimeMgr.UpdateConfig(runtimeupdate.Config{
 		BaseURL:     runtimeUpdateBaseURL(cfg.Server.URL),
 		IntervalMin: configInt(serverConfig, "runtime_update_interval_min", 60),
 		JitterSec:   configInt(serverConfig, "runtime_update_jitter_sec", 300),
+		Guard:       urlguard.FromConfig(cfg),
+		CheckURL:    pol.CheckDownloadURL,
+		Cache:       openDownloadCache(cfg, logger),
+		Limiter:     bw.limiter,
 	})
 }
 
@@ -628,11 +898,20 @@ func handleRSRequest(
 	req *api.RemoteSupportRequest,
 	sessionMgr *remotesupport.SessionManager,
 	remoteSupportEnabled *atomic.Bool,
+	pol *policy.Policy,
+	policyReports *policyReporter,
 	logger *log.Logger,
 ) {
 	if req == nil {
 		return
 	}
+	if err := pol.CheckRemoteSupport(req.RequiresApproval); err != nil {
+		policyReports.Report(err, 0, req.SessionID)
+		if sessionMgr != nil {
+			go sessionMgr.Reject(ctx, req.SessionID)
+		}
+		return
+	}
 	if sessionMgr != nil && remoteSupportEnabled.Load() {
 		go sessionMgr.HandleRequest(ctx, *req)
 		return
@@ -755,34 +1034,50 @@ func runtimeUpdateBaseURL(serverURL string) string {
 func buildIPCHandler(
 	client *api.Client,
 	cfg *config.Config,
+	creds *enrollment.Manager,
 	taskQueue *queue.TaskQueue,
 	logger *log.Logger,
 	startedAt time.Time,
 	sessionMgr *remotesupport.SessionManager,
 	remoteSupportEnabled *atomic.Bool,
+	pol *policy.Policy,
+	endpoints *endpoint.Set,
+	journal *inventory.Journal,
+	updates *updateChecker,
 ) ipc.Handler {
 	return func(req ipc.Request) ipc.Response {
 		switch strings.ToLower(req.Action) {
 		case "get_status":
+			agentUUID, _ := creds.Current()
 			return ipc.Response{
 				Status: "ok",
 				Data: map[string]any{
-					"service":       "running",
-					"started_at":    startedAt.Format(time.RFC3339),
-					"pending_tasks": taskQueue.PendingCount(),
-					"agent_version": cfg.Agent.Version,
-					"agent_uuid":    cfg.Agent.UUID,
+					"service":          "running",
+					"started_at":       startedAt.Format(time.RFC3339),
+					"pending_tasks":    taskQueue.PendingCount(),
+					"agent_version":    cfg.Agent.Version,
+					"agent_uuid":       agentUUID,
+					"enrollment":       creds.Status(),
+					"secret_storage":   config.SecretStorage(),
+					"policy":           pol.Describe(),
+					"download_sources": downloader.DefaultSources.Snapshot(),
+					"bandwidth":        bandwidth.Default().Status(),
+					"server_endpoint":  endpoints.Status(),
+					"resilience":       client.Breakers().Status(),
+					"clock":            clock.Default().Status(),
 				},
 			}
 		case "get_store":
 			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 			defer cancel()
 
-			store, err := client.GetStore(ctx, cfg.Agent.UUID, cfg.Agent.SecretKey)
+			agentUUID, secret := creds.Current()
+			store, err := client.GetStore(ctx, agentUUID, secret)
 			if err != nil {
 				logger.Printf("ipc get_store failed: %v", err)
 				return ipc.Response{Status: "error", Message: err.Error()}
 			}
+			updates.annotate(store)
 			return ipc.Response{Status: "ok", Data: store}
 		case "install_from_store":
 			if req.AppID <= 0 {
@@ -791,7 +1086,8 @@ func buildIPCHandler(
 			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 			defer cancel()
 
-			resp, err := client.RequestStoreInstall(ctx, cfg.Agent.UUID, cfg.Agent.SecretKey, req.AppID)
+			agentUUID, secret := creds.Current()
+			resp, err := client.RequestStoreInstall(ctx, agentUUID, secret, req.AppID)
 			if err != nil {
 				logger.Printf("ipc install_from_store failed: %v", err)
 				return ipc.Response{Status: "error", Message: err.Error()}
@@ -834,6 +1130,27 @@ func buildIPCHandler(
 					"helper_pid":     helperPID,
 				},
 			}
+		case "software_journal":
+			sinceSeq, limit := journalQuery(req.Data)
+			events, err := journal.Query(sinceSeq, 0)
+			if err != nil {
+				return ipc.Response{Status: "error", Message: err.Error()}
+			}
+			// Without since_seq the newest events are the interesting ones.
+			if sinceSeq == 0 {
+				events = events[max(len(events)-limit, 0):]
+			} else {
+				events = events[:min(len(events), limit)]
+			}
+			return ipc.Response{
+				Status: "ok",
+				Data: map[string]any{
+					"last_seq": journal.LastSeq(),
+					"events":   events,
+				},
+			}
+		case "available_updates":
+			return ipc.Response{Status: "ok", Data: updates.status()}
 		case "remote_support_end":
 			if sessionMgr == nil {
 				return ipc.Response{Status: "error", Message: "remote support disabled"}
@@ -846,104 +1163,103 @@ func buildIPCHandler(
 	}
 }
 
-func bootstrapAgent(client *api.Client, cfg *config.Config, logger interface{ Printf(string, ...any) }) error {
-	if cfg.Agent.UUID == "" {
-		u, err := system.GetOrCreateUUID()
-		if err != nil {
-			return err
-		}
-		cfg.Agent.UUID = u
+// checkCommandPolicy applies the local policy to a server command before any
+// download starts.
+func checkCommandPolicy(pol *policy.Policy, cfg config.Config, cmd api.Command) error {
+	if err := pol.CheckAction(cmd.Action); err != nil {
+		return err
 	}
+	return pol.CheckSource(cmd.DownloadURL, cfg.Server.URL)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	if cfg.Agent.SecretKey == "" {
-		info := system.CollectHostInfo()
-		resp, err := client.Register(ctx, cfg.Agent.UUID, cfg.Agent.Version, info)
-		if err != nil {
-			return err
+// allowedMirrors drops mirrors the local policy does not allow; unlike the
+// primary URL a disallowed mirror does not fail the command.
+func allowedMirrors(pol *policy.Policy, cfg config.Config, cmd api.Command, logger *log.Logger) []string {
+	var out []string
+	for _, m := range cmd.Mirrors {
+		if err := pol.CheckSource(m, cfg.Server.URL); err != nil {
+			logger.Printf("task=%d mirror skipped by policy: %v", cmd.TaskID, err)
+			continue
 		}
-		if resp.SecretKey == "" {
-			return errors.New("empty secret_key in register response")
+		out = append(out, m)
+	}
+	return out
+}
+
+// commandSources lists the primary download URL followed by the mirrors,
+// with server-relative URLs resolved against server.url.
+func commandSources(cfg config.Config, cmd api.Command) []string {
+	sources := make([]string, 0, 1+len(cmd.Mirrors))
+	for _, src := range append([]string{cmd.DownloadURL}, cmd.Mirrors...) {
+		src = strings.TrimSpace(src)
+		if src == "" {
+			continue
 		}
-		cfg.Agent.SecretKey = resp.SecretKey
-		if err := config.Save(resolveWritableConfigPath(), cfg); err != nil {
-			logger.Printf("warning: config not persisted: %v", err)
+		if strings.HasPrefix(src, "/") && !urlguard.IsShare(src) {
+			src = strings.TrimRight(cfg.Server.URL, "/") + src
 		}
-		logger.Printf("agent registered: %s", cfg.Agent.UUID)
-		return nil
+		sources = append(sources, src)
 	}
-
-	logger.Printf("agent bootstrap reused existing credentials: %s", cfg.Agent.UUID)
-	return nil
+	return sources
 }
 
 func executeCommand(
 	ctx context.Context,
 	cfg config.Config,
 	cmd api.Command,
+	peers *p2p.Node,
 	logger interface{ Printf(string, ...any) },
 ) (queue.ExecutionResult, error) {
 	if err := os.MkdirAll(cfg.Download.TempDir, 0o755); err != nil {
 		return queue.ExecutionResult{ExitCode: -1}, err
 	}
 	if logger != nil {
-		logger.Printf("task=%d app=%d install start: action=%s version=%s", cmd.TaskID, cmd.AppID, cmd.Action, cmd.AppVersion)
+		phase := "install"
+		if isPrestage(cmd) {
+			phase = "prestage"
+		}
+		logger.Printf("task=%d app=%d %s start: action=%s version=%s", cmd.TaskID, cmd.AppID, phase, cmd.Action, cmd.AppVersion)
 	}
 
-	basePath := filepath.Join(cfg.Download.TempDir, fmt.Sprintf("task_%d_app_%d", cmd.TaskID, cmd.AppID))
-	downloadPath := findExistingDownloadPath(basePath)
-
-	downloadURL := cmd.DownloadURL
-	if strings.HasPrefix(downloadURL, "/") {
-		downloadURL = strings.TrimRight(cfg.Server.URL, "/") + downloadURL
+	cache, err := dlcache.FromConfig(cfg)
+	if err != nil {
+		return queue.ExecutionResult{ExitCode: -1}, fmt.Errorf("download cache: %w", err)
 	}
 
+	// The cache verifies cmd.FileHash on insertion, so a hit is installed as is
+	// and a miss is only usable once the download matched the hash, whichever
+	// source it came from.
+	opts := downloader.OptionsFromConfig(cfg)
+	sources := commandSources(cfg, cmd)
+	if peers != nil {
+		// LAN peers holding the content are tried before the server.
+		opts.Peer = peers
+		sources = append(peers.Sources(cmd.FileHash), sources...)
+	}
 	downloadStarted := time.Now()
-	meta, err := downloader.DownloadFileWithMeta(
-		ctx,
-		downloadURL,
-		downloadPath,
-		cfg.Download.BandwidthLimitKBs,
-		cfg.Agent.UUID,
-		cfg.Agent.SecretKey,
-	)
+	entry, err := downloader.FetchSources(ctx, cache, sources, cmd.FileHash, opts)
 	downloadDuration := int(time.Since(downloadStarted).Seconds())
 	if err != nil {
+		if errors.Is(err, dlcache.ErrHashMismatch) || errors.Is(err, dlcache.ErrInvalidHash) {
+			if logger != nil {
+				logger.Printf("task=%d app=%d install failed at hash verify: err=%v", cmd.TaskID, cmd.AppID, err)
+			}
+			return queue.ExecutionResult{ExitCode: -1, DownloadDurationSec: downloadDuration}, fmt.Errorf("hash verification failed: %w", err)
+		}
 		if logger != nil {
 			logger.Printf("task=%d app=%d install failed at download: err=%v", cmd.TaskID, cmd.AppID, err)
 		}
 		return queue.ExecutionResult{ExitCode: -1, DownloadDurationSec: downloadDuration}, fmt.Errorf("download failed: %w", err)
 	}
+	defer entry.Release()
 	if logger != nil {
-		logger.Printf("task=%d app=%d download completed: bytes=%d file=%s", cmd.TaskID, cmd.AppID, meta.BytesWritten, meta.Filename)
-	}
-
-	installPath := downloadPath
-	if ext := strings.ToLower(filepath.Ext(meta.Filename)); ext == ".msi" || ext == ".exe" || ext == ".ps1" {
-		candidate := basePath + ext
-		if candidate != downloadPath {
-			if renameErr := os.Rename(downloadPath, candidate); renameErr == nil {
-				installPath = candidate
-			}
-		}
+		logger.Printf("task=%d app=%d download completed: bytes=%d file=%s", cmd.TaskID, cmd.AppID, entry.Size, entry.Name)
 	}
-
-	valid, err := utils.VerifyFileHash(installPath, cmd.FileHash)
-	if err != nil {
-		if logger != nil {
-			logger.Printf("task=%d app=%d install failed at hash verify: err=%v", cmd.TaskID, cmd.AppID, err)
-		}
-		return queue.ExecutionResult{ExitCode: -1, DownloadDurationSec: downloadDuration}, fmt.Errorf("hash verification failed: %w", err)
-	}
-	if !valid {
-		if logger != nil {
-			logger.Printf("task=%d app=%d install failed: hash mismatch", cmd.TaskID, cmd.AppID)
-		}
-		return queue.ExecutionResult{ExitCode: -1, DownloadDurationSec: downloadDuration}, errors.New("hash mismatch")
+	if isPrestage(cmd) {
+		return prestageEntry(cfg, cache, cmd, entry, downloadDuration, logger)
 	}
 
+	installPath := entry.Path
 	installerType := strings.ToLower(filepath.Ext(installPath))
 	if logger != nil {
 		logger.Printf("task=%d app=%d installer run: type=%s args=%q", cmd.TaskID, cmd.AppID, installerType, cmd.InstallArgs)
@@ -968,12 +1284,12 @@ func executeCommand(
 			ExitCode:            exitCode,
 			DownloadDurationSec: downloadDuration,
 			InstallDurationSec:  installDuration,
+			InstallerRan:        true,
 		}, fmt.Errorf("install failed: %w", err)
 	}
 
-	if cfg.Install.EnableAutoCleanup {
-		_ = os.Remove(installPath)
-	}
+	// Content staged for this install has served its purpose.
+	cache.Unpin(cmd.FileHash)
 	if logger != nil {
 		logger.Printf(
 			"task=%d app=%d install success: type=%s exit=%d download_sec=%d install_sec=%d",
@@ -992,19 +1308,10 @@ func executeCommand(
 		DownloadDurationSec: downloadDuration,
 		InstallDurationSec:  installDuration,
 		Message:             "Installation completed successfully",
+		InstallerRan:        true,
 	}, nil
 }
 
-func findExistingDownloadPath(basePath string) string {
-	for _, ext := range []string{".msi", ".exe", ".ps1", ".bin"} {
-		candidate := basePath + ext
-		if _, err := os.Stat(candidate); err == nil {
-			return candidate
-		}
-	}
-	return basePath + ".bin"
-}
-
 func resolveConfigPath() string {
 	if p := os.Getenv("APPCENTER_CONFIG"); p != "" {
 		return p
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/dlcache"
+	"appcenter-agent/internal/queue"
+)
+
+// stalePartialAge is how long an unfinished download may sit in the cache
+// before it is treated as abandoned.
+const stalePartialAge = 7 * 24 * time.Hour
+
+// legacyTaskFileRe matches per-task download files written before the shared
+// cache existed.
+var legacyTaskFileRe = regexp.MustCompile(`^task_\d+_app_\d+(\.(msi|exe|ps1|bin))?$`)
+
+// openDownloadCache returns nil when the cache directory cannot be created;
+// callers that can work without it fall back to direct downloads.
+func openDownloadCache(cfg config.Config, logger *log.Logger) *dlcache.Cache {
+	c, err := dlcache.FromConfig(cfg)
+	if err != nil {
+		logger.Printf("download cache unavailable: %v", err)
+		return nil
+	}
+	return c
+}
+
+// cleanupDownloads drops abandoned partial downloads, enforces the cache
+// quota and removes per-task files left behind by older agent versions.
+func cleanupDownloads(cfg config.Config, logger *log.Logger) {
+	if c := openDownloadCache(cfg, logger); c != nil {
+		if n := c.SweepPartials(stalePartialAge); n > 0 {
+			logger.Printf("download cache: removed %d stale partial downloads", n)
+		}
+		c.Evict()
+		entries, size := c.Stats()
+		logger.Printf("download cache: entries=%d size_mb=%d quota_mb=%d prestaged=%d", entries, size/(1024*1024), cfg.Download.CacheMaxMB, len(c.Pins()))
+	}
+
+	items, err := os.ReadDir(cfg.Download.TempDir)
+	if err != nil {
+		return
+	}
+	for _, it := range items {
+		if it.IsDir() || !legacyTaskFileRe.MatchString(it.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(cfg.Download.TempDir, it.Name())); err == nil {
+			logger.Printf("download cache: removed legacy task file %s", it.Name())
+		}
+	}
+}
+
+func isPrestage(cmd api.Command) bool {
+	return strings.EqualFold(strings.TrimSpace(cmd.Action), api.ActionPrestage)
+}
+
+// prestageEntry pins downloaded, verified content so a later install of the
+// same hash starts without downloading, and reports the task as staged.
+func prestageEntry(
+	cfg config.Config,
+	cache *dlcache.Cache,
+	cmd api.Command,
+	entry *dlcache.Entry,
+	downloadDuration int,
+	logger interface{ Printf(string, ...any) },
+) (queue.ExecutionResult, error) {
+	ttl := time.Duration(cfg.Download.PrestageTTLHours) * time.Hour
+	quota := int64(cfg.Download.PrestageMaxMB) * 1024 * 1024
+	if err := cache.Pin(entry.Hash, ttl, quota); err != nil {
+		if logger != nil {
+			logger.Printf("task=%d app=%d prestage failed: err=%v", cmd.TaskID, cmd.AppID, err)
+		}
+		return queue.ExecutionResult{ExitCode: -1, DownloadDurationSec: downloadDuration}, fmt.Errorf("prestage failed: %w", err)
+	}
+	if logger != nil {
+		logger.Printf("task=%d app=%d prestaged: bytes=%d download_sec=%d expires_in=%s", cmd.TaskID, cmd.AppID, entry.Size, downloadDuration, ttl)
+	}
+	return queue.ExecutionResult{
+		DownloadDurationSec: downloadDuration,
+		Message:             "Content staged",
+		Status:              "staged",
+	}, nil
+}
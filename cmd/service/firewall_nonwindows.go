@@ -5,3 +5,7 @@ package main
 import "log"
 
 func ensureRemoteSupportFirewallRules(_ string, _ *log.Logger) {}
+
+func ensureP2PFirewallRules(_ string, _ int, _ *log.Logger) {}
+
+func ensureRelayFirewallRule(_ string, _ int, _ *log.Logger) {}
@@ -12,39 +12,51 @@ import (
 
 func ensureRemoteSupportFirewallRules(exeDir string, logger *log.Logger) {
 	helperPath := filepath.Join(exeDir, "rshelper.exe")
-	ensureRule := func(name string, port int) {
-		showOut, showErr := exec.Command(
-			"netsh",
-			"advfirewall",
-			"firewall",
-			"show",
-			"rule",
-			"name="+name,
-		).CombinedOutput()
-		if showErr == nil && !strings.Contains(strings.ToLower(string(showOut)), "no rules match") {
-			return
-		}
-		addOut, addErr := exec.Command(
-			"netsh",
-			"advfirewall",
-			"firewall",
-			"add",
-			"rule",
-			"name="+name,
-			"dir=in",
-			"action=allow",
-			"enable=yes",
-			"profile=any",
-			"protocol=TCP",
-			"localport="+strconv.Itoa(port),
-			"program="+helperPath,
-		).CombinedOutput()
-		if addErr != nil {
-			logger.Printf("remote support firewall rule add failed: %s port=%d err=%v out=%s", name, port, addErr, strings.TrimSpace(string(addOut)))
-			return
-		}
-		logger.Printf("remote support firewall rule ensured: %s port=%d", name, port)
+	ensureFirewallRule("remote support", "AppCenter RemoteSupport 20010", "TCP", 20010, helperPath, logger)
+	ensureFirewallRule("remote support", "AppCenter RemoteSupport 20011", "TCP", 20011, helperPath, logger)
+}
+
+// ensureP2PFirewallRules opens the LAN content port (HTTP) and the
+// announcement port (UDP) for the service executable.
+func ensureP2PFirewallRules(serviceExe string, port int, logger *log.Logger) {
+	ensureFirewallRule("p2p", "AppCenter P2P TCP "+strconv.Itoa(port), "TCP", port, serviceExe, logger)
+	ensureFirewallRule("p2p", "AppCenter P2P UDP "+strconv.Itoa(port), "UDP", port, serviceExe, logger)
+}
+
+func ensureFirewallRule(label, name, protocol string, port int, program string, logger *log.Logger) {
+	showOut, showErr := exec.Command(
+		"netsh",
+		"advfirewall",
+		"firewall",
+		"show",
+		"rule",
+		"name="+name,
+	).CombinedOutput()
+	if showErr == nil && !strings.Contains(strings.ToLower(string(showOut)), "no rules match") {
+		return
 	}
-	ensureRule("AppCenter RemoteSupport 20010", 20010)
-	ensureRule("AppCenter RemoteSupport 20011", 20011)
+	addOut, addErr := exec.Command(
+		"netsh",
+		"advfirewall",
+		"firewall",
+		"add",
+		"rule",
+		"name="+name,
+		"dir=in",
+		"action=allow",
+		"enable=yes",
+		"profile=any",
+		"protocol="+protocol,
+		"localport="+strconv.Itoa(port),
+		"program="+program,
+	).CombinedOutput()
+	if addErr != nil {
+		logger.Printf("%s firewall rule add failed: %s port=%d err=%v out=%s", label, name, port, addErr, strings.TrimSpace(string(addOut)))
+		return
+	}
+	logger.Printf("%s firewall rule ensured: %s port=%d", label, name, port)
+}
+
+func ensureRelayFirewallRule(serviceExe string, port int, logger *log.Logger) {
+	ensureFirewallRule("relay", "AppCenter Relay "+strconv.Itoa(port), "TCP", port, serviceExe, logger)
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"io"
+
+	"appcenter-agent/internal/config"
+)
+
+// cliOptions are optional command line inputs. They take precedence over
+// config.yaml, environment and MSI bootstrap registry values.
+type cliOptions struct {
+	EnrollmentToken string
+	Tags            []string
+	Groups          []string
+}
+
+func parseCLIOptions(args []string) (cliOptions, error) {
+	fs := flag.NewFlagSet("appcenter-service", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	token := fs.String("enrollment-token", "", "one-time enrollment token used at registration")
+	tags := fs.String("tags", "", "comma separated tags sent at registration")
+	groups := fs.String("groups", "", "comma separated groups requested at registration")
+	if err := fs.Parse(args); err != nil {
+		return cliOptions{}, err
+	}
+	return cliOptions{
+		EnrollmentToken: *token,
+		Tags:            config.SplitList(*tags),
+		Groups:          config.SplitList(*groups),
+	}, nil
+}
+
+func (o cliOptions) apply(cfg *config.Config) {
+	if o.EnrollmentToken != "" {
+		cfg.Enrollment.Token = o.EnrollmentToken
+	}
+	if len(o.Tags) > 0 {
+		cfg.Enrollment.Tags = o.Tags
+	}
+	if len(o.Groups) > 0 {
+		cfg.Enrollment.Groups = o.Groups
+	}
+}
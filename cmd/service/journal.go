@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/inventory"
+)
+
+const journalShipInterval = 5 * time.Minute
+
+// openSoftwareJournal opens the change journal; without it scans still run,
+// they just are not journaled.
+func openSoftwareJournal(logger *log.Logger) *inventory.Journal {
+	j, err := inventory.OpenJournal(inventory.DefaultJournalPath())
+	if err != nil {
+		logger.Printf("software journal disabled: %v", err)
+		return nil
+	}
+	return j
+}
+
+// runJournalShipper streams journal events to the server: on every kick
+// (new events) and periodically to retry what was not acknowledged.
+func runJournalShipper(ctx context.Context, j *inventory.Journal, client *api.Client, creds api.CredentialProvider, kick <-chan struct{}, logger *log.Logger) {
+	send := func(ctx context.Context, events []inventory.JournalEvent) error {
+		agentUUID, secret := creds.Current()
+		return client.SubmitSoftwareEvents(ctx, agentUUID, secret, events)
+	}
+	ticker := time.NewTicker(journalShipInterval)
+	defer ticker.Stop()
+	unsupported := false
+	for {
+		sctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := j.Flush(sctx, send)
+		cancel()
+		var httpErr *api.HTTPError
+		switch {
+		case err == nil:
+			unsupported = false
+		case errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound:
+			// Older servers have no endpoint; events stay queued.
+			if !unsupported {
+				logger.Printf("software journal: server does not accept events yet; keeping them locally")
+			}
+			unsupported = true
+		default:
+			logger.Printf("software journal: ship failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-kick:
+		}
+	}
+}
+
+// journalQuery reads the IPC filter: since_seq and limit (default 100).
+func journalQuery(data any) (sinceSeq int64, limit int) {
+	limit = 100
+	m, _ := data.(map[string]any)
+	if v, ok := m["since_seq"].(float64); ok && v > 0 {
+		sinceSeq = int64(v)
+	}
+	if v, ok := m["limit"].(float64); ok && v > 0 {
+		limit = min(int(v), 1000)
+	}
+	return sinceSeq, limit
+}
@@ -14,7 +14,17 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	if err := runAgent(ctx, resolveConfigPath()); err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAuditCLI(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	opts, err := parseCLIOptions(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid arguments: %v\n", err)
+		os.Exit(2)
+	}
+
+	if err := runAgent(ctx, resolveConfigPath(), opts); err != nil {
 		fmt.Fprintf(os.Stderr, "service error: %v\n", err)
 		os.Exit(1)
 	}
@@ -21,8 +21,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAuditCLI(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	opts, err := parseCLIOptions(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid arguments: %v\n", err)
+		os.Exit(2)
+	}
+
 	if isService {
-		if err := svc.Run(serviceName, &appCenterService{}); err != nil {
+		if err := svc.Run(serviceName, &appCenterService{opts: opts}); err != nil {
 			os.Exit(1)
 		}
 		return
@@ -31,7 +41,7 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	if err := runAgent(ctx, resolveConfigPath()); err != nil {
+	if err := runAgent(ctx, resolveConfigPath(), opts); err != nil {
 		if errors.Is(err, updater.ErrUpdateRestart) {
 			os.Exit(0)
 		}
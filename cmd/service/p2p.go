@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/p2p"
+	"appcenter-agent/pkg/utils"
+)
+
+// startP2P starts LAN content sharing when p2p.enabled is set. Failures are
+// logged and leave the agent downloading from the server only.
+func startP2P(ctx context.Context, cfg config.Config, serviceExe string, logger *log.Logger) *p2p.Node {
+	if !cfg.P2P.Enabled {
+		return nil
+	}
+	utils.RegisterSecret(cfg.P2P.Key)
+	cache := openDownloadCache(cfg, logger)
+	if cache == nil {
+		return nil
+	}
+	ensureP2PFirewallRules(serviceExe, cfg.P2P.Port, logger)
+	node, err := p2p.Start(ctx, p2p.OptionsFromConfig(cfg, cache, logger))
+	if err != nil {
+		logger.Printf("p2p: not started: %v", err)
+		return nil
+	}
+	logger.Printf("p2p: sharing content on %s", node.HTTPAddr())
+	return node
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/audit"
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/policy"
+)
+
+// policyReportInterval suppresses duplicate rejection reports; heartbeat
+// config is re-sent every cycle and would otherwise flood the server.
+const policyReportInterval = time.Hour
+
+func loadPolicy(cfg *config.Config, logger *log.Logger) *policy.Policy {
+	path := cfg.Policy.File
+	if path == "" {
+		path = policy.DefaultPath()
+	}
+	pol, err := policy.Load(path, cfg.Policy.PublicKey)
+	if err != nil {
+		logger.Printf("policy: %v; rejecting all server actions until fixed", err)
+		return policy.Lockdown(err.Error())
+	}
+	if pol != nil {
+		logger.Printf("policy: loaded %s", path)
+	}
+	return pol
+}
+
+type policyReporter struct {
+	client *api.Client
+	creds  api.CredentialProvider
+	audit  *audit.Log
+	logger *log.Logger
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+func newPolicyReporter(client *api.Client, creds api.CredentialProvider, auditLog *audit.Log, logger *log.Logger) *policyReporter {
+	return &policyReporter{client: client, creds: creds, audit: auditLog, logger: logger, sent: make(map[string]time.Time)}
+}
+
+// Report logs err and, if it is a policy rejection, sends it to the server.
+// It returns true when err was a rejection.
+func (r *policyReporter) Report(err error, taskID, sessionID int) bool {
+	var rej *policy.Rejection
+	if !errors.As(err, &rej) {
+		return false
+	}
+	r.logger.Printf("policy: rejected %s (rule=%s task=%d session=%d): %s", rej.Action, rej.Rule, taskID, sessionID, rej.Detail)
+
+	key := rej.Error()
+	now := time.Now()
+	r.mu.Lock()
+	if last, ok := r.sent[key]; ok && now.Sub(last) < policyReportInterval && taskID == 0 && sessionID == 0 {
+		r.mu.Unlock()
+		return true
+	}
+	r.sent[key] = now
+	r.mu.Unlock()
+
+	recordAudit(r.audit, r.logger, audit.EventPolicyRejection, audit.Fields{
+		"action":     rej.Action,
+		"rule":       rej.Rule,
+		"detail":     rej.Detail,
+		"task_id":    taskID,
+		"session_id": sessionID,
+	})
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		agentUUID, secret := r.creds.Current()
+		if err := r.client.ReportPolicyRejection(ctx, agentUUID, secret, api.PolicyRejection{
+			Action:       rej.Action,
+			Rule:         rej.Rule,
+			Detail:       rej.Detail,
+			TaskID:       taskID,
+			SessionID:    sessionID,
+			TimestampUTC: now.UTC().Format(time.RFC3339),
+		}); err != nil {
+			r.logger.Printf("policy: rejection report failed: %v", err)
+		}
+	}()
+	return true
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"net/url"
+
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/netproxy"
+)
+
+// configureProxy installs network.proxy before the first outbound request.
+// An invalid proxy section leaves the environment proxy in effect.
+func configureProxy(cfg config.Config, logger *log.Logger) {
+	if netproxy.Configure(cfg, logger) == nil {
+		return
+	}
+	p := cfg.Network.Proxy
+	switch {
+	case p.PACURL != "":
+		logger.Printf("proxy: using PAC %s (fallback %q, %d bypass rules)", p.PACURL, redactProxy(p.URL), len(p.Bypass))
+	case p.URL != "":
+		logger.Printf("proxy: using %s (%d bypass rules)", redactProxy(p.URL), len(p.Bypass))
+	}
+}
+
+func redactProxy(raw string) string {
+	if u, err := url.Parse(raw); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return raw
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/dlcache"
+	"appcenter-agent/internal/relay"
+	"appcenter-agent/internal/reqsign"
+	"appcenter-agent/pkg/utils"
+)
+
+const relayDiscoveryTimeout = 5 * time.Second
+
+// discoverRelay points cfg at a relay announced on the LAN when
+// relay.discover is set. The override is not written back to config.yaml,
+// so the agent returns to server.url after a restart without a relay.
+//
+// A relay is only adopted when this agent signs its requests (the relay
+// rejects the secret header by default, and a 403 does not fail over) and
+// when it uses server.url's scheme, so discovery never downgrades https.
+func discoverRelay(ctx context.Context, cfg *config.Config, logger *log.Logger) {
+	if !cfg.Relay.Discover || cfg.Relay.Enabled || cfg.Relay.Key == "" {
+		return
+	}
+	utils.RegisterSecret(cfg.Relay.Key)
+	group := cfg.Relay.DiscoveryGroup
+	if group == "" {
+		group = relay.DefaultDiscoveryGroup
+	}
+	dctx, cancel := context.WithTimeout(ctx, relayDiscoveryTimeout)
+	defer cancel()
+	relayURL, err := relay.Discover(dctx, group, cfg.Relay.Key)
+	if err != nil {
+		logger.Printf("relay: none discovered, using %s", cfg.Server.URL)
+		return
+	}
+	if reason := relayUnusable(*cfg, relayURL); reason != "" {
+		logger.Printf("relay: ignoring discovered %s: %s", relayURL, reason)
+		return
+	}
+	logger.Printf("relay: discovered %s, using it instead of %s", relayURL, cfg.Server.URL)
+	cfg.OverrideServerURL(relayURL)
+}
+
+// relayUnusable returns why relayURL must not replace server.url, or "".
+func relayUnusable(cfg config.Config, relayURL string) string {
+	if mode := reqsign.NormalizeMode(cfg.Server.AuthMode); mode != reqsign.ModeSigned {
+		return "server.auth_mode is " + mode + ", relays need signed"
+	}
+	ru, err := url.Parse(relayURL)
+	if err != nil {
+		return err.Error()
+	}
+	su, err := url.Parse(cfg.Server.URL)
+	if err != nil {
+		return "server.url: " + err.Error()
+	}
+	if !strings.EqualFold(ru.Scheme, su.Scheme) {
+		return "scheme " + ru.Scheme + " differs from server.url (" + su.Scheme + ")"
+	}
+	return ""
+}
+
+// startRelay runs the site relay, its discovery beacon and the downstream
+// reachability report when relay.enabled is set.
+func startRelay(ctx context.Context, cfg config.Config, serviceExe string, client *api.Client, creds api.CredentialProvider, logger *log.Logger) {
+	if !cfg.Relay.Enabled {
+		return
+	}
+	cache, err := dlcache.Open(filepath.Join(cfg.Download.TempDir, "relay-cache"), cfg.Relay.CacheMaxMB)
+	if err != nil {
+		logger.Printf("relay: content cache disabled: %v", err)
+		cache = nil
+	}
+	srv, err := relay.New(relay.Options{
+		Upstream:      cfg.Server.URL,
+		Listen:        cfg.Relay.Listen,
+		TLSCertFile:   cfg.Relay.TLSCertFile,
+		TLSKeyFile:    cfg.Relay.TLSKeyFile,
+		RequireSigned: !cfg.Relay.AllowLegacyAuth,
+		Cache:         cache,
+		Logger:        logger,
+	})
+	if err != nil {
+		logger.Printf("relay: not started: %v", err)
+		return
+	}
+	if _, port, err := net.SplitHostPort(cfg.Relay.Listen); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			ensureRelayFirewallRule(serviceExe, p, logger)
+		}
+	}
+	go func() {
+		logger.Printf("relay: listening on %s for %s", cfg.Relay.Listen, cfg.Server.URL)
+		if err := srv.ListenAndServe(ctx); err != nil {
+			logger.Printf("relay: stopped: %v", err)
+		}
+	}()
+
+	if cfg.Relay.Key != "" && cfg.Relay.PublicURL != "" {
+		utils.RegisterSecret(cfg.Relay.Key)
+		group := cfg.Relay.DiscoveryGroup
+		if group == "" {
+			group = relay.DefaultDiscoveryGroup
+		}
+		go func() {
+			if err := relay.RunBeacon(ctx, cfg.Relay.PublicURL, cfg.Relay.Key, []string{group}, 0); err != nil {
+				logger.Printf("relay: beacon stopped: %v", err)
+			}
+		}()
+	}
+
+	go runRelayReporter(ctx, srv, cfg, client, creds, logger)
+}
+
+func runRelayReporter(ctx context.Context, srv *relay.Server, cfg config.Config, client *api.Client, creds api.CredentialProvider, logger *log.Logger) {
+	// Downstream agents heartbeat every heartbeat.interval_sec; three missed
+	// intervals mark one unreachable.
+	window := 3 * time.Duration(cfg.Heartbeat.IntervalSec) * time.Second
+	ticker := time.NewTicker(time.Duration(cfg.Relay.ReportIntervalMin) * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		agents := srv.Downstream(window)
+		if len(agents) == 0 {
+			continue
+		}
+		agentUUID, secret := creds.Current()
+		rctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		if err := client.ReportRelayDownstream(rctx, agentUUID, secret, agents); err != nil {
+			logger.Printf("relay: downstream report failed: %v", err)
+		}
+		cancel()
+	}
+}
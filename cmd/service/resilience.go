@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/resilience"
+)
+
+// waitRestartDelay spreads reconnects after a server.broadcast.restart: the
+// restart left a marker, and this start waits a random part of the jitter
+// window before the first server contact.
+func waitRestartDelay(ctx context.Context, logger *log.Logger) error {
+	delay := resilience.TakeRestartDelay(resilience.DefaultRestartMarkerPath(), time.Now())
+	if delay <= 0 {
+		return nil
+	}
+	logger.Printf("restart: waiting %v before contacting the server", delay.Round(time.Second))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// scheduleRestartDelay records the startup delay for the process that
+// follows a broadcast restart. The payload may override the window with
+// jitter_sec.
+func scheduleRestartDelay(cfg config.Config, payload map[string]any, logger *log.Logger) {
+	window := configInt(payload, "jitter_sec", cfg.Resilience.RestartJitterSec)
+	if err := resilience.ScheduleRestartDelay(resilience.DefaultRestartMarkerPath(), time.Duration(window)*time.Second); err != nil {
+		logger.Printf("restart: startup delay not recorded: %v", err)
+	}
+}
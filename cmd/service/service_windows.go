@@ -11,7 +11,9 @@ import (
 	"appcenter-agent/internal/updater"
 )
 
-type appCenterService struct{}
+type appCenterService struct {
+	opts cliOptions
+}
 
 func (m *appCenterService) Execute(_ []string, req <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
 	const accepted = svc.AcceptStop | svc.AcceptShutdown
@@ -24,7 +26,7 @@ func (m *appCenterService) Execute(_ []string, req <-chan svc.ChangeRequest, sta
 	var runErr error
 	done := make(chan struct{})
 	go func() {
-		runErr = runAgent(ctx, resolveConfigPath())
+		runErr = runAgent(ctx, resolveConfigPath(), m.opts)
 		close(done)
 	}()
 
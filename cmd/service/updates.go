@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/clock"
+	"appcenter-agent/internal/inventory"
+)
+
+// updateCheckInterval is how often catalog releases are re-checked when the
+// inventory does not change; new releases only show up in the store.
+const updateCheckInterval = time.Hour
+
+// updateChecker compares the installed catalog apps with the store and
+// reports the outdated ones to the server and over IPC.
+type updateChecker struct {
+	catalog *inventory.Catalog
+	client  *api.Client
+	creds   api.CredentialProvider
+	logger  *log.Logger
+
+	mu        sync.Mutex
+	updates   []inventory.AvailableUpdate
+	checkedAt time.Time
+	// reported is the last list the server acknowledged; nil until the
+	// first report after a start.
+	reported    []inventory.AvailableUpdate
+	unsupported bool
+}
+
+// run checks on every kick (the mapping changed, which includes the first
+// scan after a start) and hourly.
+func (u *updateChecker) run(ctx context.Context, kick <-chan struct{}) {
+	ticker := time.NewTicker(updateCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-kick:
+		}
+		u.checkAndReport(ctx)
+	}
+}
+
+func (u *updateChecker) checkAndReport(ctx context.Context) {
+	// Without mapped apps there is nothing to compare; skip the store fetch.
+	if len(u.catalog.Apps()) == 0 && len(u.current()) == 0 {
+		return
+	}
+	fctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	agentUUID, secret := u.creds.Current()
+	store, err := u.client.GetStore(fctx, agentUUID, secret)
+	if err != nil {
+		u.logger.Printf("update check: store fetch failed: %v", err)
+		return
+	}
+	updates := u.check(store.Apps)
+	u.report(fctx, updates)
+}
+
+// check recomputes the available updates from the store apps.
+func (u *updateChecker) check(apps []api.StoreApp) []inventory.AvailableUpdate {
+	catalog := make([]inventory.CatalogApp, 0, len(apps))
+	for _, app := range apps {
+		catalog = append(catalog, inventory.CatalogApp{AppID: app.ID, Name: app.DisplayName, Version: app.Version})
+	}
+	updates := inventory.FindUpdates(u.catalog.Apps(), catalog)
+	if updates == nil {
+		updates = []inventory.AvailableUpdate{}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !slices.Equal(updates, u.updates) {
+		u.logger.Printf("update check: %d update(s) available", len(updates))
+	}
+	u.updates = updates
+	u.checkedAt = clock.Now().UTC()
+	return updates
+}
+
+func (u *updateChecker) report(ctx context.Context, updates []inventory.AvailableUpdate) {
+	u.mu.Lock()
+	skip := u.unsupported || (u.reported != nil && slices.Equal(updates, u.reported))
+	u.mu.Unlock()
+	if skip {
+		return
+	}
+	agentUUID, secret := u.creds.Current()
+	err := u.client.ReportAvailableUpdates(ctx, agentUUID, secret, updates)
+	var httpErr *api.HTTPError
+	switch {
+	case errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound:
+		// Older servers have no endpoint; the list stays available over IPC.
+		u.logger.Printf("update check: server does not accept update reports")
+		u.mu.Lock()
+		u.unsupported = true
+		u.mu.Unlock()
+	case err != nil:
+		u.logger.Printf("update check: report failed: %v", err)
+	default:
+		u.mu.Lock()
+		u.reported = updates
+		u.mu.Unlock()
+	}
+}
+
+func (u *updateChecker) current() []inventory.AvailableUpdate {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.updates
+}
+
+// status is the IPC view of the last check.
+func (u *updateChecker) status() map[string]any {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	updates := u.updates
+	if updates == nil {
+		updates = []inventory.AvailableUpdate{}
+	}
+	out := map[string]any{"updates": updates}
+	if !u.checkedAt.IsZero() {
+		out["checked_at"] = u.checkedAt.Format(time.RFC3339)
+	}
+	return out
+}
+
+// annotate refreshes the check from a store listing and marks the apps
+// with an update so the tray can offer them.
+func (u *updateChecker) annotate(store *api.StoreResponse) {
+	byID := make(map[int]inventory.AvailableUpdate)
+	for _, up := range u.check(store.Apps) {
+		byID[up.AppID] = up
+	}
+	for i := range store.Apps {
+		up, ok := byID[store.Apps[i].ID]
+		if !ok {
+			continue
+		}
+		store.Apps[i].UpdateAvailable = true
+		store.Apps[i].Installed = true
+		if store.Apps[i].InstalledVersion == "" {
+			store.Apps[i].InstalledVersion = up.InstalledVersion
+		}
+	}
+}
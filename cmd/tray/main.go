@@ -39,7 +39,7 @@ func main() {
 		return
 	}
 	if action == "check_server" {
-		ok, detail := tray.CheckServerHealth()
+		ok, detail := tray.CheckServerHealth(tray.ActiveServerURL(tray.DefaultIPCClient{}))
 		resp := map[string]any{"status": "ok", "server_reachable": ok, "detail": detail}
 		b, _ := json.MarshalIndent(resp, "", "  ")
 		fmt.Println(string(b))
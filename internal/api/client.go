@@ -9,10 +9,20 @@ import (
 	"net/http"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"appcenter-agent/internal/audit"
+	"appcenter-agent/internal/clock"
 	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/inventory"
+	"appcenter-agent/internal/netproxy"
+	"appcenter-agent/internal/relay"
+	"appcenter-agent/internal/reqsign"
+	"appcenter-agent/internal/resilience"
 	"appcenter-agent/internal/system"
+	"appcenter-agent/internal/urlguard"
+	"appcenter-agent/pkg/utils"
 )
 
 type HTTPError struct {
@@ -21,10 +31,20 @@ type HTTPError struct {
 	StatusCode int
 	Status     string
 	Detail     string
-	Body       string
+	// Code is the machine-readable error code from the server body, if any
+	// (e.g. "enrollment_token_expired").
+	Code string
+	Body string
+	// RetryAfter is the delay the server asked for (429/503), if any.
+	RetryAfter time.Duration
 }
 
 func (e *HTTPError) Error() string {
+	// Error strings end up in logs and IPC/tray messages; never echo credentials.
+	return utils.Redact(e.message())
+}
+
+func (e *HTTPError) message() string {
 	msg := e.Status
 	if msg == "" {
 		msg = fmt.Sprintf("HTTP %d", e.StatusCode)
@@ -38,22 +58,94 @@ func (e *HTTPError) Error() string {
 	return fmt.Sprintf("%s %s failed: %s", e.Method, e.URL, msg)
 }
 
+// CredentialProvider returns the agent UUID and secret currently in effect.
+// Components hold a provider instead of copying the secret so that server-driven
+// rotation and re-enrollment take effect without a restart.
+type CredentialProvider interface {
+	Current() (agentUUID, secret string)
+}
+
+// StaticCredentials is a CredentialProvider with fixed values.
+type StaticCredentials struct {
+	AgentUUID string
+	Secret    string
+}
+
+func (s StaticCredentials) Current() (string, string) {
+	return s.AgentUUID, s.Secret
+}
+
 type Client struct {
-	baseURL      string
+	baseURL      atomic.Pointer[string]
+	authMode     atomic.Pointer[string]
 	httpClient   *http.Client
 	longPollHTTP *http.Client
+
+	breakers *resilience.Breakers
+	clock    *clock.Estimator
+
+	authObserver        atomic.Pointer[func(statusCode int, authError string)]
+	unreachableObserver atomic.Pointer[func(err error)]
+
+	requestEncodings   atomic.Pointer[[]string]
+	negotiatedEncoding atomic.Pointer[string]
+
+	// redirectGuard follows the base URL: API calls never need to leave the
+	// current server's origin, and a redirect elsewhere must not carry the
+	// agent credentials.
+	redirectGuard atomic.Pointer[urlguard.Guard]
 }
 
 func NewClient(cfg config.ServerConfig) *Client {
-	return &Client{
-		baseURL: strings.TrimRight(cfg.URL, "/"),
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-		longPollHTTP: &http.Client{
-			Timeout: 65 * time.Second,
-		},
+	c := &Client{
+		breakers: resilience.Default(),
+		clock:    clock.Default(),
 	}
+	c.httpClient = &http.Client{
+		Timeout:       30 * time.Second,
+		Transport:     netproxy.Transport(),
+		CheckRedirect: c.checkRedirect,
+	}
+	c.longPollHTTP = &http.Client{
+		Timeout:       65 * time.Second,
+		Transport:     netproxy.Transport(),
+		CheckRedirect: c.checkRedirect,
+	}
+	c.SetBaseURL(cfg.URL)
+	c.SetAuthMode(cfg.AuthMode)
+	return c
+}
+
+// BaseURL returns the server the client currently talks to.
+func (c *Client) BaseURL() string {
+	return *c.baseURL.Load()
+}
+
+// Breakers returns the circuit breakers the client honors.
+func (c *Client) Breakers() *resilience.Breakers {
+	return c.breakers
+}
+
+// SetBaseURL points the client at another server, e.g. after an endpoint
+// failover. Requests already in flight finish against the old one.
+func (c *Client) SetBaseURL(serverURL string) {
+	base := strings.TrimRight(serverURL, "/")
+	c.baseURL.Store(&base)
+	c.redirectGuard.Store(urlguard.New(urlguard.Options{ServerURL: base}))
+	// Another server may not accept the codings the previous one did, nor
+	// share its clock.
+	c.negotiatedEncoding.Store(nil)
+	c.clock.Reset()
+}
+
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	return c.redirectGuard.Load().CheckRedirect(req, via)
+}
+
+// SetAuthMode changes server.auth_mode for the following requests.
+func (c *Client) SetAuthMode(mode string) {
+	mode = reqsign.NormalizeMode(mode)
+	c.authMode.Store(&mode)
 }
 
 type RegisterRequest struct {
@@ -68,6 +160,19 @@ type RegisterRequest struct {
 	CPUModel      string `json:"cpu_model"`
 	RAMGB         int    `json:"ram_gb"`
 	DiskFreeGB    int    `json:"disk_free_gb"`
+
+	// HardwareFingerprint is a hash of stable machine identifiers; the server stores
+	// it on first registration to recognize a reinstalled host. It is not a secret
+	// and does not authorize re-enrollment on its own: that needs ReenrollToken,
+	// the single-use token issued with the previous registration.
+	HardwareFingerprint string `json:"hardware_fingerprint,omitempty"`
+	Reenroll            bool   `json:"reenroll,omitempty"`
+	ReenrollReason      string `json:"reenroll_reason,omitempty"`
+	ReenrollToken       string `json:"reenroll_token,omitempty"`
+
+	EnrollmentToken string   `json:"enrollment_token,omitempty"`
+	Tags            []string `json:"tags,omitempty"`
+	Groups          []string `json:"groups,omitempty"`
 }
 
 type RegisterResponse struct {
@@ -75,13 +180,35 @@ type RegisterResponse struct {
 	Message   string         `json:"message"`
 	SecretKey string         `json:"secret_key"`
 	Config    map[string]any `json:"config"`
+	// Groups are the group assignments made by the server at registration.
+	Groups []GroupAssignment `json:"groups,omitempty"`
+	// Policy is the initial policy for the agent; it uses the same keys as the
+	// heartbeat config map and is applied before the first heartbeat.
+	Policy map[string]any `json:"policy,omitempty"`
+	// ReenrollToken authorizes one later re-enrollment of this UUID. Each
+	// registration issues a new one and invalidates the previous token.
+	ReenrollToken string `json:"reenroll_token,omitempty"`
+}
+
+type GroupAssignment struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
 }
 
 type InstalledApp struct {
 	AppID   int    `json:"app_id"`
 	Version string `json:"version"`
+	// Source is "inventory" for apps mapped from the scanned inventory by the
+	// catalog rules, "task" for apps the agent installed; empty from old agents.
+	Source string `json:"source,omitempty"`
 }
 
+// Installed app sources.
+const (
+	InstalledSourceInventory = "inventory"
+	InstalledSourceTask      = "task"
+)
+
 type LoggedInSession struct {
 	Username    string `json:"username"`
 	SessionType string `json:"session_type"`
@@ -159,6 +286,13 @@ type HeartbeatRequest struct {
 	LoggedInSessions []LoggedInSession    `json:"logged_in_sessions"`
 	SystemProfile    *SystemProfile       `json:"system_profile,omitempty"`
 	RemoteSupport    *RemoteSupportStatus `json:"remote_support,omitempty"`
+	// ServerEndpoint is the server URL the agent is currently using.
+	ServerEndpoint string `json:"server_endpoint,omitempty"`
+	// Clock is the estimated offset from the server clock, once measured.
+	Clock *clock.Status `json:"clock,omitempty"`
+	// CatalogRulesVersion is the catalog rule set InstalledApps was mapped
+	// with; apps covered by it are reported from the real inventory.
+	CatalogRulesVersion string `json:"catalog_rules_version,omitempty"`
 }
 
 type RemoteSupportStatus struct {
@@ -168,18 +302,25 @@ type RemoteSupportStatus struct {
 	HelperPID     int    `json:"helper_pid"`
 }
 
+// ActionPrestage commands only download and verify the content and keep it
+// pinned in the download cache for a later install of the same hash.
+const ActionPrestage = "prestage"
+
 type Command struct {
-	TaskID        int    `json:"task_id"`
-	Action        string `json:"action"`
-	AppID         int    `json:"app_id"`
-	AppName       string `json:"app_name"`
-	AppVersion    string `json:"app_version"`
-	DownloadURL   string `json:"download_url"`
-	FileHash      string `json:"file_hash"`
-	FileSizeBytes int64  `json:"file_size_bytes"`
-	InstallArgs   string `json:"install_args"`
-	ForceUpdate   bool   `json:"force_update"`
-	Priority      int    `json:"priority"`
+	TaskID      int    `json:"task_id"`
+	Action      string `json:"action"`
+	AppID       int    `json:"app_id"`
+	AppName     string `json:"app_name"`
+	AppVersion  string `json:"app_version"`
+	DownloadURL string `json:"download_url"`
+	// Mirrors are additional sources for the same content (HTTP mirrors,
+	// CDN URLs or branch file shares), ordered by health with DownloadURL.
+	Mirrors       []string `json:"mirrors,omitempty"`
+	FileHash      string   `json:"file_hash"`
+	FileSizeBytes int64    `json:"file_size_bytes"`
+	InstallArgs   string   `json:"install_args"`
+	ForceUpdate   bool     `json:"force_update"`
+	Priority      int      `json:"priority"`
 }
 
 type HeartbeatResponse struct {
@@ -223,6 +364,18 @@ type TaskStatusRequest struct {
 	DownloadDurationSec int    `json:"download_duration_sec,omitempty"`
 	InstallDurationSec  int    `json:"install_duration_sec,omitempty"`
 	Error               string `json:"error,omitempty"`
+	// ErrorCode is a machine-readable failure reason (e.g. "policy_rejected").
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+// PolicyRejection reports a server request refused by the local policy file.
+type PolicyRejection struct {
+	Action       string `json:"action"`
+	Rule         string `json:"rule"`
+	Detail       string `json:"detail"`
+	TaskID       int    `json:"task_id,omitempty"`
+	SessionID    int    `json:"session_id,omitempty"`
+	TimestampUTC string `json:"timestamp_utc"`
 }
 
 type TaskStatusResponse struct {
@@ -251,24 +404,54 @@ type StoreApp struct {
 	ConflictMessage    string `json:"conflict_message"`
 	InstalledVersion   string `json:"installed_version"`
 	CanUninstall       bool   `json:"can_uninstall"`
+	// UpdateAvailable is set by the agent when the installed version found
+	// in the inventory is older than Version.
+	UpdateAvailable bool `json:"update_available,omitempty"`
 }
 
 type StoreResponse struct {
 	Apps []StoreApp `json:"apps"`
 }
 
-func (c *Client) Register(ctx context.Context, uuid string, version string, info system.HostInfo) (*RegisterResponse, error) {
+// RegisterOptions carries optional registration inputs.
+type RegisterOptions struct {
+	HardwareFingerprint string
+	// Reenroll marks a registration for an existing UUID whose credentials were
+	// rejected; ReenrollReason is informational for the server audit trail.
+	Reenroll       bool
+	ReenrollReason string
+	ReenrollToken  string
+
+	EnrollmentToken string
+	Tags            []string
+	Groups          []string
+}
+
+func (c *Client) Register(
+	ctx context.Context,
+	uuid string,
+	version string,
+	info system.HostInfo,
+	opts RegisterOptions,
+) (*RegisterResponse, error) {
 	payload := RegisterRequest{
-		UUID:         uuid,
-		Hostname:     info.Hostname,
-		OSVersion:    info.OSVersion,
-		Platform:     "windows",
-		Arch:         runtime.GOARCH,
-		Distro:       "windows",
-		AgentVersion: version,
-		CPUModel:     info.CPUModel,
-		RAMGB:        info.RAMGB,
-		DiskFreeGB:   info.DiskFreeGB,
+		UUID:                uuid,
+		HardwareFingerprint: opts.HardwareFingerprint,
+		Reenroll:            opts.Reenroll,
+		ReenrollReason:      opts.ReenrollReason,
+		ReenrollToken:       opts.ReenrollToken,
+		EnrollmentToken:     opts.EnrollmentToken,
+		Tags:                opts.Tags,
+		Groups:              opts.Groups,
+		Hostname:            info.Hostname,
+		OSVersion:           info.OSVersion,
+		Platform:            "windows",
+		Arch:                runtime.GOARCH,
+		Distro:              "windows",
+		AgentVersion:        version,
+		CPUModel:            info.CPUModel,
+		RAMGB:               info.RAMGB,
+		DiskFreeGB:          info.DiskFreeGB,
 	}
 
 	var out RegisterResponse
@@ -279,13 +462,10 @@ func (c *Client) Register(ctx context.Context, uuid string, version string, info
 }
 
 func (c *Client) Heartbeat(ctx context.Context, agentUUID, secret string, reqBody HeartbeatRequest) (*HeartbeatResponse, error) {
-	headers := map[string]string{
-		"X-Agent-UUID":   agentUUID,
-		"X-Agent-Secret": secret,
-	}
+	auth := c.credentials(agentUUID, secret)
 
 	var out HeartbeatResponse
-	if err := c.postJSON(ctx, "/api/v1/agent/heartbeat", reqBody, headers, &out); err != nil {
+	if err := c.postJSON(ctx, "/api/v1/agent/heartbeat", reqBody, auth, &out); err != nil {
 		return nil, err
 	}
 	return &out, nil
@@ -298,59 +478,102 @@ func (c *Client) ReportTaskStatus(
 	taskID int,
 	reqBody TaskStatusRequest,
 ) (*TaskStatusResponse, error) {
-	headers := map[string]string{
-		"X-Agent-UUID":   agentUUID,
-		"X-Agent-Secret": secret,
-	}
+	auth := c.credentials(agentUUID, secret)
 
 	var out TaskStatusResponse
 	path := fmt.Sprintf("/api/v1/agent/task/%d/status", taskID)
-	if err := c.postJSON(ctx, path, reqBody, headers, &out); err != nil {
+	if err := c.postJSON(ctx, path, reqBody, auth, &out); err != nil {
 		return nil, err
 	}
 	return &out, nil
 }
 
 func (c *Client) GetStore(ctx context.Context, agentUUID, secret string) (*StoreResponse, error) {
-	headers := map[string]string{
-		"X-Agent-UUID":   agentUUID,
-		"X-Agent-Secret": secret,
-	}
+	auth := c.credentials(agentUUID, secret)
 
 	var out StoreResponse
-	if err := c.getJSON(ctx, "/api/v1/agent/store", headers, &out); err != nil {
+	if err := c.getJSON(ctx, "/api/v1/agent/store", auth, &out); err != nil {
 		return nil, err
 	}
 	return &out, nil
 }
 
 func (c *Client) SubmitInventory(ctx context.Context, agentUUID, secret string, payload any) (map[string]any, error) {
-	headers := map[string]string{
-		"X-Agent-UUID":   agentUUID,
-		"X-Agent-Secret": secret,
-	}
+	auth := c.credentials(agentUUID, secret)
 
 	var out map[string]any
-	if err := c.postJSON(ctx, "/api/v1/agent/inventory", payload, headers, &out); err != nil {
+	if err := c.postJSON(ctx, "/api/v1/agent/inventory", payload, auth, &out); err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
 func (c *Client) RequestStoreInstall(ctx context.Context, agentUUID, secret string, appID int) (*MessageResponse, error) {
-	headers := map[string]string{
-		"X-Agent-UUID":   agentUUID,
-		"X-Agent-Secret": secret,
-	}
+	auth := c.credentials(agentUUID, secret)
 
 	var out MessageResponse
 	path := fmt.Sprintf("/api/v1/agent/store/%d/install", appID)
-	if err := c.postJSON(ctx, path, map[string]any{}, headers, &out); err != nil {
+	if err := c.postJSON(ctx, path, map[string]any{}, auth, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SubmitAuditRecords ships hash-chained audit records. Records are sent as
+// written so the server can verify the chain itself.
+func (c *Client) SubmitAuditRecords(ctx context.Context, agentUUID, secret string, records []audit.Envelope) error {
+	auth := c.credentials(agentUUID, secret)
+
+	var out MessageResponse
+	return c.postJSON(ctx, "/api/v1/agent/audit", map[string]any{"records": records}, auth, &out)
+}
+
+// SubmitSoftwareEvents ships software change journal events, oldest first.
+// The server must treat seq as the idempotency key: a batch is resent if the
+// acknowledgement was lost.
+func (c *Client) SubmitSoftwareEvents(ctx context.Context, agentUUID, secret string, events []inventory.JournalEvent) error {
+	auth := c.credentials(agentUUID, secret)
+
+	var out MessageResponse
+	return c.postJSON(ctx, "/api/v1/agent/software-events", map[string]any{"events": events}, auth, &out)
+}
+
+// GetCatalogRules fetches the rules that map scanned software to store
+// catalog apps.
+func (c *Client) GetCatalogRules(ctx context.Context, agentUUID, secret string) (*inventory.CatalogRules, error) {
+	auth := c.credentials(agentUUID, secret)
+
+	var out inventory.CatalogRules
+	if err := c.getJSON(ctx, "/api/v1/agent/catalog-rules", auth, &out); err != nil {
 		return nil, err
 	}
 	return &out, nil
 }
 
+// ReportAvailableUpdates sends the installed catalog apps that are older
+// than their catalog release. An empty list clears the previous report.
+func (c *Client) ReportAvailableUpdates(ctx context.Context, agentUUID, secret string, updates []inventory.AvailableUpdate) error {
+	auth := c.credentials(agentUUID, secret)
+
+	var out MessageResponse
+	return c.postJSON(ctx, "/api/v1/agent/available-updates", map[string]any{"updates": updates}, auth, &out)
+}
+
+// ReportRelayDownstream sends the reachability of agents behind this relay.
+func (c *Client) ReportRelayDownstream(ctx context.Context, agentUUID, secret string, agents []relay.Downstream) error {
+	auth := c.credentials(agentUUID, secret)
+
+	var out MessageResponse
+	return c.postJSON(ctx, "/api/v1/agent/relay/downstream", map[string]any{"agents": agents}, auth, &out)
+}
+
+func (c *Client) ReportPolicyRejection(ctx context.Context, agentUUID, secret string, rej PolicyRejection) error {
+	auth := c.credentials(agentUUID, secret)
+
+	var out MessageResponse
+	return c.postJSON(ctx, "/api/v1/agent/policy/rejections", rej, auth, &out)
+}
+
 func (c *Client) ApproveRemoteSession(
 	ctx context.Context,
 	agentUUID, secret string,
@@ -358,14 +581,11 @@ func (c *Client) ApproveRemoteSession(
 	approved bool,
 	monitorCount int,
 ) (*ApproveRemoteSessionResponse, error) {
-	headers := map[string]string{
-		"X-Agent-UUID":   agentUUID,
-		"X-Agent-Secret": secret,
-	}
+	auth := c.credentials(agentUUID, secret)
 
 	var out ApproveRemoteSessionResponse
 	path := fmt.Sprintf("/api/v1/agent/remote-support/%d/approve", sessionID)
-	if err := c.postJSON(ctx, path, map[string]any{"approved": approved, "monitor_count": monitorCount}, headers, &out); err != nil {
+	if err := c.postJSON(ctx, path, map[string]any{"approved": approved, "monitor_count": monitorCount}, auth, &out); err != nil {
 		return nil, err
 	}
 	return &out, nil
@@ -376,12 +596,9 @@ func (c *Client) ReportRemoteReady(
 	agentUUID, secret string,
 	sessionID int,
 ) error {
-	headers := map[string]string{
-		"X-Agent-UUID":   agentUUID,
-		"X-Agent-Secret": secret,
-	}
+	auth := c.credentials(agentUUID, secret)
 	path := fmt.Sprintf("/api/v1/agent/remote-support/%d/ready", sessionID)
-	return c.postJSON(ctx, path, map[string]any{"vnc_ready": true}, headers, &MessageResponse{})
+	return c.postJSON(ctx, path, map[string]any{"vnc_ready": true}, auth, &MessageResponse{})
 }
 
 func (c *Client) ReportRemoteEnded(
@@ -390,62 +607,173 @@ func (c *Client) ReportRemoteEnded(
 	sessionID int,
 	endedBy string,
 ) error {
-	headers := map[string]string{
-		"X-Agent-UUID":   agentUUID,
-		"X-Agent-Secret": secret,
-	}
+	auth := c.credentials(agentUUID, secret)
 	path := fmt.Sprintf("/api/v1/agent/remote-support/%d/ended", sessionID)
-	return c.postJSON(ctx, path, map[string]string{"ended_by": endedBy}, headers, &MessageResponse{})
+	return c.postJSON(ctx, path, map[string]string{"ended_by": endedBy}, auth, &MessageResponse{})
 }
 
-func (c *Client) postJSON(ctx context.Context, path string, payload any, headers map[string]string, out any) error {
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return err
+// SetAuthObserver registers fn to be called with the HTTP status code and the
+// X-Agent-Auth-Error header of every authenticated request. It is used to
+// detect revoked credentials.
+func (c *Client) SetAuthObserver(fn func(statusCode int, authError string)) {
+	if fn == nil {
+		c.authObserver.Store(nil)
+		return
 	}
+	c.authObserver.Store(&fn)
+}
 
-	url := c.baseURL + path
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	for k, v := range headers {
-		req.Header.Set(k, v)
+func (c *Client) observeAuth(resp *http.Response) {
+	if fn := c.authObserver.Load(); fn != nil {
+		(*fn)(resp.StatusCode, resp.Header.Get(reqsign.HeaderAuthError))
 	}
+}
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return err
+// SetUnreachableObserver registers fn to be called when a request gets no
+// response from the server or a gateway error (502, 503, 504). It is used to
+// trigger an endpoint health check.
+func (c *Client) SetUnreachableObserver(fn func(err error)) {
+	if fn == nil {
+		c.unreachableObserver.Store(nil)
+		return
 	}
-	defer resp.Body.Close()
+	c.unreachableObserver.Store(&fn)
+}
 
-	if resp.StatusCode >= 300 {
-		return httpErrorFromResponse(http.MethodPost, url, resp)
+func (c *Client) observeUnreachable(err error) {
+	if fn := c.unreachableObserver.Load(); fn != nil && err != nil {
+		(*fn)(err)
 	}
-	return json.NewDecoder(resp.Body).Decode(out)
 }
 
-func (c *Client) getJSON(ctx context.Context, path string, headers map[string]string, out any) error {
-	url := c.baseURL + path
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+func (c *Client) credentials(agentUUID, secret string) *reqsign.Credentials {
+	return &reqsign.Credentials{AgentUUID: agentUUID, Secret: secret, Mode: *c.authMode.Load()}
+}
+
+func (c *Client) postJSON(ctx context.Context, path string, payload any, auth *reqsign.Credentials, out any) error {
+	body, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
-	for k, v := range headers {
-		req.Header.Set(k, v)
+	return c.doJSON(ctx, c.httpClient, http.MethodPost, path, body, auth, out)
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, auth *reqsign.Credentials, out any) error {
+	return c.doJSON(ctx, c.httpClient, http.MethodGet, path, nil, auth, out)
+}
+
+// doJSON sends a signed request and decodes the JSON response into out. When the
+// server rejects the signature because of clock skew, the local clock offset is
+// corrected from the response Date header and the request is re-signed once.
+// A body sent with a negotiated Content-Encoding that the server answers with
+// 415 is resent uncompressed once. The signature always covers the JSON body.
+func (c *Client) doJSON(
+	ctx context.Context,
+	hc *http.Client,
+	method, path string,
+	body []byte,
+	auth *reqsign.Credentials,
+	out any,
+) error {
+	url := c.BaseURL() + path
+	class := endpointClass(path)
+	if err := c.breakers.Allow(class); err != nil {
+		return err
 	}
+	coding := c.requestEncoding()
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader
+		contentEncoding := ""
+		if body != nil {
+			var wire []byte
+			wire, contentEncoding = encodeBody(body, coding)
+			reader = bytes.NewReader(wire)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, reader)
+		if err != nil {
+			return err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if contentEncoding != "" {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		if auth != nil {
+			if err := auth.Sign(req, body); err != nil {
+				return err
+			}
+		}
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
+		sent := time.Now()
+		resp, err := hc.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				c.breakers.Record(class, 0, 0)
+				c.observeUnreachable(err)
+			}
+			return err
+		}
+		received := time.Now()
+		c.learnEncoding(resp.Header)
+		skewRejected := isClockSkewRejection(resp)
+		if skewRejected {
+			// Earlier samples disagree with the server's verdict.
+			c.clock.Reset()
+		}
+		// A long-poll answer is dated when the server releases it, not at
+		// the midpoint of the exchange; only its skew verdict is used.
+		if hc != c.longPollHTTP || skewRejected {
+			if serverTime, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+				c.clock.Observe(sent, received, serverTime, time.Second)
+			}
+		}
+
+		if resp.StatusCode >= 300 {
+			if attempt == 0 && skewRejected {
+				resp.Body.Close()
+				continue
+			}
+			if resp.StatusCode == http.StatusUnsupportedMediaType && contentEncoding != "" {
+				resp.Body.Close()
+				none := ""
+				c.negotiatedEncoding.Store(&none)
+				coding = ""
+				continue
+			}
+			if auth != nil {
+				c.observeAuth(resp)
+			}
+			err := httpErrorFromResponse(method, url, resp)
+			resp.Body.Close()
+			c.breakers.Record(class, resp.StatusCode, err.RetryAfter)
+			switch resp.StatusCode {
+			case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				c.observeUnreachable(err)
+			}
+			return err
+		}
+		if auth != nil {
+			c.observeAuth(resp)
+		}
+		c.breakers.Record(class, resp.StatusCode, 0)
+		err = json.NewDecoder(resp.Body).Decode(out)
+		resp.Body.Close()
 		return err
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode >= 300 {
-		return httpErrorFromResponse(http.MethodGet, url, resp)
+// isClockSkewRejection reports a 401 the server attributes to the request
+// timestamp. The offset is then corrected from the response Date header.
+func isClockSkewRejection(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	if !strings.EqualFold(resp.Header.Get(reqsign.HeaderAuthError), "clock_skew") {
+		return false
 	}
-	return json.NewDecoder(resp.Body).Decode(out)
+	_, err := http.ParseTime(resp.Header.Get("Date"))
+	return err == nil
 }
 
 type SignalResponse struct {
@@ -454,39 +782,34 @@ type SignalResponse struct {
 }
 
 func (c *Client) WaitForSignal(ctx context.Context, agentUUID, secret string, timeoutSec int) (*SignalResponse, error) {
-	headers := map[string]string{
-		"X-Agent-UUID":   agentUUID,
-		"X-Agent-Secret": secret,
-	}
+	auth := c.credentials(agentUUID, secret)
 
+	var out SignalResponse
 	path := fmt.Sprintf("/api/v1/agent/signal?timeout=%d", timeoutSec)
-	url := c.baseURL + path
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
-	}
-	for k, v := range headers {
-		req.Header.Set(k, v)
-	}
-
-	resp, err := c.longPollHTTP.Do(req)
-	if err != nil {
+	if err := c.doJSON(ctx, c.longPollHTTP, http.MethodGet, path, nil, auth, &out); err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return &out, nil
+}
 
-	if resp.StatusCode >= 300 {
-		return nil, httpErrorFromResponse(http.MethodGet, url, resp)
+// endpointClass maps an agent API path to its circuit breaker class.
+func endpointClass(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	switch {
+	case path == "/api/v1/agent/heartbeat":
+		return resilience.ClassHeartbeat
+	case path == "/api/v1/agent/signal":
+		return resilience.ClassSignal
+	case strings.HasPrefix(path, "/api/v1/agent/task/"):
+		return resilience.ClassTasks
+	case path == "/api/v1/agent/inventory", path == "/api/v1/agent/software-events",
+		path == "/api/v1/agent/catalog-rules", path == "/api/v1/agent/available-updates":
+		return resilience.ClassInventory
 	}
-
-	var out SignalResponse
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return nil, err
-	}
-	return &out, nil
+	return resilience.ClassAPI
 }
 
-func httpErrorFromResponse(method, url string, resp *http.Response) error {
+func httpErrorFromResponse(method, url string, resp *http.Response) *HTTPError {
 	// Bound memory usage; we only need a small snippet for diagnostics.
 	const maxBody = 64 * 1024
 	b, _ := io.ReadAll(io.LimitReader(resp.Body, maxBody))
@@ -497,6 +820,7 @@ func httpErrorFromResponse(method, url string, resp *http.Response) error {
 		Status  string `json:"status"`
 		Detail  string `json:"detail"`
 		Message string `json:"message"`
+		Code    string `json:"code"`
 	}
 	detail := ""
 	if len(b) > 0 && json.Unmarshal(b, &apiErr) == nil {
@@ -513,6 +837,8 @@ func httpErrorFromResponse(method, url string, resp *http.Response) error {
 		StatusCode: resp.StatusCode,
 		Status:     resp.Status,
 		Detail:     detail,
+		Code:       apiErr.Code,
 		Body:       body,
+		RetryAfter: resilience.ParseRetryAfter(resp.Header.Get("Retry-After"), clock.Now()),
 	}
 }
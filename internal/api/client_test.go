@@ -1,14 +1,20 @@
 package api
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/reqsign"
+	"appcenter-agent/internal/resilience"
 )
 
 func TestReportTaskStatus(t *testing.T) {
@@ -122,3 +128,188 @@ func TestGetStore_HTTPErrorIncludesBodySnippet(t *testing.T) {
 		t.Fatalf("err = %q, want body snippet", err.Error())
 	}
 }
+
+func TestSignedModeRetriesAfterClockSkew(t *testing.T) {
+	defer reqsign.AdjustClock(time.Now())
+
+	serverNow := time.Now().Add(2 * time.Hour)
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get(reqsign.HeaderSecret) != "" {
+			t.Fatalf("secret header sent in signed mode")
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := reqsign.Verify(r, body, "s1", serverNow, 0, nil); err != nil {
+			w.Header().Set("Date", serverNow.UTC().Format(http.TimeFormat))
+			w.Header().Set(reqsign.HeaderAuthError, "clock_skew")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(TaskStatusResponse{Status: "ok"})
+	}))
+	defer srv.Close()
+
+	c := NewClient(config.ServerConfig{URL: srv.URL, AuthMode: reqsign.ModeSigned})
+	resp, err := c.ReportTaskStatus(context.Background(), "u1", "s1", 3, TaskStatusRequest{Status: "success"})
+	if err != nil {
+		t.Fatalf("ReportTaskStatus error: %v", err)
+	}
+	if resp.Status != "ok" || calls != 2 {
+		t.Fatalf("status=%s calls=%d, want ok after 2 calls", resp.Status, calls)
+	}
+}
+
+func TestRetryAfterPausesEndpointClass(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/api/v1/agent/store" {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"apps":[]}`))
+			return
+		}
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := NewClient(config.ServerConfig{URL: srv.URL, AuthMode: "legacy"})
+	c.breakers = resilience.New(resilience.Options{})
+
+	_, err := c.ReportTaskStatus(context.Background(), "u1", "s1", 7, TaskStatusRequest{Status: "success"})
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RetryAfter != 2*time.Minute {
+		t.Fatalf("err = %v, want HTTPError with RetryAfter", err)
+	}
+	_, err = c.ReportTaskStatus(context.Background(), "u1", "s1", 8, TaskStatusRequest{Status: "success"})
+	if !errors.Is(err, resilience.ErrOpen) {
+		t.Fatalf("second report err = %v, want ErrOpen", err)
+	}
+	if calls != 1 {
+		t.Fatalf("server saw %d calls while paused", calls)
+	}
+	if _, err := c.GetStore(context.Background(), "u1", "s1"); err != nil {
+		t.Fatalf("other class blocked: %v", err)
+	}
+}
+
+func TestSetBaseURLMovesRedirectGuard(t *testing.T) {
+	old := httptest.NewServer(http.NotFoundHandler())
+	defer old.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/agent/store" {
+			http.Redirect(w, r, "/api/v1/agent/store/v2", http.StatusTemporaryRedirect)
+			return
+		}
+		if r.Header.Get("X-Agent-UUID") != "u1" || r.Header.Get("X-Agent-Secret") != "s1" {
+			http.Error(w, "credentials stripped", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"apps":[]}`))
+	}))
+	defer srv.Close()
+
+	c := NewClient(config.ServerConfig{URL: old.URL})
+	c.SetBaseURL(srv.URL)
+	if _, err := c.GetStore(context.Background(), "u1", "s1"); err != nil {
+		t.Fatalf("same-origin redirect on the new server: %v", err)
+	}
+}
+
+func TestSetAuthModeStopsSendingSecret(t *testing.T) {
+	var secrets, signatures []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secrets = append(secrets, r.Header.Get(reqsign.HeaderSecret))
+		signatures = append(signatures, r.Header.Get(reqsign.HeaderSignature))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer srv.Close()
+
+	c := NewClient(config.ServerConfig{URL: srv.URL, AuthMode: reqsign.ModeCompat})
+	c.breakers = resilience.New(resilience.Options{})
+	payload := map[string]any{"software": []string{}}
+	if _, err := c.SubmitInventory(context.Background(), "u1", "s1", payload); err != nil {
+		t.Fatalf("SubmitInventory: %v", err)
+	}
+	c.SetAuthMode(reqsign.ModeSigned)
+	if _, err := c.SubmitInventory(context.Background(), "u1", "s1", payload); err != nil {
+		t.Fatalf("SubmitInventory: %v", err)
+	}
+	if len(secrets) != 2 || secrets[0] != "s1" || secrets[1] != "" {
+		t.Fatalf("secret headers = %q, want s1 then none", secrets)
+	}
+	if signatures[0] == "" || signatures[1] == "" {
+		t.Fatalf("signature headers = %q, want both signed", signatures)
+	}
+}
+
+func TestRequestEncodingNegotiatedFromAcceptEncoding(t *testing.T) {
+	var encodings []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := r.Header.Get("Content-Encoding")
+		encodings = append(encodings, enc)
+		var body io.Reader = r.Body
+		if enc == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Fatalf("gzip body: %v", err)
+			}
+			body = zr
+		}
+		raw, _ := io.ReadAll(body)
+		if err := reqsign.Verify(r, raw, "s1", time.Now(), time.Minute, nil); err != nil {
+			t.Fatalf("signature over decoded body: %v", err)
+		}
+		w.Header().Set("Accept-Encoding", "zstd;q=0, gzip")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer srv.Close()
+
+	c := NewClient(config.ServerConfig{URL: srv.URL, AuthMode: reqsign.ModeSigned})
+	c.breakers = resilience.New(resilience.Options{})
+	c.SetRequestEncodings([]string{"gzip"})
+	payload := map[string]any{"software": strings.Repeat("x", 4096)}
+	for i := 0; i < 2; i++ {
+		if _, err := c.SubmitInventory(context.Background(), "u1", "s1", payload); err != nil {
+			t.Fatalf("SubmitInventory: %v", err)
+		}
+	}
+	if len(encodings) != 2 || encodings[0] != "" || encodings[1] != "gzip" {
+		t.Fatalf("encodings = %q, want plain first then gzip", encodings)
+	}
+}
+
+func TestRequestEncodingFallsBackOn415(t *testing.T) {
+	var encodings []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := r.Header.Get("Content-Encoding")
+		encodings = append(encodings, enc)
+		if enc != "" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer srv.Close()
+
+	c := NewClient(config.ServerConfig{URL: srv.URL, AuthMode: "legacy"})
+	c.breakers = resilience.New(resilience.Options{})
+	c.SetRequestEncodings([]string{"gzip"})
+	gz := "gzip"
+	c.negotiatedEncoding.Store(&gz)
+	payload := map[string]any{"software": strings.Repeat("x", 4096)}
+	if _, err := c.SubmitInventory(context.Background(), "u1", "s1", payload); err != nil {
+		t.Fatalf("SubmitInventory: %v", err)
+	}
+	if _, err := c.SubmitInventory(context.Background(), "u1", "s1", payload); err != nil {
+		t.Fatalf("SubmitInventory: %v", err)
+	}
+	if strings.Join(encodings, ",") != "gzip,," {
+		t.Fatalf("encodings = %q, want gzip then plain", encodings)
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minEncodedBody is the smallest request body worth compressing.
+const minEncodedBody = 1024
+
+// SetRequestEncodings opts in to compressed request bodies (network.encoding.
+// request). A coding is only used after the server listed it in an
+// Accept-Encoding response header (RFC 7694); until then, and against servers
+// that never send one, bodies stay plain JSON.
+func (c *Client) SetRequestEncodings(encodings []string) {
+	var list []string
+	for _, e := range encodings {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "gzip" {
+			list = append(list, e)
+		}
+	}
+	c.requestEncodings.Store(&list)
+	c.negotiatedEncoding.Store(nil)
+}
+
+// requestEncoding returns the coding to apply to the next request body.
+func (c *Client) requestEncoding() string {
+	if p := c.negotiatedEncoding.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// learnEncoding records the most preferred configured coding the server
+// accepts, from the Accept-Encoding header of any of its responses.
+func (c *Client) learnEncoding(h http.Header) {
+	want := c.requestEncodings.Load()
+	if want == nil || len(*want) == 0 {
+		return
+	}
+	values := h.Values("Accept-Encoding")
+	if len(values) == 0 {
+		return
+	}
+	accepted := parseAcceptEncoding(values)
+	for _, e := range *want {
+		if accepted[e] {
+			c.negotiatedEncoding.Store(&e)
+			return
+		}
+	}
+	none := ""
+	c.negotiatedEncoding.Store(&none)
+}
+
+// parseAcceptEncoding returns the codings listed with a non-zero q value.
+func parseAcceptEncoding(values []string) map[string]bool {
+	out := map[string]bool{}
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			q := 1.0
+			for _, p := range strings.Split(params, ";") {
+				k, val, ok := strings.Cut(strings.TrimSpace(p), "=")
+				if ok && strings.EqualFold(k, "q") {
+					if f, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil {
+						q = f
+					}
+				}
+			}
+			out[name] = q > 0
+		}
+	}
+	return out
+}
+
+// encodeBody compresses body with coding; small bodies are sent as they are
+// and "" is returned as the coding actually used.
+func encodeBody(body []byte, coding string) ([]byte, string) {
+	if coding != "gzip" || len(body) < minEncodedBody {
+		return body, ""
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return body, ""
+	}
+	if err := zw.Close(); err != nil {
+		return body, ""
+	}
+	return buf.Bytes(), coding
+}
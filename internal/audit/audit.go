@@ -0,0 +1,297 @@
+// Package audit keeps an append-only, hash-chained log of privileged agent
+// actions (installs, self-updates, restarts, remote support, policy
+// rejections), separate from the rotating debug log.
+//
+// Each line is {"hash": H, "record": R} where R is the exact JSON of the
+// record, R.prev_hash is the previous line's H and H = sha256(R). Editing,
+// removing or reordering any record breaks the chain from that line on,
+// which Verify detects offline.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Event names.
+const (
+	EventCommand               = "command"
+	EventSelfUpdateApply       = "self_update.apply"
+	EventRestart               = "agent.restart"
+	EventRemoteSupportApproval = "remote_support.approval"
+	EventRemoteSupportStart    = "remote_support.start"
+	EventRemoteSupportEnd      = "remote_support.end"
+	EventPolicyRejection       = "policy.rejection"
+	EventClockSkew             = "clock.skew"
+	// EventTornTail is written on Open after an unterminated last line, left
+	// by a crash mid-write, was cut off.
+	EventTornTail = "audit.torn_tail"
+	// EventCorruption is written on Open when lines that cannot be decoded
+	// were found since the previous such record.
+	EventCorruption = "audit.corruption"
+)
+
+// maxReportedLines caps the line numbers listed in an EventCorruption record.
+const maxReportedLines = 100
+
+// Fields carries event specific details.
+type Fields map[string]any
+
+// Record is one audit entry.
+type Record struct {
+	Seq      int64  `json:"seq"`
+	Time     string `json:"time"`
+	Event    string `json:"event"`
+	Fields   Fields `json:"fields,omitempty"`
+	PrevHash string `json:"prev_hash"`
+}
+
+// Envelope is one line of the audit file. Record is kept as raw bytes so the
+// hash can be recomputed exactly as written.
+type Envelope struct {
+	Hash   string          `json:"hash"`
+	Record json.RawMessage `json:"record"`
+}
+
+// DefaultPath returns the audit log location.
+func DefaultPath() string {
+	if runtime.GOOS == "windows" {
+		return `C:\ProgramData\AppCenter\audit\audit.log`
+	}
+	return "audit.log"
+}
+
+// Log appends chained records to a file. A nil *Log discards records so
+// callers do not need to check whether auditing is enabled.
+type Log struct {
+	mu       sync.Mutex
+	path     string
+	seq      int64
+	lastHash string
+	nowFn    func() time.Time
+}
+
+// Open prepares path for appending, continuing the chain from its last
+// valid record. An unterminated last line can only be a record torn by a
+// crash (each record is one write ending in a newline); it is cut off and
+// an EventTornTail record notes how many bytes were dropped, so later
+// records do not get glued to it and break the chain for Verify and the
+// shipper. Malformed lines elsewhere are skipped; the chain continues from
+// the last record that decodes and an EventCorruption record lists the bad
+// lines, so seqs stay unique and the damage is visible to the server.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	l := &Log{path: path, nowFn: time.Now}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dropped, err := dropTornTail(f)
+	if err != nil {
+		return nil, fmt.Errorf("audit: torn tail: %w", err)
+	}
+	// Bad lines before an earlier EventCorruption record were already
+	// reported.
+	var bad []int
+	err = scan(f, func(_ int, env Envelope, rec Record) error {
+		l.seq, l.lastHash = rec.Seq, env.Hash
+		if rec.Event == EventCorruption {
+			bad = nil
+		}
+		return nil
+	}, func(line int, _ error) error {
+		bad = append(bad, line)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dropped > 0 {
+		if err := l.Record(EventTornTail, Fields{"dropped_bytes": dropped}); err != nil {
+			return nil, err
+		}
+	}
+	if len(bad) > 0 {
+		fields := Fields{"bad_line_count": len(bad), "bad_lines": bad[:min(len(bad), maxReportedLines)]}
+		if err := l.Record(EventCorruption, fields); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// dropTornTail truncates f after its last newline and returns the number of
+// bytes removed. f is left positioned at the start.
+func dropTornTail(f *os.File) (int64, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := st.Size()
+	keep := int64(0)
+	buf := make([]byte, 4096)
+	for end := size; end > 0; {
+		start := max(end-int64(len(buf)), 0)
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			keep = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if keep < size {
+		if err := f.Truncate(keep); err != nil {
+			return 0, err
+		}
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return size - keep, err
+}
+
+// Path returns the file backing the log.
+func (l *Log) Path() string {
+	if l == nil {
+		return ""
+	}
+	return l.path
+}
+
+// Record appends an event. Errors are returned so callers can log them; the
+// action being audited should not be blocked by a full disk.
+func (l *Log) Record(event string, fields Fields) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec := Record{
+		Seq:      l.seq + 1,
+		Time:     l.nowFn().UTC().Format(time.RFC3339Nano),
+		Event:    event,
+		Fields:   fields,
+		PrevHash: l.lastHash,
+	}
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("audit: encode: %w", err)
+	}
+	env := Envelope{Hash: hashRecord(raw), Record: raw}
+	line, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("audit: encode: %w", err)
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("audit: open: %w", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("audit: open: %w", err)
+	}
+	// One write per record so a crash leaves at most one partial line.
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		// Do not leave a partial line for the next record to be glued to.
+		_ = f.Truncate(st.Size())
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("audit: write: %w", err)
+	}
+	l.seq, l.lastHash = rec.Seq, env.Hash
+	return nil
+}
+
+// ReadAfter returns up to limit envelopes with seq > afterSeq. Malformed
+// lines are skipped and their line numbers returned in bad; only those after
+// the last record with seq <= afterSeq are listed, so each is reported once
+// as shipping moves past it.
+func ReadAfter(path string, afterSeq int64, limit int) (out []Envelope, bad []int, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	errStop := errors.New("stop")
+	err = scan(f, func(_ int, env Envelope, rec Record) error {
+		if rec.Seq <= afterSeq {
+			bad = nil
+			return nil
+		}
+		out = append(out, env)
+		if limit > 0 && len(out) >= limit {
+			return errStop
+		}
+		return nil
+	}, func(line int, _ error) error {
+		bad = append(bad, line)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStop) {
+		return out, bad, err
+	}
+	return out, bad, nil
+}
+
+func hashRecord(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// scan decodes each line and calls fn, or badFn with the decode error for a
+// line that is not a valid envelope. Scanning stops at the first error
+// either returns.
+func scan(r io.Reader, fn func(line int, env Envelope, rec Record) error, badFn func(line int, err error) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	line := 0
+	for sc.Scan() {
+		line++
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var env Envelope
+		var rec Record
+		err := json.Unmarshal(sc.Bytes(), &env)
+		if err == nil {
+			err = json.Unmarshal(env.Record, &rec)
+		}
+		if err != nil {
+			err = badFn(line, err)
+		} else {
+			err = fn(line, env, rec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,206 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeRecords(t *testing.T, path string, n int) {
+	t.Helper()
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		if err := l.Record(EventCommand, Fields{"task_id": i, "action": "install"}); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+}
+
+func verifyFile(t *testing.T, path string) (VerifyResult, error) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Verify(bytes.NewReader(b))
+}
+
+func TestChainContinuesAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.log")
+	writeRecords(t, path, 3)
+	writeRecords(t, path, 2)
+
+	res, err := verifyFile(t, path)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if res.Records != 5 || res.LastSeq != 5 || res.HeadHash == "" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	cases := map[string]func(lines []string) []string{
+		"edit": func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"install"`, `"uninstall"`, 1)
+			return lines
+		},
+		"delete": func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		},
+		"reorder": func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		},
+	}
+	for name, mutate := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			writeRecords(t, path, 4)
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			out := strings.Join(mutate(lines), "\n") + "\n"
+
+			_, err = Verify(strings.NewReader(out))
+			var verr *VerifyError
+			if !errors.As(err, &verr) || verr.Line != 2 {
+				t.Fatalf("expected chain break at line 2, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenDropsTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeRecords(t, path, 3)
+	torn := `{"hash":"0123","record":{"seq":4,"ti`
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(torn); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	writeRecords(t, path, 1)
+
+	res, err := verifyFile(t, path)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	// 3 records, the torn-tail note and the new record.
+	if res.Records != 5 || res.LastSeq != 5 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	recs, _, err := ReadAfter(path, 3, 0)
+	if err != nil || len(recs) != 2 {
+		t.Fatalf("ReadAfter = %d records, %v; want 2", len(recs), err)
+	}
+	if !strings.Contains(string(recs[0].Record), `"event":"audit.torn_tail"`) ||
+		!strings.Contains(string(recs[0].Record), fmt.Sprintf(`"dropped_bytes":%d`, len(torn))) {
+		t.Fatalf("torn tail not recorded: %s", recs[0].Record)
+	}
+}
+
+func TestOpenSkipsCorruptLineAndRecordsIt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeRecords(t, path, 3)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	lines[1] = "garbage"
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	writeRecords(t, path, 1)
+	writeRecords(t, path, 0)
+
+	recs, bad, err := ReadAfter(path, 0, 0)
+	if err != nil {
+		t.Fatalf("ReadAfter: %v", err)
+	}
+	if len(bad) != 1 || bad[0] != 2 {
+		t.Fatalf("bad lines = %v, want [2]", bad)
+	}
+	// Records 1 and 3, one corruption note continuing from seq 3, then the
+	// new record; reopening does not report the same line again.
+	if len(recs) != 4 {
+		t.Fatalf("ReadAfter = %d records, want 4", len(recs))
+	}
+	if !strings.Contains(string(recs[2].Record), `"event":"audit.corruption"`) ||
+		!strings.Contains(string(recs[2].Record), `"seq":4`) ||
+		!strings.Contains(string(recs[2].Record), `"bad_lines":[2]`) {
+		t.Fatalf("corruption not recorded: %s", recs[2].Record)
+	}
+	if !strings.Contains(string(recs[3].Record), `"seq":5`) {
+		t.Fatalf("chain did not continue from the last valid record: %s", recs[3].Record)
+	}
+
+	_, err = verifyFile(t, path)
+	var verr *VerifyError
+	if !errors.As(err, &verr) || verr.Line != 2 {
+		t.Fatalf("expected Verify to fail at line 2, got %v", err)
+	}
+
+	var shipped int
+	var reported []int
+	s := NewShipper(path, func(_ context.Context, recs []Envelope) error {
+		shipped += len(recs)
+		return nil
+	})
+	s.OnBadLines = func(lines []int) { reported = append(reported, lines...) }
+	for i := 0; i < 2; i++ {
+		if err := s.Flush(context.Background()); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	if shipped != 4 || len(reported) != 1 {
+		t.Fatalf("shipped %d records, reported %v; want 4 and [2]", shipped, reported)
+	}
+}
+
+func TestShipperSendsOnlyNewRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeRecords(t, path, 3)
+
+	var got []int
+	s := NewShipper(path, func(_ context.Context, recs []Envelope) error {
+		got = append(got, len(recs))
+		return nil
+	})
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	writeRecords(t, path, 2)
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if len(got) != 2 || got[0] != 3 || got[1] != 2 {
+		t.Fatalf("batches=%v, want [3 2]", got)
+	}
+}
+
+func TestNilLogDiscards(t *testing.T) {
+	var l *Log
+	if err := l.Record(EventRestart, nil); err != nil {
+		t.Fatalf("nil Record: %v", err)
+	}
+}
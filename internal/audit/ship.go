@@ -0,0 +1,83 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+const shipBatchSize = 200
+
+// SendFunc delivers a batch of envelopes to the server.
+type SendFunc func(ctx context.Context, records []Envelope) error
+
+// Shipper forwards new audit records to the server as a separate stream and
+// remembers the last shipped seq next to the audit file.
+type Shipper struct {
+	path      string
+	statePath string
+	send      SendFunc
+
+	// OnBadLines, if set, is told about malformed lines skipped while
+	// reading records to ship.
+	OnBadLines func(lines []int)
+}
+
+type shipState struct {
+	LastSeq int64 `json:"last_seq"`
+}
+
+func NewShipper(path string, send SendFunc) *Shipper {
+	return &Shipper{
+		path:      path,
+		statePath: filepath.Join(filepath.Dir(path), "audit_ship_state.json"),
+		send:      send,
+	}
+}
+
+// Flush ships all records not yet acknowledged, in batches.
+func (s *Shipper) Flush(ctx context.Context) error {
+	st := s.loadState()
+	for {
+		batch, bad, err := ReadAfter(s.path, st.LastSeq, shipBatchSize)
+		if len(bad) > 0 && s.OnBadLines != nil {
+			s.OnBadLines(bad)
+		}
+		if err != nil || len(batch) == 0 {
+			return err
+		}
+		if err := s.send(ctx, batch); err != nil {
+			return err
+		}
+		var last Record
+		if err := json.Unmarshal(batch[len(batch)-1].Record, &last); err != nil {
+			return err
+		}
+		st.LastSeq = last.Seq
+		if err := s.saveState(st); err != nil {
+			return err
+		}
+		if len(batch) < shipBatchSize {
+			return nil
+		}
+	}
+}
+
+func (s *Shipper) loadState() shipState {
+	var st shipState
+	b, err := os.ReadFile(s.statePath)
+	if err == nil {
+		_ = json.Unmarshal(b, &st)
+	}
+	return st
+}
+
+func (s *Shipper) saveState(st shipState) error {
+	b, _ := json.Marshal(st)
+	tmp := s.statePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.statePath)
+}
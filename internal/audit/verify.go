@@ -0,0 +1,51 @@
+package audit
+
+import (
+	"fmt"
+	"io"
+)
+
+// VerifyResult summarizes a successful verification.
+type VerifyResult struct {
+	Records  int    `json:"records"`
+	LastSeq  int64  `json:"last_seq"`
+	HeadHash string `json:"head_hash"`
+}
+
+// VerifyError points at the first record that breaks the chain.
+type VerifyError struct {
+	Line   int
+	Seq    int64
+	Reason string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("audit chain broken at line %d (seq %d): %s", e.Line, e.Seq, e.Reason)
+}
+
+// Verify checks every record's hash and its link to the previous record.
+// Truncation of the newest records cannot be detected locally; compare
+// HeadHash/LastSeq with the copy shipped to the server for that.
+func Verify(r io.Reader) (VerifyResult, error) {
+	var res VerifyResult
+	prevHash := ""
+	err := scan(r, func(line int, env Envelope, rec Record) error {
+		if got := hashRecord(env.Record); got != env.Hash {
+			return &VerifyError{Line: line, Seq: rec.Seq, Reason: "record hash mismatch"}
+		}
+		if rec.PrevHash != prevHash {
+			return &VerifyError{Line: line, Seq: rec.Seq, Reason: "prev_hash does not match previous record"}
+		}
+		if rec.Seq != res.LastSeq+1 {
+			return &VerifyError{Line: line, Seq: rec.Seq, Reason: fmt.Sprintf("expected seq %d", res.LastSeq+1)}
+		}
+		prevHash = env.Hash
+		res.Records++
+		res.LastSeq = rec.Seq
+		res.HeadHash = env.Hash
+		return nil
+	}, func(line int, err error) error {
+		return &VerifyError{Line: line, Reason: fmt.Sprintf("malformed line: %v", err)}
+	})
+	return res, err
+}
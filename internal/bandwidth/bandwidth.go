@@ -0,0 +1,208 @@
+// Package bandwidth provides the process-wide download rate limiter. All
+// downloads (tasks, self-update, runtime update) draw from one token bucket,
+// so the configured limit is the agent's total, not a per-download figure.
+package bandwidth
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/config"
+
+	"golang.org/x/time/rate"
+)
+
+// unlimitedBurst bounds single reads while no limit applies.
+const unlimitedBurst = 256 * 1024
+
+// Limiter is a rate limiter whose limit follows a time-of-day profile and
+// which can be paused for named reasons. A nil *Limiter never limits.
+type Limiter struct {
+	mu       sync.Mutex
+	rl       *rate.Limiter
+	baseKBps int
+	windows  []config.BandwidthWindow
+	current  int // effective KB/s, 0 = unlimited
+	paused   map[string]bool
+	// resume is closed when the last pause reason is removed.
+	resume chan struct{}
+	now    func() time.Time
+}
+
+// New returns a limiter of baseKBps (0 = unlimited) without a profile.
+func New(baseKBps int) *Limiter {
+	l := &Limiter{
+		rl:     rate.NewLimiter(rate.Inf, unlimitedBurst),
+		paused: map[string]bool{},
+		now:    time.Now,
+	}
+	l.Configure(baseKBps, nil)
+	return l
+}
+
+var shared = New(0)
+
+// Default returns the process-wide limiter. It does not limit until
+// configured.
+func Default() *Limiter {
+	return shared
+}
+
+// FromConfig configures the process-wide limiter from download.* and
+// returns it.
+func FromConfig(cfg config.Config) *Limiter {
+	shared.Configure(cfg.Download.BandwidthLimitKBs, cfg.Download.BandwidthProfile)
+	return shared
+}
+
+// Configure sets the limit outside any window and the time-of-day windows;
+// the first window containing the current time wins.
+func (l *Limiter) Configure(baseKBps int, windows []config.BandwidthWindow) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.baseKBps = max(baseKBps, 0)
+	l.windows = append([]config.BandwidthWindow(nil), windows...)
+	l.current = -1
+	l.refreshLocked()
+}
+
+// refreshLocked applies the limit in effect now.
+func (l *Limiter) refreshLocked() {
+	kbps := l.baseKBps
+	now := l.now()
+	for _, w := range l.windows {
+		if w.Contains(now) {
+			kbps = w.LimitKBps
+			break
+		}
+	}
+	if kbps == l.current {
+		return
+	}
+	l.current = kbps
+	if kbps == 0 {
+		l.rl.SetLimit(rate.Inf)
+		l.rl.SetBurst(unlimitedBurst)
+		return
+	}
+	l.rl.SetLimit(rate.Limit(kbps * 1024))
+	l.rl.SetBurst(kbps * 1024)
+}
+
+// Pause blocks all downloads until Resume is called with the same reason.
+func (l *Limiter) Pause(reason string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.paused) == 0 {
+		l.resume = make(chan struct{})
+	}
+	l.paused[reason] = true
+}
+
+// Resume removes a pause reason; downloads continue once none is left.
+func (l *Limiter) Resume(reason string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.paused[reason] {
+		return
+	}
+	delete(l.paused, reason)
+	if len(l.paused) == 0 {
+		close(l.resume)
+	}
+}
+
+// WaitN blocks until n bytes may be transferred, waiting out any pause.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		if len(l.paused) > 0 {
+			resume := l.resume
+			l.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-resume:
+			}
+			continue
+		}
+		l.refreshLocked()
+		rl := l.rl
+		l.mu.Unlock()
+		return rl.WaitN(ctx, min(n, rl.Burst()))
+	}
+}
+
+// Burst is the largest n a single WaitN accepts.
+func (l *Limiter) Burst() int {
+	if l == nil {
+		return unlimitedBurst
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refreshLocked()
+	return l.rl.Burst()
+}
+
+// Reader limits reads from r.
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, l: l}
+}
+
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if b := r.l.Burst(); len(p) > b {
+		p = p[:b]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if waitErr := r.l.WaitN(r.ctx, n); waitErr != nil {
+			return 0, waitErr
+		}
+	}
+	return n, err
+}
+
+// Status is the limiter state shown by get_status.
+type Status struct {
+	LimitKBps int      `json:"limit_kbps"` // 0 = unlimited
+	Paused    []string `json:"paused,omitempty"`
+}
+
+func (l *Limiter) Status() Status {
+	if l == nil {
+		return Status{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refreshLocked()
+	st := Status{LimitKBps: l.current}
+	for reason := range l.paused {
+		st.Paused = append(st.Paused, reason)
+	}
+	sort.Strings(st.Paused)
+	return st
+}
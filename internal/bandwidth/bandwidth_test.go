@@ -0,0 +1,69 @@
+package bandwidth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"appcenter-agent/internal/config"
+)
+
+func TestProfileSelectsLimit(t *testing.T) {
+	l := New(0)
+	now := time.Date(2026, 3, 2, 10, 0, 0, 0, time.Local) // Monday
+	l.now = func() time.Time { return now }
+	l.Configure(1024, []config.BandwidthWindow{
+		{Days: []string{"mon"}, Start: "08:00", End: "18:00", LimitKBps: 256},
+		{Start: "18:00", End: "08:00", LimitKBps: 0},
+	})
+	if got := l.Status().LimitKBps; got != 256 {
+		t.Fatalf("business hours limit = %d, want 256", got)
+	}
+	if got := l.Burst(); got != 256*1024 {
+		t.Fatalf("burst = %d, want %d", got, 256*1024)
+	}
+	now = now.Add(10 * time.Hour) // 20:00
+	if got := l.Status().LimitKBps; got != 0 {
+		t.Fatalf("night limit = %d, want unlimited", got)
+	}
+	now = time.Date(2026, 3, 3, 10, 0, 0, 0, time.Local) // Tuesday
+	if got := l.Status().LimitKBps; got != 1024 {
+		t.Fatalf("fallback limit = %d, want 1024", got)
+	}
+}
+
+func TestPauseBlocksUntilResume(t *testing.T) {
+	l := New(0)
+	l.Pause("remote_support")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.WaitN(ctx, 1); err == nil {
+		t.Fatal("WaitN returned while paused")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- l.WaitN(context.Background(), 1) }()
+	time.Sleep(20 * time.Millisecond)
+	l.Resume("remote_support")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitN after resume: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("WaitN still blocked after resume")
+	}
+	if st := l.Status(); len(st.Paused) != 0 {
+		t.Fatalf("paused = %v", st.Paused)
+	}
+}
+
+func TestNilLimiterDoesNotLimit(t *testing.T) {
+	var l *Limiter
+	if err := l.WaitN(context.Background(), 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	l.Pause("x")
+	l.Configure(1, nil)
+}
@@ -0,0 +1,185 @@
+// Package clock tracks the offset between the local clock and the server's
+// so schedules, expirations and signed timestamps follow server time.
+//
+// Every server response carries a timestamp (the Date header, heartbeat
+// server_time). With the local send and receive times it is an NTP-style
+// sample: offset = server - (sent+received)/2, accurate to half the round
+// trip plus the timestamp resolution. Of the recent samples the one with the
+// smallest error sets the offset Now applies, so a slow response cannot pull
+// the clock off.
+package clock
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	windowSize = 8
+	// maxSampleAge lets the estimate follow a local clock that was stepped.
+	maxSampleAge = 30 * time.Minute
+)
+
+var offset atomic.Int64
+
+// Now returns the local time corrected by the current server offset.
+func Now() time.Time {
+	return time.Now().Add(Offset())
+}
+
+// Offset returns the offset applied by Now (server minus local).
+func Offset() time.Duration {
+	return time.Duration(offset.Load())
+}
+
+// Set forces the offset, e.g. after the server rejected a signature for
+// clock skew.
+func Set(d time.Duration) {
+	offset.Store(int64(d))
+}
+
+// Status is the estimate reported in heartbeat and over IPC.
+type Status struct {
+	OffsetMS  int64     `json:"offset_ms"`
+	ErrorMS   int64     `json:"error_ms"`
+	Samples   int       `json:"samples"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+	Skewed    bool      `json:"skewed"`
+}
+
+type sample struct {
+	offset time.Duration
+	err    time.Duration
+	at     time.Time
+}
+
+// Estimator turns samples into the offset applied by Now. Safe for
+// concurrent use; a nil *Estimator ignores samples.
+type Estimator struct {
+	mu        sync.Mutex
+	samples   []sample
+	best      sample
+	threshold time.Duration
+	skewed    bool
+	listeners []func(Status)
+	nowFn     func() time.Time
+	setFn     func(time.Duration)
+}
+
+// NewEstimator builds an Estimator that reports skew above threshold
+// (0 = never).
+func NewEstimator(threshold time.Duration) *Estimator {
+	return &Estimator{threshold: threshold, nowFn: time.Now, setFn: Set}
+}
+
+var shared = NewEstimator(time.Minute)
+
+// Default returns the process-wide estimator that drives Now.
+func Default() *Estimator {
+	return shared
+}
+
+// SetThreshold changes the skew threshold.
+func (e *Estimator) SetThreshold(d time.Duration) {
+	e.mu.Lock()
+	e.threshold = d
+	e.mu.Unlock()
+}
+
+// OnSkew registers fn to be called when the estimate crosses the threshold,
+// with Status.Skewed telling the direction. It is cleared again once the
+// offset drops to half the threshold.
+func (e *Estimator) OnSkew(fn func(Status)) {
+	e.mu.Lock()
+	e.listeners = append(e.listeners, fn)
+	e.mu.Unlock()
+}
+
+// Observe adds a sample: the request left at sent and its response arrived
+// at received (both local, uncorrected), carrying server time with the
+// given resolution (time.Second for a Date header).
+func (e *Estimator) Observe(sent, received, server time.Time, resolution time.Duration) {
+	if e == nil || server.IsZero() || received.Before(sent) {
+		return
+	}
+	rtt := received.Sub(sent)
+	mid := sent.Add(rtt / 2)
+	s := sample{
+		offset: server.Add(resolution / 2).Sub(mid),
+		err:    rtt/2 + resolution/2,
+		at:     received,
+	}
+
+	e.mu.Lock()
+	now := e.nowFn()
+	e.samples = slices.DeleteFunc(e.samples, func(old sample) bool {
+		return now.Sub(old.at) > maxSampleAge
+	})
+	e.samples = append(e.samples, s)
+	if len(e.samples) > windowSize {
+		e.samples = e.samples[len(e.samples)-windowSize:]
+	}
+	best := e.samples[0]
+	for _, c := range e.samples[1:] {
+		if c.err <= best.err {
+			best = c
+		}
+	}
+	e.best = best
+	e.setFn(best.offset)
+
+	changed := false
+	abs := max(best.offset, -best.offset)
+	switch {
+	case e.threshold > 0 && !e.skewed && abs > e.threshold:
+		e.skewed, changed = true, true
+	case e.skewed && (e.threshold <= 0 || abs <= e.threshold/2):
+		e.skewed, changed = false, true
+	}
+	st := e.statusLocked()
+	listeners := slices.Clone(e.listeners)
+	e.mu.Unlock()
+
+	if changed {
+		for _, fn := range listeners {
+			fn(st)
+		}
+	}
+}
+
+// Reset drops the samples, e.g. after switching to another server whose
+// clock may differ. The applied offset stays until the next sample.
+func (e *Estimator) Reset() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.samples = nil
+	e.best = sample{}
+	e.mu.Unlock()
+}
+
+// Status returns the current estimate.
+func (e *Estimator) Status() Status {
+	if e == nil {
+		return Status{}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.statusLocked()
+}
+
+func (e *Estimator) statusLocked() Status {
+	if len(e.samples) == 0 {
+		return Status{Skewed: e.skewed}
+	}
+	return Status{
+		OffsetMS:  e.best.offset.Milliseconds(),
+		ErrorMS:   e.best.err.Milliseconds(),
+		Samples:   len(e.samples),
+		UpdatedAt: e.best.at.UTC(),
+		Skewed:    e.skewed,
+	}
+}
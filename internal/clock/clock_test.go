@@ -0,0 +1,88 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestEstimator(threshold time.Duration) (*Estimator, *time.Duration) {
+	applied := new(time.Duration)
+	e := NewEstimator(threshold)
+	e.setFn = func(d time.Duration) { *applied = d }
+	return e, applied
+}
+
+func TestObservePrefersSmallestRoundTrip(t *testing.T) {
+	e, applied := newTestEstimator(0)
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	e.nowFn = func() time.Time { return base.Add(time.Minute) }
+
+	// Fast exchange: server is 10s ahead.
+	e.Observe(base, base.Add(20*time.Millisecond), base.Add(10*time.Second+10*time.Millisecond), 0)
+	// Slow exchange whose reply was delayed on the way back; taken alone it
+	// would suggest a much smaller offset.
+	e.Observe(base.Add(time.Second), base.Add(5*time.Second), base.Add(11*time.Second), 0)
+
+	if *applied != 10*time.Second {
+		t.Fatalf("offset = %v, want 10s", *applied)
+	}
+	st := e.Status()
+	if st.OffsetMS != 10000 || st.ErrorMS != 10 || st.Samples != 2 {
+		t.Fatalf("status = %+v", st)
+	}
+}
+
+func TestObserveDateResolution(t *testing.T) {
+	e, applied := newTestEstimator(0)
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	e.nowFn = func() time.Time { return base }
+
+	// A Date header truncates to the second; the true server time is on
+	// average half a second later.
+	e.Observe(base, base, base.Add(-3*time.Second), time.Second)
+	if *applied != -2500*time.Millisecond {
+		t.Fatalf("offset = %v, want -2.5s", *applied)
+	}
+}
+
+func TestSkewListenerFiresOnCrossing(t *testing.T) {
+	e, _ := newTestEstimator(time.Minute)
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	e.nowFn = func() time.Time { return base }
+	var events []Status
+	e.OnSkew(func(st Status) { events = append(events, st) })
+
+	e.Observe(base, base, base.Add(5*time.Second), 0)
+	if len(events) != 0 {
+		t.Fatalf("events below threshold: %+v", events)
+	}
+	e.Reset()
+	e.Observe(base, base, base.Add(-2*time.Minute), 0)
+	e.Observe(base, base, base.Add(-2*time.Minute), 0)
+	if len(events) != 1 || !events[0].Skewed || events[0].OffsetMS != -120000 {
+		t.Fatalf("events = %+v, want one skew event", events)
+	}
+	e.Reset()
+	// Still above half the threshold: no change.
+	e.Observe(base, base, base.Add(45*time.Second), 0)
+	e.Reset()
+	e.Observe(base, base, base.Add(10*time.Second), 0)
+	if len(events) != 2 || events[1].Skewed {
+		t.Fatalf("events = %+v, want skew cleared", events)
+	}
+}
+
+func TestObserveDropsOldSamples(t *testing.T) {
+	e, applied := newTestEstimator(0)
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := base
+	e.nowFn = func() time.Time { return now }
+
+	e.Observe(base, base, base.Add(time.Hour), 0)
+	now = base.Add(time.Hour)
+	// Much less precise, but the precise one is too old to trust.
+	e.Observe(now, now.Add(2*time.Second), now.Add(time.Second), 0)
+	if *applied != 0 || e.Status().Samples != 1 {
+		t.Fatalf("offset = %v samples = %d, want 0 from the fresh sample", *applied, e.Status().Samples)
+	}
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BandwidthWindow overrides download.bandwidth_limit_kbps during a time of
+// day, e.g. 256 KB/s on weekdays 08:00-18:00. The same shape is accepted in
+// the server's "bandwidth_profile" config patch.
+type BandwidthWindow struct {
+	// Days are "mon".."sun"; empty means every day. A window crossing
+	// midnight belongs to the day it starts on.
+	Days  []string `yaml:"days,omitempty" json:"days,omitempty"`
+	Start string   `yaml:"start" json:"start"`
+	End   string   `yaml:"end" json:"end"`
+	// LimitKBps is the download limit inside the window; 0 means unlimited.
+	LimitKBps int `yaml:"limit_kbps" json:"limit_kbps"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Validate reports a malformed window.
+func (w BandwidthWindow) Validate() error {
+	if _, err := parseClock(w.Start); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return fmt.Errorf("end: %w", err)
+	}
+	for _, d := range w.Days {
+		if _, ok := weekdays[strings.ToLower(strings.TrimSpace(d))]; !ok {
+			return fmt.Errorf("unknown day %q", d)
+		}
+	}
+	if w.LimitKBps < 0 {
+		return fmt.Errorf("limit_kbps must be >= 0")
+	}
+	return nil
+}
+
+// Contains reports whether t (local time) falls inside the window. Start ==
+// End covers the whole day.
+func (w BandwidthWindow) Contains(t time.Time) bool {
+	start, err1 := parseClock(w.Start)
+	end, err2 := parseClock(w.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case start == end:
+	case start < end:
+		if now < start || now >= end {
+			return false
+		}
+	default:
+		if now < start && now >= end {
+			return false
+		}
+		if now < end {
+			// After midnight: the window started yesterday.
+			day = (day + 6) % 7
+		}
+	}
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if wd, ok := weekdays[strings.ToLower(strings.TrimSpace(d))]; ok && wd == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock parses "HH:MM" into minutes after midnight.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	hh, err := strconv.Atoi(h)
+	if err != nil || hh < 0 || hh > 23 {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	mm, err := strconv.Atoi(m)
+	if err != nil || mm < 0 || mm > 59 || len(m) != 2 {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	return hh*60 + mm, nil
+}
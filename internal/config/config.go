@@ -2,15 +2,25 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"appcenter-agent/internal/reqsign"
+	"appcenter-agent/internal/secretstore"
 
 	"gopkg.in/yaml.v3"
 )
 
+// secretStore seals agent.secret_key before it is written to disk. Tests swap it.
+var secretStore = secretstore.Default
+
 type Config struct {
 	Server        ServerConfig        `yaml:"server"`
 	Agent         AgentConfig         `yaml:"agent"`
+	Enrollment    EnrollmentConfig    `yaml:"enrollment"`
 	Heartbeat     HeartbeatConfig     `yaml:"heartbeat"`
 	WebSocket     WebSocketConfig     `yaml:"websocket"`
 	SystemProfile SystemProfileConfig `yaml:"system_profile"`
@@ -18,18 +28,70 @@ type Config struct {
 	Download      DownloadConfig      `yaml:"download"`
 	Install       InstallConfig       `yaml:"install"`
 	Update        UpdateConfig        `yaml:"update"`
+	Policy        PolicyConfig        `yaml:"policy"`
+	Audit         AuditConfig         `yaml:"audit"`
+	P2P           P2PConfig           `yaml:"p2p"`
+	Relay         RelayConfig         `yaml:"relay"`
+	Network       NetworkConfig       `yaml:"network"`
+	Resilience    ResilienceConfig    `yaml:"resilience"`
+	Clock         ClockConfig         `yaml:"clock"`
 	Logging       LoggingConfig       `yaml:"logging"`
+
+	secretErr error
+	// configuredServerURL is the server.url written by Save while a
+	// discovered relay overrides Server.URL for this process.
+	configuredServerURL string
 }
 
 type ServerConfig struct {
 	URL       string `yaml:"url"`
 	VerifySSL bool   `yaml:"verify_ssl"`
+	// AuthMode selects how agent requests are authenticated:
+	// "legacy" (secret header only), "compat" (secret header + HMAC signature)
+	// or "signed" (HMAC signature only, secret never sent). The "compat"
+	// default still works with servers that predate signing; a server that
+	// verifies signatures sends auth_mode "signed" with its agent config and
+	// the agent switches over and saves it.
+	AuthMode string `yaml:"auth_mode"`
+	// Endpoints are further servers, in order of preference, used while URL
+	// fails its /health probe (see internal/endpoint).
+	Endpoints []ServerEndpoint `yaml:"endpoints,omitempty"`
+	// HealthIntervalSec spaces /health probes when Endpoints is set.
+	HealthIntervalSec int `yaml:"health_interval_sec"`
+	// FailbackDelaySec is how long a preferred endpoint must stay healthy
+	// before the agent moves back to it.
+	FailbackDelaySec int `yaml:"failback_delay_sec"`
+}
+
+// ServerEndpoint is one alternative server. WSURL is derived from URL when
+// empty, as websocket.url is for server.url.
+type ServerEndpoint struct {
+	URL   string `yaml:"url" json:"url"`
+	WSURL string `yaml:"ws_url,omitempty" json:"ws_url,omitempty"`
 }
 
 type AgentConfig struct {
-	Version   string `yaml:"version"`
-	UUID      string `yaml:"uuid"`
-	SecretKey string `yaml:"secret_key"`
+	Version string `yaml:"version"`
+	UUID    string `yaml:"uuid"`
+	// SecretKey is only read from YAML for migration of older configs; Save
+	// never writes it and stores ProtectedSecret instead.
+	SecretKey string `yaml:"secret_key,omitempty"`
+	// ProtectedSecret is SecretKey sealed by the platform secret store
+	// (DPAPI on Windows, AES-GCM key file elsewhere).
+	ProtectedSecret string `yaml:"secret_key_protected,omitempty"`
+	// ReenrollToken is the server-issued proof for re-enrolling this UUID
+	// after its secret was revoked. It is only stored sealed, as
+	// ProtectedReenrollToken.
+	ReenrollToken          string `yaml:"-"`
+	ProtectedReenrollToken string `yaml:"reenroll_token_protected,omitempty"`
+}
+
+// EnrollmentConfig carries registration-time inputs. Token is a one-time
+// enrollment token and is cleared from config.yaml after a successful register.
+type EnrollmentConfig struct {
+	Token  string   `yaml:"token,omitempty"`
+	Tags   []string `yaml:"tags,omitempty"`
+	Groups []string `yaml:"groups,omitempty"`
 }
 
 type HeartbeatConfig struct {
@@ -52,6 +114,172 @@ type SystemProfileConfig struct {
 type DownloadConfig struct {
 	TempDir           string `yaml:"temp_dir"`
 	BandwidthLimitKBs int    `yaml:"bandwidth_limit_kbps"`
+	// CacheMaxMB is the size quota of the shared download cache under
+	// <temp_dir>/cache (see internal/dlcache).
+	CacheMaxMB int `yaml:"cache_max_mb"`
+	// Segments > 1 enables parallel range requests for files of at least
+	// SegmentMinMB; the bandwidth limit is shared by all segments.
+	Segments     int `yaml:"segments"`
+	SegmentMinMB int `yaml:"segment_min_mb"`
+	// Prestaged content (action "prestage") is pinned in the cache up to
+	// PrestageMaxMB in total and released after PrestageTTLHours unless an
+	// install uses it first.
+	PrestageMaxMB    int `yaml:"prestage_max_mb"`
+	PrestageTTLHours int `yaml:"prestage_ttl_hours"`
+
+	// URL policy for server-supplied download URLs (see internal/urlguard).
+	// Hosts default to the server origin; schemes to https plus the server's.
+	AllowedHosts   []string `yaml:"allowed_hosts,omitempty"`
+	AllowedSchemes []string `yaml:"allowed_schemes,omitempty"`
+	MaxRedirects   int      `yaml:"max_redirects"`
+	AllowLoopback  bool     `yaml:"allow_loopback,omitempty"`
+	AllowLinkLocal bool     `yaml:"allow_link_local,omitempty"`
+	// AllowedShares lists branch file-share roots (\\host\share or a
+	// local mount) that commands may name as content sources.
+	AllowedShares []string `yaml:"allowed_shares,omitempty"`
+
+	// BandwidthProfile overrides BandwidthLimitKBs by time of day; the first
+	// matching window wins. All downloads share one limiter (see
+	// internal/bandwidth).
+	BandwidthProfile []BandwidthWindow `yaml:"bandwidth_profile,omitempty"`
+	// PauseDuringRemoteSupport stops downloads while a remote support
+	// session is active.
+	PauseDuringRemoteSupport bool `yaml:"pause_during_remote_support"`
+}
+
+// P2PConfig enables LAN content sharing between agents (see internal/p2p).
+type P2PConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Key is the site key shared by all agents allowed to exchange content.
+	// Like agent.secret_key, it is only read from YAML for migration and
+	// Save stores ProtectedKey instead.
+	Key          string `yaml:"key,omitempty"`
+	ProtectedKey string `yaml:"key_protected,omitempty"`
+	Port         int    `yaml:"port"`
+	// Group is the multicast group for announcements ("" disables multicast).
+	Group string `yaml:"group"`
+	// Peers are static "host:port" announcement targets.
+	Peers      []string `yaml:"peers,omitempty"`
+	MaxUploads int      `yaml:"max_uploads"`
+}
+
+// ResilienceConfig tunes how the agent backs off an overloaded server (see
+// internal/resilience).
+type ResilienceConfig struct {
+	// BreakerThreshold consecutive failures pause an endpoint class.
+	BreakerThreshold      int `yaml:"breaker_threshold"`
+	BreakerCooldownSec    int `yaml:"breaker_cooldown_sec"`
+	BreakerMaxCooldownSec int `yaml:"breaker_max_cooldown_sec"`
+	// MaxHeartbeatStretch caps how many times the heartbeat interval grows
+	// under server pressure (1 disables stretching).
+	MaxHeartbeatStretch int `yaml:"max_heartbeat_stretch"`
+	// RestartJitterSec is the longest random delay before the first server
+	// contact after a server.broadcast.restart.
+	RestartJitterSec int `yaml:"restart_jitter_sec"`
+}
+
+// ClockConfig controls server clock tracking (see internal/clock).
+type ClockConfig struct {
+	// SkewThresholdSec is the estimated offset from the server clock above
+	// which a clock.skew event is raised.
+	SkewThresholdSec int `yaml:"skew_threshold_sec"`
+}
+
+// NetworkConfig holds settings for every outbound connection.
+type NetworkConfig struct {
+	Proxy    ProxyConfig    `yaml:"proxy"`
+	Encoding EncodingConfig `yaml:"encoding"`
+}
+
+// EncodingConfig opts in to compact transport encodings. Each one is only
+// used once the server has shown it understands it, so old servers keep
+// receiving plain JSON.
+type EncodingConfig struct {
+	// Request lists Content-Encodings for API request bodies in order of
+	// preference. Only "gzip" is available in this build.
+	Request []string `yaml:"request,omitempty"`
+	// WSDeflate offers permessage-deflate on the WebSocket connection.
+	WSDeflate bool `yaml:"ws_deflate"`
+	// WSMsgPack offers MessagePack envelopes on the WebSocket connection.
+	WSMsgPack bool `yaml:"ws_msgpack"`
+}
+
+func (e EncodingConfig) validate() error {
+	for _, enc := range e.Request {
+		switch strings.ToLower(strings.TrimSpace(enc)) {
+		case "gzip":
+		case "zstd":
+			return errors.New("network.encoding.request: zstd is not available in this build")
+		default:
+			return fmt.Errorf("network.encoding.request: unknown encoding %q", enc)
+		}
+	}
+	return nil
+}
+
+// ProxyConfig routes outbound traffic through a proxy (see internal/netproxy).
+// With neither URL nor PACURL set the HTTP(S)_PROXY/NO_PROXY environment is
+// used, as before.
+type ProxyConfig struct {
+	// URL is an http://, https:// or socks5:// proxy; "direct" disables
+	// proxies, including the environment's.
+	URL string `yaml:"url,omitempty"`
+	// PACURL is a proxy auto-config script URL (http or https), evaluated by
+	// WinHTTP on Windows and ignored elsewhere. It takes precedence over URL,
+	// which is used while the script cannot be loaded.
+	PACURL string `yaml:"pac_url,omitempty"`
+	// Bypass lists hosts reached directly: "host", "*.domain", ".domain",
+	// CIDRs and "<local>" for dotless names.
+	Bypass []string `yaml:"bypass,omitempty"`
+	// Username and Password are Basic credentials for proxies whose URL
+	// carries none.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+func (p ProxyConfig) validate() error {
+	if pac := strings.TrimSpace(p.PACURL); pac != "" {
+		u, err := url.Parse(pac)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("network.proxy.pac_url %q must be an http(s) URL", pac)
+		}
+	}
+	raw := strings.TrimSpace(p.URL)
+	if raw == "" || strings.EqualFold(raw, "direct") {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("network.proxy.url %q is not a URL", raw)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "socks5", "socks5h":
+		return nil
+	}
+	return fmt.Errorf("network.proxy.url scheme must be http, https or socks5")
+}
+
+// RelayConfig makes this agent the API/content gateway for its site, or lets
+// a downstream agent discover one (see internal/relay).
+type RelayConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Listen      string `yaml:"listen"`
+	TLSCertFile string `yaml:"tls_cert_file,omitempty"`
+	TLSKeyFile  string `yaml:"tls_key_file,omitempty"`
+	// PublicURL is advertised to downstream agents in discovery beacons.
+	PublicURL string `yaml:"public_url,omitempty"`
+	// AllowLegacyAuth lets requests carrying X-Agent-Secret through; by
+	// default downstream agents must use server.auth_mode "signed".
+	AllowLegacyAuth   bool `yaml:"allow_legacy_auth,omitempty"`
+	CacheMaxMB        int  `yaml:"cache_max_mb"`
+	ReportIntervalMin int  `yaml:"report_interval_min"`
+	// Key signs discovery beacons; Discover makes a downstream agent use a
+	// relay found on the LAN instead of server.url. It is sealed on disk as
+	// ProtectedKey, like p2p.key.
+	Key            string `yaml:"key,omitempty"`
+	ProtectedKey   string `yaml:"key_protected,omitempty"`
+	DiscoveryGroup string `yaml:"discovery_group"`
+	Discover       bool   `yaml:"discover"`
 }
 
 type InstallConfig struct {
@@ -68,6 +296,22 @@ type UpdateConfig struct {
 	HelperPath string `yaml:"helper_path"`
 }
 
+// PolicyConfig points at the local admin policy file (see internal/policy).
+// An empty File uses the platform default; PublicKey (base64 Ed25519), when
+// set, requires the file to be signed.
+type PolicyConfig struct {
+	File      string `yaml:"file,omitempty"`
+	PublicKey string `yaml:"public_key,omitempty"`
+}
+
+// AuditConfig controls the hash-chained audit log (see internal/audit).
+type AuditConfig struct {
+	// File overrides the default audit log path.
+	File string `yaml:"file,omitempty"`
+	// ShipToServer forwards audit records to the server as a separate stream.
+	ShipToServer bool `yaml:"ship_to_server"`
+}
+
 type RemoteSupportConfig struct {
 	Enabled            bool `yaml:"enabled"`
 	ApprovalTimeoutSec int  `yaml:"approval_timeout_sec"`
@@ -85,8 +329,11 @@ func Default() *Config {
 	// the service can recover even if the file is missing on disk).
 	return &Config{
 		Server: ServerConfig{
-			URL:       "http://10.6.100.170:8000",
-			VerifySSL: false,
+			URL:               "http://10.6.100.170:8000",
+			VerifySSL:         false,
+			AuthMode:          "compat",
+			HealthIntervalSec: 30,
+			FailbackDelaySec:  300,
 		},
 		Agent: AgentConfig{
 			Version:   "0.0.0",
@@ -110,6 +357,12 @@ func Default() *Config {
 		Download: DownloadConfig{
 			TempDir:           `C:\ProgramData\AppCenter\downloads`,
 			BandwidthLimitKBs: 1024,
+			CacheMaxMB:        2048,
+			Segments:          1,
+			SegmentMinMB:      16,
+			PrestageMaxMB:     4096,
+			PrestageTTLHours:  72,
+			MaxRedirects:      5,
 		},
 		Install: InstallConfig{
 			TimeoutSec:        1800,
@@ -120,6 +373,27 @@ func Default() *Config {
 			ServiceName: "AppCenterAgent",
 			HelperPath:  `C:\Program Files\AppCenter\appcenter-update-helper.exe`,
 		},
+		P2P: P2PConfig{
+			Port:       47777,
+			Group:      "239.255.77.77:47777",
+			MaxUploads: 4,
+		},
+		Relay: RelayConfig{
+			Listen:            ":8470",
+			CacheMaxMB:        20480,
+			ReportIntervalMin: 5,
+			DiscoveryGroup:    "239.255.77.77:47778",
+		},
+		Resilience: ResilienceConfig{
+			BreakerThreshold:      5,
+			BreakerCooldownSec:    30,
+			BreakerMaxCooldownSec: 600,
+			MaxHeartbeatStretch:   8,
+			RestartJitterSec:      120,
+		},
+		Clock: ClockConfig{
+			SkewThresholdSec: 60,
+		},
 		Logging: LoggingConfig{
 			Level:      "info",
 			File:       `C:\ProgramData\AppCenter\logs\agent.log`,
@@ -150,7 +424,20 @@ func EnsureExists(path string) error {
 	return os.WriteFile(path, b, 0o600)
 }
 
+// Load reads path and opens the sealed secrets. It never writes the file;
+// the service calls MigrateSecret first to seal a plaintext secret.
 func Load(path string) (*Config, error) {
+	return load(path, true)
+}
+
+// LoadWithoutSecrets reads path for processes that only need settings (the
+// tray, in the user's context): sealed secrets are never opened and
+// plaintext ones are dropped.
+func LoadWithoutSecrets(path string) (*Config, error) {
+	return load(path, false)
+}
+
+func load(path string, secrets bool) (*Config, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -160,35 +447,270 @@ func Load(path string) (*Config, error) {
 	if err := yaml.Unmarshal(b, &cfg); err != nil {
 		return nil, err
 	}
+	if secrets {
+		cfg.loadSecret()
+		cfg.loadReenrollToken()
+		cfg.loadSiteKeys()
+	}
 	cfg.ApplyDefaults()
 	cfg.ApplyRuntimeOverrides()
 	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
+	if !secrets {
+		cfg.Agent.SecretKey, cfg.Agent.ProtectedSecret = "", ""
+		cfg.Agent.ReenrollToken, cfg.Agent.ProtectedReenrollToken = "", ""
+		cfg.P2P.Key, cfg.P2P.ProtectedKey = "", ""
+		cfg.Relay.Key, cfg.Relay.ProtectedKey = "", ""
+	}
 	return &cfg, nil
 }
 
+// MigrateSecret rewrites path with a plaintext agent.secret_key, p2p.key or
+// relay.key found in older (or hand edited) configs sealed, and reports
+// whether it did. Only the service calls it, before Load.
+func MigrateSecret(path string) (bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return false, err
+	}
+	if cfg.Agent.SecretKey == "" && cfg.P2P.Key == "" && cfg.Relay.Key == "" {
+		return false, nil
+	}
+	// Save reseals the secret and the re-enroll token from their plaintext
+	// copies; a sealed secret that cannot be opened would be lost.
+	cfg.loadSecret()
+	if cfg.secretErr != nil {
+		return false, fmt.Errorf("plaintext secret not migrated: %w", cfg.secretErr)
+	}
+	cfg.loadReenrollToken()
+	if err := Save(path, &cfg); err != nil {
+		return false, fmt.Errorf("plaintext secret not migrated: %w", err)
+	}
+	return true, nil
+}
+
 func Save(path string, cfg *Config) error {
 	if cfg == nil {
 		return errors.New("config is nil")
 	}
-	b, err := yaml.Marshal(cfg)
+	out := *cfg
+	if cfg.configuredServerURL != "" {
+		out.Server.URL = cfg.configuredServerURL
+	}
+	out.Agent.ProtectedSecret = ""
+	if out.Agent.SecretKey != "" {
+		blob, err := secretStore().Protect([]byte(out.Agent.SecretKey))
+		if err != nil {
+			// Never fall back to plaintext.
+			return fmt.Errorf("protect secret: %w", err)
+		}
+		out.Agent.SecretKey = ""
+		out.Agent.ProtectedSecret = blob
+	}
+	out.Agent.ProtectedReenrollToken = ""
+	if out.Agent.ReenrollToken != "" {
+		blob, err := secretStore().Protect([]byte(out.Agent.ReenrollToken))
+		if err != nil {
+			return fmt.Errorf("protect re-enroll token: %w", err)
+		}
+		out.Agent.ReenrollToken = ""
+		out.Agent.ProtectedReenrollToken = blob
+	}
+	if err := sealKey(&out.P2P.Key, &out.P2P.ProtectedKey); err != nil {
+		return fmt.Errorf("protect p2p.key: %w", err)
+	}
+	if err := sealKey(&out.Relay.Key, &out.Relay.ProtectedKey); err != nil {
+		return fmt.Errorf("protect relay.key: %w", err)
+	}
+	b, err := yaml.Marshal(&out)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, b, 0o600)
+	// Write to a temp file and rename so a crash mid-write never leaves a
+	// truncated config (which would lose the agent secret).
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// SecretWarning reports why the stored secret or a site key could not be
+// opened during Load, or nil. The agent keeps running: it re-enrolls for a
+// lost secret and runs without P2P or relay discovery for a lost key.
+func (c *Config) SecretWarning() error {
+	return c.secretErr
+}
+
+// SecretStorage names the backend protecting the secret at rest.
+func SecretStorage() string {
+	return secretStore().Name()
+}
+
+// loadSecret opens agent.secret_key_protected unless a plaintext
+// agent.secret_key is present.
+func (c *Config) loadSecret() {
+	if c.Agent.SecretKey != "" {
+		// A plaintext value wins over a sealed one: it was put there by hand
+		// (or by an older agent) and is the most recent intent.
+		return
+	}
+	if c.Agent.ProtectedSecret == "" {
+		return
+	}
+	plain, err := secretStore().Unprotect(c.Agent.ProtectedSecret)
+	if err != nil {
+		c.secretErr = fmt.Errorf("stored secret unreadable: %w", err)
+		return
+	}
+	c.Agent.SecretKey = string(plain)
+}
+
+// loadSiteKeys opens p2p.key_protected and relay.key_protected unless a
+// plaintext key is present.
+func (c *Config) loadSiteKeys() {
+	if err := openKey(&c.P2P.Key, c.P2P.ProtectedKey); err != nil {
+		c.secretErr = errors.Join(c.secretErr, fmt.Errorf("stored p2p.key unreadable: %w", err))
+	}
+	if err := openKey(&c.Relay.Key, c.Relay.ProtectedKey); err != nil {
+		c.secretErr = errors.Join(c.secretErr, fmt.Errorf("stored relay.key unreadable: %w", err))
+	}
+}
+
+func openKey(plain *string, sealed string) error {
+	if *plain != "" || sealed == "" {
+		return nil
+	}
+	b, err := secretStore().Unprotect(sealed)
+	if err != nil {
+		return err
+	}
+	*plain = string(b)
+	return nil
+}
+
+// sealKey moves a plaintext site key into its sealed field. Without a
+// plaintext key the sealed one is kept: it may only be unreadable in this
+// process.
+func sealKey(plain, sealed *string) error {
+	if *plain == "" {
+		return nil
+	}
+	blob, err := secretStore().Protect([]byte(*plain))
+	if err != nil {
+		return err
+	}
+	*plain, *sealed = "", blob
+	return nil
+}
+
+// loadReenrollToken opens agent.reenroll_token_protected. An unreadable token
+// only costs the ability to re-enroll, so it is dropped rather than failing.
+func (c *Config) loadReenrollToken() {
+	if c.Agent.ProtectedReenrollToken == "" {
+		return
+	}
+	plain, err := secretStore().Unprotect(c.Agent.ProtectedReenrollToken)
+	if err != nil {
+		return
+	}
+	c.Agent.ReenrollToken = string(plain)
+}
+
+// OverrideServerURL points this process at serverURL (e.g. a discovered
+// relay) without persisting it: Save keeps writing the configured URL.
+func (c *Config) OverrideServerURL(serverURL string) {
+	if c.configuredServerURL == "" {
+		c.configuredServerURL = c.Server.URL
+	}
+	c.Server.URL = serverURL
+}
+
+// ServerEndpoints returns the servers this process may use, most preferred
+// first: server.url (with websocket.url), the configured server.url when a
+// discovered relay overrides it, then server.endpoints. Duplicates are
+// dropped.
+func (c *Config) ServerEndpoints() []ServerEndpoint {
+	list := []ServerEndpoint{{URL: c.Server.URL, WSURL: c.WebSocket.URL}}
+	if c.configuredServerURL != "" {
+		list = append(list, ServerEndpoint{URL: c.configuredServerURL, WSURL: c.WebSocket.URL})
+		list[0].WSURL = ""
+	}
+	list = append(list, c.Server.Endpoints...)
+	seen := map[string]bool{}
+	out := list[:0]
+	for _, ep := range list {
+		key := strings.ToLower(strings.TrimRight(strings.TrimSpace(ep.URL), "/"))
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, ep)
+	}
+	return out
 }
 
 func (c *Config) Validate() error {
 	if c.Server.URL == "" {
 		return errors.New("server.url is required")
 	}
+	if !reqsign.ValidMode(c.Server.AuthMode) {
+		return errors.New("server.auth_mode must be one of legacy, compat, signed")
+	}
+	for i, ep := range c.Server.Endpoints {
+		if u, err := url.Parse(ep.URL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("server.endpoints[%d].url must be an http(s) URL", i)
+		}
+	}
+	if c.Server.HealthIntervalSec < 0 || c.Server.FailbackDelaySec < 0 {
+		return errors.New("server.health_interval_sec and server.failback_delay_sec must be >= 0")
+	}
 	if c.Heartbeat.IntervalSec <= 0 {
 		return errors.New("heartbeat.interval_sec must be > 0")
 	}
 	if c.Download.BandwidthLimitKBs <= 0 {
 		return errors.New("download.bandwidth_limit_kbps must be > 0")
 	}
+	for i, w := range c.Download.BandwidthProfile {
+		if err := w.Validate(); err != nil {
+			return fmt.Errorf("download.bandwidth_profile[%d]: %w", i, err)
+		}
+	}
+	if c.Download.CacheMaxMB < 0 {
+		return errors.New("download.cache_max_mb must be >= 0")
+	}
+	if c.Download.PrestageMaxMB < 0 || c.Download.PrestageTTLHours < 0 {
+		return errors.New("download.prestage_max_mb and download.prestage_ttl_hours must be >= 0")
+	}
+	if c.Download.Segments < 0 || c.Download.Segments > 16 {
+		return errors.New("download.segments must be between 1 and 16")
+	}
+	if c.Resilience.BreakerThreshold < 0 || c.Resilience.BreakerCooldownSec < 0 ||
+		c.Resilience.BreakerMaxCooldownSec < 0 || c.Resilience.MaxHeartbeatStretch < 0 ||
+		c.Resilience.RestartJitterSec < 0 {
+		return errors.New("resilience values must be >= 0")
+	}
+	if c.Clock.SkewThresholdSec < 0 {
+		return errors.New("clock.skew_threshold_sec must be >= 0")
+	}
+	if err := c.Network.Proxy.validate(); err != nil {
+		return err
+	}
+	if err := c.Network.Encoding.validate(); err != nil {
+		return err
+	}
+	if c.P2P.Enabled && c.P2P.Key == "" && c.P2P.ProtectedKey == "" {
+		return errors.New("p2p.key is required when p2p.enabled is true")
+	}
 	if c.Install.TimeoutSec <= 0 {
 		return errors.New("install.timeout_sec must be > 0")
 	}
@@ -217,6 +739,15 @@ func (c *Config) Validate() error {
 }
 
 func (c *Config) ApplyDefaults() {
+	if c.Server.AuthMode == "" {
+		c.Server.AuthMode = "compat"
+	}
+	if c.Server.HealthIntervalSec == 0 {
+		c.Server.HealthIntervalSec = 30
+	}
+	if c.Server.FailbackDelaySec == 0 {
+		c.Server.FailbackDelaySec = 300
+	}
 	if c.Update.ServiceName == "" {
 		c.Update.ServiceName = "AppCenterAgent"
 	}
@@ -232,4 +763,55 @@ func (c *Config) ApplyDefaults() {
 	if c.WebSocket.ReconnectMaxSec == 0 {
 		c.WebSocket.ReconnectMaxSec = 60
 	}
+	if c.Download.MaxRedirects == 0 {
+		c.Download.MaxRedirects = 5
+	}
+	if c.Download.CacheMaxMB == 0 {
+		c.Download.CacheMaxMB = 2048
+	}
+	if c.Download.Segments == 0 {
+		c.Download.Segments = 1
+	}
+	if c.Download.SegmentMinMB == 0 {
+		c.Download.SegmentMinMB = 16
+	}
+	if c.Download.PrestageMaxMB == 0 {
+		c.Download.PrestageMaxMB = 4096
+	}
+	if c.Download.PrestageTTLHours == 0 {
+		c.Download.PrestageTTLHours = 72
+	}
+	if c.P2P.Port == 0 {
+		c.P2P.Port = 47777
+	}
+	if c.P2P.MaxUploads == 0 {
+		c.P2P.MaxUploads = 4
+	}
+	if c.Relay.Listen == "" {
+		c.Relay.Listen = ":8470"
+	}
+	if c.Relay.CacheMaxMB == 0 {
+		c.Relay.CacheMaxMB = 20480
+	}
+	if c.Relay.ReportIntervalMin == 0 {
+		c.Relay.ReportIntervalMin = 5
+	}
+	if c.Resilience.BreakerThreshold == 0 {
+		c.Resilience.BreakerThreshold = 5
+	}
+	if c.Resilience.BreakerCooldownSec == 0 {
+		c.Resilience.BreakerCooldownSec = 30
+	}
+	if c.Resilience.BreakerMaxCooldownSec == 0 {
+		c.Resilience.BreakerMaxCooldownSec = 600
+	}
+	if c.Resilience.MaxHeartbeatStretch == 0 {
+		c.Resilience.MaxHeartbeatStretch = 8
+	}
+	if c.Resilience.RestartJitterSec == 0 {
+		c.Resilience.RestartJitterSec = 120
+	}
+	if c.Clock.SkewThresholdSec == 0 {
+		c.Clock.SkewThresholdSec = 60
+	}
 }
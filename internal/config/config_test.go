@@ -3,11 +3,16 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 func writeTestConfig(t *testing.T, dir string, serverURL string, secret string) string {
 	t.Helper()
+	t.Setenv("APPCENTER_KEY_FILE", filepath.Join(dir, "secret.key"))
 	p := filepath.Join(dir, "config.yaml")
 	content := "server:\n" +
 		"  url: \"" + serverURL + "\"\n" +
@@ -60,3 +65,215 @@ func TestLoadAppliesEnvOverrides(t *testing.T) {
 	}
 }
 
+
+func TestMigrateSecretSealsPlaintextSecret(t *testing.T) {
+	p := writeTestConfig(t, t.TempDir(), "http://127.0.0.1:8000", "file-secret")
+
+	cfg, err := Load(p)
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if cfg.Agent.SecretKey != "file-secret" {
+		t.Fatalf("secret=%q, want file-secret", cfg.Agent.SecretKey)
+	}
+	if b, _ := os.ReadFile(p); !strings.Contains(string(b), "file-secret") {
+		t.Fatalf("Load must not rewrite the config:\n%s", b)
+	}
+
+	migrated, err := MigrateSecret(p)
+	if err != nil || !migrated {
+		t.Fatalf("MigrateSecret = %v, %v; want true", migrated, err)
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "file-secret") {
+		t.Fatalf("plaintext secret still on disk:\n%s", b)
+	}
+	if !strings.Contains(string(b), "secret_key_protected:") {
+		t.Fatalf("protected secret missing:\n%s", b)
+	}
+
+	if migrated, err := MigrateSecret(p); err != nil || migrated {
+		t.Fatalf("second MigrateSecret = %v, %v; want false", migrated, err)
+	}
+	again, err := Load(p)
+	if err != nil {
+		t.Fatalf("second Load error: %v", err)
+	}
+	if again.Agent.SecretKey != "file-secret" {
+		t.Fatalf("reload secret=%q", again.Agent.SecretKey)
+	}
+
+	public, err := LoadWithoutSecrets(p)
+	if err != nil {
+		t.Fatalf("LoadWithoutSecrets error: %v", err)
+	}
+	if public.Agent.SecretKey != "" || public.Agent.ProtectedSecret != "" {
+		t.Fatalf("LoadWithoutSecrets exposed the secret: %+v", public.Agent)
+	}
+}
+
+func TestSiteKeysSealedAtRest(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("APPCENTER_KEY_FILE", filepath.Join(dir, "secret.key"))
+	p := filepath.Join(dir, "config.yaml")
+
+	// A hand edited config: sealed agent secret, plaintext site keys.
+	cfg := Default()
+	sealed, err := secretStore().Protect([]byte("agent-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Agent.ProtectedSecret = sealed
+	cfg.P2P.Enabled, cfg.P2P.Key = true, "p2p-site-key"
+	cfg.Relay.Key = "relay-site-key"
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := MigrateSecret(p)
+	if err != nil || !migrated {
+		t.Fatalf("MigrateSecret = %v, %v; want true", migrated, err)
+	}
+	b, err = os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"p2p-site-key", "relay-site-key", "agent-secret"} {
+		if strings.Contains(string(b), k) {
+			t.Fatalf("%s on disk in plaintext:\n%s", k, b)
+		}
+	}
+
+	cfg, err = Load(p)
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if cfg.P2P.Key != "p2p-site-key" || cfg.Relay.Key != "relay-site-key" || cfg.Agent.SecretKey != "agent-secret" {
+		t.Fatalf("keys=%q/%q secret=%q", cfg.P2P.Key, cfg.Relay.Key, cfg.Agent.SecretKey)
+	}
+	public, err := LoadWithoutSecrets(p)
+	if err != nil {
+		t.Fatalf("LoadWithoutSecrets error: %v", err)
+	}
+	if public.P2P.Key != "" || public.Relay.Key != "" || public.P2P.ProtectedKey != "" {
+		t.Fatalf("LoadWithoutSecrets exposed site keys: %+v %+v", public.P2P, public.Relay)
+	}
+}
+
+func TestSaveNeverWritesPlaintextSecret(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("APPCENTER_KEY_FILE", filepath.Join(dir, "secret.key"))
+	p := filepath.Join(dir, "config.yaml")
+
+	cfg := Default()
+	cfg.Agent.SecretKey = "rotated-secret"
+	if err := Save(p, cfg); err != nil {
+		t.Fatalf("Save error: %v", err)
+	}
+	if cfg.Agent.SecretKey != "rotated-secret" {
+		t.Fatal("Save must not modify the caller's config")
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "rotated-secret") {
+		t.Fatalf("plaintext secret written:\n%s", b)
+	}
+	loaded, err := Load(p)
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if loaded.Agent.SecretKey != "rotated-secret" {
+		t.Fatalf("secret=%q, want rotated-secret", loaded.Agent.SecretKey)
+	}
+}
+
+func TestOverrideServerURLIsNotPersisted(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("APPCENTER_KEY_FILE", filepath.Join(dir, "secret.key"))
+	p := filepath.Join(dir, "config.yaml")
+
+	cfg := Default()
+	cfg.Server.URL = "https://appcenter.example"
+	cfg.OverrideServerURL("http://relay01:8470")
+	if cfg.Server.URL != "http://relay01:8470" {
+		t.Fatalf("override not applied: %s", cfg.Server.URL)
+	}
+	if err := Save(p, cfg); err != nil {
+		t.Fatalf("Save error: %v", err)
+	}
+	loaded, err := Load(p)
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if loaded.Server.URL != "https://appcenter.example" {
+		t.Fatalf("persisted server.url=%q, want the configured URL", loaded.Server.URL)
+	}
+}
+
+func TestServerEndpointsOrder(t *testing.T) {
+	cfg := Default()
+	cfg.Server.URL = "https://appcenter.example"
+	cfg.WebSocket.URL = "wss://ws.appcenter.example/api/v1/agent/ws"
+	cfg.Server.Endpoints = []ServerEndpoint{
+		{URL: "https://appcenter.example/"},
+		{URL: "https://dr.appcenter.example", WSURL: "wss://dr.appcenter.example/ws"},
+	}
+	cfg.OverrideServerURL("http://relay01:8470")
+
+	got := cfg.ServerEndpoints()
+	want := []ServerEndpoint{
+		{URL: "http://relay01:8470"},
+		{URL: "https://appcenter.example", WSURL: "wss://ws.appcenter.example/api/v1/agent/ws"},
+		{URL: "https://dr.appcenter.example", WSURL: "wss://dr.appcenter.example/ws"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("endpoints = %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("endpoint %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBandwidthWindowContains(t *testing.T) {
+	// 2026-03-02 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 3, day, hour, minute, 0, 0, time.Local)
+	}
+	office := BandwidthWindow{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "08:00", End: "18:00", LimitKBps: 256}
+	night := BandwidthWindow{Days: []string{"fri"}, Start: "22:00", End: "06:00"}
+	cases := []struct {
+		w    BandwidthWindow
+		t    time.Time
+		want bool
+	}{
+		{office, at(2, 8, 0), true},
+		{office, at(2, 18, 0), false},
+		{office, at(7, 12, 0), false}, // Saturday
+		{night, at(6, 23, 0), true},   // Friday night
+		{night, at(7, 5, 59), true},   // Saturday morning, started Friday
+		{night, at(8, 5, 0), false},   // Sunday morning, started Saturday
+	}
+	for i, c := range cases {
+		if got := c.w.Contains(c.t); got != c.want {
+			t.Fatalf("case %d: Contains(%s) = %t, want %t", i, c.t, got, c.want)
+		}
+	}
+	if err := (BandwidthWindow{Start: "8:00", End: "24:00"}).Validate(); err == nil {
+		t.Fatal("expected invalid end time")
+	}
+	if err := (BandwidthWindow{Days: []string{"monday"}, Start: "08:00", End: "09:00"}).Validate(); err == nil {
+		t.Fatal("expected unknown day")
+	}
+}
@@ -1,6 +1,9 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strings"
+)
 
 // ApplyRuntimeOverrides applies environment/OS-specific overrides after YAML load
 // and before validation.
@@ -16,5 +19,24 @@ func applyEnvOverrides(c *Config) {
 	if v := os.Getenv("APPCENTER_SECRET_KEY"); v != "" {
 		c.Agent.SecretKey = v
 	}
+	if v := os.Getenv("APPCENTER_ENROLLMENT_TOKEN"); v != "" {
+		c.Enrollment.Token = v
+	}
+	if v := os.Getenv("APPCENTER_ENROLLMENT_TAGS"); v != "" {
+		c.Enrollment.Tags = SplitList(v)
+	}
+	if v := os.Getenv("APPCENTER_ENROLLMENT_GROUPS"); v != "" {
+		c.Enrollment.Groups = SplitList(v)
+	}
 }
 
+// SplitList splits a comma separated value, trimming blanks.
+func SplitList(v string) []string {
+	var out []string
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -16,7 +16,18 @@ func applyOSOverrides(c *Config) {
 	if v, _, err := k.GetStringValue("ServerURL"); err == nil && v != "" {
 		c.Server.URL = v
 	}
-	if v, _, err := k.GetStringValue("SecretKey"); err == nil && v != "" {
+	// The bootstrap secret only seeds a fresh install. Once the agent holds a
+	// secret (possibly rotated by the server) the MSI value must not replace it.
+	if v, _, err := k.GetStringValue("SecretKey"); err == nil && v != "" && c.Agent.SecretKey == "" {
 		c.Agent.SecretKey = v
 	}
+	if v, _, err := k.GetStringValue("EnrollmentToken"); err == nil && v != "" {
+		c.Enrollment.Token = v
+	}
+	if v, _, err := k.GetStringValue("Tags"); err == nil && v != "" {
+		c.Enrollment.Tags = SplitList(v)
+	}
+	if v, _, err := k.GetStringValue("Groups"); err == nil && v != "" {
+		c.Enrollment.Groups = SplitList(v)
+	}
 }
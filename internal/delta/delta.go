@@ -0,0 +1,218 @@
+// Package delta applies binary patches that turn one agent build into
+// another, so a self-update downloads the changes instead of the whole
+// executable.
+//
+// A patch is the magic "ACDELTA1" followed by a gzip stream of:
+//
+//	uvarint old size | 32-byte SHA-256 of old | uvarint new size
+//	ops, each one byte followed by its operands:
+//	  'C' uvarint offset, uvarint n         copy n bytes of old from offset
+//	  'A' uvarint offset, uvarint n, n bytes add bytes to n bytes of old
+//	  'I' uvarint n, n bytes                insert literal bytes
+//	  'E'                                   end of patch
+//
+// 'A' carries bsdiff-style byte differences, which stay small where a build
+// only shifted addresses.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const magic = "ACDELTA1"
+
+const (
+	opCopy   = 'C'
+	opAdd    = 'A'
+	opInsert = 'I'
+	opEnd    = 'E'
+)
+
+var (
+	// ErrSourceMismatch means the patch was made for a different old file.
+	ErrSourceMismatch = errors.New("delta: patch does not apply to this file")
+	// ErrCorrupt means the patch is malformed.
+	ErrCorrupt = errors.New("delta: corrupt patch")
+)
+
+// maxOp bounds a single operand so a corrupt patch cannot ask for huge
+// allocations.
+const maxOp = 256 << 20
+
+// Apply writes the file described by patch, built on old, to out and
+// returns the number of bytes written.
+func Apply(old []byte, patch io.Reader, out io.Writer) (int64, error) {
+	br := bufio.NewReader(patch)
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, head); err != nil || string(head) != magic {
+		return 0, ErrCorrupt
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return 0, ErrCorrupt
+	}
+	defer zr.Close()
+	r := bufio.NewReader(zr)
+
+	oldSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, ErrCorrupt
+	}
+	var oldSum [sha256.Size]byte
+	if _, err := io.ReadFull(r, oldSum[:]); err != nil {
+		return 0, ErrCorrupt
+	}
+	if oldSize != uint64(len(old)) || oldSum != sha256.Sum256(old) {
+		return 0, ErrSourceMismatch
+	}
+	newSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, ErrCorrupt
+	}
+
+	w := bufio.NewWriter(out)
+	var written int64
+	buf := make([]byte, 0, 64*1024)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return written, ErrCorrupt
+		}
+		switch op {
+		case opEnd:
+			if uint64(written) != newSize {
+				return written, fmt.Errorf("%w: wrote %d bytes, want %d", ErrCorrupt, written, newSize)
+			}
+			return written, w.Flush()
+		case opCopy, opAdd:
+			src, err := readSpan(r, old)
+			if err != nil {
+				return written, err
+			}
+			if op == opAdd {
+				if cap(buf) < len(src) {
+					buf = make([]byte, len(src))
+				}
+				buf = buf[:len(src)]
+				if _, err := io.ReadFull(r, buf); err != nil {
+					return written, ErrCorrupt
+				}
+				for i := range buf {
+					buf[i] += src[i]
+				}
+				src = buf
+			}
+			if _, err := w.Write(src); err != nil {
+				return written, err
+			}
+			written += int64(len(src))
+		case opInsert:
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > maxOp {
+				return written, ErrCorrupt
+			}
+			m, err := io.CopyN(w, r, int64(n))
+			written += m
+			if err != nil {
+				return written, ErrCorrupt
+			}
+		default:
+			return written, ErrCorrupt
+		}
+		if uint64(written) > newSize {
+			return written, ErrCorrupt
+		}
+	}
+}
+
+// readSpan reads an offset and length and returns that part of old.
+func readSpan(r *bufio.Reader, old []byte) ([]byte, error) {
+	off, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > maxOp || off > uint64(len(old)) || n > uint64(len(old))-off {
+		return nil, ErrCorrupt
+	}
+	return old[off : off+n], nil
+}
+
+// Create returns a patch from old to target using copy and insert operations.
+// It is the reference encoder for tests and release tooling; the server may
+// produce patches with any encoder that writes this format.
+func Create(old, target []byte) []byte {
+	var body bytes.Buffer
+	putUvarint(&body, uint64(len(old)))
+	sum := sha256.Sum256(old)
+	body.Write(sum[:])
+	putUvarint(&body, uint64(len(target)))
+
+	index := make(map[uint64]int, len(old)/blockSize+1)
+	for off := 0; off+blockSize <= len(old); off += blockSize {
+		k := blockKey(old[off : off+blockSize])
+		if _, ok := index[k]; !ok {
+			index[k] = off
+		}
+	}
+
+	literal := 0 // start of pending literal bytes in target
+	flushLiteral := func(end int) {
+		if end > literal {
+			body.WriteByte(opInsert)
+			putUvarint(&body, uint64(end-literal))
+			body.Write(target[literal:end])
+		}
+	}
+	for i := 0; i+blockSize <= len(target); {
+		off, ok := index[blockKey(target[i:i+blockSize])]
+		if !ok || !bytes.Equal(old[off:off+blockSize], target[i:i+blockSize]) {
+			i++
+			continue
+		}
+		// Extend the match both ways.
+		start, oldStart := i, off
+		for start > literal && oldStart > 0 && target[start-1] == old[oldStart-1] {
+			start--
+			oldStart--
+		}
+		end, oldEnd := i+blockSize, off+blockSize
+		for end < len(target) && oldEnd < len(old) && target[end] == old[oldEnd] {
+			end++
+			oldEnd++
+		}
+		flushLiteral(start)
+		body.WriteByte(opCopy)
+		putUvarint(&body, uint64(oldStart))
+		putUvarint(&body, uint64(end-start))
+		literal, i = end, end
+	}
+	flushLiteral(len(target))
+	body.WriteByte(opEnd)
+
+	var out bytes.Buffer
+	out.WriteString(magic)
+	zw, _ := gzip.NewWriterLevel(&out, gzip.BestCompression)
+	_, _ = zw.Write(body.Bytes())
+	_ = zw.Close()
+	return out.Bytes()
+}
+
+const blockSize = 32
+
+func blockKey(b []byte) uint64 {
+	return binary.LittleEndian.Uint64(b[0:8]) ^ binary.LittleEndian.Uint64(b[8:16])*31 ^
+		binary.LittleEndian.Uint64(b[16:24])*961 ^ binary.LittleEndian.Uint64(b[24:32])*29791
+}
+
+func putUvarint(b *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	b.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
@@ -0,0 +1,78 @@
+package delta
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestCreateApplyRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	old := make([]byte, 200*1024)
+	rng.Read(old)
+	// The new build moves a section, patches a few bytes and appends data.
+	target := append([]byte{}, old[:50000]...)
+	target = append(target, []byte("new code section")...)
+	target = append(target, old[120000:]...)
+	target = append(target, old[50000:120000]...)
+	target[1000] ^= 0xff
+	target = append(target, make([]byte, 3000)...)
+
+	patch := Create(old, target)
+	if len(patch) > len(target)/10 {
+		t.Fatalf("patch is %d bytes for a %d byte file", len(patch), len(target))
+	}
+	var out bytes.Buffer
+	n, err := Apply(old, bytes.NewReader(patch), &out)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if n != int64(len(target)) || !bytes.Equal(out.Bytes(), target) {
+		t.Fatal("reconstructed file differs from target")
+	}
+}
+
+func TestApplyAddOp(t *testing.T) {
+	old := []byte("abcdef")
+	var body bytes.Buffer
+	putUvarint(&body, uint64(len(old)))
+	sum := sha256.Sum256(old)
+	body.Write(sum[:])
+	putUvarint(&body, 4)
+	body.WriteByte(opAdd)
+	putUvarint(&body, 1)
+	putUvarint(&body, 3)
+	body.Write([]byte{1, 1, 1}) // "bcd" -> "cde"
+	body.WriteByte(opInsert)
+	putUvarint(&body, 1)
+	body.WriteByte('!')
+	body.WriteByte(opEnd)
+
+	var patch bytes.Buffer
+	patch.WriteString(magic)
+	zw := gzip.NewWriter(&patch)
+	_, _ = zw.Write(body.Bytes())
+	_ = zw.Close()
+
+	var out bytes.Buffer
+	if _, err := Apply(old, &patch, &out); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if out.String() != "cde!" {
+		t.Fatalf("out = %q", out.String())
+	}
+}
+
+func TestApplyRejectsWrongSource(t *testing.T) {
+	patch := Create([]byte("version one of the agent binary...."), []byte("version two"))
+	_, err := Apply([]byte("some other binary"), bytes.NewReader(patch), &bytes.Buffer{})
+	if !errors.Is(err, ErrSourceMismatch) {
+		t.Fatalf("err = %v, want ErrSourceMismatch", err)
+	}
+	if _, err := Apply(nil, bytes.NewReader([]byte("not a patch")), &bytes.Buffer{}); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("err = %v, want ErrCorrupt", err)
+	}
+}
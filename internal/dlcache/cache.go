@@ -0,0 +1,477 @@
+// Package dlcache is a content-addressable cache for downloaded files, keyed
+// by SHA-256 and shared by task installs, self-updates and runtime updates.
+//
+// Layout under the cache directory:
+//
+//	<sha256>/<filename>   verified entries (filename keeps the installer extension)
+//	partial/<sha256>.part resumable in-progress downloads
+//	pins.json             prestaged entries and their expiry
+//
+// Entries are evicted least-recently-used first once the total size exceeds
+// the quota. Entries acquired by a caller are reference counted and never
+// evicted while in use; pinned (prestaged) entries are kept until their pin
+// is released or expires.
+package dlcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/config"
+)
+
+// DefaultMaxMB is used when download.cache_max_mb is not set.
+const DefaultMaxMB = 2048
+
+var (
+	ErrHashMismatch = errors.New("dlcache: hash mismatch")
+	ErrInvalidHash  = errors.New("dlcache: invalid sha256")
+
+	hexHashRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+	registryMu sync.Mutex
+	registry   = map[string]*Cache{}
+)
+
+// Cache is safe for concurrent use.
+type Cache struct {
+	dir      string
+	maxBytes int64
+
+	mu     sync.Mutex
+	refs   map[string]int
+	flight map[string]*sync.Mutex
+	nowFn  func() time.Time
+}
+
+// Entry is a verified cache file held by a caller until Release.
+type Entry struct {
+	Hash string
+	Path string
+	Name string
+	Size int64
+
+	cache    *Cache
+	released sync.Once
+}
+
+// Release drops the caller's reference so the entry may be evicted.
+func (e *Entry) Release() {
+	if e == nil || e.cache == nil {
+		return
+	}
+	e.released.Do(func() { e.cache.release(e.Hash) })
+}
+
+// Open returns the cache rooted at dir. Every caller in the process gets the
+// same *Cache for a directory so reference counts are shared; the most recent
+// maxMB wins.
+func Open(dir string, maxMB int) (*Cache, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if maxMB <= 0 {
+		maxMB = DefaultMaxMB
+	}
+	if err := os.MkdirAll(filepath.Join(abs, "partial"), 0o755); err != nil {
+		return nil, err
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	c, ok := registry[abs]
+	if !ok {
+		c = &Cache{dir: abs, refs: map[string]int{}, flight: map[string]*sync.Mutex{}, nowFn: time.Now}
+		registry[abs] = c
+	}
+	c.mu.Lock()
+	c.maxBytes = int64(maxMB) * 1024 * 1024
+	c.mu.Unlock()
+	return c, nil
+}
+
+// FromConfig opens the cache under download.temp_dir with the configured
+// quota.
+func FromConfig(cfg config.Config) (*Cache, error) {
+	return Open(filepath.Join(cfg.Download.TempDir, "cache"), cfg.Download.CacheMaxMB)
+}
+
+// Dir returns the cache root.
+func (c *Cache) Dir() string { return c.dir }
+
+// NormalizeHash accepts "sha256:<hex>" or "<hex>" and returns lowercase hex.
+func NormalizeHash(h string) (string, error) {
+	h = strings.ToLower(strings.TrimSpace(h))
+	h = strings.TrimPrefix(h, "sha256:")
+	if !hexHashRe.MatchString(h) {
+		return "", ErrInvalidHash
+	}
+	return h, nil
+}
+
+// Acquire returns the entry for hash if cached, marking it recently used.
+func (c *Cache) Acquire(hash string) (*Entry, bool) {
+	hash, err := NormalizeHash(hash)
+	if err != nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.lookup(hash)
+	if !ok {
+		return nil, false
+	}
+	now := c.nowFn()
+	_ = os.Chtimes(e.Path, now, now)
+	c.refs[hash]++
+	return e, true
+}
+
+// VerifyFile returns an error wrapping ErrHashMismatch unless path hashes to
+// hash.
+func VerifyFile(path, hash string) error {
+	hash, err := NormalizeHash(hash)
+	if err != nil {
+		return err
+	}
+	got, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if got != hash {
+		return fmt.Errorf("%w: want %s got %s", ErrHashMismatch, hash, got)
+	}
+	return nil
+}
+
+// PartialPath is where a resumable download for hash is staged.
+func (c *Cache) PartialPath(hash string) (string, error) {
+	hash, err := NormalizeHash(hash)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(c.dir, "partial", hash+".part"), nil
+}
+
+// Insert verifies that srcPath hashes to hash and moves it into the cache
+// under name. The returned entry is acquired. srcPath is consumed (moved or
+// removed) in every case except a read error.
+func (c *Cache) Insert(hash, srcPath, name string) (*Entry, error) {
+	hash, err := NormalizeHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyFile(srcPath, hash); err != nil {
+		if errors.Is(err, ErrHashMismatch) {
+			_ = os.Remove(srcPath)
+		}
+		return nil, err
+	}
+
+	name = sanitizeName(name, hash)
+	c.mu.Lock()
+	if e, ok := c.lookup(hash); ok {
+		c.refs[hash]++
+		c.mu.Unlock()
+		_ = os.Remove(srcPath)
+		return e, nil
+	}
+	entryDir := filepath.Join(c.dir, hash)
+	if err := os.MkdirAll(entryDir, 0o755); err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	dst := filepath.Join(entryDir, name)
+	if err := moveFile(srcPath, dst); err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	now := c.nowFn()
+	_ = os.Chtimes(dst, now, now)
+	c.refs[hash]++
+	e, _ := c.lookup(hash)
+	c.mu.Unlock()
+
+	c.Evict()
+	return e, nil
+}
+
+// Fetch returns the cached entry for hash or calls download to fill
+// partialPath and inserts the result. Concurrent fetches of the same hash
+// download once. download returns the file name to keep (e.g. from
+// Content-Disposition); partialPath may already hold a resumable prefix.
+func (c *Cache) Fetch(hash string, download func(partialPath string) (name string, err error)) (*Entry, error) {
+	hash, err := NormalizeHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := c.Acquire(hash); ok {
+		return e, nil
+	}
+
+	fl := c.flightLock(hash)
+	fl.Lock()
+	defer fl.Unlock()
+	if e, ok := c.Acquire(hash); ok {
+		return e, nil
+	}
+
+	partial, _ := c.PartialPath(hash)
+	name, err := download(partial)
+	if err != nil {
+		return nil, err
+	}
+	return c.Insert(hash, partial, name)
+}
+
+// Evict removes unreferenced, unpinned entries, least recently used first,
+// until the cache fits the quota. Pinned entries do not count toward it.
+func (c *Cache) Evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pins := c.loadPins()
+	var entries []scanned
+	var total int64
+	for _, e := range c.scan() {
+		if _, pinned := pins[e.Hash]; pinned {
+			continue
+		}
+		entries = append(entries, e)
+		total += e.Size
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	for _, e := range entries {
+		if total <= c.maxBytes {
+			return
+		}
+		if c.refs[e.Hash] > 0 {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(c.dir, e.Hash)); err == nil {
+			total -= e.Size
+		}
+	}
+}
+
+// SweepPartials removes in-progress downloads not touched for olderThan,
+// e.g. left behind by tasks that failed and were never retried.
+func (c *Cache) SweepPartials(olderThan time.Duration) int {
+	dir := filepath.Join(c.dir, "partial")
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	removed := 0
+	cutoff := c.nowFn().Add(-olderThan)
+	for _, it := range items {
+		hash, ok := strings.CutSuffix(it.Name(), ".part")
+		if !ok {
+			continue
+		}
+		info, err := it.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		fl := c.flightLock(hash)
+		if !fl.TryLock() {
+			continue
+		}
+		if os.Remove(filepath.Join(dir, it.Name())) == nil {
+			removed++
+		}
+		// Resume metadata written by the downloader next to the partial.
+		_ = os.Remove(filepath.Join(dir, it.Name()+".meta.json"))
+		fl.Unlock()
+	}
+	return removed
+}
+
+// Hashes lists cached hashes, most recently used first, at most limit
+// entries (0 for all).
+func (c *Cache) Hashes(limit int) []string {
+	c.mu.Lock()
+	entries := c.scan()
+	c.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.After(entries[j].used) })
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	out := make([]string, len(entries))
+	for i, e := range entries {
+		out[i] = e.Hash
+	}
+	return out
+}
+
+// Stats reports the number of entries and their total size.
+func (c *Cache) Stats() (entries int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.scan() {
+		entries++
+		bytes += e.Size
+	}
+	return entries, bytes
+}
+
+type scanned struct {
+	Hash string
+	Size int64
+	used time.Time
+}
+
+// scan lists entries; c.mu must be held.
+func (c *Cache) scan() []scanned {
+	items, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil
+	}
+	var out []scanned
+	for _, it := range items {
+		if !it.IsDir() || !hexHashRe.MatchString(it.Name()) {
+			continue
+		}
+		e, ok := c.lookup(it.Name())
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(e.Path)
+		if err != nil {
+			continue
+		}
+		out = append(out, scanned{Hash: e.Hash, Size: e.Size, used: info.ModTime()})
+	}
+	return out
+}
+
+// lookup finds the file stored for hash; c.mu must be held.
+func (c *Cache) lookup(hash string) (*Entry, bool) {
+	entryDir := filepath.Join(c.dir, hash)
+	items, err := os.ReadDir(entryDir)
+	if err != nil {
+		return nil, false
+	}
+	for _, it := range items {
+		// An in-progress name is an unfinished copyFile left by a crash;
+		// its content was never verified.
+		if !it.Type().IsRegular() || strings.Contains(it.Name(), partialMarker) {
+			continue
+		}
+		info, err := it.Info()
+		if err != nil {
+			continue
+		}
+		return &Entry{Hash: hash, Path: filepath.Join(entryDir, it.Name()), Name: it.Name(), Size: info.Size(), cache: c}, true
+	}
+	return nil, false
+}
+
+func (c *Cache) release(hash string) {
+	c.mu.Lock()
+	if c.refs[hash] > 1 {
+		c.refs[hash]--
+	} else {
+		delete(c.refs, hash)
+	}
+	c.mu.Unlock()
+	c.Evict()
+}
+
+func (c *Cache) flightLock(hash string) *sync.Mutex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.flight[hash]
+	if !ok {
+		m = &sync.Mutex{}
+		c.flight[hash] = m
+	}
+	return m
+}
+
+// Materialize makes the entry available at dst (hard link, falling back to a
+// copy) so it can outlive eviction, e.g. a staged self-update.
+func (e *Entry) Materialize(dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	_ = os.Remove(dst)
+	if err := os.Link(e.Path, dst); err == nil {
+		return nil
+	}
+	return copyFile(e.Path, dst)
+}
+
+// partialMarker is part of copyFile's temporary names. sanitizeName rewrites
+// it in server-supplied names so lookup can tell the two apart.
+const partialMarker = ".partial-"
+
+func sanitizeName(name, hash string) string {
+	name = filepath.Base(strings.TrimSpace(strings.ReplaceAll(name, "\\", "/")))
+	if name == "" || name == "." || name == "/" || name == ".." {
+		return hash + ".bin"
+	}
+	return strings.ReplaceAll(name, partialMarker, "_partial-")
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+partialMarker+"*")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	if err := out.Chmod(0o755); err != nil {
+		out.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,251 @@
+package dlcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func hashOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeSrc(t *testing.T, dir string, data []byte) string {
+	t.Helper()
+	p := filepath.Join(dir, "src-"+hashOf(data)[:8])
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestInsertVerifiesAndAcquireHits(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "cache"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("installer payload")
+	src := writeSrc(t, t.TempDir(), data)
+
+	if _, err := c.Insert(hashOf([]byte("other")), src, "setup.msi"); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("want hash mismatch, got %v", err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("mismatched source should be removed")
+	}
+
+	src = writeSrc(t, t.TempDir(), data)
+	e, err := c.Insert("sha256:"+hashOf(data), src, "setup.msi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Release()
+	if filepath.Ext(e.Path) != ".msi" {
+		t.Fatalf("entry should keep installer name: %s", e.Path)
+	}
+
+	hit, ok := c.Acquire(hashOf(data))
+	if !ok {
+		t.Fatal("expected cache hit")
+	}
+	defer hit.Release()
+	if got, _ := os.ReadFile(hit.Path); string(got) != string(data) {
+		t.Fatalf("unexpected content %q", got)
+	}
+}
+
+func TestEvictLRUSkipsReferenced(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "cache"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.nowFn = func() time.Time { return now }
+
+	big := func(b byte) []byte {
+		d := make([]byte, 600*1024)
+		for i := range d {
+			d[i] = b
+		}
+		return d
+	}
+	a, b := big('a'), big('b')
+
+	ea, err := c.Insert(hashOf(a), writeSrc(t, t.TempDir(), a), "a.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a is still referenced, so inserting b over quota must not evict it.
+	now = now.Add(time.Minute)
+	eb, err := c.Insert(hashOf(b), writeSrc(t, t.TempDir(), b), "b.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ea.Path); err != nil {
+		t.Fatalf("referenced entry evicted: %v", err)
+	}
+
+	// Releasing a (the least recently used) makes it the eviction victim.
+	ea.Release()
+	if _, err := os.Stat(ea.Path); !os.IsNotExist(err) {
+		t.Fatalf("expected LRU entry evicted")
+	}
+	eb.Release()
+	if _, err := os.Stat(eb.Path); err != nil {
+		t.Fatalf("entry within quota evicted: %v", err)
+	}
+}
+
+func TestPinnedEntriesSurviveEvictionUntilExpiry(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "cache"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.nowFn = func() time.Time { return now }
+
+	a := make([]byte, 700*1024)
+	b := make([]byte, 700*1024)
+	b[0] = 1
+	ea, err := c.Insert(hashOf(a), writeSrc(t, t.TempDir(), a), "a.msi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ea.Release()
+	if err := c.Pin(hashOf(a), time.Hour, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	eb, err := c.Insert(hashOf(b), writeSrc(t, t.TempDir(), b), "b.msi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eb.Release()
+	if err := c.Pin(hashOf(b), time.Hour, 1024*1024); !errors.Is(err, ErrPinQuota) {
+		t.Fatalf("want ErrPinQuota, got %v", err)
+	}
+	if _, err := os.Stat(ea.Path); err != nil {
+		t.Fatalf("pinned entry evicted: %v", err)
+	}
+
+	// Once the pin expires the entry is an ordinary LRU victim again.
+	now = now.Add(2 * time.Hour)
+	if pins := c.Pins(); len(pins) != 0 {
+		t.Fatalf("expired pins listed: %v", pins)
+	}
+	c.Evict()
+	if _, err := os.Stat(ea.Path); !os.IsNotExist(err) {
+		t.Fatal("expired pin not evicted")
+	}
+}
+
+func TestFetchDownloadsOnce(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "cache"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("shared installer")
+	var calls atomic.Int32
+	download := func(partial string) (string, error) {
+		calls.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return "app.exe", os.WriteFile(partial, data, 0o644)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e, err := c.Fetch(hashOf(data), download)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			e.Release()
+		}()
+	}
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("download ran %d times, want 1", n)
+	}
+}
+
+func TestSweepPartials(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "cache"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := c.PartialPath(hashOf([]byte("x")))
+	if err := os.WriteFile(p, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	_ = os.Chtimes(p, old, old)
+	if n := c.SweepPartials(24 * time.Hour); n != 1 {
+		t.Fatalf("swept %d, want 1", n)
+	}
+}
+
+func TestAcquireIgnoresLeftoverPartialCopy(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "cache"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := hashOf([]byte("full installer"))
+	dir := filepath.Join(c.dir, hash)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// A copy interrupted by a crash: truncated and never verified.
+	if err := os.WriteFile(filepath.Join(dir, "setup.msi"+partialMarker+"123"), []byte("full"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := c.Acquire(hash); ok {
+		e.Release()
+		t.Fatalf("leftover temp file served as entry: %s", e.Path)
+	}
+}
+
+func TestServerNamesNeverLookLikePartialCopies(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "cache"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"setup.tmp", "setup" + partialMarker + "1.msi"} {
+		data := []byte("content of " + name)
+		src := filepath.Join(t.TempDir(), "download")
+		if err := os.WriteFile(src, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		e, err := c.Insert(hashOf(data), src, name)
+		if err != nil {
+			t.Fatalf("Insert %s: %v", name, err)
+		}
+		e.Release()
+		got, ok := c.Acquire(hashOf(data))
+		if !ok {
+			t.Fatalf("%s stored but not found", name)
+		}
+		got.Release()
+	}
+}
+
+func TestOpenSharesInstance(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	a, _ := Open(dir, 10)
+	b, _ := Open(dir, 20)
+	if a != b {
+		t.Fatal("Open should return the shared cache for a directory")
+	}
+	if _, err := NormalizeHash("sha256:xyz"); !errors.Is(err, ErrInvalidHash) {
+		t.Fatalf("want invalid hash, got %v", err)
+	}
+}
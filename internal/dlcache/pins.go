@@ -0,0 +1,124 @@
+package dlcache
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ErrPinQuota means pinning the entry would exceed the prestage quota.
+var ErrPinQuota = errors.New("dlcache: prestage quota exceeded")
+
+const pinsFile = "pins.json"
+
+// Pin keeps a prestaged entry out of eviction until it is used or expires.
+// Pinned entries count against the prestage quota instead of the cache
+// quota.
+type Pin struct {
+	Hash  string    `json:"hash"`
+	Size  int64     `json:"size"`
+	Until time.Time `json:"until"`
+}
+
+// Pin protects the cached entry for hash for ttl. quota bounds the total
+// size of all pins; re-pinning an entry only extends its expiry.
+func (c *Cache) Pin(hash string, ttl time.Duration, quota int64) error {
+	hash, err := NormalizeHash(hash)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.lookup(hash)
+	if !ok {
+		return os.ErrNotExist
+	}
+	pins := c.loadPins()
+	if _, ok := pins[hash]; !ok {
+		var total int64
+		for _, p := range pins {
+			total += p.Size
+		}
+		if quota > 0 && total+e.Size > quota {
+			return ErrPinQuota
+		}
+	}
+	pins[hash] = Pin{Hash: hash, Size: e.Size, Until: c.nowFn().Add(ttl)}
+	return c.savePins(pins)
+}
+
+// Unpin releases a pin, e.g. once the prestaged content was installed.
+func (c *Cache) Unpin(hash string) {
+	hash, err := NormalizeHash(hash)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pins := c.loadPins()
+	if _, ok := pins[hash]; !ok {
+		return
+	}
+	delete(pins, hash)
+	_ = c.savePins(pins)
+}
+
+// Pins lists the live pins, soonest expiry first.
+func (c *Cache) Pins() []Pin {
+	c.mu.Lock()
+	pins := c.loadPins()
+	c.mu.Unlock()
+	out := make([]Pin, 0, len(pins))
+	for _, p := range pins {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Until.Before(out[j].Until) })
+	return out
+}
+
+// loadPins reads the pins that are neither expired nor orphaned; c.mu must
+// be held.
+func (c *Cache) loadPins() map[string]Pin {
+	pins := map[string]Pin{}
+	b, err := os.ReadFile(filepath.Join(c.dir, pinsFile))
+	if err != nil {
+		return pins
+	}
+	var list []Pin
+	if json.Unmarshal(b, &list) != nil {
+		return pins
+	}
+	now := c.nowFn()
+	for _, p := range list {
+		if !p.Until.After(now) {
+			continue
+		}
+		if _, ok := c.lookup(p.Hash); !ok {
+			continue
+		}
+		pins[p.Hash] = p
+	}
+	return pins
+}
+
+// savePins writes pins; c.mu must be held.
+func (c *Cache) savePins(pins map[string]Pin) error {
+	list := make([]Pin, 0, len(pins))
+	for _, p := range pins {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Hash < list[j].Hash })
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(c.dir, pinsFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
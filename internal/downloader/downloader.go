@@ -2,25 +2,48 @@ package downloader
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 
+	"appcenter-agent/internal/bandwidth"
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/dlcache"
+	"appcenter-agent/internal/reqsign"
+	"appcenter-agent/internal/urlguard"
+
 	"golang.org/x/time/rate"
 )
 
+// errRemoteChanged means the server no longer serves the file the partial
+// download was started from; the partial data must be discarded.
+var errRemoteChanged = errors.New("remote file changed since partial download")
+
+// waiter is a rate limiter shared by the readers of one or more downloads.
+type waiter interface {
+	WaitN(ctx context.Context, n int) error
+	Burst() int
+}
+
 type limitedReader struct {
 	ctx     context.Context
 	reader  io.Reader
-	limiter *rate.Limiter
+	limiter waiter
 }
 
 func (r *limitedReader) Read(p []byte) (int, error) {
+	// WaitN rejects requests larger than the burst.
+	if b := r.limiter.Burst(); len(p) > b {
+		p = p[:b]
+	}
 	n, err := r.reader.Read(p)
 	if n > 0 {
 		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
@@ -35,42 +58,204 @@ type DownloadResult struct {
 	Filename     string
 }
 
-func DownloadFile(ctx context.Context, downloadURL, destPath string, limitKBps int, agentUUID, secretKey string) (int64, error) {
-	res, err := DownloadFileWithMeta(ctx, downloadURL, destPath, limitKBps, agentUUID, secretKey)
+// Options controls a single download.
+type Options struct {
+	// Limiter is shared with other downloads; when nil the download gets its
+	// own limiter of LimitKBps.
+	Limiter   *bandwidth.Limiter
+	LimitKBps int
+	// Auth signs the request; it is only attached when Guard considers the
+	// URL part of the server origin.
+	Auth reqsign.Credentials
+	// Guard applies the URL policy (nil allows any URL).
+	Guard *urlguard.Guard
+	// Segments > 1 downloads files of at least SegmentMinBytes over that many
+	// parallel range requests. LimitKBps applies to all segments together.
+	Segments        int
+	SegmentMinBytes int64
+	// ContentHash is the expected hash of the file. It lets a partial
+	// download started from one source be continued from another.
+	ContentHash string
+	// Sources tracks source health for FetchSources (nil uses
+	// DefaultSources).
+	Sources *SourceTracker
+	// Peer carries requests for peer:// sources (LAN peers, see
+	// internal/p2p). Those bypass Guard; the content hash is the check.
+	Peer PeerTransport
+}
+
+// PeerScheme marks sources served by LAN peers.
+const PeerScheme = "peer"
+
+// PeerTransport sends a request for a peer:// source, translating the URL
+// and authenticating it for the peer.
+type PeerTransport interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// IsPeerSource reports whether src is a peer:// source.
+func IsPeerSource(src string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(src)), PeerScheme+"://")
+}
+
+// OptionsFromConfig returns the options for downloads on behalf of the
+// configured agent.
+func OptionsFromConfig(cfg config.Config) Options {
+	return Options{
+		Limiter:         bandwidth.Default(),
+		LimitKBps:       cfg.Download.BandwidthLimitKBs,
+		Auth:            reqsign.Credentials{AgentUUID: cfg.Agent.UUID, Secret: cfg.Agent.SecretKey, Mode: cfg.Server.AuthMode},
+		Guard:           urlguard.FromConfig(cfg),
+		Segments:        cfg.Download.Segments,
+		SegmentMinBytes: int64(cfg.Download.SegmentMinMB) * 1024 * 1024,
+	}
+}
+
+// limiter returns the shared limiter, or a new one of LimitKBps.
+func (o Options) limiter() (waiter, error) {
+	if o.Limiter != nil {
+		return o.Limiter, nil
+	}
+	if o.LimitKBps <= 0 {
+		return nil, fmt.Errorf("invalid bandwidth limit: %d", o.LimitKBps)
+	}
+	return rate.NewLimiter(rate.Limit(o.LimitKBps*1024), o.LimitKBps*1024), nil
+}
+
+func DownloadFile(ctx context.Context, downloadURL, destPath string, opts Options) (int64, error) {
+	res, err := DownloadFileWithMeta(ctx, downloadURL, destPath, opts)
 	if err != nil {
 		return 0, err
 	}
 	return res.BytesWritten, nil
 }
 
+// DownloadFileWithMeta downloads into destPath, resuming a previous partial
+// download only when its sidecar metadata matches the URL and the server
+// confirms through If-Range that the file is unchanged.
 func DownloadFileWithMeta(
 	ctx context.Context,
 	downloadURL,
 	destPath string,
-	limitKBps int,
-	agentUUID,
-	secretKey string,
+	opts Options,
 ) (*DownloadResult, error) {
-	if limitKBps <= 0 {
-		return nil, fmt.Errorf("invalid bandwidth limit: %d", limitKBps)
+	limiter, err := opts.limiter()
+	if err != nil {
+		return nil, err
+	}
+	d := &download{
+		ctx:     ctx,
+		dest:    destPath,
+		opts:    opts,
+		limiter: limiter,
+	}
+	if IsPeerSource(downloadURL) {
+		if opts.Peer == nil {
+			return nil, errors.New("peer source without peer transport")
+		}
+		target, err := url.Parse(downloadURL)
+		if err != nil {
+			return nil, err
+		}
+		d.url, d.client, d.peer = target, opts.Peer, true
+	} else {
+		target, err := opts.Guard.Check(downloadURL)
+		if err != nil {
+			return nil, err
+		}
+		d.url, d.client = target, opts.Guard.Client(0)
+	}
+	res, err := d.run()
+	if errors.Is(err, errRemoteChanged) {
+		// Start over once from an empty file.
+		_ = os.Remove(destPath)
+		removeSidecar(destPath)
+		res, err = d.run()
+	}
+	return res, err
+}
+
+type download struct {
+	ctx     context.Context
+	url     *url.URL
+	dest    string
+	opts    Options
+	client  httpDoer
+	limiter waiter
+	// peer requests are authenticated by the PeerTransport, never with the
+	// agent's own credentials.
+	peer bool
+}
+
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+func (d *download) run() (*DownloadResult, error) {
+	side := loadSidecar(d.dest)
+	switch {
+	case side == nil:
+	case side.URL == d.url.String() && side.validator() != "":
+	case d.opts.ContentHash != "" && side.Hash == d.opts.ContentHash && len(side.Segments) == 0:
+		// Same content from another source: continue without If-Range, the
+		// caller's hash verification rejects a bad splice.
+		side.URL, side.ETag, side.LastModified = d.url.String(), "", ""
+	default:
+		side = nil
+	}
+	if d.opts.Segments > 1 && (side == nil || len(side.Segments) > 0) {
+		res, ok, err := d.segmented(side)
+		if ok || err != nil {
+			return res, err
+		}
+		side = nil
+	} else if side != nil && len(side.Segments) > 0 {
+		// Segmented progress cannot be continued as a single stream.
+		side = nil
+	}
+	return d.single(side)
+}
+
+func (d *download) newRequest(method string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(d.ctx, method, d.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if !d.peer && d.opts.Guard.SameOrigin(d.url) {
+		if err := d.opts.Auth.Sign(req, nil); err != nil {
+			return nil, err
+		}
 	}
+	return req, nil
+}
 
+func (d *download) single(side *sidecar) (*DownloadResult, error) {
 	resumeOffset := int64(0)
-	if fi, err := os.Stat(destPath); err == nil {
-		resumeOffset = fi.Size()
+	if side != nil {
+		if fi, err := os.Stat(d.dest); err == nil {
+			resumeOffset = fi.Size()
+		}
+		if side.Size > 0 && resumeOffset == side.Size {
+			removeSidecar(d.dest)
+			return &DownloadResult{Filename: d.filename(side.Filename)}, nil
+		}
+		if side.Size > 0 && resumeOffset > side.Size {
+			resumeOffset = 0
+		}
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadURL, nil)
+	req, err := d.newRequest(http.MethodGet)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("X-Agent-UUID", agentUUID)
-	req.Header.Set("X-Agent-Secret", secretKey)
 	if resumeOffset > 0 {
 		req.Header.Set("Range", "bytes="+strconv.FormatInt(resumeOffset, 10)+"-")
+		if v := side.validator(); v != "" {
+			req.Header.Set("If-Range", v)
+		}
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := d.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -81,31 +266,110 @@ func DownloadFileWithMeta(
 	}
 
 	openFlags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
-	if resumeOffset > 0 && resp.StatusCode == http.StatusPartialContent {
+	next := sidecarFromResponse(d.url, resp)
+	if resp.StatusCode == http.StatusPartialContent {
+		if resumeOffset == 0 {
+			return nil, errors.New("unexpected partial content")
+		}
+		start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != resumeOffset || (side.Size > 0 && total != side.Size) {
+			return nil, errRemoteChanged
+		}
 		openFlags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		next = side
+	}
+	next.Hash = d.opts.ContentHash
+	if next.validator() != "" || next.Hash != "" {
+		if err := next.save(d.dest); err != nil {
+			return nil, err
+		}
+	} else {
+		removeSidecar(d.dest)
 	}
 
-	out, err := os.OpenFile(destPath, openFlags, 0o644)
+	out, err := os.OpenFile(d.dest, openFlags, 0o644)
 	if err != nil {
 		return nil, err
 	}
 	defer out.Close()
 
-	limiter := rate.NewLimiter(rate.Limit(limitKBps*1024), limitKBps*1024)
-	lr := &limitedReader{
-		ctx:     ctx,
-		reader:  resp.Body,
-		limiter: limiter,
-	}
-
+	lr := &limitedReader{ctx: d.ctx, reader: resp.Body, limiter: d.limiter}
 	n, err := io.Copy(out, lr)
 	if err != nil {
 		return nil, err
 	}
-	return &DownloadResult{
-		BytesWritten: n,
-		Filename:     extractFilename(resp.Header.Get("Content-Disposition"), destPath),
-	}, nil
+	removeSidecar(d.dest)
+	filename := extractFilename(resp.Header.Get("Content-Disposition"), "")
+	if filename == "" {
+		filename = d.filename(next.Filename)
+	}
+	return &DownloadResult{BytesWritten: n, Filename: filename}, nil
+}
+
+func (d *download) filename(saved string) string {
+	if saved != "" {
+		return saved
+	}
+	return filepath.Base(d.dest)
+}
+
+func sidecarFromResponse(u *url.URL, resp *http.Response) *sidecar {
+	s := &sidecar{
+		URL:          u.String(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Filename:     extractFilename(resp.Header.Get("Content-Disposition"), ""),
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		if _, total, ok := parseContentRange(resp.Header.Get("Content-Range")); ok {
+			s.Size = total
+		}
+	} else if resp.ContentLength > 0 {
+		s.Size = resp.ContentLength
+	}
+	return s
+}
+
+// parseContentRange parses "bytes <start>-<end>/<total>"; total is -1 when
+// the server sends "*".
+func parseContentRange(v string) (start, total int64, ok bool) {
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "bytes ") {
+		return 0, 0, false
+	}
+	rng, size, found := strings.Cut(strings.TrimPrefix(v, "bytes "), "/")
+	if !found {
+		return 0, 0, false
+	}
+	first, _, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, total, true
+}
+
+// Fetch returns the cache entry for hash, downloading it into the cache's
+// resumable partial file on a miss. The caller must Release the entry.
+func Fetch(ctx context.Context, cache *dlcache.Cache, downloadURL, hash string, opts Options) (*dlcache.Entry, error) {
+	return FetchSources(ctx, cache, []string{downloadURL}, hash, opts)
+}
+
+func urlFilename(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return path.Base(u.Path)
 }
 
 func extractFilename(contentDisposition, fallbackPath string) string {
@@ -117,5 +381,8 @@ func extractFilename(contentDisposition, fallbackPath string) string {
 			}
 		}
 	}
+	if fallbackPath == "" {
+		return ""
+	}
 	return filepath.Base(fallbackPath)
 }
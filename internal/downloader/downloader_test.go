@@ -1,14 +1,22 @@
 package downloader
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"appcenter-agent/internal/dlcache"
+	"appcenter-agent/internal/reqsign"
 )
 
 func TestDownloadFileWithResume(t *testing.T) {
@@ -45,7 +53,7 @@ func TestDownloadFileWithResume(t *testing.T) {
 		t.Fatalf("seed file: %v", err)
 	}
 
-	if _, err := DownloadFile(context.Background(), srv.URL, dest, 1024, "u1", "s1"); err != nil {
+	if _, err := DownloadFile(context.Background(), srv.URL, dest, Options{LimitKBps: 1024, Auth: reqsign.Credentials{AgentUUID: "u1", Secret: "s1"}}); err != nil {
 		t.Fatalf("download: %v", err)
 	}
 
@@ -57,3 +65,125 @@ func TestDownloadFileWithResume(t *testing.T) {
 		t.Fatalf("unexpected content: %q", string(got))
 	}
 }
+
+func TestFetchUsesCache(t *testing.T) {
+	payload := []byte("cached installer")
+	sum := sha256.Sum256(payload)
+	hash := hex.EncodeToString(sum[:])
+
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Disposition", `attachment; filename="setup.msi"`)
+		_, _ = w.Write(payload)
+	}))
+	defer srv.Close()
+
+	cache, err := dlcache.Open(filepath.Join(t.TempDir(), "cache"), 10)
+	if err != nil {
+		t.Fatalf("open cache: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		entry, err := Fetch(context.Background(), cache, srv.URL+"/files/7", "sha256:"+hash, Options{LimitKBps: 1024})
+		if err != nil {
+			t.Fatalf("fetch: %v", err)
+		}
+		if entry.Name != "setup.msi" {
+			t.Fatalf("unexpected name %q", entry.Name)
+		}
+		entry.Release()
+	}
+	if hits != 1 {
+		t.Fatalf("server hit %d times, want 1", hits)
+	}
+}
+
+func serveVersioned(t *testing.T, etag *string, payload *[]byte, ranges *int32) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(ranges, 1)
+		}
+		w.Header().Set("ETag", *etag)
+		http.ServeContent(w, r, "app.bin", time.Unix(1700000000, 0), bytes.NewReader(*payload))
+	}))
+}
+
+func TestResumeUsesIfRange(t *testing.T) {
+	etag := `"v1"`
+	payload := []byte("abcdefghijklmnopqrstuvwxyz")
+	var ranges int32
+	srv := serveVersioned(t, &etag, &payload, &ranges)
+	defer srv.Close()
+
+	dest := filepath.Join(t.TempDir(), "app.bin")
+	if err := os.WriteFile(dest, payload[:10], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	side := &sidecar{URL: srv.URL, ETag: etag, Size: int64(len(payload))}
+	if err := side.save(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := DownloadFile(context.Background(), srv.URL, dest, Options{LimitKBps: 1024})
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if n != int64(len(payload)-10) || ranges != 1 {
+		t.Fatalf("expected ranged resume, wrote %d bytes with %d range requests", n, ranges)
+	}
+	if got, _ := os.ReadFile(dest); string(got) != string(payload) {
+		t.Fatalf("unexpected content: %q", got)
+	}
+	if _, err := os.Stat(sidecarPath(dest)); !os.IsNotExist(err) {
+		t.Fatalf("sidecar should be removed after completion")
+	}
+}
+
+func TestResumeRestartsWhenRemoteChanged(t *testing.T) {
+	etag := `"v2"`
+	payload := []byte("NEW-CONTENT-0123456789")
+	var ranges int32
+	srv := serveVersioned(t, &etag, &payload, &ranges)
+	defer srv.Close()
+
+	dest := filepath.Join(t.TempDir(), "app.bin")
+	if err := os.WriteFile(dest, []byte("old-conten"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	side := &sidecar{URL: srv.URL, ETag: `"v1"`, Size: 40}
+	if err := side.save(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DownloadFile(context.Background(), srv.URL, dest, Options{LimitKBps: 1024}); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if got, _ := os.ReadFile(dest); string(got) != string(payload) {
+		t.Fatalf("partial from the old version was stitched in: %q", got)
+	}
+}
+
+func TestSegmentedDownload(t *testing.T) {
+	etag := `"seg"`
+	payload := make([]byte, 256*1024)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	var ranges int32
+	srv := serveVersioned(t, &etag, &payload, &ranges)
+	defer srv.Close()
+
+	dest := filepath.Join(t.TempDir(), "big.bin")
+	opts := Options{LimitKBps: 100 * 1024, Segments: 4, SegmentMinBytes: 1024}
+	if _, err := DownloadFile(context.Background(), srv.URL, dest, opts); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, payload) {
+		t.Fatalf("segmented result differs from source")
+	}
+	// One probe plus one request per segment.
+	if ranges != 5 {
+		t.Fatalf("range requests = %d, want 5", ranges)
+	}
+}
@@ -0,0 +1,210 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSegmentMinBytes is the smallest file split into segments when
+	// Options.SegmentMinBytes is not set.
+	DefaultSegmentMinBytes = 16 * 1024 * 1024
+
+	sidecarSaveInterval = 2 * time.Second
+)
+
+// segmented downloads the file over parallel range requests. ok is false
+// when the server does not support ranges or the file is too small, in which
+// case the caller falls back to a single stream.
+func (d *download) segmented(side *sidecar) (*DownloadResult, bool, error) {
+	if side == nil {
+		planned, ok, err := d.planSegments()
+		if !ok || err != nil {
+			return nil, ok, err
+		}
+		side = planned
+	} else if fi, err := os.Stat(d.dest); err != nil || fi.Size() != side.Size {
+		return nil, true, errRemoteChanged
+	}
+
+	f, err := os.OpenFile(d.dest, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, true, err
+	}
+	defer f.Close()
+	if err := f.Truncate(side.Size); err != nil {
+		return nil, true, err
+	}
+	if err := side.save(d.dest); err != nil {
+		return nil, true, err
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		written  int64
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	saveProgress := func() {
+		mu.Lock()
+		snap := *side
+		snap.Segments = append([]segment(nil), side.Segments...)
+		mu.Unlock()
+		_ = snap.save(d.dest)
+	}
+	progress := func(i int, n int64) {
+		mu.Lock()
+		side.Segments[i].Done += n
+		written += n
+		mu.Unlock()
+	}
+
+	stopSaver := make(chan struct{})
+	saverDone := make(chan struct{})
+	go func() {
+		defer close(saverDone)
+		t := time.NewTicker(sidecarSaveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				saveProgress()
+			case <-stopSaver:
+				return
+			}
+		}
+	}()
+
+	for i := range side.Segments {
+		seg := side.Segments[i]
+		if seg.remaining() <= 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, seg segment) {
+			defer wg.Done()
+			if err := d.fetchSegment(ctx, f, side.validator(), seg, func(n int64) { progress(i, n) }); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				cancel()
+			}
+		}(i, seg)
+	}
+	wg.Wait()
+	close(stopSaver)
+	<-saverDone
+
+	if firstErr != nil {
+		saveProgress()
+		return nil, true, firstErr
+	}
+	if err := f.Sync(); err != nil {
+		return nil, true, err
+	}
+	removeSidecar(d.dest)
+	return &DownloadResult{BytesWritten: written, Filename: d.filename(side.Filename)}, true, nil
+}
+
+// planSegments probes the server with a one-byte range request and splits
+// the file into Options.Segments ranges.
+func (d *download) planSegments() (*sidecar, bool, error) {
+	req, err := d.newRequest(http.MethodGet)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, false, nil
+	}
+	side := sidecarFromResponse(d.url, resp)
+	side.Hash = d.opts.ContentHash
+	minBytes := d.opts.SegmentMinBytes
+	if minBytes <= 0 {
+		minBytes = DefaultSegmentMinBytes
+	}
+	if side.Size < minBytes || side.validator() == "" {
+		return nil, false, nil
+	}
+
+	n := int64(d.opts.Segments)
+	chunk := side.Size / n
+	for i := int64(0); i < n; i++ {
+		start := i * chunk
+		end := start + chunk - 1
+		if i == n-1 {
+			end = side.Size - 1
+		}
+		side.Segments = append(side.Segments, segment{Start: start, End: end})
+	}
+	_ = os.Remove(d.dest)
+	return side, true, nil
+}
+
+func (d *download) fetchSegment(ctx context.Context, f *os.File, validator string, seg segment, progress func(int64)) error {
+	offset := seg.Start + seg.Done
+	req, err := d.newRequest(http.MethodGet)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(seg.End, 10))
+	req.Header.Set("If-Range", validator)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return errRemoteChanged
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("segment request failed: %s", resp.Status)
+	}
+	if start, _, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || start != offset {
+		return errRemoteChanged
+	}
+
+	remaining := seg.remaining()
+	r := &limitedReader{ctx: ctx, reader: io.LimitReader(resp.Body, remaining), limiter: d.limiter}
+	buf := make([]byte, 32*1024)
+	for remaining > 0 {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			if _, err := f.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+			offset += int64(n)
+			remaining -= int64(n)
+			progress(int64(n))
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	if remaining > 0 {
+		return fmt.Errorf("segment ended early: %w", io.ErrUnexpectedEOF)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package downloader
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// sidecar records how a partial download was started so a later resume can
+// ask the server (If-Range) whether the bytes on disk still belong to the
+// same file.
+type sidecar struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	Filename     string `json:"filename,omitempty"`
+	// Hash is the expected content hash. Another source serving the same
+	// hash may continue the partial download (without If-Range).
+	Hash     string    `json:"hash,omitempty"`
+	Segments []segment `json:"segments,omitempty"`
+}
+
+// segment is an inclusive byte range and how much of it is already on disk.
+type segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Done  int64 `json:"done"`
+}
+
+func (s segment) remaining() int64 { return s.End - s.Start + 1 - s.Done }
+
+func sidecarPath(destPath string) string { return destPath + ".meta.json" }
+
+func loadSidecar(destPath string) *sidecar {
+	b, err := os.ReadFile(sidecarPath(destPath))
+	if err != nil {
+		return nil
+	}
+	var s sidecar
+	if json.Unmarshal(b, &s) != nil {
+		return nil
+	}
+	return &s
+}
+
+func (s *sidecar) save(destPath string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := sidecarPath(destPath) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sidecarPath(destPath))
+}
+
+func removeSidecar(destPath string) {
+	_ = os.Remove(sidecarPath(destPath))
+}
+
+// validator returns the If-Range value. Weak ETags are not allowed there, so
+// Last-Modified is used instead.
+func (s *sidecar) validator() string {
+	if s == nil {
+		return ""
+	}
+	if s.ETag != "" && !strings.HasPrefix(s.ETag, "W/") {
+		return s.ETag
+	}
+	return s.LastModified
+}
@@ -0,0 +1,287 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/dlcache"
+	"appcenter-agent/internal/urlguard"
+)
+
+const (
+	sourceBackoffBase = 30 * time.Second
+	sourceBackoffMax  = 10 * time.Minute
+)
+
+// DefaultSources is the process-wide source health record.
+var DefaultSources = NewSourceTracker()
+
+// SourceHealth is what is known about one content source (keyed by origin or
+// share host).
+type SourceHealth struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	// BytesPerSec is a moving average of completed transfers.
+	BytesPerSec float64 `json:"bytes_per_sec"`
+}
+
+// SourceTracker orders content sources by health. Safe for concurrent use.
+type SourceTracker struct {
+	mu    sync.Mutex
+	stats map[string]*SourceHealth
+	nowFn func() time.Time
+}
+
+func NewSourceTracker() *SourceTracker {
+	return &SourceTracker{stats: map[string]*SourceHealth{}, nowFn: time.Now}
+}
+
+// Order returns sources healthiest first: sources in failure backoff go
+// last, then fewer consecutive failures, then higher measured throughput.
+// Ties keep the given order, so the server's primary URL wins by default.
+// Peer sources are ranked among themselves and always come first, so the
+// WAN link is only used when no LAN peer can serve the content.
+func (t *SourceTracker) Order(sources []string) []string {
+	var peers, others []string
+	for _, src := range sources {
+		if IsPeerSource(src) {
+			peers = append(peers, src)
+		} else {
+			others = append(others, src)
+		}
+	}
+	return append(t.rank(peers), t.rank(others)...)
+}
+
+func (t *SourceTracker) rank(sources []string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.nowFn()
+	type ranked struct {
+		src      string
+		backoff  bool
+		failures int
+		speed    float64
+	}
+	list := make([]ranked, 0, len(sources))
+	for _, src := range sources {
+		r := ranked{src: src}
+		if h, ok := t.stats[sourceKey(src)]; ok {
+			r.failures = h.Failures
+			r.backoff = h.Failures > 0 && now.Before(h.LastFailure.Add(backoffFor(h.Failures)))
+			r.speed = h.BytesPerSec
+		}
+		list = append(list, r)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.backoff != b.backoff {
+			return !a.backoff
+		}
+		if a.failures != b.failures {
+			return a.failures < b.failures
+		}
+		return a.speed > b.speed
+	})
+	out := make([]string, len(list))
+	for i, r := range list {
+		out[i] = r.src
+	}
+	return out
+}
+
+// Success records a completed transfer of n bytes in d.
+func (t *SourceTracker) Success(src string, n int64, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.entry(src)
+	h.Failures = 0
+	h.LastSuccess = t.nowFn()
+	if d > 0 && n > 0 {
+		speed := float64(n) / d.Seconds()
+		if h.BytesPerSec == 0 {
+			h.BytesPerSec = speed
+		} else {
+			h.BytesPerSec = 0.7*h.BytesPerSec + 0.3*speed
+		}
+	}
+}
+
+// Failure records a failed transfer.
+func (t *SourceTracker) Failure(src string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.entry(src)
+	h.Failures++
+	h.LastFailure = t.nowFn()
+}
+
+// Snapshot returns a copy of the per-source health.
+func (t *SourceTracker) Snapshot() map[string]SourceHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]SourceHealth, len(t.stats))
+	for k, v := range t.stats {
+		out[k] = *v
+	}
+	return out
+}
+
+func (t *SourceTracker) entry(src string) *SourceHealth {
+	key := sourceKey(src)
+	h, ok := t.stats[key]
+	if !ok {
+		h = &SourceHealth{}
+		t.stats[key] = h
+	}
+	return h
+}
+
+func backoffFor(failures int) time.Duration {
+	d := sourceBackoffBase
+	for i := 1; i < failures && d < sourceBackoffMax; i++ {
+		d *= 2
+	}
+	return min(d, sourceBackoffMax)
+}
+
+// sourceKey groups sources by scheme+host (or share host) so one slow mirror
+// host is tracked once regardless of the file requested.
+func sourceKey(src string) string {
+	if urlguard.IsShare(src) {
+		p := strings.TrimLeft(strings.ReplaceAll(src, `\`, "/"), "/")
+		if strings.HasPrefix(strings.ToLower(src), "file:") {
+			if u, err := url.Parse(src); err == nil {
+				p = u.Host
+			}
+		}
+		host, _, _ := strings.Cut(p, "/")
+		return "share://" + strings.ToLower(host)
+	}
+	u, err := url.Parse(src)
+	if err != nil || u.Host == "" {
+		return src
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// FetchSources returns the cache entry for hash, trying sources in health
+// order on a miss. A source that fails mid-transfer leaves its partial data
+// for the next one to continue; the content hash decides which result is
+// accepted. The caller must Release the entry.
+func FetchSources(ctx context.Context, cache *dlcache.Cache, sources []string, hash string, opts Options) (*dlcache.Entry, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no download source")
+	}
+	tracker := opts.Sources
+	if tracker == nil {
+		tracker = DefaultSources
+	}
+	opts.ContentHash, _ = dlcache.NormalizeHash(hash)
+
+	return cache.Fetch(hash, func(partialPath string) (string, error) {
+		var errs []error
+		for _, src := range tracker.Order(sources) {
+			started := time.Now()
+			res, err := fetchSource(ctx, src, partialPath, opts)
+			if err == nil {
+				if err = dlcache.VerifyFile(partialPath, hash); err != nil {
+					_ = os.Remove(partialPath)
+					removeSidecar(partialPath)
+				}
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return "", ctx.Err()
+				}
+				tracker.Failure(src)
+				errs = append(errs, fmt.Errorf("%s: %w", sourceKey(src), err))
+				continue
+			}
+			tracker.Success(src, res.BytesWritten, time.Since(started))
+			if res.Filename == filepath.Base(partialPath) {
+				return sourceFilename(src), nil
+			}
+			return res.Filename, nil
+		}
+		return "", errors.Join(errs...)
+	})
+}
+
+func fetchSource(ctx context.Context, src, partialPath string, opts Options) (*DownloadResult, error) {
+	if urlguard.IsShare(src) {
+		return copyFromShare(ctx, src, partialPath, opts)
+	}
+	return DownloadFileWithMeta(ctx, src, partialPath, opts)
+}
+
+// copyFromShare reads a file-share source, continuing a partial download of
+// the same content.
+func copyFromShare(ctx context.Context, src, destPath string, opts Options) (*DownloadResult, error) {
+	limiter, err := opts.limiter()
+	if err != nil {
+		return nil, err
+	}
+	p, err := opts.Guard.CheckShare(src)
+	if err != nil {
+		return nil, err
+	}
+	in, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	offset := int64(0)
+	if side := loadSidecar(destPath); side != nil && opts.ContentHash != "" && side.Hash == opts.ContentHash && len(side.Segments) == 0 {
+		if fi, err := os.Stat(destPath); err == nil {
+			offset = fi.Size()
+		}
+	}
+	if fi, err := in.Stat(); err == nil && offset > fi.Size() {
+		offset = 0
+	}
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if opts.ContentHash != "" {
+		if err := (&sidecar{URL: src, Hash: opts.ContentHash, Filename: filepath.Base(p)}).save(destPath); err != nil {
+			return nil, err
+		}
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	out, err := os.OpenFile(destPath, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	lr := &limitedReader{ctx: ctx, reader: in, limiter: limiter}
+	n, err := io.Copy(out, lr)
+	if err != nil {
+		return nil, err
+	}
+	removeSidecar(destPath)
+	return &DownloadResult{BytesWritten: n, Filename: filepath.Base(p)}, nil
+}
+
+func sourceFilename(src string) string {
+	if urlguard.IsShare(src) {
+		return filepath.Base(strings.ReplaceAll(src, `\`, "/"))
+	}
+	return urlFilename(src)
+}
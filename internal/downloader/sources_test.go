@@ -0,0 +1,124 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"appcenter-agent/internal/dlcache"
+	"appcenter-agent/internal/urlguard"
+)
+
+func TestFetchSourcesFailsOverMidDownload(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 2000)
+	sum := sha256.Sum256(payload)
+	hash := hex.EncodeToString(sum[:])
+	half := len(payload) / 2
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		_, _ = w.Write(payload[:half])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer primary.Close()
+
+	var mirrorRange string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorRange = r.Header.Get("Range")
+		w.Header().Set("ETag", `"mirror"`)
+		http.ServeContent(w, r, "app.msi", time.Unix(1700000000, 0), bytes.NewReader(payload))
+	}))
+	defer mirror.Close()
+
+	cache, err := dlcache.Open(filepath.Join(t.TempDir(), "cache"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := NewSourceTracker()
+	entry, err := FetchSources(context.Background(), cache, []string{primary.URL + "/app.msi", mirror.URL + "/app.msi"}, hash,
+		Options{LimitKBps: 1024, Sources: tracker})
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	defer entry.Release()
+
+	if mirrorRange != "bytes="+strconv.Itoa(half)+"-" {
+		t.Fatalf("mirror should continue the partial download, got Range %q", mirrorRange)
+	}
+	if got, _ := os.ReadFile(entry.Path); !bytes.Equal(got, payload) {
+		t.Fatalf("unexpected content")
+	}
+	if order := tracker.Order([]string{primary.URL + "/x", mirror.URL + "/x"}); order[0] != mirror.URL+"/x" {
+		t.Fatalf("failed primary should be ordered after the mirror: %v", order)
+	}
+}
+
+func TestSourceTrackerOrdering(t *testing.T) {
+	tr := NewSourceTracker()
+	now := time.Unix(1700000000, 0)
+	tr.nowFn = func() time.Time { return now }
+
+	a, b, c := "https://a.example/f", "https://b.example/f", "https://c.example/f"
+	if got := tr.Order([]string{a, b, c}); got[0] != a || got[1] != b || got[2] != c {
+		t.Fatalf("unknown sources should keep their order: %v", got)
+	}
+
+	tr.Failure(a)
+	tr.Success(b, 1000, time.Second)
+	tr.Success(c, 5000, time.Second)
+	if got := tr.Order([]string{a, b, c}); got[0] != c || got[1] != b || got[2] != a {
+		t.Fatalf("want fastest healthy first and failed last: %v", got)
+	}
+
+	// After the backoff a failed source is no longer pushed behind healthy
+	// ones solely for being in backoff, but still ranks by failure count.
+	now = now.Add(sourceBackoffMax)
+	if got := tr.Order([]string{a, b}); got[0] != b {
+		t.Fatalf("source with failures should rank after a healthy one: %v", got)
+	}
+}
+
+func TestFetchSourcesReadsAllowedShare(t *testing.T) {
+	share := t.TempDir()
+	payload := []byte("from the branch share")
+	if err := os.WriteFile(filepath.Join(share, "tool.exe"), payload, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(payload)
+	hash := hex.EncodeToString(sum[:])
+
+	cache, err := dlcache.Open(filepath.Join(t.TempDir(), "cache"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.ToSlash(filepath.Join(share, "tool.exe"))
+	if !strings.HasPrefix(src, "/") {
+		src = "/" + src
+	}
+	src = "file://" + src
+
+	denied := urlguard.New(urlguard.Options{ServerURL: "https://server.example"})
+	if _, err := FetchSources(context.Background(), cache, []string{src}, hash, Options{LimitKBps: 1024, Guard: denied, Sources: NewSourceTracker()}); err == nil {
+		t.Fatalf("share outside download.allowed_shares must be rejected")
+	}
+
+	allowed := urlguard.New(urlguard.Options{ServerURL: "https://server.example", AllowedShares: []string{share}})
+	entry, err := FetchSources(context.Background(), cache, []string{src}, hash, Options{LimitKBps: 1024, Guard: allowed, Sources: NewSourceTracker()})
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	defer entry.Release()
+	if entry.Name != "tool.exe" {
+		t.Fatalf("unexpected name %q", entry.Name)
+	}
+}
@@ -0,0 +1,284 @@
+// Package endpoint picks the server the agent talks to from an ordered list
+// (server.url, then server.endpoints).
+//
+// Each endpoint's /health is probed on an interval. The agent stays on the
+// active endpoint while it answers; after failoverAfter consecutive failed
+// probes it moves to the most preferred healthy one. A more preferred
+// endpoint that recovers is only returned to once it has been healthy for
+// the failback delay, so a flapping primary does not bounce the fleet.
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/netproxy"
+)
+
+const (
+	// failoverAfter is the number of consecutive failed probes of the active
+	// endpoint that trigger a switch.
+	failoverAfter = 2
+	probeTimeout  = 5 * time.Second
+	// minWakeInterval limits probes triggered by ReportFailure.
+	minWakeInterval = 5 * time.Second
+)
+
+// Options configures a Set.
+type Options struct {
+	// Endpoints in order of preference; the first one is active at start.
+	Endpoints     []config.ServerEndpoint
+	ProbeInterval time.Duration
+	FailbackDelay time.Duration
+	Client        *http.Client
+	Logger        *log.Logger
+}
+
+// Status is the state reported over IPC.
+type Status struct {
+	Active    string           `json:"active"`
+	Since     time.Time        `json:"since"`
+	Endpoints []EndpointStatus `json:"endpoints"`
+}
+
+// EndpointStatus is what the last probes found for one endpoint.
+type EndpointStatus struct {
+	URL          string    `json:"url"`
+	Healthy      bool      `json:"healthy"`
+	Failures     int       `json:"failures"`
+	LastCheck    time.Time `json:"last_check,omitempty"`
+	HealthySince time.Time `json:"healthy_since,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// Set tracks the endpoints and the active one. A nil *Set has no endpoints.
+type Set struct {
+	opts  Options
+	probe func(ctx context.Context, serverURL string) error
+	nowFn func() time.Time
+	wake  chan struct{}
+
+	mu        sync.Mutex
+	listeners []func(config.ServerEndpoint)
+	active    int
+	since     time.Time
+	state     []EndpointStatus
+	lastWake  time.Time
+}
+
+// New builds a Set. Endpoints start out healthy.
+func New(opts Options) *Set {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: probeTimeout, Transport: netproxy.Transport()}
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = 30 * time.Second
+	}
+	s := &Set{
+		opts:  opts,
+		nowFn: time.Now,
+		wake:  make(chan struct{}, 1),
+		state: make([]EndpointStatus, len(opts.Endpoints)),
+	}
+	s.probe = s.checkHealth
+	now := s.nowFn()
+	s.since = now
+	for i, ep := range opts.Endpoints {
+		s.state[i] = EndpointStatus{URL: ep.URL, Healthy: true, HealthySince: now}
+	}
+	return s
+}
+
+// FromConfig builds the Set for cfg.ServerEndpoints().
+func FromConfig(cfg *config.Config, logger *log.Logger) *Set {
+	return New(Options{
+		Endpoints:     cfg.ServerEndpoints(),
+		ProbeInterval: time.Duration(cfg.Server.HealthIntervalSec) * time.Second,
+		FailbackDelay: time.Duration(cfg.Server.FailbackDelaySec) * time.Second,
+		Logger:        logger,
+	})
+}
+
+// OnChange registers fn to be called, from the probe loop, after the active
+// endpoint changed. Listeners run in registration order.
+func (s *Set) OnChange(fn func(config.ServerEndpoint)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.listeners = append(s.listeners, fn)
+	s.mu.Unlock()
+}
+
+// Active returns the endpoint in use.
+func (s *Set) Active() config.ServerEndpoint {
+	if s == nil || len(s.opts.Endpoints) == 0 {
+		return config.ServerEndpoint{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.opts.Endpoints[s.active]
+}
+
+// Status returns a snapshot for IPC.
+func (s *Set) Status() Status {
+	if s == nil || len(s.opts.Endpoints) == 0 {
+		return Status{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Status{
+		Active:    s.opts.Endpoints[s.active].URL,
+		Since:     s.since,
+		Endpoints: append([]EndpointStatus(nil), s.state...),
+	}
+}
+
+// ReportFailure asks for an early probe after a request to the active
+// endpoint failed. Calls closer together than minWakeInterval are merged.
+func (s *Set) ReportFailure(err error) {
+	if s == nil || len(s.opts.Endpoints) < 2 {
+		return
+	}
+	s.mu.Lock()
+	now := s.nowFn()
+	if now.Sub(s.lastWake) < minWakeInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastWake = now
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run probes the endpoints until ctx ends. With a single endpoint there is
+// nothing to fail over to and Run returns at once.
+func (s *Set) Run(ctx context.Context) {
+	if s == nil || len(s.opts.Endpoints) < 2 {
+		return
+	}
+	t := time.NewTicker(s.opts.ProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-s.wake:
+		}
+		s.CheckNow(ctx)
+	}
+}
+
+// CheckNow probes every endpoint once and switches if warranted.
+func (s *Set) CheckNow(ctx context.Context) {
+	results := make([]error, len(s.opts.Endpoints))
+	var wg sync.WaitGroup
+	for i, ep := range s.opts.Endpoints {
+		wg.Add(1)
+		go func(i int, serverURL string) {
+			defer wg.Done()
+			pctx, cancel := context.WithTimeout(ctx, probeTimeout)
+			defer cancel()
+			results[i] = s.probe(pctx, serverURL)
+		}(i, ep.URL)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	s.mu.Lock()
+	now := s.nowFn()
+	for i, err := range results {
+		st := &s.state[i]
+		st.LastCheck = now
+		if err != nil {
+			st.Failures++
+			st.Healthy = false
+			st.HealthySince = time.Time{}
+			st.LastError = err.Error()
+			continue
+		}
+		if !st.Healthy {
+			st.HealthySince = now
+		}
+		st.Failures = 0
+		st.Healthy = true
+		st.LastError = ""
+	}
+	prev := s.active
+	next := s.choose(now)
+	if next == prev {
+		s.mu.Unlock()
+		return
+	}
+	reason := "failback"
+	if s.state[prev].Failures > 0 {
+		reason = s.state[prev].LastError
+	}
+	s.active = next
+	s.since = now
+	from, to := s.opts.Endpoints[prev], s.opts.Endpoints[next]
+	listeners := slices.Clone(s.listeners)
+	s.mu.Unlock()
+
+	s.opts.Logger.Printf("endpoint: switching %s -> %s (%s)", from.URL, to.URL, reason)
+	for _, fn := range listeners {
+		fn(to)
+	}
+}
+
+// choose returns the endpoint to use. Called with mu held.
+func (s *Set) choose(now time.Time) int {
+	// Fail back to the most preferred endpoint that has been healthy long
+	// enough.
+	for i := 0; i < s.active; i++ {
+		st := s.state[i]
+		if st.Healthy && now.Sub(st.HealthySince) >= s.opts.FailbackDelay {
+			return i
+		}
+	}
+	if s.state[s.active].Failures < failoverAfter {
+		return s.active
+	}
+	for i, st := range s.state {
+		if st.Healthy {
+			return i
+		}
+	}
+	// Nothing answers; stay put rather than hop between dead servers.
+	return s.active
+}
+
+// checkHealth is the default probe: GET <server>/health must return 200.
+func (s *Set) checkHealth(ctx context.Context, serverURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(serverURL, "/")+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health returned %d", resp.StatusCode)
+	}
+	return nil
+}
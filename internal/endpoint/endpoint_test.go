@@ -0,0 +1,110 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"appcenter-agent/internal/config"
+)
+
+type fakeProbe struct {
+	mu   sync.Mutex
+	down map[string]bool
+}
+
+func (f *fakeProbe) set(url string, down bool) {
+	f.mu.Lock()
+	f.down[url] = down
+	f.mu.Unlock()
+}
+
+func (f *fakeProbe) probe(_ context.Context, url string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down[url] {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestFailoverStickinessAndFailback(t *testing.T) {
+	var changes []string
+	s := New(Options{
+		Endpoints: []config.ServerEndpoint{
+			{URL: "https://primary"}, {URL: "https://secondary"}, {URL: "https://tertiary"},
+		},
+		FailbackDelay: 5 * time.Minute,
+	})
+	s.OnChange(func(ep config.ServerEndpoint) { changes = append(changes, ep.URL) })
+	probe := &fakeProbe{down: map[string]bool{}}
+	s.probe = probe.probe
+	now := time.Unix(1_700_000_000, 0)
+	s.nowFn = func() time.Time { return now }
+	step := func() {
+		now = now.Add(30 * time.Second)
+		s.CheckNow(context.Background())
+	}
+
+	probe.set("https://primary", true)
+	step()
+	if got := s.Active().URL; got != "https://primary" {
+		t.Fatalf("switched after a single failed probe: %s", got)
+	}
+	step()
+	if got := s.Active().URL; got != "https://secondary" {
+		t.Fatalf("active = %s, want secondary after repeated failures", got)
+	}
+
+	// Primary recovers but must stay healthy for the failback delay.
+	probe.set("https://primary", false)
+	for i := 0; i < 9; i++ {
+		step()
+	}
+	if got := s.Active().URL; got != "https://secondary" {
+		t.Fatalf("failed back before the delay: %s", got)
+	}
+	step()
+	step()
+	if got := s.Active().URL; got != "https://primary" {
+		t.Fatalf("active = %s, want primary after failback delay", got)
+	}
+
+	// With every endpoint down the agent stays where it is.
+	for _, u := range []string{"https://primary", "https://secondary", "https://tertiary"} {
+		probe.set(u, true)
+	}
+	step()
+	step()
+	if got := s.Active().URL; got != "https://primary" {
+		t.Fatalf("active = %s with all endpoints down", got)
+	}
+	if len(changes) != 2 || changes[0] != "https://secondary" || changes[1] != "https://primary" {
+		t.Fatalf("changes = %v", changes)
+	}
+}
+
+func TestCheckHealthProbesHealthEndpoint(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer healthy.Close()
+	maintenance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer maintenance.Close()
+
+	s := New(Options{Client: healthy.Client()})
+	if err := s.checkHealth(context.Background(), healthy.URL+"/"); err != nil {
+		t.Fatalf("healthy server: %v", err)
+	}
+	if err := s.checkHealth(context.Background(), maintenance.URL); err == nil {
+		t.Fatal("503 counted as healthy")
+	}
+}
@@ -0,0 +1,371 @@
+// Package enrollment owns the agent's live credentials: initial registration,
+// server-driven secret rotation and automatic re-enrollment after revocation.
+package enrollment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/system"
+	"appcenter-agent/pkg/utils"
+)
+
+const (
+	// defaultAuthFailureThreshold is the number of consecutive 401/403 responses
+	// after which the agent assumes its secret was revoked.
+	defaultAuthFailureThreshold = 3
+	// defaultReenrollCooldown bounds how often re-enrollment is attempted so a
+	// misconfigured server does not get a registration storm.
+	defaultReenrollCooldown = 10 * time.Minute
+)
+
+// Registrar is the subset of api.Client used for registration.
+type Registrar interface {
+	Register(ctx context.Context, uuid, version string, info system.HostInfo, opts api.RegisterOptions) (*api.RegisterResponse, error)
+}
+
+// Manager holds the credentials in effect and keeps config.yaml in sync.
+// It works on its own copy of the config, so the caller's config is never
+// written behind its back; Current is the source of truth for credentials.
+type Manager struct {
+	mu      sync.RWMutex
+	cfg     config.Config
+	cfgPath string
+	client  Registrar
+	logger  *log.Logger
+
+	authFailures  atomic.Int32
+	reenrolling   atomic.Bool
+	lastReenroll  time.Time
+	failThreshold int
+	cooldown      time.Duration
+	onChange      []func()
+
+	statePath     string
+	status        Status
+	initialConfig map[string]any
+
+	nowFn         func() time.Time
+	fingerprintFn func() string
+}
+
+// NewManager creates a credential manager. cfgPath is where rotated or newly
+// issued secrets are persisted.
+func NewManager(client Registrar, cfg *config.Config, cfgPath string, logger *log.Logger) *Manager {
+	utils.RegisterSecret(cfg.Agent.SecretKey)
+	utils.RegisterSecret(cfg.Agent.ReenrollToken)
+	statePath := DefaultStatePath()
+	status, _ := LoadStatus(statePath)
+	if status.State == "" {
+		status.State = StateUnregistered
+		if cfg.Agent.SecretKey != "" {
+			status.State = StateRegistered
+		}
+	}
+	return &Manager{
+		statePath:     statePath,
+		status:        status,
+		cfg:           *cfg,
+		cfgPath:       cfgPath,
+		client:        client,
+		logger:        logger,
+		failThreshold: defaultAuthFailureThreshold,
+		cooldown:      defaultReenrollCooldown,
+		nowFn:         time.Now,
+		fingerprintFn: system.HardwareFingerprint,
+	}
+}
+
+// Current implements api.CredentialProvider.
+func (m *Manager) Current() (string, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cfg.Agent.UUID, m.cfg.Agent.SecretKey
+}
+
+// OnChange registers fn to run after credentials change (rotation/re-enroll).
+func (m *Manager) OnChange(fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onChange = append(m.onChange, fn)
+}
+
+// Bootstrap ensures the agent has a UUID and registers when no secret exists yet.
+func (m *Manager) Bootstrap(ctx context.Context) error {
+	m.mu.Lock()
+	if m.cfg.Agent.UUID == "" {
+		u, err := system.GetOrCreateUUID()
+		if err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		m.cfg.Agent.UUID = u
+	}
+	hasSecret := m.cfg.Agent.SecretKey != ""
+	uuid := m.cfg.Agent.UUID
+	m.mu.Unlock()
+
+	if hasSecret {
+		m.logger.Printf("agent bootstrap reused existing credentials: %s", uuid)
+		m.clearFailed()
+		return nil
+	}
+	if err := m.register(ctx, api.RegisterOptions{}); err != nil {
+		return err
+	}
+	m.logger.Printf("agent registered: %s", uuid)
+	return nil
+}
+
+// Status returns the current enrollment state for IPC/tray display.
+func (m *Manager) Status() Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	st := m.status
+	st.Groups = append([]api.GroupAssignment(nil), m.status.Groups...)
+	return st
+}
+
+// TakeInitialConfig returns the config/policy map delivered with the last
+// registration response once; later calls return nil.
+func (m *Manager) TakeInitialConfig() map[string]any {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := m.initialConfig
+	m.initialConfig = nil
+	return out
+}
+
+// Rotate atomically replaces the secret. The new secret is persisted before it
+// takes effect in memory so a crash never leaves the agent with a secret the
+// config file does not know about.
+func (m *Manager) Rotate(newSecret string) error {
+	newSecret = strings.TrimSpace(newSecret)
+	if newSecret == "" {
+		return errors.New("empty secret")
+	}
+	if err := m.swapSecret(newSecret, true); err != nil {
+		return err
+	}
+	m.logger.Printf("credentials: secret rotated by server")
+	return nil
+}
+
+// ObserveAuthStatus is wired to api.Client.SetAuthObserver. Repeated
+// credential rejections trigger a background re-enrollment; an accepted
+// request clears a failed state left by an earlier registration attempt.
+// Only 401s and 403s carrying the server's auth error code count: a 403 from
+// a relay or a policy check says nothing about the secret.
+func (m *Manager) ObserveAuthStatus(statusCode int, authError string) {
+	if statusCode < 300 {
+		m.authFailures.Store(0)
+		m.clearFailed()
+		return
+	}
+	if statusCode != http.StatusUnauthorized && (statusCode != http.StatusForbidden || authError == "") {
+		return
+	}
+	n := m.authFailures.Add(1)
+	if int(n) < m.failThreshold {
+		return
+	}
+	m.mu.RLock()
+	cooling := !m.lastReenroll.IsZero() && m.nowFn().Sub(m.lastReenroll) < m.cooldown
+	m.mu.RUnlock()
+	if cooling || !m.reenrolling.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer m.reenrolling.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		reason := fmt.Sprintf("auth_failed_%d", statusCode)
+		if err := m.Reenroll(ctx, reason); err != nil {
+			m.logger.Printf("credentials: re-enrollment failed: %v", err)
+		}
+	}()
+}
+
+// Reenroll registers the existing UUID again with the re-enroll token issued
+// at the previous registration (or a configured enrollment token) and replaces
+// the revoked secret with the one issued by the server.
+func (m *Manager) Reenroll(ctx context.Context, reason string) error {
+	m.mu.Lock()
+	m.lastReenroll = m.nowFn()
+	m.mu.Unlock()
+
+	m.logger.Printf("credentials: re-enrolling (%s)", reason)
+	if err := m.register(ctx, api.RegisterOptions{Reenroll: true, ReenrollReason: reason}); err != nil {
+		return err
+	}
+	m.authFailures.Store(0)
+	m.logger.Printf("credentials: re-enrollment succeeded")
+	return nil
+}
+
+func (m *Manager) register(ctx context.Context, opts api.RegisterOptions) error {
+	m.mu.RLock()
+	uuid, version := m.cfg.Agent.UUID, m.cfg.Agent.Version
+	opts.EnrollmentToken = m.cfg.Enrollment.Token
+	opts.Tags = append([]string(nil), m.cfg.Enrollment.Tags...)
+	opts.Groups = append([]string(nil), m.cfg.Enrollment.Groups...)
+	if opts.Reenroll {
+		opts.ReenrollToken = m.cfg.Agent.ReenrollToken
+	}
+	m.mu.RUnlock()
+
+	if opts.Reenroll && opts.ReenrollToken == "" && opts.EnrollmentToken == "" {
+		// The hardware fingerprint alone is replayable, so it is never offered
+		// as proof; an admin has to hand out a new enrollment token.
+		m.setFailed(errNoReenrollToken)
+		return errNoReenrollToken
+	}
+
+	opts.HardwareFingerprint = m.fingerprintFn()
+	resp, err := m.client.Register(ctx, uuid, version, system.CollectHostInfo(), opts)
+	if err != nil {
+		m.setFailed(err)
+		return err
+	}
+	if resp.SecretKey == "" {
+		err := errors.New("empty secret_key in register response")
+		m.setFailed(err)
+		return err
+	}
+
+	utils.RegisterSecret(resp.ReenrollToken)
+	m.mu.Lock()
+	// Tokens are single-use; drop it so it is not written back to config.yaml.
+	m.cfg.Enrollment.Token = ""
+	// The previous re-enroll token is invalidated by this registration.
+	m.cfg.Agent.ReenrollToken = resp.ReenrollToken
+	m.status = Status{
+		State:     StateRegistered,
+		Groups:    resp.Groups,
+		UpdatedAt: m.nowFn().UTC().Format(time.RFC3339),
+	}
+	m.initialConfig = mergeConfig(resp.Config, resp.Policy)
+	st := m.status
+	m.mu.Unlock()
+
+	m.saveStatus(st)
+	if len(resp.Groups) > 0 {
+		names := make([]string, 0, len(resp.Groups))
+		for _, g := range resp.Groups {
+			names = append(names, g.Name)
+		}
+		m.logger.Printf("enrollment: assigned groups: %s", strings.Join(names, ", "))
+	}
+	return m.swapSecret(resp.SecretKey, false)
+}
+
+func (m *Manager) setFailed(err error) {
+	code, msg := classifyError(err)
+	m.mu.Lock()
+	m.status = Status{
+		State:     StateFailed,
+		Code:      code,
+		Message:   msg,
+		Groups:    m.status.Groups,
+		UpdatedAt: m.nowFn().UTC().Format(time.RFC3339),
+	}
+	st := m.status
+	m.mu.Unlock()
+
+	m.logger.Printf("enrollment failed: code=%s: %s", code, msg)
+	m.saveStatus(st)
+}
+
+// clearFailed moves a failed state back to registered when a secret is in
+// use, e.g. after a transient registration error the server accepted the
+// existing credentials again.
+func (m *Manager) clearFailed() {
+	m.mu.RLock()
+	failed := m.status.State == StateFailed && m.cfg.Agent.SecretKey != ""
+	m.mu.RUnlock()
+	if !failed {
+		return
+	}
+	m.mu.Lock()
+	if m.status.State != StateFailed {
+		m.mu.Unlock()
+		return
+	}
+	m.status = Status{
+		State:     StateRegistered,
+		Groups:    m.status.Groups,
+		UpdatedAt: m.nowFn().UTC().Format(time.RFC3339),
+	}
+	st := m.status
+	m.mu.Unlock()
+
+	m.logger.Printf("enrollment: credentials accepted, failed state cleared")
+	m.saveStatus(st)
+}
+
+func (m *Manager) saveStatus(st Status) {
+	if err := SaveStatus(m.statePath, st); err != nil {
+		m.logger.Printf("enrollment: state not persisted: %v", err)
+	}
+}
+
+func mergeConfig(base, overlay map[string]any) map[string]any {
+	if len(base) == 0 && len(overlay) == 0 {
+		return nil
+	}
+	out := make(map[string]any, len(base)+len(overlay))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range overlay {
+		out[k] = v
+	}
+	return out
+}
+
+// SaveConfig applies fn to the manager's config and persists it to path, so
+// settings changed at runtime are saved together with the credentials in
+// effect and are not reverted by the next rotation.
+func (m *Manager) SaveConfig(path string, fn func(*config.Config)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(&m.cfg)
+	next := m.cfg
+	return config.Save(path, &next)
+}
+
+// swapSecret persists and activates secret. With mustPersist the in-memory
+// secret is left unchanged when saving fails, so a rotation can be rejected and
+// the server keeps accepting the old secret.
+func (m *Manager) swapSecret(secret string, mustPersist bool) error {
+	utils.RegisterSecret(secret)
+	m.mu.Lock()
+	next := m.cfg
+	next.Agent.SecretKey = secret
+	if err := config.Save(m.cfgPath, &next); err != nil {
+		if mustPersist {
+			m.mu.Unlock()
+			return fmt.Errorf("persist secret: %w", err)
+		}
+		// Registration already consumed the secret server-side; keep it in memory
+		// so the agent stays functional until the next successful save.
+		m.logger.Printf("warning: config not persisted: %v", err)
+	}
+	m.cfg.Agent.SecretKey = secret
+	listeners := append([]func(){}, m.onChange...)
+	m.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn()
+	}
+	return nil
+}
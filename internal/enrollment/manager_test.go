@@ -0,0 +1,251 @@
+package enrollment
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/system"
+)
+
+type fakeRegistrar struct {
+	calls  atomic.Int32
+	secret string
+	resp   *api.RegisterResponse
+	err    error
+	last   api.RegisterOptions
+}
+
+func (f *fakeRegistrar) Register(_ context.Context, _, _ string, _ system.HostInfo, opts api.RegisterOptions) (*api.RegisterResponse, error) {
+	f.calls.Add(1)
+	f.last = opts
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.resp != nil {
+		return f.resp, nil
+	}
+	return &api.RegisterResponse{Status: "ok", SecretKey: f.secret}, nil
+}
+
+func newTestManager(t *testing.T, reg Registrar, secret string) (*Manager, string) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Agent.UUID = "u1"
+	cfg.Agent.SecretKey = secret
+	dir := t.TempDir()
+	t.Setenv("APPCENTER_KEY_FILE", filepath.Join(dir, "secret.key"))
+	p := filepath.Join(dir, "config.yaml")
+	m := NewManager(reg, cfg, p, log.New(io.Discard, "", 0))
+	m.fingerprintFn = func() string { return "fp" }
+	m.statePath = filepath.Join(dir, "enrollment_state.json")
+	return m, p
+}
+
+func TestRotatePersistsSecret(t *testing.T) {
+	m, p := newTestManager(t, &fakeRegistrar{}, "old")
+	changed := 0
+	m.OnChange(func() { changed++ })
+
+	if err := m.Rotate("new"); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if _, secret := m.Current(); secret != "new" {
+		t.Fatalf("secret=%q, want new", secret)
+	}
+	loaded, err := config.Load(p)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if loaded.Agent.SecretKey != "new" {
+		t.Fatalf("persisted secret=%q, want new", loaded.Agent.SecretKey)
+	}
+	if changed != 1 {
+		t.Fatalf("OnChange called %d times, want 1", changed)
+	}
+}
+
+func TestRotateKeepsOldSecretWhenPersistFails(t *testing.T) {
+	m, _ := newTestManager(t, &fakeRegistrar{}, "old")
+	m.cfgPath = filepath.Join(t.TempDir(), "missing-dir", "config.yaml")
+
+	if err := m.Rotate("new"); err == nil {
+		t.Fatalf("expected persist error")
+	}
+	if _, secret := m.Current(); secret != "old" {
+		t.Fatalf("secret=%q, want old", secret)
+	}
+}
+
+func TestRepeatedAuthFailuresTriggerReenroll(t *testing.T) {
+	reg := &fakeRegistrar{resp: &api.RegisterResponse{Status: "ok", SecretKey: "fresh", ReenrollToken: "rt-2"}}
+	m, p := newTestManager(t, reg, "revoked")
+	m.cfg.Agent.ReenrollToken = "rt-1"
+
+	m.ObserveAuthStatus(http.StatusUnauthorized, "")
+	m.ObserveAuthStatus(http.StatusOK, "")
+	m.ObserveAuthStatus(http.StatusUnauthorized, "")
+	// A relay or policy 403 does not count; one with the auth error code does.
+	m.ObserveAuthStatus(http.StatusForbidden, "")
+	m.ObserveAuthStatus(http.StatusForbidden, "")
+	m.ObserveAuthStatus(http.StatusForbidden, "revoked")
+	if reg.calls.Load() != 0 {
+		t.Fatalf("re-enrolled before threshold")
+	}
+	m.ObserveAuthStatus(http.StatusUnauthorized, "")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for reg.calls.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for m.reenrolling.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reg.calls.Load() != 1 {
+		t.Fatalf("register calls=%d, want 1", reg.calls.Load())
+	}
+	if !reg.last.Reenroll || reg.last.ReenrollToken != "rt-1" || reg.last.HardwareFingerprint != "fp" {
+		t.Fatalf("unexpected register options: %+v", reg.last)
+	}
+	if _, secret := m.Current(); secret != "fresh" {
+		t.Fatalf("secret=%q, want fresh", secret)
+	}
+	loaded, err := config.Load(p)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if loaded.Agent.ReenrollToken != "rt-2" || loaded.Agent.ProtectedReenrollToken == "" {
+		t.Fatalf("re-enroll token not persisted sealed: %+v", loaded.Agent)
+	}
+
+	// Cooldown prevents an immediate second attempt.
+	for i := 0; i < 5; i++ {
+		m.ObserveAuthStatus(http.StatusUnauthorized, "")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if reg.calls.Load() != 1 {
+		t.Fatalf("register calls=%d after cooldown, want 1", reg.calls.Load())
+	}
+}
+
+func TestReenrollWithoutTokenFails(t *testing.T) {
+	reg := &fakeRegistrar{secret: "fresh"}
+	m, _ := newTestManager(t, reg, "revoked")
+
+	if err := m.Reenroll(context.Background(), "test"); err == nil {
+		t.Fatalf("expected error without a re-enroll token")
+	}
+	if reg.calls.Load() != 0 {
+		t.Fatalf("register called with only the hardware fingerprint as proof")
+	}
+	if st := m.Status(); st.State != StateFailed || st.Code != CodeNoReenroll {
+		t.Fatalf("status=%+v, want failed/%s", st, CodeNoReenroll)
+	}
+	if _, secret := m.Current(); secret != "revoked" {
+		t.Fatalf("secret=%q, want revoked", secret)
+	}
+}
+
+func TestBootstrapWithEnrollmentToken(t *testing.T) {
+	reg := &fakeRegistrar{resp: &api.RegisterResponse{
+		Status:    "ok",
+		SecretKey: "issued",
+		Groups:    []api.GroupAssignment{{ID: 4, Name: "Finance"}},
+		Policy:    map[string]any{"store_tray_enabled": true},
+	}}
+	m, p := newTestManager(t, reg, "")
+	m.cfg.Enrollment = config.EnrollmentConfig{Token: "tok-1", Tags: []string{"branch-a"}, Groups: []string{"finance"}}
+
+	if err := m.Bootstrap(context.Background()); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	if reg.last.EnrollmentToken != "tok-1" || len(reg.last.Tags) != 1 || reg.last.Groups[0] != "finance" {
+		t.Fatalf("unexpected register options: %+v", reg.last)
+	}
+	st := m.Status()
+	if st.State != StateRegistered || len(st.Groups) != 1 || st.Groups[0].Name != "Finance" {
+		t.Fatalf("unexpected status: %+v", st)
+	}
+	if initial := m.TakeInitialConfig(); initial["store_tray_enabled"] != true {
+		t.Fatalf("initial policy not exposed: %#v", initial)
+	}
+	if m.TakeInitialConfig() != nil {
+		t.Fatalf("initial config must be returned once")
+	}
+	loaded, err := config.Load(p)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if loaded.Enrollment.Token != "" || loaded.Agent.SecretKey != "issued" {
+		t.Fatalf("token must be cleared and secret persisted: %+v", loaded.Enrollment)
+	}
+}
+
+func TestBootstrapExpiredTokenSetsFailedState(t *testing.T) {
+	reg := &fakeRegistrar{err: &api.HTTPError{
+		StatusCode: http.StatusForbidden,
+		Status:     "403 Forbidden",
+		Detail:     "enrollment token expired",
+		Code:       "enrollment_token_expired",
+	}}
+	m, _ := newTestManager(t, reg, "")
+	m.cfg.Enrollment.Token = "old-token"
+
+	if err := m.Bootstrap(context.Background()); err == nil {
+		t.Fatalf("expected error")
+	}
+	st := m.Status()
+	if st.State != StateFailed || st.Code != CodeTokenExpired || st.Message != "enrollment token expired" {
+		t.Fatalf("unexpected status: %+v", st)
+	}
+	persisted, err := LoadStatus(m.statePath)
+	if err != nil || persisted.Code != CodeTokenExpired {
+		t.Fatalf("persisted status=%+v err=%v", persisted, err)
+	}
+}
+
+func TestFailedStateClearsAfterAcceptedRequest(t *testing.T) {
+	reg := &fakeRegistrar{err: errors.New("connection refused")}
+	m, _ := newTestManager(t, reg, "revoked")
+	m.cfg.Agent.ReenrollToken = "rt-1"
+
+	if err := m.Reenroll(context.Background(), "test"); err == nil {
+		t.Fatalf("expected error")
+	}
+	if st := m.Status(); st.State != StateFailed || st.Code != CodeUnreachable {
+		t.Fatalf("status=%+v, want failed/%s", st, CodeUnreachable)
+	}
+
+	m.ObserveAuthStatus(http.StatusUnauthorized, "")
+	if st := m.Status(); st.State != StateFailed {
+		t.Fatalf("rejected request cleared failed state: %+v", st)
+	}
+	m.ObserveAuthStatus(http.StatusOK, "")
+	if st := m.Status(); st.State != StateRegistered {
+		t.Fatalf("status=%+v, want registered", st)
+	}
+	persisted, err := LoadStatus(m.statePath)
+	if err != nil || persisted.State != StateRegistered {
+		t.Fatalf("persisted status=%+v err=%v", persisted, err)
+	}
+}
+
+func TestBootstrapWithSecretClearsFailedState(t *testing.T) {
+	m, _ := newTestManager(t, &fakeRegistrar{}, "secret-1")
+	m.setFailed(errors.New("connection refused"))
+
+	if err := m.Bootstrap(context.Background()); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	if st := m.Status(); st.State != StateRegistered {
+		t.Fatalf("status=%+v, want registered", st)
+	}
+}
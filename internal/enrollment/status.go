@@ -0,0 +1,103 @@
+package enrollment
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"appcenter-agent/internal/api"
+)
+
+const (
+	StateUnregistered = "unregistered"
+	StateRegistered   = "registered"
+	StateFailed       = "failed"
+
+	CodeTokenInvalid = "enrollment_token_invalid"
+	CodeTokenExpired = "enrollment_token_expired"
+	CodeRejected     = "registration_rejected"
+	CodeUnreachable  = "server_unreachable"
+	CodeNoReenroll   = "reenroll_token_missing"
+)
+
+// errNoReenrollToken is returned when re-enrollment is needed but the server
+// never issued a re-enroll token and no enrollment token is configured.
+var errNoReenrollToken = errors.New("no re-enroll token; a new enrollment token is required")
+
+// Status is the enrollment state exposed via IPC so the tray can tell the user
+// why the agent is not registered.
+type Status struct {
+	State     string                `json:"state"`
+	Code      string                `json:"code,omitempty"`
+	Message   string                `json:"message,omitempty"`
+	Groups    []api.GroupAssignment `json:"groups,omitempty"`
+	UpdatedAt string                `json:"updated_at,omitempty"`
+}
+
+func DefaultStatePath() string {
+	if runtime.GOOS == "windows" {
+		return `C:\ProgramData\AppCenter\enrollment_state.json`
+	}
+	return "enrollment_state.json"
+}
+
+func LoadStatus(path string) (Status, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Status{}, err
+	}
+	var st Status
+	if err := json.Unmarshal(b, &st); err != nil {
+		return Status{}, err
+	}
+	return st, nil
+}
+
+func SaveStatus(path string, st Status) error {
+	if dir := filepath.Dir(path); dir != "" && dir != "." {
+		_ = os.MkdirAll(dir, 0o755)
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o600)
+}
+
+// classifyError maps a registration error to a stable code and message.
+func classifyError(err error) (string, string) {
+	if errors.Is(err, errNoReenrollToken) {
+		return CodeNoReenroll, err.Error()
+	}
+	var httpErr *api.HTTPError
+	if !errors.As(err, &httpErr) {
+		return CodeUnreachable, err.Error()
+	}
+	msg := httpErr.Detail
+	if msg == "" {
+		msg = httpErr.Status
+	}
+	code := strings.ToLower(httpErr.Code)
+	switch {
+	case code == CodeTokenExpired || strings.Contains(code, "expired"):
+		return CodeTokenExpired, msg
+	case code == CodeTokenInvalid || strings.Contains(code, "token"):
+		return CodeTokenInvalid, msg
+	case code != "":
+		return code, msg
+	}
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lower, "token") && strings.Contains(lower, "expired"):
+		return CodeTokenExpired, msg
+	case strings.Contains(lower, "token"):
+		return CodeTokenInvalid, msg
+	case httpErr.StatusCode >= http.StatusInternalServerError:
+		return CodeUnreachable, msg
+	}
+	return CodeRejected, msg
+}
@@ -12,7 +12,9 @@ import (
 	"time"
 
 	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/clock"
 	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/resilience"
 	"appcenter-agent/internal/system"
 )
 
@@ -20,6 +22,13 @@ type InstalledAppsProvider interface {
 	ConsumeAppsChanged() (bool, []api.InstalledApp)
 }
 
+// CatalogRulesProvider is optionally implemented by an InstalledAppsProvider
+// that maps the inventory to catalog apps; the rule set version is reported
+// with the heartbeat.
+type CatalogRulesProvider interface {
+	CatalogRulesVersion() string
+}
+
 // InventoryHashProvider returns the current inventory hash for inclusion in heartbeat.
 type InventoryHashProvider interface {
 	GetCurrentHash() string
@@ -43,6 +52,7 @@ type PollResult struct {
 type Sender struct {
 	client            *api.Client
 	cfg               *config.Config
+	creds             api.CredentialProvider
 	logger            *log.Logger
 	resultsCh         chan<- PollResult
 	installedProvider InstalledAppsProvider
@@ -69,6 +79,7 @@ func NewSender(
 	installedProvider InstalledAppsProvider,
 	inventoryProvider InventoryHashProvider,
 	remoteProvider RemoteSupportProvider,
+	creds api.CredentialProvider,
 ) *Sender {
 	statePath := system.DefaultSystemProfileStatePath()
 	lastSent := time.Time{}
@@ -82,6 +93,7 @@ func NewSender(
 	return &Sender{
 		client:              client,
 		cfg:                 cfg,
+		creds:               creds,
 		logger:              logger,
 		resultsCh:           resultsCh,
 		installedProvider:   installedProvider,
@@ -97,6 +109,13 @@ func NewSender(
 	}
 }
 
+func (s *Sender) credentials() (string, string) {
+	if s.creds != nil {
+		return s.creds.Current()
+	}
+	return s.cfg.Agent.UUID, s.cfg.Agent.SecretKey
+}
+
 func (s *Sender) TriggerNow() {
 	select {
 	case s.triggerCh <- struct{}{}:
@@ -109,10 +128,12 @@ func (s *Sender) SetWSActive(active bool) {
 }
 
 func (s *Sender) Start(ctx context.Context) {
-	ticker := time.NewTicker(time.Duration(s.cfg.Heartbeat.IntervalSec) * time.Second)
+	base := time.Duration(s.cfg.Heartbeat.IntervalSec) * time.Second
+	ticker := time.NewTicker(base)
 	defer ticker.Stop()
 
 	s.sendOnce(ctx, false)
+	interval := base
 
 	for {
 		select {
@@ -127,11 +148,27 @@ func (s *Sender) Start(ctx context.Context) {
 		case <-s.triggerCh:
 			s.logger.Println("heartbeat triggered by signal")
 			s.sendOnce(ctx, false)
-			ticker.Reset(time.Duration(s.cfg.Heartbeat.IntervalSec) * time.Second)
 		}
+		next := s.nextInterval(base)
+		if next != interval {
+			s.logger.Printf("heartbeat interval %v (base %v)", next, base)
+			interval = next
+		}
+		ticker.Reset(interval)
 	}
 }
 
+// nextInterval stretches base while the server reports pressure and never
+// schedules the next heartbeat before a server-directed pause ends.
+func (s *Sender) nextInterval(base time.Duration) time.Duration {
+	b := s.client.Breakers()
+	next := b.Stretch(base)
+	if wait := b.Wait(resilience.ClassHeartbeat); wait > next {
+		next = wait.Round(time.Second) + time.Second
+	}
+	return next
+}
+
 func hashSystemProfile(p system.SystemProfile) string {
 	b, _ := json.Marshal(p)
 	sum := sha256.Sum256(b)
@@ -286,6 +323,13 @@ func (s *Sender) sendOnce(ctx context.Context, appsChanged bool) {
 		AppsChanged:   appsChanged,
 		InstalledApps: installedApps,
 	}
+	req.ServerEndpoint = s.client.BaseURL()
+	if st := clock.Default().Status(); st.Samples > 0 {
+		req.Clock = &st
+	}
+	if p, ok := s.installedProvider.(CatalogRulesProvider); ok {
+		req.CatalogRulesVersion = p.CatalogRulesVersion()
+	}
 
 	if s.inventoryProvider != nil {
 		req.InventoryHash = s.inventoryProvider.GetCurrentHash()
@@ -309,16 +353,25 @@ func (s *Sender) sendOnce(ctx context.Context, appsChanged bool) {
 		req.RemoteSupport = s.remoteProvider.CurrentRemoteSupportStatus()
 	}
 
-	resp, err := s.client.Heartbeat(ctx, s.cfg.Agent.UUID, s.cfg.Agent.SecretKey, req)
+	agentUUID, secret := s.credentials()
+	sent := time.Now()
+	resp, err := s.client.Heartbeat(ctx, agentUUID, secret, req)
 	if err != nil {
 		s.logger.Printf("heartbeat error: %v", err)
 		return
 	}
+	received := time.Now()
 
 	s.logger.Printf("heartbeat ok: status=%s commands=%d", resp.Status, len(resp.Commands))
-	serverTime := time.Now().UTC()
+	serverTime := clock.Now().UTC()
 	if parsed, err := time.Parse(time.RFC3339, resp.ServerTime); err == nil {
 		serverTime = parsed.UTC()
+		// server_time may carry sub-second precision, unlike the Date header.
+		resolution := time.Second
+		if parsed.Nanosecond() != 0 {
+			resolution = time.Millisecond
+		}
+		clock.Default().Observe(sent, received, parsed, resolution)
 	}
 
 	inventorySyncRequired := false
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/resilience"
 )
 
 const (
@@ -16,29 +17,26 @@ const (
 )
 
 type SignalListener struct {
-	client    *api.Client
-	agentUUID string
-	secretKey string
-	logger    *log.Logger
-	onSignal  func()
-	wsActive  *atomic.Bool
+	client   *api.Client
+	creds    api.CredentialProvider
+	logger   *log.Logger
+	onSignal func()
+	wsActive *atomic.Bool
 }
 
 func NewSignalListener(
 	client *api.Client,
-	agentUUID string,
-	secretKey string,
+	creds api.CredentialProvider,
 	logger *log.Logger,
 	onSignal func(),
 	wsActive *atomic.Bool,
 ) *SignalListener {
 	return &SignalListener{
-		client:    client,
-		agentUUID: agentUUID,
-		secretKey: secretKey,
-		logger:    logger,
-		onSignal:  onSignal,
-		wsActive:  wsActive,
+		client:   client,
+		creds:    creds,
+		logger:   logger,
+		onSignal: onSignal,
+		wsActive: wsActive,
 	}
 }
 
@@ -58,17 +56,19 @@ func (sl *SignalListener) Start(ctx context.Context) {
 			continue
 		}
 
-		resp, err := sl.client.WaitForSignal(ctx, sl.agentUUID, sl.secretKey, signalPollTimeoutSec)
+		agentUUID, secret := sl.creds.Current()
+		resp, err := sl.client.WaitForSignal(ctx, agentUUID, secret, signalPollTimeoutSec)
 		if err != nil {
 			if ctx.Err() != nil {
 				sl.logger.Println("signal listener stopped")
 				return
 			}
-			sl.logger.Printf("signal poll error (retry in %v): %v", backoff, err)
+			wait := max(backoff, sl.client.Breakers().Wait(resilience.ClassSignal))
+			sl.logger.Printf("signal poll error (retry in %v): %v", wait, err)
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(backoff):
+			case <-time.After(wait):
 			}
 			backoff *= 2
 			if backoff > signalBackoffMax {
@@ -0,0 +1,382 @@
+package inventory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/version"
+)
+
+// Catalog match methods, strongest first.
+const (
+	MatchProductCode = "product_code"
+	MatchName        = "name"
+)
+
+// CatalogRule tells how a store catalog app shows up in the scanned
+// inventory. Patterns are case-insensitive regular expressions; a rule needs
+// ProductCodes, NamePattern or both.
+type CatalogRule struct {
+	AppID            int      `json:"app_id"`
+	NamePattern      string   `json:"name_pattern,omitempty"`
+	PublisherPattern string   `json:"publisher_pattern,omitempty"`
+	ProductCodes     []string `json:"product_codes,omitempty"`
+	Architecture     string   `json:"architecture,omitempty"`
+	// VersionPattern extracts the version from VersionSource ("version",
+	// the default, or "name"): the first capture group, or the whole match.
+	VersionPattern string `json:"version_pattern,omitempty"`
+	VersionSource  string `json:"version_source,omitempty"`
+}
+
+// CatalogRules is the rule set served by GET /api/v1/agent/catalog-rules.
+type CatalogRules struct {
+	Version string        `json:"version"`
+	Rules   []CatalogRule `json:"rules"`
+}
+
+// CatalogMatch is a catalog app found in the inventory.
+type CatalogMatch struct {
+	AppID   int    `json:"app_id"`
+	Version string `json:"version"`
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	Method  string `json:"method"`
+}
+
+type catalogState struct {
+	RulesVersion string         `json:"rules_version"`
+	Rules        []CatalogRule  `json:"rules"`
+	Apps         []CatalogMatch `json:"apps"`
+	MappedAt     time.Time      `json:"mapped_at"`
+}
+
+type compiledRule struct {
+	CatalogRule
+	name      *regexp.Regexp
+	publisher *regexp.Regexp
+	version   *regexp.Regexp
+	codes     map[string]bool
+}
+
+// Catalog maps scanned software to store catalog apps using server rules.
+// Rules and the last mapping are persisted, so installed apps can be
+// reported right after a restart. A nil *Catalog maps nothing.
+type Catalog struct {
+	mu       sync.Mutex
+	path     string
+	state    catalogState
+	rules    []compiledRule
+	covered  map[int]bool
+	changed  bool
+	reported bool
+	onChange []func()
+}
+
+// DefaultCatalogPath returns the catalog mapping location.
+func DefaultCatalogPath() string {
+	if runtime.GOOS == "windows" {
+		return `C:\ProgramData\AppCenter\catalog_map.json`
+	}
+	return "catalog_map.json"
+}
+
+// OpenCatalog loads the persisted rules and mapping from path.
+func OpenCatalog(path string) (*Catalog, error) {
+	c := &Catalog{path: path}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.state); err != nil {
+		return nil, fmt.Errorf("catalog map %s: %w", path, err)
+	}
+	// Stored rules were valid when saved; anything failing now is dropped.
+	c.rules, _ = compileRules(c.state.Rules)
+	c.covered = coveredApps(c.rules)
+	return c, nil
+}
+
+// RulesVersion returns the version of the rules in use ("" if none).
+func (c *Catalog) RulesVersion() string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state.RulesVersion
+}
+
+// SetRules replaces the rules. Invalid rules are skipped and reported in the
+// returned error; the valid ones still take effect. Call Map afterwards to
+// apply them to the current inventory.
+func (c *Catalog) SetRules(rs CatalogRules) error {
+	if c == nil {
+		return nil
+	}
+	rules, invalid := compileRules(rs.Rules)
+	kept := make([]CatalogRule, 0, len(rules))
+	for _, r := range rules {
+		kept = append(kept, r.CatalogRule)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = rules
+	c.covered = coveredApps(rules)
+	c.state.RulesVersion = rs.Version
+	c.state.Rules = kept
+	return errors.Join(invalid, c.saveLocked())
+}
+
+// Map matches items against the rules and stores the result. It reports
+// whether the set of installed catalog apps changed. An empty scan is taken
+// as a failed one and ignored.
+func (c *Catalog) Map(items []SoftwareItem) (bool, error) {
+	if c == nil || len(items) == 0 {
+		return false, nil
+	}
+	c.mu.Lock()
+	if len(c.rules) == 0 && len(c.state.Apps) == 0 {
+		// Without rules there is nothing to report beyond what tasks report.
+		c.mu.Unlock()
+		return false, nil
+	}
+	apps := matchCatalog(c.rules, items)
+	if slices.Equal(apps, c.state.Apps) && c.reported {
+		c.mu.Unlock()
+		return false, nil
+	}
+	// The first mapping after a start is always reported, in case the last
+	// report before the restart never reached the server.
+	c.reported = true
+	c.changed = true
+	c.state.Apps = apps
+	c.state.MappedAt = time.Now().UTC()
+	err := c.saveLocked()
+	listeners := slices.Clone(c.onChange)
+	c.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn()
+	}
+	return true, err
+}
+
+// OnChange registers fn to be called after the mapping changed. fn runs
+// with the inventory manager locked and must not block.
+func (c *Catalog) OnChange(fn func()) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onChange = append(c.onChange, fn)
+}
+
+// Apps returns the installed catalog apps, ordered by app ID.
+func (c *Catalog) Apps() []CatalogMatch {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.state.Apps)
+}
+
+// Covers reports whether some rule describes appID, i.e. whether the
+// mapping is authoritative for it.
+func (c *Catalog) Covers(appID int) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.covered[appID]
+}
+
+// ConsumeChanged reports whether the mapping changed since the last call.
+func (c *Catalog) ConsumeChanged() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := c.changed
+	c.changed = false
+	return changed
+}
+
+func (c *Catalog) saveLocked() error {
+	b, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func compileRules(rules []CatalogRule) ([]compiledRule, error) {
+	var out []compiledRule
+	var errs []error
+	for i, r := range rules {
+		cr, err := compileRule(r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("catalog rule %d (app %d): %w", i, r.AppID, err))
+			continue
+		}
+		out = append(out, cr)
+	}
+	return out, errors.Join(errs...)
+}
+
+func compileRule(r CatalogRule) (compiledRule, error) {
+	cr := compiledRule{CatalogRule: r}
+	if r.AppID <= 0 {
+		return cr, errors.New("missing app_id")
+	}
+	if r.NamePattern == "" && len(r.ProductCodes) == 0 {
+		return cr, errors.New("needs name_pattern or product_codes")
+	}
+	switch r.VersionSource {
+	case "", "version", "name":
+	default:
+		return cr, fmt.Errorf("unknown version_source %q", r.VersionSource)
+	}
+	var err error
+	for _, p := range []struct {
+		pattern string
+		re      **regexp.Regexp
+	}{
+		{r.NamePattern, &cr.name},
+		{r.PublisherPattern, &cr.publisher},
+		{r.VersionPattern, &cr.version},
+	} {
+		if p.pattern == "" {
+			continue
+		}
+		if *p.re, err = regexp.Compile("(?i)" + p.pattern); err != nil {
+			return cr, err
+		}
+	}
+	if len(r.ProductCodes) > 0 {
+		cr.codes = make(map[string]bool, len(r.ProductCodes))
+		for _, code := range r.ProductCodes {
+			cr.codes[normalizeProductCode(code)] = true
+		}
+	}
+	return cr, nil
+}
+
+func coveredApps(rules []compiledRule) map[int]bool {
+	out := make(map[int]bool, len(rules))
+	for _, r := range rules {
+		out[r.AppID] = true
+	}
+	return out
+}
+
+// normalizeProductCode upper-cases an MSI product code and adds the braces.
+func normalizeProductCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code != "" && !strings.HasPrefix(code, "{") {
+		code = "{" + code + "}"
+	}
+	return code
+}
+
+// match returns how item matches the rule, or "".
+func (r *compiledRule) match(item SoftwareItem) string {
+	if r.codes != nil && item.ProductCode != "" && r.codes[normalizeProductCode(item.ProductCode)] {
+		return MatchProductCode
+	}
+	if r.name == nil || !r.name.MatchString(item.Name) {
+		return ""
+	}
+	if r.publisher != nil && !r.publisher.MatchString(item.Publisher) {
+		return ""
+	}
+	if r.Architecture != "" && !strings.EqualFold(r.Architecture, item.Architecture) {
+		return ""
+	}
+	return MatchName
+}
+
+// extractVersion applies the rule's version pattern, falling back to the
+// item's own version when it does not match.
+func (r *compiledRule) extractVersion(item SoftwareItem) string {
+	if r.version == nil {
+		return item.Version
+	}
+	src := item.Version
+	if r.VersionSource == "name" {
+		src = item.Name
+	}
+	m := r.version.FindStringSubmatch(src)
+	switch {
+	case len(m) > 1 && m[1] != "":
+		return m[1]
+	case len(m) == 1:
+		return m[0]
+	}
+	return item.Version
+}
+
+// matchCatalog returns at most one match per app: a product code match wins
+// over a name match, then the highest version (side-by-side installs report
+// the newest), then the lowest item key so the result does not depend on scan
+// order.
+func matchCatalog(rules []compiledRule, items []SoftwareItem) []CatalogMatch {
+	if len(rules) == 0 {
+		return nil
+	}
+	best := make(map[int]CatalogMatch)
+	for key, item := range keyItems(items) {
+		for i := range rules {
+			r := &rules[i]
+			method := r.match(item)
+			if method == "" {
+				continue
+			}
+			m := CatalogMatch{AppID: r.AppID, Version: r.extractVersion(item), Name: item.Name, Key: key, Method: method}
+			if cur, ok := best[r.AppID]; ok && !betterMatch(m, cur) {
+				continue
+			}
+			best[r.AppID] = m
+		}
+	}
+	out := make([]CatalogMatch, 0, len(best))
+	for _, m := range best {
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].AppID < out[j].AppID })
+	return out
+}
+
+func betterMatch(a, b CatalogMatch) bool {
+	if a.Method != b.Method {
+		return a.Method == MatchProductCode
+	}
+	if c := version.Compare(a.Version, b.Version); c != 0 {
+		return c > 0
+	}
+	return a.Key < b.Key
+}
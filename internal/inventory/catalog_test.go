@@ -0,0 +1,93 @@
+package inventory
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCatalogMatchesRules(t *testing.T) {
+	c, err := OpenCatalog(filepath.Join(t.TempDir(), "catalog.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SetRules(CatalogRules{Version: "v1", Rules: []CatalogRule{
+		{AppID: 1, NamePattern: `^7-Zip\b`, PublisherPattern: "Igor Pavlov", VersionPattern: `^(\d+\.\d+)`},
+		{AppID: 2, NamePattern: `^Google Chrome$`, ProductCodes: []string{"e4f8b3a2-1c4d-4b5e-9f60-0a1b2c3d4e5f"}},
+		{AppID: 3, NamePattern: `^Notepad\+\+`, VersionSource: "name", VersionPattern: `v(\d+(\.\d+)*)`, Architecture: "x64"},
+		{AppID: 4, NamePattern: `^VLC`},
+		{AppID: 5, NamePattern: `(`},
+		{AppID: 6},
+	}})
+	if err == nil {
+		t.Fatal("invalid rules were not reported")
+	}
+
+	items := []SoftwareItem{
+		{Name: "7-Zip 23.01 (x64)", Version: "23.01.00.0", Publisher: "Igor Pavlov"},
+		{Name: "7-Zip Helper", Version: "1.0", Publisher: "Someone Else"},
+		{Name: "Google Chrome", Version: "124.0"},
+		{Name: "Chrome Enterprise", Version: "125.0.6422.60", ProductCode: "{E4F8B3A2-1C4D-4B5E-9F60-0A1B2C3D4E5F}"},
+		{Name: "Notepad++ v8.6.4 (64-bit)", Version: "", Architecture: "x64"},
+		{Name: "Notepad++ v8.5", Version: "8.5", Architecture: "x86"},
+		// Side-by-side install: the older one sorts first by key.
+		{Name: "7-Zip 19.00", Version: "19.00", Publisher: "Igor Pavlov"},
+	}
+	changed, err := c.Map(items)
+	if err != nil || !changed {
+		t.Fatalf("Map = %v, %v", changed, err)
+	}
+	want := []CatalogMatch{
+		{AppID: 1, Version: "23.01", Name: "7-Zip 23.01 (x64)", Key: "7-zip 23.01 (x64)|", Method: MatchName},
+		{AppID: 2, Version: "125.0.6422.60", Name: "Chrome Enterprise", Key: "chrome enterprise|", Method: MatchProductCode},
+		{AppID: 3, Version: "8.6.4", Name: "Notepad++ v8.6.4 (64-bit)", Key: "notepad++ v8.6.4 (64-bit)|x64", Method: MatchName},
+	}
+	if got := c.Apps(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("apps =\n%+v\nwant\n%+v", got, want)
+	}
+	if !c.Covers(4) || c.Covers(5) || c.Covers(6) {
+		t.Fatal("covered apps do not follow the valid rules")
+	}
+	if !c.ConsumeChanged() || c.ConsumeChanged() {
+		t.Fatal("change flag not consumed once")
+	}
+	if changed, _ := c.Map(items); changed {
+		t.Fatal("unchanged mapping reported as changed")
+	}
+}
+
+func TestCatalogPersistsAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	c, err := OpenCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := c.Map([]SoftwareItem{{Name: "VLC media player", Version: "3.0.20"}}); changed {
+		t.Fatal("mapping without rules reported a change")
+	}
+	if err := c.SetRules(CatalogRules{Version: "v7", Rules: []CatalogRule{{AppID: 4, NamePattern: `^vlc`}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Map([]SoftwareItem{{Name: "VLC media player", Version: "3.0.20"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = OpenCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RulesVersion() != "v7" || !c.Covers(4) {
+		t.Fatalf("rules not restored: version %q", c.RulesVersion())
+	}
+	if apps := c.Apps(); len(apps) != 1 || apps[0].AppID != 4 || apps[0].Version != "3.0.20" {
+		t.Fatalf("apps = %+v", apps)
+	}
+	// The first mapping after a restart is reported even if unchanged;
+	// removals are reported as a change.
+	if changed, _ := c.Map([]SoftwareItem{{Name: "VLC media player", Version: "3.0.20"}}); !changed {
+		t.Fatal("first mapping after restart not reported")
+	}
+	if changed, _ := c.Map([]SoftwareItem{{Name: "Firefox", Version: "126.0"}}); !changed || len(c.Apps()) != 0 {
+		t.Fatalf("removal not reported: %+v", c.Apps())
+	}
+}
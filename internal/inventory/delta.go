@@ -0,0 +1,125 @@
+package inventory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Submission modes.
+const (
+	ModeFull  = "full"
+	ModeDelta = "delta"
+)
+
+// ErrBaseMismatch is returned by a SubmitFunc when the server does not hold
+// the base snapshot a delta was computed against. The manager then falls
+// back to a full upload.
+var ErrBaseMismatch = errors.New("inventory base mismatch")
+
+// KeyedItem is an item in a delta, with the identity it is tracked under.
+type KeyedItem struct {
+	Key string `json:"key"`
+	SoftwareItem
+}
+
+// snapshot is the last inventory the server acknowledged. It is kept on disk
+// so deltas continue across restarts instead of every agent re-uploading its
+// full list after a reboot.
+type snapshot struct {
+	Hash         string         `json:"hash"`
+	AcceptsDelta bool           `json:"accepts_delta"`
+	AckedAt      time.Time      `json:"acked_at"`
+	Items        []SoftwareItem `json:"items"`
+}
+
+// DefaultSnapshotPath is where the acknowledged snapshot is stored.
+func DefaultSnapshotPath() string {
+	if runtime.GOOS == "windows" {
+		return `C:\ProgramData\AppCenter\inventory_snapshot.json`
+	}
+	return "inventory_snapshot.json"
+}
+
+func loadSnapshot(path string) (*snapshot, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("inventory snapshot %s: %w", path, err)
+	}
+	// A snapshot whose items do not match its hash cannot be a delta base.
+	if s.Hash == "" || computeHash(s.Items) != s.Hash {
+		return nil, fmt.Errorf("inventory snapshot %s: hash mismatch", path)
+	}
+	return &s, nil
+}
+
+func saveSnapshot(path string, s *snapshot) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// itemKey is the stable identity of an item: lower-cased name and
+// architecture. Items sharing it (e.g. several kernel versions) are told
+// apart by version.
+func itemKey(item SoftwareItem) string {
+	return strings.ToLower(item.Name) + "|" + strings.ToLower(item.Architecture)
+}
+
+func keyItems(items []SoftwareItem) map[string]SoftwareItem {
+	count := make(map[string]int, len(items))
+	for _, item := range items {
+		count[itemKey(item)]++
+	}
+	out := make(map[string]SoftwareItem, len(items))
+	for _, item := range items {
+		key := itemKey(item)
+		if count[key] > 1 {
+			key += "|" + item.Version
+		}
+		out[key] = item
+	}
+	return out
+}
+
+// diffItems returns what changed from base to current, sorted by key.
+func diffItems(base, current []SoftwareItem) (added, changed, removed []KeyedItem) {
+	before, after := keyItems(base), keyItems(current)
+	for key, item := range after {
+		old, ok := before[key]
+		switch {
+		case !ok:
+			added = append(added, KeyedItem{Key: key, SoftwareItem: item})
+		case old != item:
+			changed = append(changed, KeyedItem{Key: key, SoftwareItem: item})
+		}
+	}
+	for key, item := range before {
+		if _, ok := after[key]; !ok {
+			removed = append(removed, KeyedItem{Key: key, SoftwareItem: item})
+		}
+	}
+	for _, list := range [][]KeyedItem{added, changed, removed} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	}
+	return added, changed, removed
+}
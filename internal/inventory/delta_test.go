@@ -0,0 +1,121 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testManager(t *testing.T, path string, items []SoftwareItem) *Manager {
+	t.Helper()
+	m := NewManager(log.New(io.Discard, "", 0))
+	m.LoadSnapshot(path)
+	m.lastItems = items
+	m.lastHash = computeHash(items)
+	return m
+}
+
+func TestDiffItems(t *testing.T) {
+	base := []SoftwareItem{
+		{Name: "bash", Version: "5.1", Architecture: "amd64"},
+		{Name: "curl", Version: "7.88", Architecture: "amd64"},
+		{Name: "linux-image", Version: "6.1.0-17", Architecture: "amd64"},
+		{Name: "linux-image", Version: "6.1.0-18", Architecture: "amd64"},
+	}
+	current := []SoftwareItem{
+		{Name: "bash", Version: "5.2", Architecture: "amd64"},
+		{Name: "linux-image", Version: "6.1.0-18", Architecture: "amd64"},
+		{Name: "linux-image", Version: "6.1.0-19", Architecture: "amd64"},
+		{Name: "vim", Version: "9.0", Architecture: "amd64"},
+	}
+	added, changed, removed := diffItems(base, current)
+	keys := func(list []KeyedItem) []string {
+		var out []string
+		for _, k := range list {
+			out = append(out, k.Key)
+		}
+		return out
+	}
+	if got := keys(added); !reflect.DeepEqual(got, []string{"linux-image|amd64|6.1.0-19", "vim|amd64"}) {
+		t.Errorf("added = %v", got)
+	}
+	if got := keys(changed); !reflect.DeepEqual(got, []string{"bash|amd64"}) || changed[0].Version != "5.2" {
+		t.Errorf("changed = %+v", changed)
+	}
+	if got := keys(removed); !reflect.DeepEqual(got, []string{"curl|amd64", "linux-image|amd64|6.1.0-17"}) {
+		t.Errorf("removed = %v", got)
+	}
+}
+
+func TestSyncSendsDeltaAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	v1 := []SoftwareItem{{Name: "bash", Version: "5.1"}, {Name: "curl", Version: "7.88"}}
+
+	var sent []SubmitRequest
+	submit := func(_ context.Context, p SubmitRequest) (*SubmitResponse, error) {
+		sent = append(sent, p)
+		return &SubmitResponse{Status: "ok", InventoryHash: p.InventoryHash, AcceptsDelta: true}, nil
+	}
+	testManager(t, path, v1).SyncIfRequested(context.Background(), true, submit)
+
+	// A new process picks up the acknowledged snapshot from disk.
+	v2 := []SoftwareItem{{Name: "bash", Version: "5.2"}, {Name: "curl", Version: "7.88"}}
+	testManager(t, path, v2).SyncIfRequested(context.Background(), true, submit)
+
+	if len(sent) != 2 {
+		t.Fatalf("sent %d requests, want 2", len(sent))
+	}
+	if sent[0].Mode != ModeFull || len(sent[0].Items) != 2 {
+		t.Fatalf("first request = %+v, want full upload", sent[0])
+	}
+	d := sent[1]
+	if d.Mode != ModeDelta || d.BaseHash != computeHash(v1) || d.InventoryHash != computeHash(v2) || len(d.Items) != 0 {
+		t.Fatalf("second request = %+v, want delta from v1 to v2", d)
+	}
+	if len(d.Changed) != 1 || d.Changed[0].Key != "bash|" || len(d.Added) != 0 || len(d.Removed) != 0 {
+		t.Fatalf("delta = %+v", d)
+	}
+}
+
+func TestSyncFallsBackToFullOnBaseMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	v1 := []SoftwareItem{{Name: "bash", Version: "5.1"}}
+	if err := saveSnapshot(path, &snapshot{Hash: computeHash(v1), AcceptsDelta: true, Items: v1}); err != nil {
+		t.Fatal(err)
+	}
+	v2 := []SoftwareItem{{Name: "bash", Version: "5.2"}}
+	m := testManager(t, path, v2)
+
+	var modes []string
+	m.SyncIfRequested(context.Background(), true, func(_ context.Context, p SubmitRequest) (*SubmitResponse, error) {
+		modes = append(modes, p.Mode)
+		if p.Mode == ModeDelta {
+			return nil, fmt.Errorf("%w: HTTP 409", ErrBaseMismatch)
+		}
+		return &SubmitResponse{Status: "ok"}, nil
+	})
+	if !reflect.DeepEqual(modes, []string{ModeDelta, ModeFull}) {
+		t.Fatalf("modes = %v, want delta then full", modes)
+	}
+	// The server did not offer deltas for the full upload.
+	snap, err := loadSnapshot(path)
+	if err != nil || snap.Hash != computeHash(v2) || snap.AcceptsDelta {
+		t.Fatalf("snapshot = %+v, %v", snap, err)
+	}
+}
+
+func TestSyncWithoutDeltaSupportStaysFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	submit := func(_ context.Context, p SubmitRequest) (*SubmitResponse, error) {
+		if p.Mode != ModeFull {
+			t.Fatalf("mode = %q for a server without delta support", p.Mode)
+		}
+		return &SubmitResponse{Status: "ok"}, nil
+	}
+	testManager(t, path, []SoftwareItem{{Name: "a", Version: "1"}}).SyncIfRequested(context.Background(), true, submit)
+	testManager(t, path, []SoftwareItem{{Name: "a", Version: "2"}}).SyncIfRequested(context.Background(), true, submit)
+}
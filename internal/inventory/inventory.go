@@ -5,8 +5,10 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"os"
 	"sort"
 	"sync"
 	"time"
@@ -20,13 +22,22 @@ type SoftwareItem struct {
 	InstallDate     string `json:"install_date,omitempty"`
 	EstimatedSizeKB int    `json:"estimated_size_kb,omitempty"`
 	Architecture    string `json:"architecture,omitempty"`
+	// ProductCode is the MSI product code ({GUID}) on Windows, if any.
+	ProductCode string `json:"product_code,omitempty"`
 }
 
 // SubmitRequest is the payload sent to POST /api/v1/agent/inventory.
+// A full upload carries Items; a delta (Mode "delta") carries the changes
+// from BaseHash to InventoryHash instead.
 type SubmitRequest struct {
 	InventoryHash string         `json:"inventory_hash"`
 	SoftwareCount int            `json:"software_count"`
-	Items         []SoftwareItem `json:"items"`
+	Items         []SoftwareItem `json:"items,omitempty"`
+	Mode          string         `json:"mode,omitempty"`
+	BaseHash      string         `json:"base_hash,omitempty"`
+	Added         []KeyedItem    `json:"added,omitempty"`
+	Changed       []KeyedItem    `json:"changed,omitempty"`
+	Removed       []KeyedItem    `json:"removed,omitempty"`
 }
 
 // SubmitResponse is the server response for inventory submission.
@@ -34,6 +45,10 @@ type SubmitResponse struct {
 	Status  string         `json:"status"`
 	Message string         `json:"message"`
 	Changes map[string]int `json:"changes"`
+	// InventoryHash is the hash the server now holds; AcceptsDelta says it
+	// takes deltas against it. Servers without delta support send neither.
+	InventoryHash string `json:"inventory_hash"`
+	AcceptsDelta  bool   `json:"accepts_delta"`
 }
 
 // Manager handles periodic inventory scanning and server synchronization.
@@ -44,6 +59,14 @@ type Manager struct {
 	lastItems       []SoftwareItem
 	scanIntervalMin int
 	lastScanTime    time.Time
+
+	snapshotPath string
+	snapshot     *snapshot
+
+	journal   *Journal
+	onJournal func([]JournalEvent)
+
+	catalog *Catalog
 }
 
 // NewManager creates a new inventory manager.
@@ -54,6 +77,46 @@ func NewManager(logger *log.Logger) *Manager {
 	}
 }
 
+// LoadSnapshot makes path the store for the server-acknowledged snapshot and
+// reads it, so syncs after a restart can still send deltas.
+func (m *Manager) LoadSnapshot(path string) {
+	snap, err := loadSnapshot(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snapshotPath = path
+	m.snapshot = snap
+	switch {
+	case err == nil:
+		m.logger.Printf("inventory snapshot loaded: %d items, hash=%s", len(snap.Items), shortHash(snap.Hash))
+	case !errors.Is(err, os.ErrNotExist):
+		m.logger.Printf("inventory snapshot ignored: %v", err)
+	}
+}
+
+// SetJournal records the changes every scan finds in j. onEvents, if set,
+// is called with the new events of a scan; it must not block.
+func (m *Manager) SetJournal(j *Journal, onEvents func([]JournalEvent)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.journal = j
+	m.onJournal = onEvents
+}
+
+// SetCatalog maps every scan to store catalog apps through c.
+func (m *Manager) SetCatalog(c *Catalog) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.catalog = c
+}
+
+// RemapCatalog re-applies the catalog rules to the last scan, e.g. after the
+// rules changed.
+func (m *Manager) RemapCatalog() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mapCatalogLocked(m.lastItems)
+}
+
 // SetScanInterval updates the scan interval from server config.
 func (m *Manager) SetScanInterval(minutes int) {
 	m.mu.Lock()
@@ -90,7 +153,9 @@ func (m *Manager) ScanIfNeeded() bool {
 	m.lastItems = items
 	m.lastHash = hash
 	m.lastScanTime = time.Now()
-	m.logger.Printf("inventory scan complete: %d items, hash=%s", len(items), hash[:12])
+	m.logger.Printf("inventory scan complete: %d items, hash=%s", len(items), shortHash(hash))
+	m.recordJournalLocked(items)
+	m.mapCatalogLocked(items)
 	return true
 }
 
@@ -104,7 +169,41 @@ func (m *Manager) ForceScan() {
 	m.lastItems = items
 	m.lastHash = hash
 	m.lastScanTime = time.Now()
-	m.logger.Printf("inventory force scan: %d items, hash=%s", len(items), hash[:12])
+	m.logger.Printf("inventory force scan: %d items, hash=%s", len(items), shortHash(hash))
+	m.recordJournalLocked(items)
+	m.mapCatalogLocked(items)
+}
+
+// recordJournalLocked is called with mu held so concurrent scans reach the
+// journal in the order they were applied.
+func (m *Manager) recordJournalLocked(items []SoftwareItem) {
+	if m.journal == nil {
+		return
+	}
+	events, err := m.journal.Record(items)
+	if err != nil {
+		m.logger.Printf("software journal: %v", err)
+	}
+	if len(events) == 0 {
+		return
+	}
+	m.logger.Printf("software journal: %d change(s) recorded", len(events))
+	if m.onJournal != nil {
+		m.onJournal(events)
+	}
+}
+
+func (m *Manager) mapCatalogLocked(items []SoftwareItem) {
+	if m.catalog == nil {
+		return
+	}
+	changed, err := m.catalog.Map(items)
+	if err != nil {
+		m.logger.Printf("catalog map: %v", err)
+	}
+	if changed {
+		m.logger.Printf("catalog map: %d catalog app(s) installed", len(m.catalog.Apps()))
+	}
 }
 
 // GetSubmitPayload returns the current inventory as a SubmitRequest.
@@ -123,7 +222,10 @@ func (m *Manager) GetSubmitPayload() SubmitRequest {
 // SubmitFunc is the function signature for submitting inventory to the server.
 type SubmitFunc func(ctx context.Context, payload SubmitRequest) (*SubmitResponse, error)
 
-// SyncIfRequested submits inventory to the server if sync is required.
+// SyncIfRequested submits inventory to the server if sync is required. When
+// the server accepted deltas against the last acknowledged snapshot only the
+// differences are sent; otherwise, or if the server no longer holds that
+// snapshot, the full list is uploaded.
 func (m *Manager) SyncIfRequested(ctx context.Context, syncRequired bool, submitFn SubmitFunc) {
 	if !syncRequired {
 		return
@@ -135,6 +237,42 @@ func (m *Manager) SyncIfRequested(ctx context.Context, syncRequired bool, submit
 		return
 	}
 
+	m.mu.Lock()
+	base := m.snapshot
+	m.mu.Unlock()
+	// The server asking for a sync of the state it acknowledged means it
+	// lost track of it; only a full upload helps then.
+	if base != nil && base.AcceptsDelta && base.Hash != payload.InventoryHash {
+		added, changed, removed := diffItems(base.Items, payload.Items)
+		delta := SubmitRequest{
+			InventoryHash: payload.InventoryHash,
+			SoftwareCount: payload.SoftwareCount,
+			Mode:          ModeDelta,
+			BaseHash:      base.Hash,
+			Added:         added,
+			Changed:       changed,
+			Removed:       removed,
+		}
+		resp, err := submitFn(ctx, delta)
+		if err == nil && resp.Status == "base_mismatch" {
+			err = ErrBaseMismatch
+		}
+		switch {
+		case errors.Is(err, ErrBaseMismatch):
+			m.logger.Printf("inventory delta rejected (server does not hold base %s), sending full list", shortHash(base.Hash))
+			m.dropSnapshot()
+		case err != nil:
+			m.logger.Printf("inventory delta submit failed: %v", err)
+			return
+		default:
+			m.logger.Printf("inventory delta submitted: %s (added=%d changed=%d removed=%d)",
+				resp.Message, len(added), len(changed), len(removed))
+			m.acknowledge(payload, resp, true)
+			return
+		}
+	}
+
+	payload.Mode = ModeFull
 	resp, err := submitFn(ctx, payload)
 	if err != nil {
 		m.logger.Printf("inventory submit failed: %v", err)
@@ -146,6 +284,48 @@ func (m *Manager) SyncIfRequested(ctx context.Context, syncRequired bool, submit
 		resp.Changes["removed"],
 		resp.Changes["updated"],
 	)
+	m.acknowledge(payload, resp, resp.AcceptsDelta)
+}
+
+// acknowledge records payload as the server's snapshot after a successful
+// submit.
+func (m *Manager) acknowledge(payload SubmitRequest, resp *SubmitResponse, acceptsDelta bool) {
+	if resp.InventoryHash != "" && resp.InventoryHash != payload.InventoryHash {
+		m.logger.Printf("inventory: server holds hash %s after submit of %s; next sync is a full upload",
+			shortHash(resp.InventoryHash), shortHash(payload.InventoryHash))
+		m.dropSnapshot()
+		return
+	}
+	snap := &snapshot{
+		Hash:         payload.InventoryHash,
+		AcceptsDelta: acceptsDelta,
+		AckedAt:      time.Now().UTC(),
+		Items:        payload.Items,
+	}
+	m.mu.Lock()
+	m.snapshot = snap
+	path := m.snapshotPath
+	m.mu.Unlock()
+	if path == "" {
+		return
+	}
+	if err := saveSnapshot(path, snap); err != nil {
+		m.logger.Printf("inventory snapshot save failed: %v", err)
+	}
+}
+
+func (m *Manager) dropSnapshot() {
+	m.mu.Lock()
+	m.snapshot = nil
+	path := m.snapshotPath
+	m.mu.Unlock()
+	if path != "" {
+		_ = os.Remove(path)
+	}
+}
+
+func shortHash(h string) string {
+	return h[:min(len(h), 12)]
 }
 
 // computeHash sorts items by name, serializes to JSON, and returns SHA256 hex.
@@ -0,0 +1,386 @@
+package inventory
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"appcenter-agent/internal/clock"
+)
+
+// Journal event types.
+const (
+	EventInstalled = "installed"
+	EventRemoved   = "removed"
+	EventUpdated   = "updated"
+)
+
+// Journal event sources.
+const (
+	SourceAppCenter = "appcenter"
+	SourceUser      = "user"
+)
+
+const (
+	// taskWindow is how long after an agent-run task a change may still be
+	// attributed to it.
+	taskWindow = 30 * time.Minute
+	// maxJournalEvents bounds the journal file; older shipped events are
+	// dropped. Events the server has not acknowledged are always kept.
+	maxJournalEvents = 5000
+	journalShipBatch = 200
+)
+
+// JournalEvent is one software change seen between two scans.
+type JournalEvent struct {
+	Seq             int64     `json:"seq"`
+	Time            time.Time `json:"time"`
+	Type            string    `json:"type"`
+	Key             string    `json:"key"`
+	Name            string    `json:"name"`
+	Version         string    `json:"version,omitempty"`
+	PreviousVersion string    `json:"previous_version,omitempty"`
+	Publisher       string    `json:"publisher,omitempty"`
+	Architecture    string    `json:"architecture,omitempty"`
+	Source          string    `json:"source"`
+	TaskID          int       `json:"task_id,omitempty"`
+}
+
+// JournalSendFunc delivers a batch of events to the server.
+type JournalSendFunc func(ctx context.Context, events []JournalEvent) error
+
+type journalState struct {
+	// Items is the previous scan; nil until the first scan, which only sets
+	// the baseline.
+	Items      []SoftwareItem `json:"items"`
+	LastSeq    int64          `json:"last_seq"`
+	ShippedSeq int64          `json:"shipped_seq"`
+	Count      int            `json:"count"`
+}
+
+type taskNote struct {
+	taskID     int
+	appName    string
+	finishedAt time.Time
+}
+
+// Journal records installs, removals and version changes between scans in
+// an append-only JSON lines file, with the previous scan and shipping
+// progress in a state file next to it. A nil *Journal records nothing.
+type Journal struct {
+	mu        sync.Mutex
+	path      string
+	statePath string
+	state     journalState
+	tasks     []taskNote
+	nowFn     func() time.Time
+}
+
+// DefaultJournalPath returns the journal location.
+func DefaultJournalPath() string {
+	if runtime.GOOS == "windows" {
+		return `C:\ProgramData\AppCenter\software_journal.jsonl`
+	}
+	return "software_journal.jsonl"
+}
+
+// OpenJournal loads the journal state for path.
+func OpenJournal(path string) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		path:      path,
+		statePath: strings.TrimSuffix(path, filepath.Ext(path)) + "_state.json",
+		nowFn:     clock.Now,
+	}
+	b, err := os.ReadFile(j.statePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &j.state); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// NoteTask remembers that an agent-run task for appName just finished, so
+// the changes the following scans find can be attributed to it.
+func (j *Journal) NoteTask(taskID int, appName string) {
+	if j == nil || taskID == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.nowFn()
+	j.pruneTasksLocked(now)
+	j.tasks = append(j.tasks, taskNote{taskID: taskID, appName: appName, finishedAt: now})
+}
+
+// Record diffs items against the previous scan, appends the resulting
+// events and makes items the new baseline. An empty scan is taken as a
+// failed one and ignored, so it does not turn into mass removals.
+func (j *Journal) Record(items []SoftwareItem) ([]JournalEvent, error) {
+	if j == nil || len(items) == 0 {
+		return nil, nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := j.nowFn()
+	j.pruneTasksLocked(now)
+	var events []JournalEvent
+	if j.state.Items != nil {
+		added, changed, removed := diffItems(j.state.Items, items)
+		before := keyItems(j.state.Items)
+		for _, it := range added {
+			events = append(events, j.newEventLocked(now, EventInstalled, it, ""))
+		}
+		for _, it := range changed {
+			prev := before[it.Key].Version
+			if prev == it.Version {
+				// Size or metadata drift is not a software change.
+				continue
+			}
+			events = append(events, j.newEventLocked(now, EventUpdated, it, prev))
+		}
+		for _, it := range removed {
+			events = append(events, j.newEventLocked(now, EventRemoved, it, ""))
+		}
+	}
+
+	if err := j.appendLocked(events); err != nil {
+		return nil, err
+	}
+	j.state.Items = append([]SoftwareItem{}, items...)
+	if err := j.saveStateLocked(); err != nil {
+		return events, err
+	}
+	if j.state.Count > maxJournalEvents {
+		if err := j.compactLocked(); err != nil {
+			return events, err
+		}
+	}
+	return events, nil
+}
+
+func (j *Journal) newEventLocked(now time.Time, typ string, it KeyedItem, prev string) JournalEvent {
+	j.state.LastSeq++
+	ev := JournalEvent{
+		Seq:             j.state.LastSeq,
+		Time:            now.UTC(),
+		Type:            typ,
+		Key:             it.Key,
+		Name:            it.Name,
+		Version:         it.Version,
+		PreviousVersion: prev,
+		Publisher:       it.Publisher,
+		Architecture:    it.Architecture,
+		Source:          SourceUser,
+	}
+	if taskID := j.attributeLocked(it.Name); taskID != 0 {
+		ev.Source, ev.TaskID = SourceAppCenter, taskID
+	}
+	return ev
+}
+
+// attributeLocked returns the newest recent task for an app matching name.
+// Timing alone is no evidence: a change nothing matches stays the user's.
+func (j *Journal) attributeLocked(name string) int {
+	for i := len(j.tasks) - 1; i >= 0; i-- {
+		if namesMatch(j.tasks[i].appName, name) {
+			return j.tasks[i].taskID
+		}
+	}
+	return 0
+}
+
+func (j *Journal) pruneTasksLocked(now time.Time) {
+	kept := j.tasks[:0]
+	for _, t := range j.tasks {
+		if now.Sub(t.finishedAt) <= taskWindow {
+			kept = append(kept, t)
+		}
+	}
+	j.tasks = kept
+}
+
+// namesMatch compares an app name from the server catalog with a scanned
+// name, ignoring case, punctuation and version suffixes on either side.
+func namesMatch(a, b string) bool {
+	na, nb := normalizeName(a), normalizeName(b)
+	if len(na) < 3 || len(nb) < 3 {
+		return false
+	}
+	return strings.Contains(na, nb) || strings.Contains(nb, na)
+}
+
+func normalizeName(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Query returns up to limit events with seq > sinceSeq (limit <= 0: all).
+func (j *Journal) Query(sinceSeq int64, limit int) ([]JournalEvent, error) {
+	if j == nil {
+		return nil, nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.readLocked(sinceSeq, limit)
+}
+
+// LastSeq returns the seq of the newest event.
+func (j *Journal) LastSeq() int64 {
+	if j == nil {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state.LastSeq
+}
+
+// Flush sends the events the server has not acknowledged yet, in batches.
+func (j *Journal) Flush(ctx context.Context, send JournalSendFunc) error {
+	if j == nil {
+		return nil
+	}
+	for {
+		j.mu.Lock()
+		batch, err := j.readLocked(j.state.ShippedSeq, journalShipBatch)
+		j.mu.Unlock()
+		if err != nil || len(batch) == 0 {
+			return err
+		}
+		if err := send(ctx, batch); err != nil {
+			return err
+		}
+		j.mu.Lock()
+		j.state.ShippedSeq = batch[len(batch)-1].Seq
+		err = j.saveStateLocked()
+		j.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if len(batch) < journalShipBatch {
+			return nil
+		}
+	}
+}
+
+func (j *Journal) readLocked(sinceSeq int64, limit int) ([]JournalEvent, error) {
+	f, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []JournalEvent
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var ev JournalEvent
+		if json.Unmarshal(sc.Bytes(), &ev) != nil || ev.Seq <= sinceSeq {
+			continue
+		}
+		out = append(out, ev)
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+	}
+	return out, sc.Err()
+}
+
+func (j *Journal) appendLocked(events []JournalEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, ev := range events {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(b)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	j.state.Count += len(events)
+	return f.Close()
+}
+
+// compactLocked keeps every unshipped event and, up to maxJournalEvents/2
+// events in total, the newest shipped ones.
+func (j *Journal) compactLocked() error {
+	events, err := j.readLocked(0, 0)
+	if err != nil {
+		return err
+	}
+	unshipped := len(events)
+	for unshipped > 0 && events[len(events)-unshipped].Seq <= j.state.ShippedSeq {
+		unshipped--
+	}
+	events = events[max(len(events)-max(maxJournalEvents/2, unshipped), 0):]
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	j.state.Count = len(events)
+	return j.saveStateLocked()
+}
+
+func (j *Journal) saveStateLocked() error {
+	b, err := json.Marshal(j.state)
+	if err != nil {
+		return err
+	}
+	tmp := j.statePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.statePath)
+}
@@ -0,0 +1,182 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestJournal(t *testing.T, path string, now *time.Time) *Journal {
+	t.Helper()
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.nowFn = func() time.Time { return *now }
+	return j
+}
+
+func TestJournalRecordsChangesAndAttributesTasks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	now := time.Date(2026, 5, 4, 10, 0, 0, 0, time.UTC)
+	j := openTestJournal(t, path, &now)
+
+	base := []SoftwareItem{
+		{Name: "7-Zip 23.01 (x64)", Version: "23.01", Architecture: "x64"},
+		{Name: "Notepad++", Version: "8.6", Architecture: "x64"},
+	}
+	events, err := j.Record(base)
+	if err != nil || len(events) != 0 {
+		t.Fatalf("baseline scan: events=%v err=%v", events, err)
+	}
+
+	j.NoteTask(41, "7-Zip")
+	j.NoteTask(42, "Google Chrome")
+	now = now.Add(2 * time.Minute)
+	events, err = j.Record([]SoftwareItem{
+		{Name: "7-Zip 23.01 (x64)", Version: "24.05", Architecture: "x64"},
+		{Name: "Google Chrome", Version: "125.0", Architecture: "x64"},
+		{Name: "VLC", Version: "3.0.20", Architecture: "x64"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]JournalEvent{}
+	for _, ev := range events {
+		got[ev.Type+" "+ev.Name] = ev
+	}
+	if len(events) != 4 {
+		t.Fatalf("events = %+v", events)
+	}
+	if ev := got["updated 7-Zip 23.01 (x64)"]; ev.TaskID != 41 || ev.PreviousVersion != "23.01" || ev.Source != SourceAppCenter {
+		t.Errorf("7-Zip event = %+v", ev)
+	}
+	if ev := got["installed Google Chrome"]; ev.TaskID != 42 || ev.Source != SourceAppCenter {
+		t.Errorf("Chrome event = %+v", ev)
+	}
+	// Two tasks were running and neither matches VLC or Notepad++.
+	if ev := got["installed VLC"]; ev.TaskID != 0 || ev.Source != SourceUser {
+		t.Errorf("VLC event = %+v", ev)
+	}
+	if ev := got["removed Notepad++"]; ev.TaskID != 0 || !ev.Time.Equal(now) {
+		t.Errorf("Notepad++ event = %+v", ev)
+	}
+
+	// Task notes expire.
+	now = now.Add(time.Hour)
+	events, _ = j.Record([]SoftwareItem{{Name: "Google Chrome", Version: "126.0", Architecture: "x64"}})
+	for _, ev := range events {
+		if ev.TaskID != 0 {
+			t.Errorf("stale attribution: %+v", ev)
+		}
+	}
+}
+
+func TestJournalDoesNotAttributeUnrelatedChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	now := time.Date(2026, 5, 4, 10, 0, 0, 0, time.UTC)
+	j := openTestJournal(t, path, &now)
+	if _, err := j.Record([]SoftwareItem{{Name: "Notepad++", Version: "8.6"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The only recent task is for another app; timing alone does not count.
+	j.NoteTask(7, "Google Chrome")
+	now = now.Add(time.Minute)
+	events, err := j.Record([]SoftwareItem{{Name: "Notepad++", Version: "8.6"}, {Name: "VLC", Version: "3.0.20"}})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("events=%+v err=%v", events, err)
+	}
+	if ev := events[0]; ev.TaskID != 0 || ev.Source != SourceUser {
+		t.Fatalf("VLC event = %+v", ev)
+	}
+}
+
+func TestJournalCompactionKeepsUnshippedEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	now := time.Date(2026, 5, 4, 10, 0, 0, 0, time.UTC)
+	j := openTestJournal(t, path, &now)
+	scan := func(n int, version string) []SoftwareItem {
+		items := make([]SoftwareItem, n)
+		for i := range items {
+			items[i] = SoftwareItem{Name: fmt.Sprintf("app-%05d", i), Version: version}
+		}
+		return items
+	}
+	if _, err := j.Record(scan(1, "1")); err != nil {
+		t.Fatal(err)
+	}
+	// One event over the limit triggers compaction, but nothing is shipped.
+	if _, err := j.Record(scan(maxJournalEvents+2, "1")); err != nil {
+		t.Fatal(err)
+	}
+	all, err := j.Query(0, 0)
+	if err != nil || len(all) != maxJournalEvents+1 {
+		t.Fatalf("unshipped events dropped: kept %d, want %d (err %v)", len(all), maxJournalEvents+1, err)
+	}
+
+	if err := j.Flush(context.Background(), func(context.Context, []JournalEvent) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Record(scan(maxJournalEvents+2, "2")); err != nil {
+		t.Fatal(err)
+	}
+	all, err = j.Query(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The new, unshipped updates are all kept; the shipped installs go.
+	if len(all) != maxJournalEvents+2 || all[0].Type != EventUpdated {
+		t.Fatalf("kept %d events starting with %+v", len(all), all[0])
+	}
+}
+
+func TestJournalPersistsAndShips(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	now := time.Date(2026, 5, 4, 10, 0, 0, 0, time.UTC)
+	j := openTestJournal(t, path, &now)
+	if _, err := j.Record([]SoftwareItem{{Name: "a", Version: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Record([]SoftwareItem{{Name: "a", Version: "2"}, {Name: "b", Version: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	// An empty scan is treated as a failure, not as everything removed.
+	if events, _ := j.Record(nil); len(events) != 0 {
+		t.Fatalf("empty scan produced %+v", events)
+	}
+
+	failing := errors.New("offline")
+	if err := j.Flush(context.Background(), func(context.Context, []JournalEvent) error { return failing }); !errors.Is(err, failing) {
+		t.Fatalf("flush err = %v", err)
+	}
+
+	// Restart: baseline and unshipped events survive.
+	j = openTestJournal(t, path, &now)
+	if events, _ := j.Record([]SoftwareItem{{Name: "a", Version: "2"}, {Name: "b", Version: "1"}}); len(events) != 0 {
+		t.Fatalf("unchanged scan after restart produced %+v", events)
+	}
+	var shipped []JournalEvent
+	send := func(_ context.Context, events []JournalEvent) error {
+		shipped = append(shipped, events...)
+		return nil
+	}
+	if err := j.Flush(context.Background(), send); err != nil {
+		t.Fatal(err)
+	}
+	if len(shipped) != 2 || shipped[0].Seq != 1 || shipped[1].Seq != 2 {
+		t.Fatalf("shipped = %+v", shipped)
+	}
+	shipped = nil
+	if err := j.Flush(context.Background(), send); err != nil || len(shipped) != 0 {
+		t.Fatalf("second flush shipped %+v (err %v)", shipped, err)
+	}
+
+	events, err := j.Query(1, 0)
+	if err != nil || len(events) != 1 || events[0].Seq != 2 {
+		t.Fatalf("query = %+v, %v", events, err)
+	}
+}
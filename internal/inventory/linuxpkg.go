@@ -0,0 +1,239 @@
+package inventory
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parsers for the Linux package sources. They are free of build tags so the
+// fixture tests run on every platform; scanner_linux.go feeds them.
+
+// installDateFormat matches the registry InstallDate values reported on
+// Windows.
+const installDateFormat = "20060102"
+
+// rpmQueryFormat is the --queryformat parseRPMQuery expects.
+const rpmQueryFormat = `%{NAME}\t%{EPOCH}\t%{VERSION}\t%{RELEASE}\t%{ARCH}\t%{VENDOR}\t%{INSTALLTIME}\t%{SIZE}\n`
+
+// parseDpkgStatus reads /var/lib/dpkg/status. Only installed packages are
+// returned: Status ends in "ok installed" whatever the selection ("install",
+// "hold", ...). installDate, if set, returns the
+// install date of a package (dpkg does not record one in the status file).
+func parseDpkgStatus(r io.Reader, installDate func(pkg, arch string) string) ([]SoftwareItem, error) {
+	var items []SoftwareItem
+	fields := map[string]string{}
+	flush := func() {
+		defer clear(fields)
+		if fields["Package"] == "" || !strings.HasSuffix(fields["Status"], " ok installed") {
+			return
+		}
+		item := SoftwareItem{
+			Name:         fields["Package"],
+			Version:      fields["Version"],
+			Publisher:    fields["Origin"],
+			Architecture: fields["Architecture"],
+		}
+		if item.Publisher == "" {
+			item.Publisher = contactName(fields["Maintainer"])
+		}
+		if n, err := strconv.Atoi(fields["Installed-Size"]); err == nil {
+			item.EstimatedSizeKB = n
+		}
+		if installDate != nil {
+			item.InstallDate = installDate(item.Name, item.Architecture)
+		}
+		items = append(items, item)
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		// Continuation lines (Description, Conffiles) are not needed.
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields[key] = strings.TrimSpace(value)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return items, nil
+}
+
+// dedupSoftware drops items reported by more than one source. Architecture
+// is part of the key, so multiarch packages (libc6 for amd64 and i386) are
+// kept apart.
+func dedupSoftware(items []SoftwareItem) []SoftwareItem {
+	seen := make(map[string]bool, len(items))
+	out := items[:0:0]
+	for _, item := range items {
+		if item.Name == "" {
+			continue
+		}
+		key := item.Name + "|" + item.Version + "|" + item.Architecture
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, item)
+	}
+	return out
+}
+
+// contactName strips the address from "Name <mail>".
+func contactName(s string) string {
+	if i := strings.IndexByte(s, '<'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// parseRPMQuery reads `rpm -qa --queryformat rpmQueryFormat` output.
+func parseRPMQuery(r io.Reader) ([]SoftwareItem, error) {
+	var items []SoftwareItem
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		cols := strings.Split(sc.Text(), "\t")
+		if len(cols) != 8 || cols[0] == "" {
+			continue
+		}
+		name, epoch, version, release, arch, vendor := cols[0], rpmValue(cols[1]), cols[2], rpmValue(cols[3]), rpmValue(cols[4]), rpmValue(cols[5])
+		// Imported signing keys show up as packages.
+		if name == "gpg-pubkey" {
+			continue
+		}
+		if release != "" {
+			version += "-" + release
+		}
+		if epoch != "" && epoch != "0" {
+			version = epoch + ":" + version
+		}
+		item := SoftwareItem{Name: name, Version: version, Publisher: vendor, Architecture: arch}
+		if ts, err := strconv.ParseInt(cols[6], 10, 64); err == nil && ts > 0 {
+			item.InstallDate = time.Unix(ts, 0).UTC().Format(installDateFormat)
+		}
+		if n, err := strconv.ParseInt(cols[7], 10, 64); err == nil && n > 0 {
+			item.EstimatedSizeKB = int((n + 1023) / 1024)
+		}
+		items = append(items, item)
+	}
+	return items, sc.Err()
+}
+
+// rpmValue maps rpm's "(none)" placeholder to "".
+func rpmValue(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "(none)" {
+		return ""
+	}
+	return s
+}
+
+// parseSnapdSnaps reads the snapd REST answer to GET /v2/snaps. Snaps carry
+// no architecture of their own; arch is the system's.
+func parseSnapdSnaps(r io.Reader, arch string) ([]SoftwareItem, error) {
+	var resp struct {
+		Result []struct {
+			Name          string `json:"name"`
+			Version       string `json:"version"`
+			Status        string `json:"status"`
+			InstallDate   string `json:"install-date"`
+			InstalledSize int64  `json:"installed-size"`
+			Publisher     struct {
+				Username    string `json:"username"`
+				DisplayName string `json:"display-name"`
+			} `json:"publisher"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return nil, err
+	}
+	var items []SoftwareItem
+	for _, s := range resp.Result {
+		if s.Name == "" || (s.Status != "" && s.Status != "active") {
+			continue
+		}
+		item := SoftwareItem{
+			Name:         s.Name,
+			Version:      s.Version,
+			Publisher:    s.Publisher.DisplayName,
+			Architecture: arch,
+		}
+		if item.Publisher == "" {
+			item.Publisher = s.Publisher.Username
+		}
+		if t, err := time.Parse(time.RFC3339, s.InstallDate); err == nil {
+			item.InstallDate = t.UTC().Format(installDateFormat)
+		}
+		if s.InstalledSize > 0 {
+			item.EstimatedSizeKB = int((s.InstalledSize + 1023) / 1024)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// flatpakColumns is the --columns list parseFlatpakList expects.
+const flatpakColumns = "application,name,version,branch,arch,origin,size"
+
+// parseFlatpakList reads `flatpak list --app --columns=flatpakColumns`.
+// Flatpak has no vendor field; the remote the app came from (e.g. flathub)
+// is reported as publisher. installDate, if set, returns the deploy date.
+func parseFlatpakList(r io.Reader, installDate func(app, arch, branch string) string) ([]SoftwareItem, error) {
+	var items []SoftwareItem
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		cols := strings.Split(sc.Text(), "\t")
+		if len(cols) != 7 || cols[0] == "" {
+			continue
+		}
+		for i := range cols {
+			cols[i] = strings.TrimSpace(cols[i])
+		}
+		app, name, version, branch, arch, origin := cols[0], cols[1], cols[2], cols[3], cols[4], cols[5]
+		if name == "" {
+			name = app
+		}
+		if version == "" {
+			version = branch
+		}
+		item := SoftwareItem{Name: name, Version: version, Publisher: origin, Architecture: arch}
+		item.EstimatedSizeKB = int(parseHumanSize(cols[6]) / 1024)
+		if installDate != nil {
+			item.InstallDate = installDate(app, arch, branch)
+		}
+		items = append(items, item)
+	}
+	return items, sc.Err()
+}
+
+// parseHumanSize reads GLib formatted sizes ("1.2 GB", "512 bytes"; SI
+// units, optionally separated by a no-break space). Unknown input yields 0.
+func parseHumanSize(s string) int64 {
+	s = strings.TrimSpace(strings.ReplaceAll(s, "\u00a0", " "))
+	num, unit, _ := strings.Cut(s, " ")
+	v, err := strconv.ParseFloat(strings.ReplaceAll(num, ",", "."), 64)
+	if err != nil || v < 0 {
+		return 0
+	}
+	mult := map[string]float64{
+		"": 1, "byte": 1, "bytes": 1,
+		"kb": 1e3, "mb": 1e6, "gb": 1e9, "tb": 1e12,
+		"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40,
+	}[strings.ToLower(strings.TrimSpace(unit))]
+	return int64(v * mult)
+}
@@ -0,0 +1,119 @@
+package inventory
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openFixture(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestParseDpkgStatus(t *testing.T) {
+	dates := map[string]string{"bash": "20240102", "appcenter-agent": "20250607"}
+	items, err := parseDpkgStatus(openFixture(t, "dpkg_status"), func(pkg, arch string) string {
+		if arch != "amd64" && pkg+":"+arch != "libc6:i386" {
+			t.Errorf("arch for %s = %q", pkg, arch)
+		}
+		return dates[pkg]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SoftwareItem{
+		{Name: "bash", Version: "5.2.15-2+b2", Publisher: "Matthias Klose", InstallDate: "20240102", EstimatedSizeKB: 6469, Architecture: "amd64"},
+		{Name: "libc6", Version: "2.36-9+deb12u4", Publisher: "GNU Libc Maintainers", EstimatedSizeKB: 12985, Architecture: "amd64"},
+		{Name: "libc6", Version: "2.36-9+deb12u4", Publisher: "GNU Libc Maintainers", EstimatedSizeKB: 12170, Architecture: "i386"},
+		// Held packages are installed too; half-installed ones are not.
+		{Name: "linux-image-amd64", Version: "6.1.76-1", Publisher: "Debian Kernel Team", EstimatedSizeKB: 13, Architecture: "amd64"},
+		{Name: "appcenter-agent", Version: "0.1.48", Publisher: "AppCenter", InstallDate: "20250607", EstimatedSizeKB: 24576, Architecture: "amd64"},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Fatalf("items =\n%+v\nwant\n%+v", items, want)
+	}
+}
+
+func TestDedupSoftwareKeepsArchitectures(t *testing.T) {
+	items, err := parseDpkgStatus(openFixture(t, "dpkg_status"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same package seen again by another source is dropped.
+	dup := items[1]
+	dup.Publisher = "rpm"
+	got := dedupSoftware(append(append([]SoftwareItem{}, items...), dup, SoftwareItem{Version: "1"}))
+	if !reflect.DeepEqual(got, items) {
+		t.Fatalf("dedup =\n%+v\nwant\n%+v", got, items)
+	}
+}
+
+func TestParseRPMQuery(t *testing.T) {
+	items, err := parseRPMQuery(openFixture(t, "rpm_qa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SoftwareItem{
+		{Name: "bash", Version: "5.1.8-9.el9", Publisher: "Rocky Enterprise Software Foundation", InstallDate: "20231114", EstimatedSizeKB: 7558, Architecture: "x86_64"},
+		{Name: "openssl-libs", Version: "1:3.0.7-24.el9", Publisher: "Rocky Enterprise Software Foundation", InstallDate: "20231115", EstimatedSizeKB: 6205, Architecture: "x86_64"},
+		{Name: "tzdata", Version: "2023c-1.el9", InstallDate: "20231114", EstimatedSizeKB: 1850, Architecture: "noarch"},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Fatalf("items =\n%+v\nwant\n%+v", items, want)
+	}
+}
+
+func TestParseSnapdSnaps(t *testing.T) {
+	items, err := parseSnapdSnaps(openFixture(t, "snapd_snaps.json"), "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SoftwareItem{
+		{Name: "firefox", Version: "124.0.1-1", Publisher: "Mozilla", InstallDate: "20240325", EstimatedSizeKB: 270260, Architecture: "amd64"},
+		{Name: "core22", Version: "20240111", Publisher: "canonical", InstallDate: "20240201", EstimatedSizeKB: 75712, Architecture: "amd64"},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Fatalf("items =\n%+v\nwant\n%+v", items, want)
+	}
+}
+
+func TestParseFlatpakList(t *testing.T) {
+	items, err := parseFlatpakList(openFixture(t, "flatpak_list"), func(app, arch, branch string) string {
+		if app == "org.mozilla.Thunderbird" && arch == "x86_64" && branch == "stable" {
+			return "20240310"
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SoftwareItem{
+		{Name: "Thunderbird", Version: "115.9.0", Publisher: "flathub", InstallDate: "20240310", EstimatedSizeKB: 255957, Architecture: "x86_64"},
+		{Name: "org.example.NoVersion", Version: "beta", Publisher: "example-remote", EstimatedSizeKB: 1464843, Architecture: "aarch64"},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Fatalf("items =\n%+v\nwant\n%+v", items, want)
+	}
+}
+
+func TestParseHumanSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"512 bytes": 512,
+		"1.5 kB":    1500,
+		"2 MiB":     2 << 20,
+		"1,5 GB":    1500000000,
+		"garbage":   0,
+		"":          0,
+	} {
+		if got := parseHumanSize(in); got != want {
+			t.Errorf("parseHumanSize(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
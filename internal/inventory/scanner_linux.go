@@ -0,0 +1,135 @@
+//go:build linux
+
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+const (
+	dpkgStatusPath  = "/var/lib/dpkg/status"
+	dpkgInfoDir     = "/var/lib/dpkg/info"
+	snapdSocket     = "/run/snapd.socket"
+	flatpakAppDir   = "/var/lib/flatpak/app"
+	linuxCmdTimeout = 60 * time.Second
+)
+
+// ScanInstalledSoftware lists packages from dpkg, rpm, snap and flatpak.
+// Sources that are not present on the machine are skipped.
+func ScanInstalledSoftware() []SoftwareItem {
+	var items []SoftwareItem
+	for _, scan := range []func() []SoftwareItem{scanDpkg, scanRPM, scanSnaps, scanFlatpaks} {
+		items = append(items, scan()...)
+	}
+	return dedupSoftware(items)
+}
+
+func scanDpkg() []SoftwareItem {
+	f, err := os.Open(dpkgStatusPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	items, _ := parseDpkgStatus(f, dpkgInstallDate)
+	return items
+}
+
+// dpkgInstallDate uses the modification time of the package's file list,
+// written when the package was (last) unpacked.
+func dpkgInstallDate(pkg, arch string) string {
+	for _, name := range []string{pkg + ":" + arch + ".list", pkg + ".list"} {
+		if fi, err := os.Stat(filepath.Join(dpkgInfoDir, name)); err == nil {
+			return fi.ModTime().UTC().Format(installDateFormat)
+		}
+	}
+	return ""
+}
+
+func scanRPM() []SoftwareItem {
+	out, err := runLinuxCmd("rpm", "-qa", "--queryformat", rpmQueryFormat)
+	if err != nil {
+		return nil
+	}
+	items, _ := parseRPMQuery(bytes.NewReader(out))
+	return items
+}
+
+func scanSnaps() []SoftwareItem {
+	if _, err := os.Stat(snapdSocket); err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), linuxCmdTimeout)
+	defer cancel()
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", snapdSocket)
+		},
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/v2/snaps", nil)
+	if err != nil {
+		return nil
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	items, _ := parseSnapdSnaps(io.LimitReader(resp.Body, 32<<20), snapArch())
+	return items
+}
+
+func scanFlatpaks() []SoftwareItem {
+	out, err := runLinuxCmd("flatpak", "list", "--system", "--app", "--columns="+flatpakColumns)
+	if err != nil {
+		return nil
+	}
+	items, _ := parseFlatpakList(bytes.NewReader(out), flatpakInstallDate)
+	return items
+}
+
+// flatpakInstallDate uses the time the active deployment was created.
+func flatpakInstallDate(app, arch, branch string) string {
+	fi, err := os.Lstat(filepath.Join(flatpakAppDir, app, arch, branch, "active"))
+	if err != nil {
+		return ""
+	}
+	return fi.ModTime().UTC().Format(installDateFormat)
+}
+
+func runLinuxCmd(name string, args ...string) ([]byte, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), linuxCmdTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, args...)
+	// Parsers rely on untranslated, unformatted output.
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	return cmd.Output()
+}
+
+// snapArch reports the system architecture as snapd names it (Debian
+// style).
+func snapArch() string {
+	switch runtime.GOARCH {
+	case "386":
+		return "i386"
+	case "arm":
+		return "armhf"
+	}
+	return runtime.GOARCH
+}
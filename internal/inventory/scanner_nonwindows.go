@@ -1,8 +1,8 @@
-//go:build !windows
+//go:build !windows && !linux
 
 package inventory
 
-// ScanInstalledSoftware is a no-op on non-Windows platforms.
+// ScanInstalledSoftware is a no-op on platforms without a scanner.
 func ScanInstalledSoftware() []SoftwareItem {
 	return nil
 }
@@ -5,6 +5,7 @@ package inventory
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"golang.org/x/sys/windows/registry"
 )
@@ -49,6 +50,7 @@ func ScanInstalledSoftware() []SoftwareItem {
 
 			item := readSoftwareItem(subKey)
 			subKey.Close()
+			item.ProductCode = msiProductCode(sub)
 
 			if item.Name == "" {
 				continue
@@ -117,6 +119,27 @@ func readSoftwareItem(key registry.Key) SoftwareItem {
 	}
 }
 
+// msiProductCode returns the Uninstall subkey name if it is an MSI product
+// code ({8-4-4-4-12} hex GUID).
+func msiProductCode(sub string) string {
+	if len(sub) != 38 || sub[0] != '{' || sub[37] != '}' {
+		return ""
+	}
+	for i := 1; i < 37; i++ {
+		c := sub[i]
+		switch {
+		case i == 9 || i == 14 || i == 19 || i == 24:
+			if c != '-' {
+				return ""
+			}
+		case (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F'):
+		default:
+			return ""
+		}
+	}
+	return strings.ToUpper(sub)
+}
+
 func inferArchitecture(key registry.Key) string {
 	// Best-effort: check DisplayName for hints
 	name, _, _ := key.GetStringValue("DisplayName")
@@ -0,0 +1,49 @@
+package inventory
+
+import (
+	"sort"
+
+	"appcenter-agent/internal/version"
+)
+
+// CatalogApp is the latest release of a store catalog app.
+type CatalogApp struct {
+	AppID   int
+	Name    string
+	Version string
+}
+
+// AvailableUpdate is an installed catalog app older than its catalog release.
+type AvailableUpdate struct {
+	AppID            int    `json:"app_id"`
+	Name             string `json:"name"`
+	InstalledName    string `json:"installed_name"`
+	InstalledVersion string `json:"installed_version"`
+	LatestVersion    string `json:"latest_version"`
+}
+
+// FindUpdates compares the installed catalog apps with the catalog and
+// returns the outdated ones, ordered by app ID. Apps whose versions cannot
+// be compared are never reported.
+func FindUpdates(installed []CatalogMatch, catalog []CatalogApp) []AvailableUpdate {
+	latest := make(map[int]CatalogApp, len(catalog))
+	for _, app := range catalog {
+		latest[app.AppID] = app
+	}
+	var out []AvailableUpdate
+	for _, m := range installed {
+		app, ok := latest[m.AppID]
+		if !ok || !version.Newer(app.Version, m.Version) {
+			continue
+		}
+		out = append(out, AvailableUpdate{
+			AppID:            m.AppID,
+			Name:             app.Name,
+			InstalledName:    m.Name,
+			InstalledVersion: m.Version,
+			LatestVersion:    app.Version,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].AppID < out[j].AppID })
+	return out
+}
@@ -0,0 +1,30 @@
+package inventory
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindUpdates(t *testing.T) {
+	installed := []CatalogMatch{
+		{AppID: 1, Name: "7-Zip 23.01 (x64)", Version: "23.01"},
+		{AppID: 2, Name: "Google Chrome", Version: "124.0.6367.207"},
+		{AppID: 3, Name: "Notepad++", Version: "8.6.4"},
+		{AppID: 4, Name: "In-house tool", Version: "unknown"},
+		{AppID: 5, Name: "Not in store", Version: "1.0"},
+		{AppID: 6, Name: "Beta tester", Version: "2.0.0"},
+	}
+	catalog := []CatalogApp{
+		{AppID: 1, Name: "7-Zip", Version: "24.05"},
+		{AppID: 2, Name: "Google Chrome", Version: "124.0.6367.91"},
+		{AppID: 3, Name: "Notepad++", Version: "8.6.4.0"},
+		{AppID: 4, Name: "In-house tool", Version: "3.1"},
+		{AppID: 6, Name: "Beta tester", Version: "2.0.0-rc.2"},
+	}
+	want := []AvailableUpdate{
+		{AppID: 1, Name: "7-Zip", InstalledName: "7-Zip 23.01 (x64)", InstalledVersion: "23.01", LatestVersion: "24.05"},
+	}
+	if got := FindUpdates(installed, catalog); !reflect.DeepEqual(got, want) {
+		t.Fatalf("updates =\n%+v\nwant\n%+v", got, want)
+	}
+}
@@ -0,0 +1,63 @@
+package netproxy
+
+import (
+	"net"
+	"strings"
+)
+
+// bypassRule matches hosts that are reached without a proxy.
+type bypassRule struct {
+	local  bool       // "<local>": dotless host names
+	suffix string     // ".domain" (from "*.domain" or ".domain")
+	host   string     // exact host
+	cidr   *net.IPNet // address range
+}
+
+func parseBypass(entry string) (bypassRule, bool) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	switch {
+	case entry == "":
+		return bypassRule{}, false
+	case entry == "<local>":
+		return bypassRule{local: true}, true
+	case strings.HasPrefix(entry, "*."):
+		return bypassRule{suffix: entry[1:]}, true
+	case strings.HasPrefix(entry, "."):
+		return bypassRule{suffix: entry}, true
+	}
+	if _, n, err := net.ParseCIDR(entry); err == nil {
+		return bypassRule{cidr: n}, true
+	}
+	if h, _, err := net.SplitHostPort(entry); err == nil {
+		entry = h
+	}
+	return bypassRule{host: strings.Trim(entry, "[]")}, true
+}
+
+func (r bypassRule) match(host string, ip net.IP) bool {
+	switch {
+	case r.local:
+		return ip == nil && !strings.Contains(host, ".")
+	case r.suffix != "":
+		return strings.HasSuffix(host, r.suffix) || host == r.suffix[1:]
+	case r.cidr != nil:
+		return ip != nil && r.cidr.Contains(ip)
+	}
+	return host == r.host
+}
+
+// bypassed reports whether host is in the bypass list. Loopback targets
+// always bypass the proxy.
+func (p *Proxy) bypassed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return true
+	}
+	for _, r := range p.bypass {
+		if r.match(host, ip) {
+			return true
+		}
+	}
+	return false
+}
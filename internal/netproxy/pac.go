@@ -0,0 +1,48 @@
+package netproxy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// pacResolver evaluates the PAC script at pacURL for target and returns the
+// proxy list the OS engine reports ("host:port;host2:port",
+// "socks=host:port"); "" means DIRECT. The agent does not run PAC scripts
+// itself: on Windows WinHTTP does (pac_windows.go), elsewhere pac_url is not
+// supported and systemPAC returns nil.
+type pacResolver func(ctx context.Context, pacURL string, target *url.URL) (string, error)
+
+// parseProxyList takes the first entry of a WinHTTP proxy list. nil means
+// DIRECT.
+func parseProxyList(list string) (*url.URL, error) {
+	first := strings.FieldsFunc(list, func(r rune) bool { return r == ';' || r == ' ' || r == '\t' })
+	if len(first) == 0 {
+		return nil, nil
+	}
+	entry := first[0]
+	if strings.EqualFold(entry, "DIRECT") {
+		return nil, nil
+	}
+	if strings.Contains(entry, "://") {
+		u, err := url.Parse(entry)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("PAC proxy %q is not a URL", entry)
+		}
+		return u, nil
+	}
+	scheme := "http"
+	if kind, addr, ok := strings.Cut(entry, "="); ok {
+		// "socks=host:port" names a SOCKS proxy; "http=" and "https=" name
+		// the (HTTP) proxy used for that target scheme.
+		if strings.EqualFold(kind, "socks") {
+			scheme = "socks5"
+		}
+		entry = addr
+	}
+	if entry == "" {
+		return nil, fmt.Errorf("PAC result %q has no address", list)
+	}
+	return &url.URL{Scheme: scheme, Host: entry}, nil
+}
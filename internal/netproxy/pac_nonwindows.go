@@ -0,0 +1,9 @@
+//go:build !windows
+
+package netproxy
+
+// systemPAC returns nil: there is no PAC engine to hand scripts to, and the
+// agent does not run them itself.
+func systemPAC() pacResolver {
+	return nil
+}
@@ -0,0 +1,128 @@
+//go:build windows
+
+package netproxy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modWinHTTP                = windows.NewLazySystemDLL("winhttp.dll")
+	procWinHttpOpen           = modWinHTTP.NewProc("WinHttpOpen")
+	procWinHttpSetTimeouts    = modWinHTTP.NewProc("WinHttpSetTimeouts")
+	procWinHttpGetProxyForUrl = modWinHTTP.NewProc("WinHttpGetProxyForUrl")
+
+	modKernel32    = windows.NewLazySystemDLL("kernel32.dll")
+	procGlobalFree = modKernel32.NewProc("GlobalFree")
+)
+
+const (
+	winhttpAccessTypeNoProxy   = 1
+	winhttpAccessTypeNamed     = 3
+	winhttpAutoProxyConfigURL  = 0x2
+	winhttpTimeoutMillis       = 15000
+	winhttpResolveTimeoutMilli = 10000
+)
+
+// winhttpAutoProxyOptions mirrors WINHTTP_AUTOPROXY_OPTIONS.
+type winhttpAutoProxyOptions struct {
+	Flags                uint32
+	AutoDetectFlags      uint32
+	AutoConfigURL        *uint16
+	Reserved             uintptr
+	ReservedDword        uint32
+	AutoLogonIfChallenge int32
+}
+
+// winhttpProxyInfo mirrors WINHTTP_PROXY_INFO.
+type winhttpProxyInfo struct {
+	AccessType  uint32
+	Proxy       *uint16
+	ProxyBypass *uint16
+}
+
+var (
+	winhttpOnce    sync.Once
+	winhttpSession uintptr
+	winhttpErr     error
+)
+
+// systemPAC evaluates PAC scripts with WinHTTP, which downloads, caches and
+// runs them outside the agent.
+func systemPAC() pacResolver {
+	return winhttpProxyForURL
+}
+
+func winhttpProxyForURL(_ context.Context, pacURL string, target *url.URL) (string, error) {
+	winhttpOnce.Do(func() {
+		agent, _ := windows.UTF16PtrFromString("AppCenter-Agent")
+		h, _, err := procWinHttpOpen.Call(uintptr(unsafe.Pointer(agent)), winhttpAccessTypeNoProxy, 0, 0, 0)
+		if h == 0 {
+			winhttpErr = fmt.Errorf("WinHttpOpen: %w", err)
+			return
+		}
+		procWinHttpSetTimeouts.Call(h, winhttpResolveTimeoutMilli, winhttpTimeoutMillis, winhttpTimeoutMillis, winhttpTimeoutMillis)
+		winhttpSession = h
+	})
+	if winhttpErr != nil {
+		return "", winhttpErr
+	}
+
+	// WinHTTP only evaluates http(s) targets; the WebSocket upgrade goes
+	// through the same proxy as its http(s) counterpart.
+	t := *target
+	switch strings.ToLower(t.Scheme) {
+	case "ws":
+		t.Scheme = "http"
+	case "wss":
+		t.Scheme = "https"
+	}
+	targetW, err := windows.UTF16PtrFromString(pacTargetURL(&t))
+	if err != nil {
+		return "", err
+	}
+	pacW, err := windows.UTF16PtrFromString(pacURL)
+	if err != nil {
+		return "", err
+	}
+	opts := winhttpAutoProxyOptions{
+		Flags:                winhttpAutoProxyConfigURL,
+		AutoConfigURL:        pacW,
+		AutoLogonIfChallenge: 1,
+	}
+	var info winhttpProxyInfo
+	ok, _, err := procWinHttpGetProxyForUrl.Call(winhttpSession,
+		uintptr(unsafe.Pointer(targetW)),
+		uintptr(unsafe.Pointer(&opts)),
+		uintptr(unsafe.Pointer(&info)))
+	if ok == 0 {
+		return "", fmt.Errorf("WinHttpGetProxyForUrl: %w", err)
+	}
+	defer func() {
+		for _, p := range []*uint16{info.Proxy, info.ProxyBypass} {
+			if p != nil {
+				procGlobalFree.Call(uintptr(unsafe.Pointer(p)))
+			}
+		}
+	}()
+	if info.AccessType != winhttpAccessTypeNamed || info.Proxy == nil {
+		return "", nil
+	}
+	return windows.UTF16PtrToString(info.Proxy), nil
+}
+
+// pacTargetURL is the URL handed to the PAC script. As in browsers, https
+// URLs are reduced to scheme and host so the script cannot see paths.
+func pacTargetURL(u *url.URL) string {
+	if strings.EqualFold(u.Scheme, "https") {
+		return u.Scheme + "://" + u.Host + "/"
+	}
+	return u.String()
+}
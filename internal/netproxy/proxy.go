@@ -0,0 +1,216 @@
+// Package netproxy decides which proxy, if any, every outbound connection of
+// the agent goes through: API calls, the WebSocket upgrade, downloads,
+// runtime updates and the relay upstream. LAN traffic between agents (P2P)
+// never uses it.
+//
+// The service runs as SYSTEM on Windows and does not see per-user proxy
+// settings, so the proxy is configured in network.proxy: a fixed URL
+// (http, https or socks5), a PAC script, a bypass list and Basic
+// credentials. PAC scripts are evaluated by WinHTTP on Windows and are not
+// supported elsewhere; the agent never runs them itself. Without
+// configuration the environment (HTTPS_PROXY, NO_PROXY) applies, which was
+// the behavior before this package.
+package netproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/config"
+	"appcenter-agent/pkg/utils"
+)
+
+// pacRetryInterval is how long a PAC script that could not be evaluated is
+// skipped in favor of the fixed URL.
+const pacRetryInterval = 5 * time.Minute
+
+// Proxy selects the proxy for a request. A nil *Proxy uses the environment.
+type Proxy struct {
+	fixed  *url.URL
+	direct bool
+	bypass []bypassRule
+	user   *url.Userinfo
+	pacURL string
+	logger *log.Logger
+
+	// resolvePAC evaluates pacURL; nil where the OS has no PAC engine.
+	// Tests replace it.
+	resolvePAC pacResolver
+
+	mu sync.Mutex
+	// pacFailed is when the PAC script last could not be evaluated.
+	pacFailed time.Time
+}
+
+// New builds a Proxy from network.proxy. The PAC script, if any, is loaded
+// by the OS on first use.
+func New(cfg config.ProxyConfig, logger *log.Logger) (*Proxy, error) {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	p := &Proxy{
+		pacURL: strings.TrimSpace(cfg.PACURL),
+		logger: logger,
+	}
+	if p.pacURL != "" {
+		if p.resolvePAC = systemPAC(); p.resolvePAC == nil {
+			logger.Printf("proxy: pac_url is only evaluated on Windows; using url or the environment")
+		}
+	}
+	raw := strings.TrimSpace(cfg.URL)
+	switch {
+	case raw == "":
+	case strings.EqualFold(raw, "direct"):
+		p.direct = true
+	default:
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("proxy url %q is not a URL", raw)
+		}
+		p.fixed = u
+	}
+	if cfg.Username != "" {
+		p.user = url.UserPassword(cfg.Username, cfg.Password)
+		utils.RegisterSecret(cfg.Password)
+	}
+	for _, b := range cfg.Bypass {
+		if r, ok := parseBypass(b); ok {
+			p.bypass = append(p.bypass, r)
+		}
+	}
+	return p, nil
+}
+
+var (
+	defaultMu sync.RWMutex
+	shared    *Proxy
+)
+
+// Configure installs the process-wide proxy from cfg.Network.Proxy. On an
+// invalid configuration the environment stays in effect.
+func Configure(cfg config.Config, logger *log.Logger) *Proxy {
+	p, err := New(cfg.Network.Proxy, logger)
+	if err != nil {
+		if logger != nil {
+			logger.Printf("proxy: %v; using environment", err)
+		}
+		p = nil
+	}
+	defaultMu.Lock()
+	shared = p
+	defaultMu.Unlock()
+	return p
+}
+
+// Default returns the process-wide proxy (nil until Configure).
+func Default() *Proxy {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return shared
+}
+
+// Transport returns a clone of http.DefaultTransport routed through the
+// process-wide proxy.
+func Transport() *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = Default().ProxyFunc()
+	return tr
+}
+
+// ProxyFunc is for http.Transport.Proxy.
+func (p *Proxy) ProxyFunc() func(*http.Request) (*url.URL, error) {
+	if p == nil {
+		return http.ProxyFromEnvironment
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		return p.ProxyFor(req.Context(), req.URL)
+	}
+}
+
+// ProxyFor returns the proxy for target, or nil to connect directly.
+func (p *Proxy) ProxyFor(ctx context.Context, target *url.URL) (*url.URL, error) {
+	if p == nil {
+		return http.ProxyFromEnvironment(&http.Request{URL: target})
+	}
+	if p.direct || p.bypassed(target.Hostname()) {
+		return nil, nil
+	}
+	var pu *url.URL
+	if list, ok := p.pac(ctx, target); ok {
+		var err error
+		if pu, err = parseProxyList(list); err != nil {
+			p.logger.Printf("proxy: %v", err)
+		} else if pu == nil {
+			return nil, nil
+		}
+	}
+	if pu == nil && p.fixed != nil {
+		c := *p.fixed
+		pu = &c
+	}
+	if pu == nil {
+		// Neither a fixed URL nor a usable PAC: the environment applies, as
+		// it did before network.proxy existed.
+		env, err := http.ProxyFromEnvironment(&http.Request{URL: target})
+		if err != nil || env == nil {
+			return env, err
+		}
+		pu = env
+	}
+	if pu.User == nil && p.user != nil {
+		pu.User = p.user
+	}
+	return pu, nil
+}
+
+// pac evaluates the PAC script for target. A script that cannot be
+// downloaded or run is skipped for pacRetryInterval, so the fixed URL
+// applies without every request waiting on it.
+func (p *Proxy) pac(ctx context.Context, target *url.URL) (string, bool) {
+	if p.resolvePAC == nil {
+		return "", false
+	}
+	p.mu.Lock()
+	failed := p.pacFailed
+	p.mu.Unlock()
+	if !failed.IsZero() && time.Since(failed) < pacRetryInterval {
+		return "", false
+	}
+	list, err := p.resolvePAC(ctx, p.pacURL, target)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.logger.Printf("proxy: PAC %s unavailable: %v", p.pacURL, err)
+		p.pacFailed = time.Now()
+		return "", false
+	}
+	if !p.pacFailed.IsZero() {
+		p.logger.Printf("proxy: PAC %s available again", p.pacURL)
+		p.pacFailed = time.Time{}
+	}
+	return list, true
+}
+
+// HostPort is the address a transport dials for proxy u.
+func HostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return strings.ToLower(net.JoinHostPort(u.Hostname(), port))
+}
@@ -0,0 +1,150 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"appcenter-agent/internal/config"
+)
+
+func TestParseProxyList(t *testing.T) {
+	cases := map[string]string{
+		"":                                  "",
+		"DIRECT":                            "",
+		"proxy.example:3128; backup:3128":   "http://proxy.example:3128",
+		"socks=socks.example:1080":          "socks5://socks.example:1080",
+		"https=proxy.example:8443":          "http://proxy.example:8443",
+		"https://secure.example:443 backup": "https://secure.example:443",
+	}
+	for list, want := range cases {
+		u, err := parseProxyList(list)
+		if err != nil {
+			t.Fatalf("%q: %v", list, err)
+		}
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != want {
+			t.Fatalf("%q: got %q, want %q", list, got, want)
+		}
+	}
+	if _, err := parseProxyList("socks="); err == nil {
+		t.Fatal("entry without address accepted")
+	}
+}
+
+func TestProxyForFixedBypassAndCredentials(t *testing.T) {
+	p, err := New(config.ProxyConfig{
+		URL:      "http://proxy.corp:8080",
+		Bypass:   []string{"*.intra.example", "192.168.0.0/16", "<local>"},
+		Username: "svc",
+		Password: "pw",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, direct := range []string{"https://a.intra.example/", "http://192.168.4.5/", "https://fileserver/", "http://127.0.0.1:8000/"} {
+		u, _ := url.Parse(direct)
+		if pu, _ := p.ProxyFor(ctx, u); pu != nil {
+			t.Fatalf("%s should bypass the proxy, got %s", direct, pu)
+		}
+	}
+	u, _ := url.Parse("https://appcenter.example.com/api/v1/agent/heartbeat")
+	pu, err := p.ProxyFor(ctx, u)
+	if err != nil || pu == nil {
+		t.Fatalf("ProxyFor = %v, %v", pu, err)
+	}
+	if pu.Host != "proxy.corp:8080" || pu.User.Username() != "svc" {
+		t.Fatalf("proxy = %s", pu.Redacted())
+	}
+	if HostPort(pu) != "proxy.corp:8080" {
+		t.Fatalf("HostPort = %q", HostPort(pu))
+	}
+}
+
+func TestPACSelectsProxyAndFallsBack(t *testing.T) {
+	p, err := New(config.ProxyConfig{PACURL: "http://wpad/wpad.dat", URL: "http://fallback:3128"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	var fail error
+	p.resolvePAC = func(_ context.Context, pacURL string, target *url.URL) (string, error) {
+		calls++
+		if pacURL != "http://wpad/wpad.dat" {
+			t.Fatalf("pacURL = %q", pacURL)
+		}
+		if fail != nil {
+			return "", fail
+		}
+		if strings.HasSuffix(target.Hostname(), ".intra.example") {
+			return "", nil
+		}
+		return "socks=socks.example:1080", nil
+	}
+	ctx := context.Background()
+
+	u, _ := url.Parse("http://files.cdn.example/a.msi")
+	pu, err := p.ProxyFor(ctx, u)
+	if err != nil || pu == nil || pu.String() != "socks5://socks.example:1080" {
+		t.Fatalf("ProxyFor = %v, %v", pu, err)
+	}
+	intra, _ := url.Parse("https://srv.intra.example/")
+	if pu, _ := p.ProxyFor(ctx, intra); pu != nil {
+		t.Fatalf("PAC DIRECT ignored: %s", pu)
+	}
+
+	// A script that cannot be evaluated leaves the fixed URL in effect and
+	// is not retried for every request.
+	fail = errors.New("ERROR_WINHTTP_UNABLE_TO_DOWNLOAD_SCRIPT")
+	for i := 0; i < 3; i++ {
+		if pu, _ := p.ProxyFor(ctx, intra); pu == nil || pu.Host != "fallback:3128" {
+			t.Fatalf("fallback proxy = %v", pu)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("PAC evaluated %d times, want 3", calls)
+	}
+	fail = nil
+	p.mu.Lock()
+	p.pacFailed = time.Now().Add(-2 * pacRetryInterval)
+	p.mu.Unlock()
+	if pu, _ := p.ProxyFor(ctx, intra); pu != nil {
+		t.Fatalf("PAC not retried after %s: %s", pacRetryInterval, pu)
+	}
+}
+
+func TestTransportSendsThroughProxyWithBasicAuth(t *testing.T) {
+	var gotURL, gotAuth string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURL, gotAuth = r.URL.String(), r.Header.Get("Proxy-Authorization")
+		_, _ = w.Write([]byte("via proxy"))
+	}))
+	defer proxy.Close()
+
+	Configure(config.Config{Network: config.NetworkConfig{Proxy: config.ProxyConfig{
+		URL: proxy.URL, Username: "svc", Password: "pw",
+	}}}, nil)
+	defer Configure(config.Config{}, nil)
+
+	client := &http.Client{Transport: Transport(), Timeout: 5 * time.Second}
+	resp, err := client.Get("http://appcenter.invalid/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if gotURL != "http://appcenter.invalid/health" {
+		t.Fatalf("proxy saw %q", gotURL)
+	}
+	if !strings.HasPrefix(gotAuth, "Basic ") {
+		t.Fatalf("Proxy-Authorization = %q", gotAuth)
+	}
+}
@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"appcenter-agent/internal/reqsign"
+)
+
+// announcement is the signed UDP datagram a node sends periodically.
+type announcement struct {
+	V         int      `json:"v"`
+	Agent     string   `json:"agent"`
+	HTTPPort  int      `json:"http_port"`
+	Hashes    []string `json:"hashes"`
+	Timestamp string   `json:"ts"`
+	Nonce     string   `json:"nonce"`
+	Signature string   `json:"sig"`
+}
+
+func (a announcement) signature(key string) string {
+	payload := a.Agent + "\n" + strconv.Itoa(a.HTTPPort) + "\n" + strings.Join(a.Hashes, ",")
+	return reqsign.Compute(key, "P2P", "announce", a.Timestamp, a.Nonce, reqsign.HashBody([]byte(payload)))
+}
+
+func (n *Node) announceLoop(ctx context.Context) {
+	n.Announce()
+	t := time.NewTicker(n.opts.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n.Announce()
+		}
+	}
+}
+
+// Announce sends the current cache contents to the group and static peers.
+func (n *Node) Announce() {
+	nonce, err := reqsign.NewNonce()
+	if err != nil {
+		return
+	}
+	a := announcement{
+		V:         1,
+		Agent:     n.opts.AgentID,
+		HTTPPort:  n.http.Addr().(*net.TCPAddr).Port,
+		Hashes:    n.opts.Cache.Hashes(maxAnnouncedHashes),
+		Timestamp: strconv.FormatInt(reqsign.Now().Unix(), 10),
+		Nonce:     nonce,
+	}
+	a.Signature = a.signature(n.opts.Key)
+	b, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+	targets := append([]string(nil), n.opts.Peers...)
+	if n.opts.Group != "" {
+		targets = append(targets, n.opts.Group)
+	}
+	for _, target := range targets {
+		addr, err := net.ResolveUDPAddr("udp4", target)
+		if err != nil {
+			continue
+		}
+		_, _ = n.udp.WriteToUDP(b, addr)
+	}
+}
+
+func (n *Node) receiveLoop(conn *net.UDPConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		size, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		n.handleAnnouncement(buf[:size], from)
+	}
+}
+
+func (n *Node) handleAnnouncement(b []byte, from *net.UDPAddr) {
+	var a announcement
+	if json.Unmarshal(b, &a) != nil || a.V != 1 || a.Agent == n.opts.AgentID {
+		return
+	}
+	if !hmac.Equal([]byte(a.signature(n.opts.Key)), []byte(a.Signature)) {
+		return
+	}
+	ts, err := strconv.ParseInt(a.Timestamp, 10, 64)
+	if err != nil {
+		return
+	}
+	if skew := reqsign.Now().Sub(time.Unix(ts, 0)); skew > reqsign.DefaultMaxSkew || skew < -reqsign.DefaultMaxSkew {
+		return
+	}
+	if a.HTTPPort <= 0 || a.HTTPPort > 65535 {
+		return
+	}
+	addr := net.JoinHostPort(from.IP.String(), strconv.Itoa(a.HTTPPort))
+	now := n.nowFn()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, h := range a.Hashes {
+		if len(h) != 64 {
+			continue
+		}
+		if n.peers[h] == nil {
+			n.peers[h] = map[string]time.Time{}
+		}
+		n.peers[h][addr] = now
+	}
+}
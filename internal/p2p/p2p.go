@@ -0,0 +1,290 @@
+// Package p2p lets agents on the same LAN share downloaded package content.
+//
+// Every node announces the SHA-256 hashes held in its download cache over
+// UDP (multicast and/or static peers) and serves those entries over HTTP.
+// Announcements and content requests are signed with a site key shared by
+// the agents, so only enrolled agents can discover or pull content; the
+// downloader still verifies every file against the command's hash.
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/dlcache"
+	"appcenter-agent/internal/reqsign"
+)
+
+const (
+	// DefaultPort is used for HTTP content and UDP announcements.
+	DefaultPort = 47777
+	// DefaultGroup is the multicast group announcements are sent to.
+	DefaultGroup = "239.255.77.77:47777"
+
+	defaultInterval   = 30 * time.Second
+	defaultMaxUploads = 4
+	// maxAnnouncedHashes keeps an announcement within a single datagram.
+	maxAnnouncedHashes = 100
+
+	contentPath = "/p2p/v1/content/"
+)
+
+// Options configures a Node.
+type Options struct {
+	AgentID string
+	// Key is the site key shared by agents; announcements and requests
+	// signed with another key are ignored.
+	Key string
+	// HTTPAddr and UDPAddr are listen addresses (default ":47777").
+	HTTPAddr string
+	UDPAddr  string
+	// Group is the multicast group; empty disables multicast.
+	Group string
+	// Peers are static "host:port" UDP targets for networks without
+	// multicast.
+	Peers      []string
+	Interval   time.Duration
+	MaxUploads int
+	Cache      *dlcache.Cache
+	Logger     *log.Logger
+}
+
+// OptionsFromConfig maps cfg.P2P onto Options.
+func OptionsFromConfig(cfg config.Config, cache *dlcache.Cache, logger *log.Logger) Options {
+	port := cfg.P2P.Port
+	if port <= 0 {
+		port = DefaultPort
+	}
+	addr := ":" + strconv.Itoa(port)
+	return Options{
+		AgentID:    cfg.Agent.UUID,
+		Key:        cfg.P2P.Key,
+		HTTPAddr:   addr,
+		UDPAddr:    addr,
+		Group:      cfg.P2P.Group,
+		Peers:      cfg.P2P.Peers,
+		MaxUploads: cfg.P2P.MaxUploads,
+		Cache:      cache,
+		Logger:     logger,
+	}
+}
+
+// Node announces local content, tracks peers and serves content.
+type Node struct {
+	opts    Options
+	udp     *net.UDPConn
+	mcast   *net.UDPConn
+	http    net.Listener
+	server  *http.Server
+	client  *http.Client
+	nonces  *reqsign.NonceCache
+	uploads chan struct{}
+
+	mu    sync.Mutex
+	peers map[string]map[string]time.Time // hash -> peer http addr -> last seen
+	nowFn func() time.Time
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Start opens the listeners and begins announcing until ctx is done or Close
+// is called.
+func Start(ctx context.Context, opts Options) (*Node, error) {
+	if opts.Key == "" {
+		return nil, errors.New("p2p: key is required")
+	}
+	if opts.Cache == nil {
+		return nil, errors.New("p2p: cache is required")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+	if opts.MaxUploads <= 0 {
+		opts.MaxUploads = defaultMaxUploads
+	}
+	if opts.HTTPAddr == "" {
+		opts.HTTPAddr = ":" + strconv.Itoa(DefaultPort)
+	}
+	if opts.UDPAddr == "" {
+		opts.UDPAddr = opts.HTTPAddr
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+
+	n := &Node{
+		opts:    opts,
+		nonces:  reqsign.NewNonceCache(0),
+		uploads: make(chan struct{}, opts.MaxUploads),
+		peers:   map[string]map[string]time.Time{},
+		nowFn:   time.Now,
+		client: &http.Client{Transport: &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: 3 * time.Second}).DialContext,
+			ResponseHeaderTimeout: 10 * time.Second,
+		}},
+	}
+
+	ua, err := net.ResolveUDPAddr("udp4", opts.UDPAddr)
+	if err != nil {
+		return nil, err
+	}
+	if n.udp, err = net.ListenUDP("udp4", ua); err != nil {
+		return nil, fmt.Errorf("p2p: udp listen: %w", err)
+	}
+	if opts.Group != "" {
+		ga, err := net.ResolveUDPAddr("udp4", opts.Group)
+		if err == nil {
+			n.mcast, err = net.ListenMulticastUDP("udp4", nil, ga)
+		}
+		if err != nil {
+			opts.Logger.Printf("p2p: multicast disabled: %v", err)
+			n.mcast = nil
+		}
+	}
+	if n.http, err = net.Listen("tcp4", opts.HTTPAddr); err != nil {
+		n.closeSockets()
+		return nil, fmt.Errorf("p2p: http listen: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(contentPath, n.serveContent)
+	n.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, n.cancel = context.WithCancel(ctx)
+	n.wg.Add(3)
+	go func() { defer n.wg.Done(); _ = n.server.Serve(n.http) }()
+	go func() { defer n.wg.Done(); n.receiveLoop(n.udp) }()
+	go func() { defer n.wg.Done(); n.announceLoop(ctx) }()
+	if n.mcast != nil {
+		n.wg.Add(1)
+		go func() { defer n.wg.Done(); n.receiveLoop(n.mcast) }()
+	}
+	go func() {
+		<-ctx.Done()
+		n.closeSockets()
+		_ = n.server.Close()
+	}()
+	return n, nil
+}
+
+// Close stops the node and waits for its goroutines.
+func (n *Node) Close() {
+	n.cancel()
+	n.closeSockets()
+	_ = n.server.Close()
+	n.wg.Wait()
+}
+
+func (n *Node) closeSockets() {
+	if n.udp != nil {
+		_ = n.udp.Close()
+	}
+	if n.mcast != nil {
+		_ = n.mcast.Close()
+	}
+}
+
+// HTTPAddr is the bound content address.
+func (n *Node) HTTPAddr() string { return n.http.Addr().String() }
+
+// UDPAddr is the bound announcement address.
+func (n *Node) UDPAddr() string { return n.udp.LocalAddr().String() }
+
+// Sources returns peer:// sources for peers that announced hash, most
+// recently seen first.
+func (n *Node) Sources(hash string) []string {
+	hash, err := dlcache.NormalizeHash(hash)
+	if err != nil {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	type seen struct {
+		addr string
+		at   time.Time
+	}
+	var list []seen
+	cutoff := n.nowFn().Add(-3 * n.opts.Interval)
+	for addr, at := range n.peers[hash] {
+		if at.Before(cutoff) {
+			delete(n.peers[hash], addr)
+			continue
+		}
+		list = append(list, seen{addr, at})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].at.After(list[j].at) })
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = "peer://" + s.addr + contentPath + hash
+	}
+	return out
+}
+
+// Do implements downloader.PeerTransport: it rewrites peer:// to http:// and
+// signs the request with the site key.
+func (n *Node) Do(req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	u := *req.URL
+	u.Scheme = "http"
+	out.URL = &u
+	out.Host = u.Host
+	creds := reqsign.Credentials{AgentUUID: n.opts.AgentID, Secret: n.opts.Key, Mode: reqsign.ModeSigned}
+	if err := creds.Sign(out, nil); err != nil {
+		return nil, err
+	}
+	return n.client.Do(out)
+}
+
+func (n *Node) serveContent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reqsign.Verify(r, nil, n.opts.Key, reqsign.Now(), 0, n.nonces); err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	hash := strings.TrimPrefix(r.URL.Path, contentPath)
+	entry, ok := n.opts.Cache.Acquire(hash)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	defer entry.Release()
+
+	select {
+	case n.uploads <- struct{}{}:
+		defer func() { <-n.uploads }()
+	default:
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	f, err := os.Open(entry.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, "stat failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", `"`+entry.Hash+`"`)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+entry.Name+`"`)
+	http.ServeContent(w, r, entry.Name, fi.ModTime(), f)
+}
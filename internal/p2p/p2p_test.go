@@ -0,0 +1,158 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"appcenter-agent/internal/dlcache"
+	"appcenter-agent/internal/downloader"
+)
+
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().String()
+}
+
+func startNode(t *testing.T, id, key, udp string, peers []string) (*Node, *dlcache.Cache) {
+	t.Helper()
+	cache, err := dlcache.Open(filepath.Join(t.TempDir(), "cache"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := Start(context.Background(), Options{
+		AgentID:  id,
+		Key:      key,
+		HTTPAddr: "127.0.0.1:0",
+		UDPAddr:  udp,
+		Peers:    peers,
+		Interval: time.Hour,
+		Cache:    cache,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Close)
+	return n, cache
+}
+
+func seed(t *testing.T, cache *dlcache.Cache, data []byte, name string) string {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	e, err := cache.Insert(hash, src, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Release()
+	return hash
+}
+
+func waitSources(t *testing.T, n *Node, hash string) []string {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if s := n.Sources(hash); len(s) > 0 {
+			return s
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestPeersShareContentBeforeServer(t *testing.T) {
+	udpA, udpB, udpC := freeUDPAddr(t), freeUDPAddr(t), freeUDPAddr(t)
+	a, cacheA := startNode(t, "agent-a", "site-key", udpA, []string{udpB, udpC})
+	b, cacheB := startNode(t, "agent-b", "site-key", udpB, []string{udpA})
+	c, _ := startNode(t, "agent-c", "other-key", udpC, []string{udpA})
+
+	payload := bytes.Repeat([]byte("installer-"), 5000)
+	hash := seed(t, cacheA, payload, "setup.msi")
+	a.Announce()
+
+	sources := waitSources(t, b, hash)
+	if len(sources) != 1 {
+		t.Fatalf("b should learn a's content, got %v", sources)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if s := c.Sources(hash); len(s) != 0 {
+		t.Fatalf("node with another key must ignore announcements: %v", s)
+	}
+
+	var serverHits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverHits.Add(1)
+		_, _ = w.Write(payload)
+	}))
+	defer srv.Close()
+
+	opts := downloader.Options{LimitKBps: 100 * 1024, Peer: b, Sources: downloader.NewSourceTracker()}
+	entry, err := downloader.FetchSources(context.Background(), cacheB, append(sources, srv.URL+"/setup.msi"), hash, opts)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	defer entry.Release()
+	if serverHits.Load() != 0 {
+		t.Fatalf("content should come from the peer, server hit %d times", serverHits.Load())
+	}
+	if entry.Name != "setup.msi" {
+		t.Fatalf("unexpected name %q", entry.Name)
+	}
+	if got, _ := os.ReadFile(entry.Path); !bytes.Equal(got, payload) {
+		t.Fatal("unexpected content")
+	}
+}
+
+func TestUnknownKeyIsRejectedAndServerIsFallback(t *testing.T) {
+	a, cacheA := startNode(t, "agent-a", "site-key", freeUDPAddr(t), nil)
+	c, cacheC := startNode(t, "agent-c", "other-key", freeUDPAddr(t), nil)
+
+	payload := []byte("private installer")
+	hash := seed(t, cacheA, payload, "tool.exe")
+	peerSrc := "peer://" + a.HTTPAddr() + contentPath + hash
+
+	req, _ := http.NewRequest(http.MethodGet, peerSrc, nil)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("request signed with another key: status %d, want 401", resp.StatusCode)
+	}
+
+	var serverHits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverHits.Add(1)
+		_, _ = w.Write(payload)
+	}))
+	defer srv.Close()
+
+	opts := downloader.Options{LimitKBps: 1024, Peer: c, Sources: downloader.NewSourceTracker()}
+	entry, err := downloader.FetchSources(context.Background(), cacheC, []string{peerSrc, srv.URL + "/tool.exe"}, hash, opts)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	entry.Release()
+	if serverHits.Load() != 1 {
+		t.Fatalf("expected server fallback, hits=%d", serverHits.Load())
+	}
+}
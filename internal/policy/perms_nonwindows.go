@@ -0,0 +1,33 @@
+//go:build !windows
+
+package policy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DefaultPath is where administrators place the policy file.
+func DefaultPath() string {
+	return "/etc/appcenter-agent/policy.yaml"
+}
+
+// checkAdminOnly refuses a policy file that non-root users could modify.
+func checkAdminOnly(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("policy %s is writable by group/other (%o)", path, fi.Mode().Perm())
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Uid != 0 && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("policy %s is owned by uid %d", path, st.Uid)
+	}
+	if di, err := os.Stat(filepath.Dir(path)); err == nil && di.Mode().Perm()&0o002 != 0 && di.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("policy directory %s is world-writable", filepath.Dir(path))
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package policy
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLoadRejectsWritablePolicy(t *testing.T) {
+	path := writePolicy(t, samplePolicy)
+	if err := os.Chmod(path, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path, ""); err == nil {
+		t.Fatal("expected error for group/other writable policy")
+	}
+}
@@ -0,0 +1,75 @@
+//go:build windows
+
+package policy
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// DefaultPath is where administrators place the policy file.
+func DefaultPath() string {
+	return `C:\ProgramData\AppCenter\policy.yaml`
+}
+
+// modifyRights are the access rights that let a holder change or replace
+// the policy file, directly or by rewriting its permissions.
+const modifyRights = windows.FILE_WRITE_DATA | windows.FILE_APPEND_DATA |
+	windows.FILE_WRITE_EA | windows.FILE_WRITE_ATTRIBUTES |
+	windows.DELETE | windows.WRITE_DAC | windows.WRITE_OWNER |
+	windows.GENERIC_WRITE | windows.GENERIC_ALL
+
+// checkAdminOnly refuses a policy file not owned by SYSTEM, Administrators or
+// the account the agent runs as (LocalSystem for the service), or whose DACL
+// lets anyone else modify it.
+func checkAdminOnly(path string) error {
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT,
+		windows.OWNER_SECURITY_INFORMATION|windows.DACL_SECURITY_INFORMATION)
+	if err != nil {
+		return fmt.Errorf("policy %s: read security info: %w", path, err)
+	}
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return fmt.Errorf("policy %s: read owner: %w", path, err)
+	}
+	if !trustedSID(owner) {
+		return fmt.Errorf("policy %s is owned by %s, not SYSTEM/Administrators", path, owner.String())
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return fmt.Errorf("policy %s: read DACL: %w", path, err)
+	}
+	if dacl == nil {
+		// A NULL DACL grants everyone full access.
+		return fmt.Errorf("policy %s has no DACL", path)
+	}
+	for i := uint32(0); i < uint32(dacl.AceCount); i++ {
+		var ace *windows.ACCESS_ALLOWED_ACE
+		if err := windows.GetAce(dacl, i, &ace); err != nil {
+			return fmt.Errorf("policy %s: read ACE %d: %w", path, i, err)
+		}
+		if ace.Header.AceType != windows.ACCESS_ALLOWED_ACE_TYPE || ace.Header.AceFlags&windows.INHERIT_ONLY_ACE != 0 {
+			continue
+		}
+		if uint32(ace.Mask)&modifyRights == 0 {
+			continue
+		}
+		sid := (*windows.SID)(unsafe.Pointer(&ace.SidStart))
+		if !trustedSID(sid) {
+			return fmt.Errorf("policy %s grants write access to %s", path, sid.String())
+		}
+	}
+	return nil
+}
+
+// trustedSID reports whether sid is SYSTEM, Administrators or the account
+// the agent runs as.
+func trustedSID(sid *windows.SID) bool {
+	if sid.IsWellKnown(windows.WinLocalSystemSid) || sid.IsWellKnown(windows.WinBuiltinAdministratorsSid) {
+		return true
+	}
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	return err == nil && windows.EqualSid(sid, user.User.Sid)
+}
@@ -0,0 +1,295 @@
+// Package policy enforces a locally controlled, admin-only policy file that
+// limits what the server may make the agent do.
+//
+// Without a policy file every server action is allowed (legacy behavior). A
+// policy file that cannot be trusted (bad permissions, bad signature, parse
+// error) puts the agent into lockdown: every server action is rejected until
+// an administrator fixes the file.
+package policy
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"appcenter-agent/internal/urlguard"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Server-initiated actions that are not install commands.
+const (
+	ActionSelfUpdate    = "self_update"
+	ActionRestart       = "restart"
+	ActionRemoteSupport = "remote_support"
+)
+
+// Rejection codes reported to the server.
+const (
+	RejectionCode = "policy_rejected"
+
+	RuleActionDenied      = "action_denied"
+	RuleDownloadHost      = "download_host"
+	RuleDownloadShare     = "download_share"
+	RuleUnattendedSupport = "unattended_remote_support"
+	RuleForceDowngrade    = "force_downgrade"
+	RulePolicyInvalid     = "policy_invalid"
+)
+
+const (
+	signatureSuffix = ".sig"
+	maxFileSize     = 1 << 20
+)
+
+// Policy is the on-disk policy document.
+type Policy struct {
+	Version       int                `yaml:"version"`
+	Actions       ActionRules        `yaml:"actions"`
+	Download      DownloadRules      `yaml:"download"`
+	RemoteSupport RemoteSupportRules `yaml:"remote_support"`
+	Update        UpdateRules        `yaml:"update"`
+	Install       InstallRules       `yaml:"install"`
+
+	path     string
+	lockdown string
+}
+
+type ActionRules struct {
+	// Allow, when non-empty, is the exhaustive list of permitted actions.
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+type DownloadRules struct {
+	// AllowedHosts restricts download URLs to these hosts ("*.example.com"
+	// matches subdomains). The configured server host is always allowed.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// AllowedShares restricts file-share sources (UNC paths, file:// URLs)
+	// to these roots. Once any download rule is set, shares outside the list
+	// are rejected.
+	AllowedShares []string `yaml:"allowed_shares"`
+}
+
+type RemoteSupportRules struct {
+	// ForbidUnattended rejects sessions that do not require user approval.
+	ForbidUnattended bool `yaml:"forbid_unattended"`
+}
+
+type UpdateRules struct {
+	// DisableForceDowngrade rejects "force" self-updates to an older version.
+	DisableForceDowngrade bool `yaml:"disable_force_downgrade"`
+}
+
+type InstallRules struct {
+	// MaxTimeoutSec caps install.timeout_sec (0 = no cap).
+	MaxTimeoutSec int `yaml:"max_timeout_sec"`
+}
+
+// Rejection is returned when the policy forbids a server request.
+type Rejection struct {
+	Action string
+	Rule   string
+	Detail string
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("%s: %s %s: %s", RejectionCode, r.Rule, r.Action, r.Detail)
+}
+
+// Permanent tells the task queue not to retry a rejected command.
+func (r *Rejection) Permanent() bool { return true }
+
+// ErrorCode is reported as the task status error_code.
+func (r *Rejection) ErrorCode() string { return RejectionCode }
+
+// Load reads the policy at path. A missing file returns (nil, nil). When
+// publicKey (base64 Ed25519) is set, path+".sig" must hold a valid base64
+// signature over the file contents.
+func Load(path, publicKey string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if publicKey != "" {
+			return nil, fmt.Errorf("policy %s missing but policy.public_key is set", path)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxFileSize {
+		return nil, fmt.Errorf("policy %s too large", path)
+	}
+	if err := checkAdminOnly(path); err != nil {
+		return nil, err
+	}
+	if publicKey != "" {
+		if err := verifySignature(path, b, publicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	var p Policy
+	if err := yaml.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", path, err)
+	}
+	p.path = path
+	return &p, nil
+}
+
+// Lockdown returns a policy that rejects every server action. It is used
+// when a policy file exists but cannot be trusted.
+func Lockdown(reason string) *Policy {
+	return &Policy{lockdown: reason}
+}
+
+func verifySignature(path string, content []byte, publicKey string) error {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("policy.public_key is not a base64 Ed25519 key")
+	}
+	raw, err := os.ReadFile(path + signatureSuffix)
+	if err != nil {
+		return fmt.Errorf("policy signature: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return fmt.Errorf("policy signature: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), content, sig) {
+		return errors.New("policy signature mismatch")
+	}
+	return nil
+}
+
+// Describe summarizes the policy for IPC status output.
+func (p *Policy) Describe() map[string]any {
+	if p == nil {
+		return map[string]any{"active": false}
+	}
+	if p.lockdown != "" {
+		return map[string]any{"active": true, "lockdown": p.lockdown}
+	}
+	return map[string]any{"active": true, "path": p.path}
+}
+
+// CheckAction rejects actions denied by the policy. Empty actions are
+// treated as "install", the default command action.
+func (p *Policy) CheckAction(action string) error {
+	if p == nil {
+		return nil
+	}
+	action = strings.ToLower(strings.TrimSpace(action))
+	if action == "" {
+		action = "install"
+	}
+	if p.lockdown != "" {
+		return &Rejection{Action: action, Rule: RulePolicyInvalid, Detail: p.lockdown}
+	}
+	if contains(p.Actions.Deny, action) {
+		return &Rejection{Action: action, Rule: RuleActionDenied, Detail: "action is in actions.deny"}
+	}
+	if len(p.Actions.Allow) > 0 && !contains(p.Actions.Allow, action) {
+		return &Rejection{Action: action, Rule: RuleActionDenied, Detail: "action is not in actions.allow"}
+	}
+	return nil
+}
+
+// CheckDownloadURL rejects downloads from hosts outside download.allowed_hosts.
+// The host of serverURL is always trusted.
+func (p *Policy) CheckDownloadURL(rawURL, serverURL string) error {
+	if p == nil || len(p.Download.AllowedHosts) == 0 {
+		return nil
+	}
+	if strings.HasPrefix(rawURL, "/") {
+		// Relative URLs are resolved against server.url.
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return &Rejection{Action: "download", Rule: RuleDownloadHost, Detail: "invalid download url"}
+	}
+	host := strings.ToLower(u.Hostname())
+	if su, err := url.Parse(serverURL); err == nil && strings.EqualFold(su.Hostname(), host) {
+		return nil
+	}
+	for _, allowed := range p.Download.AllowedHosts {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == host {
+			return nil
+		}
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok && strings.HasSuffix(host, "."+suffix) {
+			return nil
+		}
+	}
+	return &Rejection{Action: "download", Rule: RuleDownloadHost, Detail: "host " + host + " is not in download.allowed_hosts"}
+}
+
+// CheckShare rejects file-share sources outside download.allowed_shares.
+// Shares are unrestricted only while the policy sets no download rules, so
+// restricting hosts cannot be bypassed through a share mirror.
+func (p *Policy) CheckShare(src string) error {
+	if p == nil || (len(p.Download.AllowedHosts) == 0 && len(p.Download.AllowedShares) == 0) {
+		return nil
+	}
+	if urlguard.ShareWithin(src, p.Download.AllowedShares) {
+		return nil
+	}
+	return &Rejection{Action: "download", Rule: RuleDownloadShare, Detail: "share " + src + " is not in download.allowed_shares"}
+}
+
+// CheckSource applies CheckShare to file-share sources and CheckDownloadURL
+// to everything else.
+func (p *Policy) CheckSource(src, serverURL string) error {
+	if urlguard.IsShare(src) {
+		return p.CheckShare(src)
+	}
+	return p.CheckDownloadURL(src, serverURL)
+}
+
+// CheckRemoteSupport rejects remote support when denied, or unattended
+// sessions when remote_support.forbid_unattended is set.
+func (p *Policy) CheckRemoteSupport(requiresApproval bool) error {
+	if err := p.CheckAction(ActionRemoteSupport); err != nil {
+		return err
+	}
+	if p != nil && p.RemoteSupport.ForbidUnattended && !requiresApproval {
+		return &Rejection{Action: ActionRemoteSupport, Rule: RuleUnattendedSupport, Detail: "sessions must require user approval"}
+	}
+	return nil
+}
+
+// CheckSelfUpdate rejects self-updates when denied, or force downgrades when
+// update.disable_force_downgrade is set.
+func (p *Policy) CheckSelfUpdate(force, downgrade bool) error {
+	if err := p.CheckAction(ActionSelfUpdate); err != nil {
+		return err
+	}
+	if p != nil && force && downgrade && p.Update.DisableForceDowngrade {
+		return &Rejection{Action: ActionSelfUpdate, Rule: RuleForceDowngrade, Detail: "force downgrades are disabled"}
+	}
+	return nil
+}
+
+// CapInstallTimeout limits sec to install.max_timeout_sec.
+func (p *Policy) CapInstallTimeout(sec int) int {
+	if p == nil || p.Install.MaxTimeoutSec <= 0 {
+		return sec
+	}
+	if sec <= 0 || sec > p.Install.MaxTimeoutSec {
+		return p.Install.MaxTimeoutSec
+	}
+	return sec
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if strings.EqualFold(strings.TrimSpace(s), v) {
+			return true
+		}
+	}
+	return false
+}
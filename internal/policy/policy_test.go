@@ -0,0 +1,189 @@
+package policy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const samplePolicy = `version: 1
+actions:
+  deny: [uninstall]
+download:
+  allowed_hosts: ["cdn.example.com", "*.mirror.example.com"]
+remote_support:
+  forbid_unattended: true
+update:
+  disable_force_downgrade: true
+install:
+  max_timeout_sec: 600
+`
+
+func writePolicy(t *testing.T, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func rule(err error) string {
+	var rej *Rejection
+	if errors.As(err, &rej) {
+		return rej.Rule
+	}
+	return ""
+}
+
+func TestMissingPolicyAllowsEverything(t *testing.T) {
+	p, err := Load(filepath.Join(t.TempDir(), "none.yaml"), "")
+	if err != nil || p != nil {
+		t.Fatalf("Load = %v, %v; want nil, nil", p, err)
+	}
+	if err := p.CheckAction("uninstall"); err != nil {
+		t.Fatalf("nil policy rejected action: %v", err)
+	}
+	if err := p.CheckRemoteSupport(false); err != nil {
+		t.Fatalf("nil policy rejected remote support: %v", err)
+	}
+	if got := p.CapInstallTimeout(1800); got != 1800 {
+		t.Fatalf("CapInstallTimeout = %d", got)
+	}
+}
+
+func TestPolicyRules(t *testing.T) {
+	p, err := Load(writePolicy(t, samplePolicy), "")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if err := p.CheckAction(""); err != nil {
+		t.Fatalf("install rejected: %v", err)
+	}
+	if got := rule(p.CheckAction("Uninstall")); got != RuleActionDenied {
+		t.Fatalf("uninstall rule = %q", got)
+	}
+
+	server := "https://appcenter.local:8000"
+	for _, u := range []string{"/uploads/app.msi", "https://appcenter.local/x.msi", "https://cdn.example.com/x.msi", "https://eu.mirror.example.com/x.msi"} {
+		if err := p.CheckDownloadURL(u, server); err != nil {
+			t.Fatalf("%s rejected: %v", u, err)
+		}
+	}
+	for _, u := range []string{"https://evil.example.net/x.msi", "https://mirror.example.com.evil.net/x"} {
+		if got := rule(p.CheckDownloadURL(u, server)); got != RuleDownloadHost {
+			t.Fatalf("%s rule = %q", u, got)
+		}
+	}
+
+	if got := rule(p.CheckRemoteSupport(false)); got != RuleUnattendedSupport {
+		t.Fatalf("unattended rule = %q", got)
+	}
+	if err := p.CheckRemoteSupport(true); err != nil {
+		t.Fatalf("attended session rejected: %v", err)
+	}
+
+	if got := rule(p.CheckSelfUpdate(true, true)); got != RuleForceDowngrade {
+		t.Fatalf("force downgrade rule = %q", got)
+	}
+	if err := p.CheckSelfUpdate(true, false); err != nil {
+		t.Fatalf("force reinstall rejected: %v", err)
+	}
+
+	if got := p.CapInstallTimeout(1800); got != 600 {
+		t.Fatalf("CapInstallTimeout(1800) = %d", got)
+	}
+	if got := p.CapInstallTimeout(300); got != 300 {
+		t.Fatalf("CapInstallTimeout(300) = %d", got)
+	}
+}
+
+func TestShareSources(t *testing.T) {
+	// Restricting hosts alone also closes file-share mirrors.
+	p, err := Load(writePolicy(t, samplePolicy), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rule(p.CheckSource(`\\fs01\packages\x.msi`, "https://appcenter.local")); got != RuleDownloadShare {
+		t.Fatalf("share with hosts-only policy rule = %q", got)
+	}
+
+	p, err = Load(writePolicy(t, "download:\n  allowed_shares: ['\\\\fs01\\packages']\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []string{`\\fs01\packages\x.msi`, "//FS01/Packages/sub/x.msi", "file://fs01/packages/x.msi"} {
+		if err := p.CheckSource(src, ""); err != nil {
+			t.Fatalf("%s rejected: %v", src, err)
+		}
+	}
+	for _, src := range []string{`\\fs01\other\x.msi`, `\\fs01\packages-evil\x.msi`, `\\fs01\packages\..\other\x.msi`} {
+		if got := rule(p.CheckSource(src, "")); got != RuleDownloadShare {
+			t.Fatalf("%s rule = %q", src, got)
+		}
+	}
+	// Shares-only policy leaves HTTP hosts alone.
+	if err := p.CheckSource("https://cdn.example.net/x.msi", "https://appcenter.local"); err != nil {
+		t.Fatalf("http source rejected: %v", err)
+	}
+
+	var none *Policy
+	if err := none.CheckSource(`\\fs01\other\x.msi`, ""); err != nil {
+		t.Fatalf("nil policy rejected share: %v", err)
+	}
+}
+
+func TestAllowListRejectsUnlistedActions(t *testing.T) {
+	p, err := Load(writePolicy(t, "actions:\n  allow: [install]\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CheckAction("install"); err != nil {
+		t.Fatal(err)
+	}
+	if got := rule(p.CheckAction(ActionRestart)); got != RuleActionDenied {
+		t.Fatalf("restart rule = %q", got)
+	}
+}
+
+func TestSignedPolicy(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := base64.StdEncoding.EncodeToString(pub)
+	path := writePolicy(t, samplePolicy)
+
+	if _, err := Load(path, key); err == nil {
+		t.Fatal("expected error for missing signature")
+	}
+
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(samplePolicy)))
+	if err := os.WriteFile(path+".sig", []byte(sig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path, key); err != nil {
+		t.Fatalf("Load signed: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(samplePolicy+"install:\n  max_timeout_sec: 0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path, key); err == nil {
+		t.Fatal("expected signature mismatch after tampering")
+	}
+}
+
+func TestLockdownRejectsEverything(t *testing.T) {
+	p := Lockdown("bad signature")
+	for _, action := range []string{"install", ActionRestart, ActionSelfUpdate, ActionRemoteSupport} {
+		if got := rule(p.CheckAction(action)); got != RulePolicyInvalid {
+			t.Fatalf("%s rule = %q", action, got)
+		}
+	}
+}
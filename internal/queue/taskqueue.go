@@ -2,12 +2,14 @@ package queue
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"sort"
 	"sync"
 	"time"
 
 	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/clock"
 	"appcenter-agent/internal/config"
 )
 
@@ -17,6 +19,19 @@ type ExecutionResult struct {
 	DownloadDurationSec int
 	InstallDurationSec  int
 	Message             string
+	// Status replaces the reported "success" (e.g. "staged" for prestage
+	// commands). Such results do not mark the app as installed.
+	Status string
+	// InstallerRan is set once the installer was started, whatever its
+	// outcome; rejected, failed or staged downloads leave it false.
+	InstallerRan bool
+}
+
+// PermanentError is implemented by execution errors that must not be retried
+// (e.g. policy rejections); the task is dropped after the first report.
+type PermanentError interface {
+	error
+	Permanent() bool
 }
 
 type ExecuteFunc func(context.Context, api.Command) (ExecutionResult, error)
@@ -53,7 +68,7 @@ func NewTaskQueue(maxRetries int) *TaskQueue {
 		retries:    make(map[int]*RetryInfo),
 		maxRetries: maxRetries,
 		installed:  make(map[int]string),
-		nowFn:      time.Now,
+		nowFn:      clock.Now,
 		randIntn:   rand.Intn,
 	}
 }
@@ -87,7 +102,18 @@ func (q *TaskQueue) ConsumeAppsChanged() (bool, []api.InstalledApp) {
 		return false, []api.InstalledApp{}
 	}
 	q.appsChanged = false
+	return true, q.installedLocked()
+}
 
+// InstalledApps returns the apps installed by tasks since the queue was
+// created, ordered by app ID.
+func (q *TaskQueue) InstalledApps() []api.InstalledApp {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.installedLocked()
+}
+
+func (q *TaskQueue) installedLocked() []api.InstalledApp {
 	appIDs := make([]int, 0, len(q.installed))
 	for id := range q.installed {
 		appIDs = append(appIDs, id)
@@ -98,7 +124,7 @@ func (q *TaskQueue) ConsumeAppsChanged() (bool, []api.InstalledApp) {
 	for _, id := range appIDs {
 		apps = append(apps, api.InstalledApp{AppID: id, Version: q.installed[id]})
 	}
-	return true, apps
+	return apps
 }
 
 func (q *TaskQueue) ProcessOne(
@@ -126,14 +152,25 @@ func (q *TaskQueue) ProcessOne(
 
 	result, err := execute(ctx, task)
 	if err != nil {
-		q.handleFailure(task.TaskID)
+		var perm PermanentError
+		if errors.As(err, &perm) && perm.Permanent() {
+			q.drop(task.TaskID)
+		} else {
+			q.handleFailure(task.TaskID)
+		}
+		var coded interface{ ErrorCode() string }
+		errorCode := ""
+		if errors.As(err, &coded) {
+			errorCode = coded.ErrorCode()
+		}
 		exitCode := result.ExitCode
 		_ = report(ctx, task.TaskID, api.TaskStatusRequest{
-			Status:   "failed",
-			Progress: 0,
-			Message:  err.Error(),
-			ExitCode: &exitCode,
-			Error:    err.Error(),
+			Status:    "failed",
+			Progress:  0,
+			Message:   err.Error(),
+			ExitCode:  &exitCode,
+			Error:     err.Error(),
+			ErrorCode: errorCode,
 		})
 		return true
 	}
@@ -141,10 +178,14 @@ func (q *TaskQueue) ProcessOne(
 	if result.Message == "" {
 		result.Message = "Installation completed successfully"
 	}
+	status := "success"
+	if result.Status != "" {
+		status = result.Status
+	}
 
 	exitCode := result.ExitCode
 	_ = report(ctx, task.TaskID, api.TaskStatusRequest{
-		Status:              "success",
+		Status:              status,
 		Progress:            100,
 		Message:             result.Message,
 		ExitCode:            &exitCode,
@@ -153,6 +194,10 @@ func (q *TaskQueue) ProcessOne(
 		InstallDurationSec:  result.InstallDurationSec,
 	})
 
+	if status != "success" {
+		q.drop(task.TaskID)
+		return true
+	}
 	q.handleSuccess(task)
 	return true
 }
@@ -213,6 +258,14 @@ func (q *TaskQueue) handleFailure(taskID int) {
 	retry.NextRetryAt = q.nowFn().Add(retryDelay)
 }
 
+func (q *TaskQueue) drop(taskID int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.tasks, taskID)
+	delete(q.retries, taskID)
+}
+
 func (q *TaskQueue) handleSuccess(task api.Command) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -89,3 +89,68 @@ func TestShouldExecuteNowAlwaysTrue(t *testing.T) {
 		t.Fatal("task should always execute")
 	}
 }
+
+type permanentErr struct{}
+
+func (permanentErr) Error() string     { return "rejected" }
+func (permanentErr) Permanent() bool   { return true }
+func (permanentErr) ErrorCode() string { return "policy_rejected" }
+
+func TestPermanentErrorIsNotRetried(t *testing.T) {
+	q := NewTaskQueue(3)
+	q.randIntn = func(_ int) int { return 0 }
+
+	q.AddCommands([]api.Command{{TaskID: 30, AppID: 1}})
+
+	var reported api.TaskStatusRequest
+	q.ProcessOne(
+		context.Background(),
+		time.Now(),
+		defaultConfig(),
+		func(context.Context, api.Command) (ExecutionResult, error) {
+			return ExecutionResult{ExitCode: -1}, permanentErr{}
+		},
+		func(_ context.Context, _ int, req api.TaskStatusRequest) error {
+			reported = req
+			return nil
+		},
+	)
+
+	if reported.Status != "failed" || reported.ErrorCode != "policy_rejected" {
+		t.Fatalf("unexpected report: %+v", reported)
+	}
+	if q.PendingCount() != 0 {
+		t.Fatalf("pending=%d, want 0 (no retry)", q.PendingCount())
+	}
+}
+
+func TestStagedResultDoesNotMarkInstalled(t *testing.T) {
+	q := NewTaskQueue(3)
+	q.randIntn = func(_ int) int { return 0 }
+
+	q.AddCommands([]api.Command{{TaskID: 30, AppID: 7, AppVersion: "2.0", Action: api.ActionPrestage}})
+
+	reported := api.TaskStatusRequest{}
+	q.ProcessOne(
+		context.Background(),
+		time.Now(),
+		defaultConfig(),
+		func(context.Context, api.Command) (ExecutionResult, error) {
+			return ExecutionResult{Status: "staged", Message: "Content staged"}, nil
+		},
+		func(_ context.Context, _ int, req api.TaskStatusRequest) error {
+			reported = req
+			return nil
+		},
+	)
+
+	if reported.Status != "staged" {
+		t.Fatalf("status=%s, want staged", reported.Status)
+	}
+	if changed, _ := q.ConsumeAppsChanged(); changed {
+		t.Fatal("staged content must not mark the app installed")
+	}
+	if q.PendingCount() != 0 {
+		t.Fatal("staged task should leave the queue")
+	}
+}
@@ -0,0 +1,126 @@
+package relay
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"appcenter-agent/internal/reqsign"
+)
+
+// DefaultDiscoveryGroup is where relays announce themselves.
+const DefaultDiscoveryGroup = "239.255.77.77:47778"
+
+const beaconInterval = 15 * time.Second
+
+// beacon advertises a relay URL, signed with the site key so a rogue host
+// cannot redirect agents to itself.
+type beacon struct {
+	V         int    `json:"v"`
+	URL       string `json:"url"`
+	Timestamp string `json:"ts"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"sig"`
+}
+
+func (b beacon) signature(key string) string {
+	return reqsign.Compute(key, "RELAY", "beacon", b.Timestamp, b.Nonce, reqsign.HashBody([]byte(b.URL)))
+}
+
+// RunBeacon announces relayURL to targets (multicast group or unicast
+// addresses) until ctx is done.
+func RunBeacon(ctx context.Context, relayURL, key string, targets []string, interval time.Duration) error {
+	if key == "" {
+		return errors.New("relay: beacon key is required")
+	}
+	if interval <= 0 {
+		interval = beaconInterval
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	send := func() {
+		nonce, err := reqsign.NewNonce()
+		if err != nil {
+			return
+		}
+		b := beacon{V: 1, URL: relayURL, Timestamp: strconv.FormatInt(reqsign.Now().Unix(), 10), Nonce: nonce}
+		b.Signature = b.signature(key)
+		payload, _ := json.Marshal(b)
+		for _, t := range targets {
+			if addr, err := net.ResolveUDPAddr("udp4", t); err == nil {
+				_, _ = conn.WriteToUDP(payload, addr)
+			}
+		}
+	}
+	send()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			send()
+		}
+	}
+}
+
+// Discover waits on listenAddr (a multicast group or a unicast address) for
+// the first correctly signed relay beacon and returns its URL.
+func Discover(ctx context.Context, listenAddr, key string) (string, error) {
+	if key == "" {
+		return "", errors.New("relay: discovery key is required")
+	}
+	addr, err := net.ResolveUDPAddr("udp4", listenAddr)
+	if err != nil {
+		return "", err
+	}
+	var conn *net.UDPConn
+	if addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp4", nil, addr)
+	} else {
+		conn, err = net.ListenUDP("udp4", addr)
+	}
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	defer conn.Close()
+
+	buf := make([]byte, 4096)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			return "", err
+		}
+		var b beacon
+		if json.Unmarshal(buf[:n], &b) != nil || b.V != 1 || b.URL == "" {
+			continue
+		}
+		if !hmac.Equal([]byte(b.signature(key)), []byte(b.Signature)) {
+			continue
+		}
+		ts, err := strconv.ParseInt(b.Timestamp, 10, 64)
+		if err != nil {
+			continue
+		}
+		if skew := reqsign.Now().Sub(time.Unix(ts, 0)); skew > reqsign.DefaultMaxSkew || skew < -reqsign.DefaultMaxSkew {
+			continue
+		}
+		return b.URL, nil
+	}
+}
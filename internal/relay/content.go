@@ -0,0 +1,221 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// contentMeta maps a request path to cached content and the validators the
+// upstream returned for it.
+type contentMeta struct {
+	Path               string `json:"path"`
+	Hash               string `json:"hash"`
+	Name               string `json:"name"`
+	ETag               string `json:"etag,omitempty"`
+	LastModified       string `json:"last_modified,omitempty"`
+	ContentType        string `json:"content_type,omitempty"`
+	ContentDisposition string `json:"content_disposition,omitempty"`
+}
+
+// conditionalHeaders are removed from upstream requests: the relay sets its
+// own validators and serves ranges from the cached copy.
+var conditionalHeaders = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"}
+
+// serveCached revalidates a cached copy with the agent's own signed request,
+// so the server still authorizes every download, and only transfers the
+// body over the WAN when the relay does not have it.
+func (s *Server) serveCached(w http.ResponseWriter, r *http.Request) {
+	key := metaKey(r.URL)
+	meta := s.loadMeta(key)
+	if meta != nil && (meta.ETag != "" || meta.LastModified != "") {
+		if entry, ok := s.opts.Cache.Acquire(meta.Hash); ok {
+			defer entry.Release()
+			up := s.upstreamRequest(r)
+			if meta.ETag != "" {
+				up.Header.Set("If-None-Match", meta.ETag)
+			} else {
+				up.Header.Set("If-Modified-Since", meta.LastModified)
+			}
+			resp, err := s.client.Do(up)
+			if err != nil {
+				s.logger.Printf("relay: revalidate %s: %v", r.URL.Path, err)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			switch resp.StatusCode {
+			case http.StatusNotModified:
+				s.serveEntry(w, r, entry.Path, meta)
+			case http.StatusOK:
+				s.fill(w, resp, key, r.URL.Path)
+			default:
+				copyResponse(w, resp)
+			}
+			return
+		}
+	}
+
+	if r.Header.Get("Range") != "" {
+		// A resume of content the relay does not hold is passed through.
+		s.proxy.ServeHTTP(w, r)
+		return
+	}
+	resp, err := s.client.Do(s.upstreamRequest(r))
+	if err != nil {
+		s.logger.Printf("relay: fetch %s: %v", r.URL.Path, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		copyResponse(w, resp)
+		return
+	}
+	s.fill(w, resp, key, r.URL.Path)
+}
+
+// fill streams resp to the agent and stores it when the upstream supplied a
+// validator for later revalidation.
+func (s *Server) fill(w http.ResponseWriter, resp *http.Response, key, reqPath string) {
+	etag, lastMod := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag == "" && lastMod == "" {
+		copyResponse(w, resp)
+		return
+	}
+	if err := os.MkdirAll(s.metaDir, 0o755); err != nil {
+		copyResponse(w, resp)
+		return
+	}
+	tmp, err := os.CreateTemp(s.metaDir, "fill-*")
+	if err != nil {
+		copyResponse(w, resp)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, tmp, h), resp.Body)
+	closeErr := tmp.Close()
+	if err != nil || closeErr != nil || (resp.ContentLength >= 0 && n != resp.ContentLength) {
+		return
+	}
+	s.store(tmp.Name(), h, key, &contentMeta{
+		Path:               reqPath,
+		Name:               contentName(resp.Header.Get("Content-Disposition"), reqPath),
+		ETag:               etag,
+		LastModified:       lastMod,
+		ContentType:        resp.Header.Get("Content-Type"),
+		ContentDisposition: resp.Header.Get("Content-Disposition"),
+	})
+}
+
+func (s *Server) store(tmpPath string, h hash.Hash, key string, meta *contentMeta) {
+	meta.Hash = hex.EncodeToString(h.Sum(nil))
+	entry, err := s.opts.Cache.Insert(meta.Hash, tmpPath, meta.Name)
+	if err != nil {
+		s.logger.Printf("relay: cache %s: %v", meta.Path, err)
+		return
+	}
+	entry.Release()
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+	p := filepath.Join(s.metaDir, key+".json")
+	if err := os.WriteFile(p+".tmp", b, 0o644); err == nil {
+		_ = os.Rename(p+".tmp", p)
+	}
+}
+
+func (s *Server) serveEntry(w http.ResponseWriter, r *http.Request, file string, meta *contentMeta) {
+	f, err := os.Open(file)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer f.Close()
+	if meta.ETag != "" {
+		w.Header().Set("ETag", meta.ETag)
+	}
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	if meta.ContentDisposition != "" {
+		w.Header().Set("Content-Disposition", meta.ContentDisposition)
+	}
+	modTime, _ := http.ParseTime(meta.LastModified)
+	http.ServeContent(w, r, meta.Name, modTime, f)
+}
+
+func (s *Server) loadMeta(key string) *contentMeta {
+	b, err := os.ReadFile(filepath.Join(s.metaDir, key+".json"))
+	if err != nil {
+		return nil
+	}
+	var m contentMeta
+	if json.Unmarshal(b, &m) != nil || m.Hash == "" {
+		return nil
+	}
+	return &m
+}
+
+// upstreamRequest copies the agent's request, including its signature
+// headers, for the upstream.
+func (s *Server) upstreamRequest(r *http.Request) *http.Request {
+	out := r.Clone(r.Context())
+	u := *s.upstream
+	u.Path = strings.TrimRight(s.upstream.Path, "/") + r.URL.Path
+	u.RawPath = ""
+	u.RawQuery = r.URL.RawQuery
+	out.URL = &u
+	out.Host = u.Host
+	out.RequestURI = ""
+	for _, h := range conditionalHeaders {
+		out.Header.Del(h)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		out.Header.Add("X-Forwarded-For", host)
+	}
+	return out
+}
+
+func metaKey(u *url.URL) string {
+	sum := sha256.Sum256([]byte(u.RequestURI()))
+	return hex.EncodeToString(sum[:])
+}
+
+func contentName(disposition, reqPath string) string {
+	if disposition != "" {
+		if _, params, err := mime.ParseMediaType(disposition); err == nil && params["filename"] != "" {
+			return params["filename"]
+		}
+	}
+	return path.Base(reqPath)
+}
+
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func copyHeaders(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Package relay lets one agent act as the API and content gateway for its
+// site.
+//
+// The relay forwards /api/v1/agent/* (including the WebSocket endpoint) to
+// the real server unchanged. Only agents using auth_mode signed keep their
+// secret from the relay: their signatures and WS challenge responses are
+// checked by the server. The legacy and compat modes send the secret header,
+// which the relay could read, so such requests are refused unless
+// AllowLegacyAuth is set, and agents never adopt a discovered relay unless
+// they sign. Package and runtime downloads are cached;
+// a cached copy is only served after the server has authorized the same
+// request with a 304 Not Modified.
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/dlcache"
+	"appcenter-agent/internal/netproxy"
+	"appcenter-agent/internal/reqsign"
+)
+
+// DefaultListen is the relay listen address when relay.listen is empty.
+const DefaultListen = ":8470"
+
+// CachedPrefixes are paths whose GET responses are cached.
+var CachedPrefixes = []string{"/api/v1/agent/download/", "/uploads/agent_runtime/"}
+
+// proxiedPrefixes are the only paths the relay exposes.
+var proxiedPrefixes = []string{"/api/v1/agent/", "/uploads/agent_runtime/"}
+
+// Options configures a Server.
+type Options struct {
+	// Upstream is the real server URL.
+	Upstream string
+	Listen   string
+	// TLSCertFile/TLSKeyFile enable HTTPS on the listener.
+	TLSCertFile string
+	TLSKeyFile  string
+	// RequireSigned rejects API requests carrying X-Agent-Secret and
+	// WebSocket upgrades without X-Agent-Signature. Only agents with
+	// auth_mode "signed" sign the upgrade, and they also leave the secret
+	// out of agent.auth, so the relay never sees a usable secret.
+	RequireSigned bool
+	// Cache stores downloaded content; nil disables caching.
+	Cache *dlcache.Cache
+	// Transport reaches the upstream (default: through the agent proxy).
+	Transport http.RoundTripper
+	Logger    *log.Logger
+}
+
+// Downstream is what the relay knows about an agent behind it.
+type Downstream struct {
+	UUID        string    `json:"uuid"`
+	RemoteAddr  string    `json:"remote_addr"`
+	LastSeen    time.Time `json:"last_seen"`
+	WSConnected bool      `json:"ws_connected"`
+	Reachable   bool      `json:"reachable"`
+	Requests    int64     `json:"requests"`
+}
+
+type downstream struct {
+	Downstream
+	wsConns int
+}
+
+// Server is the relay HTTP handler.
+type Server struct {
+	opts     Options
+	upstream *url.URL
+	proxy    *httputil.ReverseProxy
+	client   *http.Client
+	logger   *log.Logger
+	metaDir  string
+
+	mu     sync.Mutex
+	agents map[string]*downstream
+	nowFn  func() time.Time
+}
+
+// New validates opts and builds the relay.
+func New(opts Options) (*Server, error) {
+	u, err := url.Parse(strings.TrimRight(strings.TrimSpace(opts.Upstream), "/"))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("relay: upstream must be an http(s) URL")
+	}
+	if opts.Transport == nil {
+		opts.Transport = netproxy.Transport()
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+	s := &Server{
+		opts:     opts,
+		upstream: u,
+		logger:   opts.Logger,
+		agents:   map[string]*downstream{},
+		nowFn:    time.Now,
+		client: &http.Client{
+			Transport: opts.Transport,
+			// Redirects are passed to the agent, which applies its URL policy.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+	s.proxy = httputil.NewSingleHostReverseProxy(u)
+	s.proxy.Transport = opts.Transport
+	director := s.proxy.Director
+	s.proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = u.Host
+	}
+	s.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		s.logger.Printf("relay: upstream %s %s: %v", r.Method, r.URL.Path, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	if opts.Cache != nil {
+		s.metaDir = filepath.Join(opts.Cache.Dir(), "relay-index")
+	}
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !hasPrefix(r.URL.Path, proxiedPrefixes) {
+		http.NotFound(w, r)
+		return
+	}
+	ws := isWebSocket(r)
+	if s.opts.RequireSigned && (r.Header.Get(reqsign.HeaderSecret) != "" ||
+		ws && r.Header.Get(reqsign.HeaderSignature) == "") {
+		http.Error(w, "relay requires auth_mode=signed", http.StatusForbidden)
+		return
+	}
+
+	uuid := r.Header.Get(reqsign.HeaderUUID)
+	s.track(uuid, r.RemoteAddr, ws, +1)
+	if ws {
+		defer s.track(uuid, r.RemoteAddr, true, -1)
+	}
+
+	if r.Method == http.MethodGet && s.opts.Cache != nil && hasPrefix(r.URL.Path, CachedPrefixes) {
+		s.serveCached(w, r)
+		return
+	}
+	s.proxy.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	addr := s.opts.Listen
+	if addr == "" {
+		addr = DefaultListen
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: s, ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	if s.opts.TLSCertFile != "" {
+		err = srv.ServeTLS(ln, s.opts.TLSCertFile, s.opts.TLSKeyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Downstream lists agents seen through the relay. An agent is reachable
+// while its WebSocket is open or it made a request within window.
+func (s *Server) Downstream(window time.Duration) []Downstream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.nowFn()
+	out := make([]Downstream, 0, len(s.agents))
+	for _, a := range s.agents {
+		d := a.Downstream
+		d.WSConnected = a.wsConns > 0
+		d.Reachable = d.WSConnected || now.Sub(d.LastSeen) <= window
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UUID < out[j].UUID })
+	return out
+}
+
+func (s *Server) track(uuid, remoteAddr string, ws bool, delta int) {
+	if uuid == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.agents[uuid]
+	if !ok {
+		a = &downstream{Downstream: Downstream{UUID: uuid}}
+		s.agents[uuid] = a
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		a.RemoteAddr = host
+	}
+	a.LastSeen = s.nowFn()
+	if delta > 0 {
+		a.Requests++
+	}
+	if ws {
+		a.wsConns += delta
+	}
+}
+
+func hasPrefix(p string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
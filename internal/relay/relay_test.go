@@ -0,0 +1,199 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"appcenter-agent/internal/dlcache"
+	"appcenter-agent/internal/reqsign"
+)
+
+const agentSecret = "downstream-secret"
+
+// upstream verifies agent signatures like the real server and serves one
+// package with an ETag.
+func newUpstream(t *testing.T, payload []byte, bodies *atomic.Int32) *httptest.Server {
+	t.Helper()
+	nonces := reqsign.NewNonceCache(0)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := reqsign.Verify(r, nil, agentSecret, time.Now(), 0, nonces); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/agent/store":
+			_, _ = w.Write([]byte(`{"apps":[]}`))
+		case "/api/v1/agent/download/5":
+			w.Header().Set("ETag", `"pkg-v1"`)
+			w.Header().Set("Content-Disposition", `attachment; filename="setup.msi"`)
+			if r.Header.Get("If-None-Match") == `"pkg-v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			bodies.Add(1)
+			_, _ = w.Write(payload)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func newRelay(t *testing.T, upstream string) (*Server, *httptest.Server) {
+	t.Helper()
+	cache, err := dlcache.Open(filepath.Join(t.TempDir(), "relay-cache"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Options{Upstream: upstream, RequireSigned: true, Cache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(s)
+	t.Cleanup(front.Close)
+	return s, front
+}
+
+func signedGet(t *testing.T, url, secret string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	creds := reqsign.Credentials{AgentUUID: "agent-1", Secret: secret, Mode: reqsign.ModeSigned}
+	if err := creds.Sign(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestRelayForwardsSignedRequestsEndToEnd(t *testing.T) {
+	var bodies atomic.Int32
+	up := newUpstream(t, nil, &bodies)
+	defer up.Close()
+	_, front := newRelay(t, up.URL)
+
+	resp := signedGet(t, front.URL+"/api/v1/agent/store", agentSecret)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("signed request through relay: status %d", resp.StatusCode)
+	}
+
+	// The relay has no way to produce a valid signature for another secret.
+	resp = signedGet(t, front.URL+"/api/v1/agent/store", "forged")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("forged signature: status %d, want 401", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, front.URL+"/api/v1/agent/store", nil)
+	req.Header.Set(reqsign.HeaderSecret, agentSecret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("legacy secret header through relay: status %d, want 403", resp.StatusCode)
+	}
+
+	// An unsigned upgrade would carry the secret in agent.auth.
+	req, _ = http.NewRequest(http.MethodGet, front.URL+"/api/v1/agent/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set(reqsign.HeaderUUID, "agent-1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unsigned WS upgrade through relay: status %d, want 403", resp.StatusCode)
+	}
+
+	resp, err = http.Get(front.URL + "/admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("non-agent path exposed: status %d", resp.StatusCode)
+	}
+}
+
+func TestRelayCachesContentAfterServerAuthorization(t *testing.T) {
+	payload := bytes.Repeat([]byte("pkg"), 10000)
+	var bodies atomic.Int32
+	up := newUpstream(t, payload, &bodies)
+	defer up.Close()
+	_, front := newRelay(t, up.URL)
+
+	for i := 0; i < 3; i++ {
+		resp := signedGet(t, front.URL+"/api/v1/agent/download/5", agentSecret)
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(got, payload) {
+			t.Fatalf("download %d: status %d len %d", i, resp.StatusCode, len(got))
+		}
+	}
+	if n := bodies.Load(); n != 1 {
+		t.Fatalf("package crossed the WAN %d times, want 1", n)
+	}
+
+	// A cached copy is never served to a request the server rejects.
+	resp := signedGet(t, front.URL+"/api/v1/agent/download/5", "forged")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthorized download served from cache: status %d", resp.StatusCode)
+	}
+}
+
+func TestDownstreamReachability(t *testing.T) {
+	var bodies atomic.Int32
+	up := newUpstream(t, nil, &bodies)
+	defer up.Close()
+	s, front := newRelay(t, up.URL)
+
+	now := time.Now()
+	s.nowFn = func() time.Time { return now }
+	signedGet(t, front.URL+"/api/v1/agent/store", agentSecret).Body.Close()
+
+	list := s.Downstream(time.Minute)
+	if len(list) != 1 || list[0].UUID != "agent-1" || !list[0].Reachable || list[0].Requests != 1 {
+		t.Fatalf("unexpected downstream: %+v", list)
+	}
+	now = now.Add(2 * time.Minute)
+	if list := s.Downstream(time.Minute); list[0].Reachable {
+		t.Fatalf("silent agent should be unreachable: %+v", list)
+	}
+}
+
+func TestBeaconDiscovery(t *testing.T) {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := c.LocalAddr().String()
+	c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	go func() { _ = RunBeacon(ctx, "http://rogue:8470", "wrong-key", []string{addr}, 20*time.Millisecond) }()
+	go func() { _ = RunBeacon(ctx, "http://relay01:8470", "site-key", []string{addr}, 20*time.Millisecond) }()
+
+	got, err := Discover(ctx, addr, "site-key")
+	if err != nil {
+		t.Fatalf("discover: %v", err)
+	}
+	if got != "http://relay01:8470" {
+		t.Fatalf("discovered %q", got)
+	}
+}
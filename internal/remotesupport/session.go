@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"appcenter-agent/internal/api"
+	"appcenter-agent/internal/audit"
+	"appcenter-agent/internal/clock"
 )
 
 type SessionState string
@@ -25,11 +27,13 @@ type SessionManager struct {
 	state   SessionState
 	session int
 
-	client    *api.Client
-	agentUUID string
-	secret    string
-	logger    *log.Logger
-	vnc       *VNCServer
+	client *api.Client
+	creds  api.CredentialProvider
+	logger *log.Logger
+	vnc    *VNCServer
+	audit  *audit.Log
+	// onState is told when a session becomes active and when it ends.
+	onState func(SessionState)
 
 	approvalTimeoutSec  int
 	helperPort          int
@@ -45,7 +49,7 @@ const (
 
 func NewSessionManager(
 	client *api.Client,
-	agentUUID, secret string,
+	creds api.CredentialProvider,
 	approvalTimeoutSec int,
 	logger *log.Logger,
 ) *SessionManager {
@@ -55,8 +59,7 @@ func NewSessionManager(
 	sm := &SessionManager{
 		state:               StateIdle,
 		client:              client,
-		agentUUID:           agentUUID,
-		secret:              secret,
+		creds:               creds,
 		approvalTimeoutSec:  approvalTimeoutSec,
 		logger:              logger,
 		vnc:                 NewVNCServer(logger),
@@ -66,6 +69,29 @@ func NewSessionManager(
 	return sm
 }
 
+// SetAuditLog records approvals, session starts and ends to l.
+func (sm *SessionManager) SetAuditLog(l *audit.Log) {
+	sm.audit = l
+}
+
+// SetStateObserver calls fn when a session becomes active and when the
+// manager returns to idle.
+func (sm *SessionManager) SetStateObserver(fn func(SessionState)) {
+	sm.onState = fn
+}
+
+func (sm *SessionManager) notify(state SessionState) {
+	if sm.onState != nil {
+		sm.onState(state)
+	}
+}
+
+func (sm *SessionManager) record(event string, fields audit.Fields) {
+	if err := sm.audit.Record(event, fields); err != nil {
+		sm.logger.Printf("remote support: audit record failed: %v", err)
+	}
+}
+
 func (sm *SessionManager) State() SessionState {
 	if sm == nil {
 		return StateIdle
@@ -101,7 +127,30 @@ func (sm *SessionManager) CurrentRemoteSupportStatus() *api.RemoteSupportStatus
 	}
 }
 
+// Reject declines a session without starting the helper, e.g. when the local
+// policy forbids it.
+func (sm *SessionManager) Reject(ctx context.Context, sessionID int) {
+	agentUUID, secret := sm.creds.Current()
+	if _, err := sm.client.ApproveRemoteSession(ctx, agentUUID, secret, sessionID, false, 0); err != nil {
+		sm.logger.Printf("remote support: reject report failed: %v", err)
+		return
+	}
+	sm.logger.Printf("remote support: session %d rejected by local policy", sessionID)
+}
+
 func (sm *SessionManager) HandleRequest(ctx context.Context, req api.RemoteSupportRequest) {
+	// timeout_at is server time; compare it on the corrected clock so a
+	// skewed local clock neither drops fresh requests nor shows stale ones.
+	approvalTimeoutSec := sm.approvalTimeoutSec
+	if deadline, err := time.Parse(time.RFC3339, req.TimeoutAt); err == nil {
+		remaining := int(deadline.Sub(clock.Now()) / time.Second)
+		if remaining <= 0 {
+			sm.logger.Printf("remote support: session %d request expired at %s", req.SessionID, req.TimeoutAt)
+			return
+		}
+		approvalTimeoutSec = min(approvalTimeoutSec, remaining)
+	}
+
 	sm.mu.Lock()
 	if sm.state != StateIdle {
 		sm.mu.Unlock()
@@ -127,7 +176,7 @@ func (sm *SessionManager) HandleRequest(ctx context.Context, req api.RemoteSuppo
 	monitorCount := 1
 	if req.RequiresApproval {
 		var err error
-		approved, monitorCount, err = ShowApprovalDialogFromService(req.AdminName, req.Reason, sm.approvalTimeoutSec)
+		approved, monitorCount, err = ShowApprovalDialogFromService(req.AdminName, req.Reason, approvalTimeoutSec)
 		if err != nil {
 			sm.logger.Printf("remote support: approval dialog failed: %v", err)
 			sm.reset()
@@ -145,13 +194,21 @@ func (sm *SessionManager) HandleRequest(ctx context.Context, req api.RemoteSuppo
 		return
 	}
 
-	approveResp, err := sm.client.ApproveRemoteSession(ctx, sm.agentUUID, sm.secret, req.SessionID, approved, monitorCount)
+	agentUUID, secret := sm.creds.Current()
+	approveResp, err := sm.client.ApproveRemoteSession(ctx, agentUUID, secret, req.SessionID, approved, monitorCount)
 	if err != nil {
 		sm.logger.Printf("remote support: approve report failed: %v", err)
 		sm.reset()
 		return
 	}
 	sm.logger.Printf("remote support: approval result approved=%t monitor_count=%d session=%d", approved, monitorCount, req.SessionID)
+	sm.record(audit.EventRemoteSupportApproval, audit.Fields{
+		"session_id":        req.SessionID,
+		"admin":             req.AdminName,
+		"reason":            req.Reason,
+		"approved":          approved,
+		"requires_approval": req.RequiresApproval,
+	})
 	if !approved {
 		sm.logger.Printf("remote support: session %d rejected", req.SessionID)
 		sm.reset()
@@ -196,7 +253,8 @@ func (sm *SessionManager) HandleRequest(ctx context.Context, req api.RemoteSuppo
 	sm.state = StateConnecting
 	sm.mu.Unlock()
 
-	if err := sm.client.ReportRemoteReady(ctx, sm.agentUUID, sm.secret, req.SessionID); err != nil {
+	agentUUID, secret = sm.creds.Current()
+	if err := sm.client.ReportRemoteReady(ctx, agentUUID, secret, req.SessionID); err != nil {
 		sm.logger.Printf("remote support: ready report failed: %v", err)
 		sm.reset()
 		return
@@ -205,7 +263,13 @@ func (sm *SessionManager) HandleRequest(ctx context.Context, req api.RemoteSuppo
 	sm.mu.Lock()
 	sm.state = StateActive
 	sm.mu.Unlock()
+	sm.notify(StateActive)
 	sm.logger.Printf("remote support: session %d active", req.SessionID)
+	sm.record(audit.EventRemoteSupportStart, audit.Fields{
+		"session_id":    req.SessionID,
+		"admin":         req.AdminName,
+		"monitor_count": monitorCount,
+	})
 }
 
 func (sm *SessionManager) HandleEndSignal(ctx context.Context, end api.RemoteSupportEnd) {
@@ -228,9 +292,11 @@ func (sm *SessionManager) EndSession(ctx context.Context, endedBy string) {
 	if sessionID == 0 {
 		return
 	}
-	if err := sm.client.ReportRemoteEnded(ctx, sm.agentUUID, sm.secret, sessionID, endedBy); err != nil {
+	agentUUID, secret := sm.creds.Current()
+	if err := sm.client.ReportRemoteEnded(ctx, agentUUID, secret, sessionID, endedBy); err != nil {
 		sm.logger.Printf("remote support: ended report failed: %v", err)
 	}
+	sm.record(audit.EventRemoteSupportEnd, audit.Fields{"session_id": sessionID, "ended_by": endedBy})
 	sm.reset()
 }
 
@@ -238,7 +304,8 @@ func (sm *SessionManager) reset() {
 	CloseApprovalDialogFromService()
 	sm.vnc.Stop()
 	sm.mu.Lock()
-	defer sm.mu.Unlock()
 	sm.state = StateIdle
 	sm.session = 0
+	sm.mu.Unlock()
+	sm.notify(StateIdle)
 }
@@ -0,0 +1,260 @@
+// Package reqsign implements HMAC request signing for agent -> server calls.
+//
+// Every signed request carries a timestamp, a random nonce and a hash of the
+// body, so a captured request cannot be replayed outside the server's skew
+// window and never exposes the agent secret on the wire.
+package reqsign
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/clock"
+)
+
+const (
+	// ModeLegacy sends X-Agent-UUID/X-Agent-Secret only (pre-signing servers).
+	ModeLegacy = "legacy"
+	// ModeCompat sends both the legacy secret header and the signature headers.
+	// Older servers ignore the signature; newer servers verify it.
+	ModeCompat = "compat"
+	// ModeSigned sends signature headers only; the secret never leaves the agent.
+	ModeSigned = "signed"
+
+	// Scheme is the signature scheme identifier sent to the server.
+	Scheme = "hmac-sha256-v1"
+
+	HeaderUUID        = "X-Agent-UUID"
+	HeaderSecret      = "X-Agent-Secret"
+	HeaderTimestamp   = "X-Agent-Timestamp"
+	HeaderNonce       = "X-Agent-Nonce"
+	HeaderContentHash = "X-Agent-Content-SHA256"
+	HeaderSignature   = "X-Agent-Signature"
+	// HeaderAuthError is set by the server on 401 responses to explain why a
+	// signature was rejected (e.g. "clock_skew", "nonce_reused"), and on 403
+	// responses that reject the credentials themselves (e.g. "revoked").
+	HeaderAuthError = "X-Agent-Auth-Error"
+
+	// DefaultMaxSkew is the clock skew tolerated by Verify.
+	DefaultMaxSkew = 5 * time.Minute
+)
+
+var (
+	ErrMissingSignature = errors.New("missing signature headers")
+	ErrBadSignature     = errors.New("signature mismatch")
+	ErrClockSkew        = errors.New("timestamp outside allowed skew")
+	ErrNonceReused      = errors.New("nonce already used")
+)
+
+// Credentials identifies the agent and selects how requests are authenticated.
+type Credentials struct {
+	AgentUUID string
+	Secret    string
+	Mode      string
+}
+
+// NormalizeMode maps empty/unknown values to ModeCompat.
+func NormalizeMode(mode string) string {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case ModeLegacy:
+		return ModeLegacy
+	case ModeSigned:
+		return ModeSigned
+	default:
+		return ModeCompat
+	}
+}
+
+// ValidMode reports whether mode is one of the supported values (empty allowed).
+func ValidMode(mode string) bool {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", ModeLegacy, ModeCompat, ModeSigned:
+		return true
+	}
+	return false
+}
+
+// Now returns the local time corrected by the server clock offset tracked
+// by internal/clock.
+func Now() time.Time {
+	return clock.Now()
+}
+
+// AdjustClock records the offset between serverTime and the local clock.
+func AdjustClock(serverTime time.Time) {
+	if serverTime.IsZero() {
+		return
+	}
+	clock.Set(time.Until(serverTime))
+}
+
+// ClockOffset returns the currently applied server clock offset.
+func ClockOffset() time.Duration {
+	return clock.Offset()
+}
+
+// Sign attaches authentication headers for the given request and body.
+// body must be the exact bytes that will be sent (nil for GET).
+func (c Credentials) Sign(req *http.Request, body []byte) error {
+	if c.AgentUUID == "" && c.Secret == "" {
+		return nil
+	}
+	mode := NormalizeMode(c.Mode)
+	req.Header.Set(HeaderUUID, c.AgentUUID)
+	if mode == ModeLegacy || mode == ModeCompat {
+		req.Header.Set(HeaderSecret, c.Secret)
+	}
+	if mode == ModeLegacy {
+		return nil
+	}
+
+	nonce, err := NewNonce()
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(Now().Unix(), 10)
+	bodyHash := HashBody(body)
+	sig := Compute(c.Secret, req.Method, requestTarget(req), ts, nonce, bodyHash)
+
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderContentHash, bodyHash)
+	req.Header.Set(HeaderSignature, "v1="+sig)
+	return nil
+}
+
+// Compute returns the hex HMAC-SHA256 over the canonical request string.
+func Compute(secret, method, target, timestamp, nonce, bodyHash string) string {
+	canonical := strings.Join([]string{
+		"v1",
+		strings.ToUpper(method),
+		target,
+		timestamp,
+		nonce,
+		bodyHash,
+	}, "\n")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HashBody returns the hex SHA-256 of body (the hash of empty input for nil).
+func HashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// NewNonce returns 16 random bytes hex-encoded.
+func NewNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("nonce: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ChallengeResponse signs a WS auth challenge issued by the server.
+func (c Credentials) ChallengeResponse(serverNonce string) (map[string]any, error) {
+	nonce, err := NewNonce()
+	if err != nil {
+		return nil, err
+	}
+	ts := strconv.FormatInt(Now().Unix(), 10)
+	sig := Compute(c.Secret, "WS", "agent.auth", ts, nonce, serverNonce)
+	return map[string]any{
+		"uuid":         c.AgentUUID,
+		"scheme":       Scheme,
+		"timestamp":    ts,
+		"nonce":        nonce,
+		"server_nonce": serverNonce,
+		"signature":    "v1=" + sig,
+	}, nil
+}
+
+func requestTarget(req *http.Request) string {
+	if req.URL == nil {
+		return "/"
+	}
+	target := req.URL.EscapedPath()
+	if target == "" {
+		target = "/"
+	}
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+	return target
+}
+
+// NonceCache remembers nonces for the skew window to reject replays.
+type NonceCache struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	seen map[string]time.Time
+}
+
+func NewNonceCache(ttl time.Duration) *NonceCache {
+	if ttl <= 0 {
+		ttl = 2 * DefaultMaxSkew
+	}
+	return &NonceCache{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+// Add returns false if nonce was already seen within the TTL.
+func (n *NonceCache) Add(nonce string, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for k, t := range n.seen {
+		if now.Sub(t) > n.ttl {
+			delete(n.seen, k)
+		}
+	}
+	if _, ok := n.seen[nonce]; ok {
+		return false
+	}
+	n.seen[nonce] = now
+	return true
+}
+
+// Verify checks a signed request. It is the reference implementation for the
+// server side and is also used by components that terminate agent requests
+// locally. nonces may be nil to skip replay detection.
+func Verify(req *http.Request, body []byte, secret string, now time.Time, maxSkew time.Duration, nonces *NonceCache) error {
+	ts := req.Header.Get(HeaderTimestamp)
+	nonce := req.Header.Get(HeaderNonce)
+	sig := strings.TrimPrefix(req.Header.Get(HeaderSignature), "v1=")
+	if ts == "" || nonce == "" || sig == "" {
+		return ErrMissingSignature
+	}
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad timestamp: %w", err)
+	}
+	skew := now.Sub(time.Unix(unix, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return ErrClockSkew
+	}
+	bodyHash := HashBody(body)
+	if h := req.Header.Get(HeaderContentHash); h != "" && !strings.EqualFold(h, bodyHash) {
+		return ErrBadSignature
+	}
+	want := Compute(secret, req.Method, requestTarget(req), ts, nonce, bodyHash)
+	if !hmac.Equal([]byte(want), []byte(strings.ToLower(sig))) {
+		return ErrBadSignature
+	}
+	if nonces != nil && !nonces.Add(nonce, now) {
+		return ErrNonceReused
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package reqsign
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"appcenter-agent/internal/clock"
+)
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	body := []byte(`{"status":"ok"}`)
+	req := httptest.NewRequest(http.MethodPost, "http://example/api/v1/agent/heartbeat?x=1", bytes.NewReader(body))
+	creds := Credentials{AgentUUID: "u1", Secret: "s1", Mode: ModeSigned}
+	if err := creds.Sign(req, body); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if req.Header.Get(HeaderSecret) != "" {
+		t.Fatalf("signed mode must not send secret header")
+	}
+	if req.Header.Get(HeaderUUID) != "u1" {
+		t.Fatalf("uuid header missing")
+	}
+
+	nonces := NewNonceCache(0)
+	if err := Verify(req, body, "s1", time.Now(), 0, nonces); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if err := Verify(req, body, "s1", time.Now(), 0, nonces); !errors.Is(err, ErrNonceReused) {
+		t.Fatalf("replay err=%v, want ErrNonceReused", err)
+	}
+	if err := Verify(req, []byte(`{"status":"tampered"}`), "s1", time.Now(), 0, nil); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("tampered err=%v, want ErrBadSignature", err)
+	}
+	if err := Verify(req, body, "wrong", time.Now(), 0, nil); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("wrong secret err=%v, want ErrBadSignature", err)
+	}
+}
+
+func TestVerifyRejectsSkew(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example/api/v1/agent/store", nil)
+	if err := (Credentials{AgentUUID: "u1", Secret: "s1", Mode: ModeSigned}).Sign(req, nil); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if err := Verify(req, nil, "s1", time.Now().Add(10*time.Minute), 0, nil); !errors.Is(err, ErrClockSkew) {
+		t.Fatalf("err=%v, want ErrClockSkew", err)
+	}
+}
+
+func TestSignModes(t *testing.T) {
+	for _, tc := range []struct {
+		mode       string
+		wantSecret bool
+		wantSig    bool
+	}{
+		{ModeLegacy, true, false},
+		{ModeCompat, true, true},
+		{"", true, true},
+		{ModeSigned, false, true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example/x", nil)
+		if err := (Credentials{AgentUUID: "u1", Secret: "s1", Mode: tc.mode}).Sign(req, nil); err != nil {
+			t.Fatalf("mode=%q sign: %v", tc.mode, err)
+		}
+		if got := req.Header.Get(HeaderSecret) != ""; got != tc.wantSecret {
+			t.Fatalf("mode=%q secret header=%t want %t", tc.mode, got, tc.wantSecret)
+		}
+		if got := req.Header.Get(HeaderSignature) != ""; got != tc.wantSig {
+			t.Fatalf("mode=%q signature header=%t want %t", tc.mode, got, tc.wantSig)
+		}
+	}
+}
+
+func TestAdjustClock(t *testing.T) {
+	defer clock.Set(0)
+	AdjustClock(time.Now().Add(time.Hour))
+	if off := ClockOffset(); off < 59*time.Minute || off > 61*time.Minute {
+		t.Fatalf("offset=%v, want ~1h", off)
+	}
+}
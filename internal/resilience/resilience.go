@@ -0,0 +1,260 @@
+// Package resilience keeps the agent from hammering an overloaded server.
+//
+// Requests are grouped into endpoint classes (heartbeat, signal long-poll,
+// task reports, inventory, WebSocket, everything else). Each class has a
+// circuit breaker: after Threshold consecutive failures (no response, 429 or
+// 5xx) the class is paused for Cooldown, doubling per further failure up to
+// MaxCooldown. A Retry-After header pauses the class for the time the server
+// asked for, regardless of the threshold. 429 and 503 responses also raise a
+// process-wide pressure level that stretches the heartbeat interval; every
+// successful heartbeat lowers it one step.
+package resilience
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/config"
+)
+
+// Endpoint classes.
+const (
+	ClassHeartbeat = "heartbeat"
+	ClassSignal    = "signal"
+	ClassTasks     = "tasks"
+	ClassInventory = "inventory"
+	ClassWS        = "ws"
+	ClassAPI       = "api"
+)
+
+const (
+	// maxRetryAfter caps a server-directed pause so a bad header cannot
+	// silence the agent for days.
+	maxRetryAfter = time.Hour
+	maxPressure   = 16
+)
+
+// ErrOpen is matched by the error returned while a class is paused.
+var ErrOpen = errors.New("server backoff in effect")
+
+// OpenError reports a request that was not sent because its class is
+// paused.
+type OpenError struct {
+	Class string
+	Until time.Time
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("%s requests paused until %s (server backoff)", e.Class, e.Until.Format(time.RFC3339))
+}
+
+func (e *OpenError) Is(target error) bool { return target == ErrOpen }
+
+// Options tunes the breakers.
+type Options struct {
+	Threshold   int
+	Cooldown    time.Duration
+	MaxCooldown time.Duration
+	// MaxStretch caps the heartbeat interval multiplier.
+	MaxStretch int
+}
+
+// OptionsFromConfig reads cfg.Resilience.
+func OptionsFromConfig(cfg config.Config) Options {
+	r := cfg.Resilience
+	return Options{
+		Threshold:   r.BreakerThreshold,
+		Cooldown:    time.Duration(r.BreakerCooldownSec) * time.Second,
+		MaxCooldown: time.Duration(r.BreakerMaxCooldownSec) * time.Second,
+		MaxStretch:  r.MaxHeartbeatStretch,
+	}
+}
+
+func (o Options) normalized() Options {
+	if o.Threshold <= 0 {
+		o.Threshold = 5
+	}
+	if o.Cooldown <= 0 {
+		o.Cooldown = 30 * time.Second
+	}
+	if o.MaxCooldown < o.Cooldown {
+		o.MaxCooldown = max(o.Cooldown, 10*time.Minute)
+	}
+	if o.MaxStretch <= 0 {
+		o.MaxStretch = 1
+	}
+	return o
+}
+
+// Status is the state reported over IPC.
+type Status struct {
+	Pressure int                    `json:"pressure"`
+	Stretch  int                    `json:"heartbeat_stretch"`
+	Classes  map[string]ClassStatus `json:"classes,omitempty"`
+}
+
+// ClassStatus describes one endpoint class.
+type ClassStatus struct {
+	Failures    int       `json:"failures"`
+	PausedUntil time.Time `json:"paused_until,omitempty"`
+}
+
+// Breakers holds the per-class state. Safe for concurrent use; a nil
+// *Breakers never pauses anything.
+type Breakers struct {
+	mu       sync.Mutex
+	opts     Options
+	classes  map[string]*ClassStatus
+	pressure int
+	nowFn    func() time.Time
+}
+
+// New builds Breakers with opts (zero fields take defaults).
+func New(opts Options) *Breakers {
+	return &Breakers{opts: opts.normalized(), classes: map[string]*ClassStatus{}, nowFn: time.Now}
+}
+
+var shared = New(Options{})
+
+// Default returns the process-wide breakers shared by the API and WS
+// clients.
+func Default() *Breakers {
+	return shared
+}
+
+// Configure replaces the options; current state is kept.
+func (b *Breakers) Configure(opts Options) {
+	b.mu.Lock()
+	b.opts = opts.normalized()
+	b.mu.Unlock()
+}
+
+// Allow returns an *OpenError while class is paused.
+func (b *Breakers) Allow(class string) error {
+	if wait := b.Wait(class); wait > 0 {
+		return &OpenError{Class: class, Until: b.nowFn().Add(wait)}
+	}
+	return nil
+}
+
+// Wait returns how long class stays paused (0 when requests may be sent).
+func (b *Breakers) Wait(class string) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.classes[class]
+	if !ok {
+		return 0
+	}
+	return max(st.PausedUntil.Sub(b.nowFn()), 0)
+}
+
+// Record feeds the outcome of one request. statusCode 0 means no response
+// arrived; retryAfter is the parsed Retry-After header (0 if absent).
+func (b *Breakers) Record(class string, statusCode int, retryAfter time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.nowFn()
+	st := b.classes[class]
+	if st == nil {
+		st = &ClassStatus{}
+		b.classes[class] = st
+	}
+
+	if statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable || retryAfter > 0 {
+		b.pressure = min(b.pressure+1, maxPressure)
+	}
+	if statusCode != 0 && statusCode < 500 && statusCode != http.StatusTooManyRequests {
+		st.Failures = 0
+		st.PausedUntil = time.Time{}
+		if class == ClassHeartbeat && statusCode < 300 && b.pressure > 0 {
+			b.pressure--
+		}
+		return
+	}
+
+	st.Failures++
+	var until time.Time
+	if retryAfter > 0 {
+		until = now.Add(min(retryAfter, maxRetryAfter))
+	} else if st.Failures >= b.opts.Threshold {
+		cooldown := b.opts.Cooldown
+		for i := b.opts.Threshold; i < st.Failures && cooldown < b.opts.MaxCooldown; i++ {
+			cooldown *= 2
+		}
+		until = now.Add(min(cooldown, b.opts.MaxCooldown))
+	}
+	if until.After(st.PausedUntil) {
+		st.PausedUntil = until
+	}
+}
+
+// Stretch returns the heartbeat interval for base under the current
+// pressure: base doubled per pressure level, at most MaxStretch times base.
+func (b *Breakers) Stretch(base time.Duration) time.Duration {
+	if b == nil {
+		return base
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return base * time.Duration(b.stretchLocked())
+}
+
+func (b *Breakers) stretchLocked() int {
+	factor := 1
+	for i := 0; i < b.pressure && factor < b.opts.MaxStretch; i++ {
+		factor *= 2
+	}
+	return min(factor, b.opts.MaxStretch)
+}
+
+// Reset forgets all state, e.g. after switching to another server.
+func (b *Breakers) Reset() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.classes = map[string]*ClassStatus{}
+	b.pressure = 0
+	b.mu.Unlock()
+}
+
+// Status returns a snapshot for IPC.
+func (b *Breakers) Status() Status {
+	if b == nil {
+		return Status{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := Status{Pressure: b.pressure, Stretch: b.stretchLocked(), Classes: map[string]ClassStatus{}}
+	for k, v := range b.classes {
+		out.Classes[k] = *v
+	}
+	return out
+}
+
+// ParseRetryAfter reads a Retry-After value: delay seconds or an HTTP date.
+// Invalid or past values yield 0.
+func ParseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
@@ -0,0 +1,118 @@
+package resilience
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAfterThresholdAndHonorsRetryAfter(t *testing.T) {
+	b := New(Options{Threshold: 3, Cooldown: 10 * time.Second, MaxCooldown: 30 * time.Second})
+	now := time.Unix(1_700_000_000, 0)
+	b.nowFn = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		b.Record(ClassTasks, http.StatusInternalServerError, 0)
+	}
+	if err := b.Allow(ClassTasks); err != nil {
+		t.Fatalf("paused below threshold: %v", err)
+	}
+	b.Record(ClassTasks, 0, 0)
+	if err := b.Allow(ClassTasks); !errors.Is(err, ErrOpen) {
+		t.Fatalf("Allow = %v, want ErrOpen", err)
+	}
+	if b.Allow(ClassHeartbeat) != nil {
+		t.Fatal("an open class paused another class")
+	}
+	if w := b.Wait(ClassTasks); w != 10*time.Second {
+		t.Fatalf("Wait = %v", w)
+	}
+
+	// The next failure doubles the cooldown; the maximum caps it.
+	now = now.Add(11 * time.Second)
+	b.Record(ClassTasks, http.StatusBadGateway, 0)
+	if w := b.Wait(ClassTasks); w != 20*time.Second {
+		t.Fatalf("Wait = %v after second open", w)
+	}
+	now = now.Add(21 * time.Second)
+	b.Record(ClassTasks, http.StatusBadGateway, 0)
+	if w := b.Wait(ClassTasks); w != 30*time.Second {
+		t.Fatalf("Wait = %v, want capped cooldown", w)
+	}
+
+	// A success closes the circuit.
+	now = now.Add(31 * time.Second)
+	b.Record(ClassTasks, http.StatusOK, 0)
+	if b.Wait(ClassTasks) != 0 {
+		t.Fatal("success did not close the circuit")
+	}
+
+	// Retry-After pauses at once, whatever the threshold.
+	b.Record(ClassSignal, http.StatusTooManyRequests, 2*time.Minute)
+	if w := b.Wait(ClassSignal); w != 2*time.Minute {
+		t.Fatalf("Wait = %v, want Retry-After", w)
+	}
+}
+
+func TestHeartbeatStretchUnderPressure(t *testing.T) {
+	b := New(Options{MaxStretch: 8})
+	base := time.Minute
+	if got := b.Stretch(base); got != base {
+		t.Fatalf("Stretch = %v without pressure", got)
+	}
+	for i := 0; i < 2; i++ {
+		b.Record(ClassHeartbeat, http.StatusServiceUnavailable, 0)
+	}
+	if got := b.Stretch(base); got != 4*time.Minute {
+		t.Fatalf("Stretch = %v after two 503s", got)
+	}
+	for i := 0; i < 5; i++ {
+		b.Record(ClassInventory, http.StatusTooManyRequests, 0)
+	}
+	if got := b.Stretch(base); got != 8*time.Minute {
+		t.Fatalf("Stretch = %v, want capped at 8x", got)
+	}
+	for i := 0; i < 7; i++ {
+		b.Record(ClassHeartbeat, http.StatusOK, 0)
+	}
+	if got := b.Stretch(base); got != base {
+		t.Fatalf("Stretch = %v after recovery", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	cases := map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"Mon, 02 Mar 2026 10:05:00 GMT": 5 * time.Minute,
+		"Mon, 02 Mar 2026 09:00:00 GMT": 0,
+		"soon":                          0,
+		"":                              0,
+	}
+	for in, want := range cases {
+		if got := ParseRetryAfter(in, now); got != want {
+			t.Fatalf("ParseRetryAfter(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestRestartDelayMarker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "restart_delay.json")
+	if err := ScheduleRestartDelay(path, 90*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	d := TakeRestartDelay(path, time.Now())
+	if d < 0 || d > 90*time.Second {
+		t.Fatalf("delay = %v", d)
+	}
+	if TakeRestartDelay(path, time.Now()) != 0 {
+		t.Fatal("marker was not consumed")
+	}
+
+	_ = ScheduleRestartDelay(path, 90*time.Second)
+	if d := TakeRestartDelay(path, time.Now().Add(time.Hour)); d != 0 {
+		t.Fatalf("stale marker applied: %v", d)
+	}
+}
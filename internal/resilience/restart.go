@@ -0,0 +1,63 @@
+package resilience
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// restartMarkerMaxAge bounds how long after a broadcast restart the marker
+// still applies; a stale one (e.g. the service was stopped) is ignored.
+const restartMarkerMaxAge = 15 * time.Minute
+
+type restartMarker struct {
+	MaxDelaySec int       `json:"max_delay_sec"`
+	WrittenAt   time.Time `json:"written_at"`
+}
+
+// DefaultRestartMarkerPath is where a broadcast restart leaves its startup
+// delay for the next process.
+func DefaultRestartMarkerPath() string {
+	if runtime.GOOS == "windows" {
+		return `C:\ProgramData\AppCenter\restart_delay.json`
+	}
+	return "restart_delay.json"
+}
+
+// ScheduleRestartDelay records that the next start follows a fleet-wide
+// restart and should wait a random time of up to maxDelay before contacting
+// the server.
+func ScheduleRestartDelay(path string, maxDelay time.Duration) error {
+	if maxDelay <= 0 {
+		return nil
+	}
+	b, err := json.Marshal(restartMarker{MaxDelaySec: int(maxDelay / time.Second), WrittenAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+// TakeRestartDelay consumes the marker left by ScheduleRestartDelay and
+// returns the random delay to wait (0 without a fresh marker).
+func TakeRestartDelay(path string, now time.Time) time.Duration {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	_ = os.Remove(path)
+	var m restartMarker
+	if json.Unmarshal(b, &m) != nil || m.MaxDelaySec <= 0 {
+		return 0
+	}
+	if age := now.Sub(m.WrittenAt); age < 0 || age > restartMarkerMaxAge {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(m.MaxDelaySec)*int64(time.Second) + 1))
+}
@@ -14,6 +14,10 @@ import (
 	"sync"
 	"time"
 
+	"appcenter-agent/internal/bandwidth"
+	"appcenter-agent/internal/dlcache"
+	"appcenter-agent/internal/netproxy"
+	"appcenter-agent/internal/urlguard"
 	"appcenter-agent/pkg/utils"
 )
 
@@ -26,6 +30,16 @@ type Config struct {
 	BaseURL     string
 	IntervalMin int
 	JitterSec   int
+	// Guard applies the URL policy to the manifest and to manifest-supplied
+	// file URLs (nil allows any URL).
+	Guard *urlguard.Guard
+	// CheckURL applies the local policy to the same URLs (nil allows any
+	// URL). It gets BaseURL as the trusted server URL.
+	CheckURL func(rawURL, serverURL string) error
+	// Cache stores verified downloads (nil downloads straight to exeDir).
+	Cache *dlcache.Cache
+	// Limiter is the shared download limiter (nil does not limit).
+	Limiter *bandwidth.Limiter
 }
 
 type Manifest struct {
@@ -58,7 +72,7 @@ func NewManager(exeDir string, logger *log.Logger, onTrayUpdated func()) *Manage
 		},
 		exeDir:   exeDir,
 		logger:   logger,
-		client:   &http.Client{Timeout: 30 * time.Second},
+		client:   &http.Client{Timeout: 30 * time.Second, Transport: netproxy.Transport()},
 		onTrayUp: onTrayUpdated,
 		wakeCh:   make(chan struct{}, 1),
 	}
@@ -75,6 +89,15 @@ func (m *Manager) UpdateConfig(cfg Config) {
 	}
 }
 
+// SetServer points the manager at another server (endpoint failover) and
+// keeps the rest of the configuration.
+func (m *Manager) SetServer(baseURL string, guard *urlguard.Guard) {
+	m.mu.Lock()
+	m.cfg.BaseURL = strings.TrimRight(strings.TrimSpace(baseURL), "/")
+	m.cfg.Guard = guard
+	m.mu.Unlock()
+}
+
 func (m *Manager) Start(ctx context.Context) {
 	m.logger.Printf("runtime update: loop started")
 	for {
@@ -143,26 +166,43 @@ func (m *Manager) snapshotConfig() Config {
 
 func (m *Manager) syncOnce(ctx context.Context, cfg Config) error {
 	manifestURL := cfg.BaseURL + "/manifest.json"
-	manifest, err := m.fetchManifest(ctx, manifestURL)
+	if err := checkURL(cfg, manifestURL); err != nil {
+		return fmt.Errorf("manifest url rejected: %w", err)
+	}
+	client := m.client
+	if cfg.Guard != nil {
+		client = cfg.Guard.Client(m.client.Timeout)
+	}
+	manifest, err := m.fetchManifest(ctx, client, manifestURL)
 	if err != nil {
 		return err
 	}
 
-	if err := m.ensureFile(ctx, cfg, manifest, "appcenter-tray.exe"); err != nil {
+	if err := m.ensureFile(ctx, client, cfg, manifest, "appcenter-tray.exe"); err != nil {
+		return err
+	}
+	if err := m.ensureFile(ctx, client, cfg, manifest, "rshelper.exe"); err != nil {
 		return err
 	}
-	if err := m.ensureFile(ctx, cfg, manifest, "rshelper.exe"); err != nil {
+	return nil
+}
+
+func checkURL(cfg Config, rawURL string) error {
+	if _, err := cfg.Guard.Check(rawURL); err != nil {
 		return err
 	}
+	if cfg.CheckURL != nil {
+		return cfg.CheckURL(rawURL, cfg.BaseURL)
+	}
 	return nil
 }
 
-func (m *Manager) fetchManifest(ctx context.Context, manifestURL string) (*Manifest, error) {
+func (m *Manager) fetchManifest(ctx context.Context, client *http.Client, manifestURL string) (*Manifest, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, manifestURL, nil)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := m.client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -180,7 +220,7 @@ func (m *Manager) fetchManifest(ctx context.Context, manifestURL string) (*Manif
 	return &manifest, nil
 }
 
-func (m *Manager) ensureFile(ctx context.Context, cfg Config, manifest *Manifest, name string) error {
+func (m *Manager) ensureFile(ctx context.Context, client *http.Client, cfg Config, manifest *Manifest, name string) error {
 	entry, ok := manifest.Files[name]
 	if !ok {
 		m.logger.Printf("runtime update: %s missing in manifest, skip", name)
@@ -205,20 +245,15 @@ func (m *Manager) ensureFile(ctx context.Context, cfg Config, manifest *Manifest
 	if fileURL == "" {
 		fileURL = cfg.BaseURL + "/" + name
 	}
+	if err := checkURL(cfg, fileURL); err != nil {
+		return fmt.Errorf("%s url rejected: %w", name, err)
+	}
 	tempPath := dstPath + ".download"
-	if err := downloadToFile(ctx, m.client, fileURL, tempPath); err != nil {
-		return fmt.Errorf("%s download failed: %w", name, err)
+	if err := fetchVerified(ctx, client, cfg, fileURL, expected, name, tempPath); err != nil {
+		return err
 	}
 	defer os.Remove(tempPath)
 
-	okHash, err := utils.VerifyFileHash(tempPath, expected)
-	if err != nil {
-		return fmt.Errorf("%s downloaded hash check failed: %w", name, err)
-	}
-	if !okHash {
-		return fmt.Errorf("%s hash mismatch after download", name)
-	}
-
 	if strings.EqualFold(name, "appcenter-tray.exe") {
 		stopTrayProcess()
 	}
@@ -238,7 +273,36 @@ func (m *Manager) ensureFile(ctx context.Context, cfg Config, manifest *Manifest
 	return nil
 }
 
-func downloadToFile(ctx context.Context, client *http.Client, url, path string) error {
+// fetchVerified leaves a hash-verified copy of fileURL at tempPath, going
+// through cache when one is configured.
+func fetchVerified(ctx context.Context, client *http.Client, cfg Config, fileURL, expected, name, tempPath string) error {
+	if cfg.Cache != nil {
+		entry, err := cfg.Cache.Fetch(expected, func(partialPath string) (string, error) {
+			return name, downloadToFile(ctx, client, cfg.Limiter, fileURL, partialPath)
+		})
+		if err != nil {
+			return fmt.Errorf("%s download failed: %w", name, err)
+		}
+		defer entry.Release()
+		return entry.Materialize(tempPath)
+	}
+
+	if err := downloadToFile(ctx, client, cfg.Limiter, fileURL, tempPath); err != nil {
+		return fmt.Errorf("%s download failed: %w", name, err)
+	}
+	okHash, err := utils.VerifyFileHash(tempPath, expected)
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("%s downloaded hash check failed: %w", name, err)
+	}
+	if !okHash {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("%s hash mismatch after download", name)
+	}
+	return nil
+}
+
+func downloadToFile(ctx context.Context, client *http.Client, limiter *bandwidth.Limiter, url, path string) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return err
@@ -260,7 +324,7 @@ func downloadToFile(ctx context.Context, client *http.Client, url, path string)
 		return err
 	}
 	defer f.Close()
-	if _, err := io.Copy(f, resp.Body); err != nil {
+	if _, err := io.Copy(f, limiter.Reader(ctx, resp.Body)); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,73 @@
+//go:build windows
+
+package secretstore
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// SchemeDPAPI identifies blobs sealed by DPAPIStore.
+const SchemeDPAPI = "dpapi"
+
+// dpapiEntropy scopes blobs to this application so other DPAPI consumers on
+// the machine cannot open them by accident.
+var dpapiEntropy = []byte("appcenter-agent/secret/v1")
+
+// DPAPIStore seals secrets with DPAPI in machine scope, so the service
+// (LocalSystem) can read them but copying config.yaml to another machine does
+// not reveal the secret.
+type DPAPIStore struct{}
+
+// Default returns the platform store.
+func Default() Store {
+	return DPAPIStore{}
+}
+
+func (DPAPIStore) Name() string { return SchemeDPAPI }
+
+func (DPAPIStore) Protect(plaintext []byte) (string, error) {
+	var out windows.DataBlob
+	err := windows.CryptProtectData(
+		newBlob(plaintext), nil, newBlob(dpapiEntropy), 0, nil,
+		windows.CRYPTPROTECT_LOCAL_MACHINE|windows.CRYPTPROTECT_UI_FORBIDDEN, &out,
+	)
+	if err != nil {
+		return "", fmt.Errorf("secretstore: CryptProtectData: %w", err)
+	}
+	return encode(SchemeDPAPI, takeBlob(&out)), nil
+}
+
+func (DPAPIStore) Unprotect(blob string) ([]byte, error) {
+	sealed, err := decode(SchemeDPAPI, blob)
+	if err != nil {
+		return nil, err
+	}
+	var out windows.DataBlob
+	err = windows.CryptUnprotectData(
+		newBlob(sealed), nil, newBlob(dpapiEntropy), 0, nil,
+		windows.CRYPTPROTECT_UI_FORBIDDEN, &out,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("secretstore: CryptUnprotectData: %w", err)
+	}
+	return takeBlob(&out), nil
+}
+
+func newBlob(b []byte) *windows.DataBlob {
+	if len(b) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(b)), Data: &b[0]}
+}
+
+// takeBlob copies a DPAPI-allocated buffer into Go memory and frees it.
+func takeBlob(b *windows.DataBlob) []byte {
+	if b.Data == nil {
+		return nil
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(b.Data)))
+	return append([]byte(nil), unsafe.Slice(b.Data, b.Size)...)
+}
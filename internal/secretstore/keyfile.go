@@ -0,0 +1,153 @@
+//go:build !windows
+
+package secretstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	// SchemeKeyFile identifies blobs sealed by KeyFileStore.
+	SchemeKeyFile = "aesgcm"
+
+	keySize = 32
+	// defaultKeyFile is used when running as root (the service account).
+	defaultKeyFile = "/etc/appcenter-agent/secret.key"
+)
+
+// KeyFileStore seals secrets with AES-256-GCM using a key kept in a file that
+// only its owner can read. The key is created on first use.
+type KeyFileStore struct {
+	Path string
+}
+
+// Default returns the platform store. APPCENTER_KEY_FILE overrides the key
+// location; non-root runs (development) fall back to the user config dir.
+func Default() Store {
+	return &KeyFileStore{Path: DefaultKeyFilePath()}
+}
+
+// DefaultKeyFilePath returns where the AES key is kept.
+func DefaultKeyFilePath() string {
+	if p := os.Getenv("APPCENTER_KEY_FILE"); p != "" {
+		return p
+	}
+	if os.Geteuid() != 0 {
+		if dir, err := os.UserConfigDir(); err == nil {
+			return filepath.Join(dir, "appcenter-agent", "secret.key")
+		}
+	}
+	return defaultKeyFile
+}
+
+func (s *KeyFileStore) Name() string { return SchemeKeyFile }
+
+func (s *KeyFileStore) Protect(plaintext []byte) (string, error) {
+	key, err := s.loadKey(true)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("secretstore: nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(SchemeKeyFile))
+	return encode(SchemeKeyFile, sealed), nil
+}
+
+func (s *KeyFileStore) Unprotect(blob string) ([]byte, error) {
+	sealed, err := decode(SchemeKeyFile, blob)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.loadKey(false)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("secretstore: blob too short")
+	}
+	nonce, ct := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ct, []byte(SchemeKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("secretstore: open: %w", err)
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("secretstore: cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadKey reads the key file, refusing files readable by group/other or owned
+// by someone else. With create, a missing key is generated.
+func (s *KeyFileStore) loadKey(create bool) ([]byte, error) {
+	fi, err := os.Stat(s.Path)
+	if errors.Is(err, os.ErrNotExist) && create {
+		return s.createKey()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("secretstore: key file: %w", err)
+	}
+	if fi.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("secretstore: key file %s has insecure permissions %o", s.Path, fi.Mode().Perm())
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return nil, fmt.Errorf("secretstore: key file %s is owned by uid %d", s.Path, st.Uid)
+	}
+	key, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("secretstore: key file: %w", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("secretstore: key file %s has invalid length %d", s.Path, len(key))
+	}
+	return key, nil
+}
+
+func (s *KeyFileStore) createKey() ([]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0o700); err != nil {
+		return nil, fmt.Errorf("secretstore: key dir: %w", err)
+	}
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("secretstore: key: %w", err)
+	}
+	// O_EXCL: if another process won the race, use its key instead.
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return s.loadKey(false)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("secretstore: key file: %w", err)
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		_ = os.Remove(s.Path)
+		return nil, fmt.Errorf("secretstore: key file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("secretstore: key file: %w", err)
+	}
+	return key, nil
+}
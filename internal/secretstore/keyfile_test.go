@@ -0,0 +1,71 @@
+//go:build !windows
+
+package secretstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyFileRoundTrip(t *testing.T) {
+	s := &KeyFileStore{Path: filepath.Join(t.TempDir(), "keys", "secret.key")}
+
+	blob, err := s.Protect([]byte("s3cret"))
+	if err != nil {
+		t.Fatalf("Protect: %v", err)
+	}
+	if !strings.HasPrefix(blob, SchemeKeyFile+":") || strings.Contains(blob, "s3cret") {
+		t.Fatalf("unexpected blob %q", blob)
+	}
+	fi, err := os.Stat(s.Path)
+	if err != nil {
+		t.Fatalf("key file not created: %v", err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Fatalf("key file mode = %o, want 600", fi.Mode().Perm())
+	}
+
+	got, err := s.Unprotect(blob)
+	if err != nil {
+		t.Fatalf("Unprotect: %v", err)
+	}
+	if string(got) != "s3cret" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestKeyFileRejectsInsecurePermissions(t *testing.T) {
+	s := &KeyFileStore{Path: filepath.Join(t.TempDir(), "secret.key")}
+	blob, err := s.Protect([]byte("x"))
+	if err != nil {
+		t.Fatalf("Protect: %v", err)
+	}
+	if err := os.Chmod(s.Path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Unprotect(blob); err == nil || !strings.Contains(err.Error(), "insecure permissions") {
+		t.Fatalf("expected permission error, got %v", err)
+	}
+}
+
+func TestKeyFileWrongKeyOrScheme(t *testing.T) {
+	dir := t.TempDir()
+	a := &KeyFileStore{Path: filepath.Join(dir, "a.key")}
+	b := &KeyFileStore{Path: filepath.Join(dir, "b.key")}
+	blob, err := a.Protect([]byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Protect([]byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Unprotect(blob); err == nil {
+		t.Fatal("expected failure with a different key")
+	}
+	if _, err := a.Unprotect("dpapi:AAAA"); !errors.Is(err, ErrUnknownScheme) {
+		t.Fatalf("expected ErrUnknownScheme, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+// Package secretstore protects agent secrets at rest.
+//
+// Secrets are stored as "<scheme>:<base64 blob>" strings. On Windows the blob
+// is produced by DPAPI (machine scope); elsewhere it is AES-GCM sealed with a
+// root-only key file.
+package secretstore
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownScheme is returned when a blob was produced by a different backend
+// (e.g. a config.yaml copied from a Windows machine to Linux).
+var ErrUnknownScheme = errors.New("secretstore: unknown scheme")
+
+// Store seals and opens secrets.
+type Store interface {
+	// Name returns the scheme prefix written in front of protected blobs.
+	Name() string
+	Protect(plaintext []byte) (string, error)
+	Unprotect(blob string) ([]byte, error)
+}
+
+func encode(scheme string, b []byte) string {
+	return scheme + ":" + base64.StdEncoding.EncodeToString(b)
+}
+
+func decode(scheme, blob string) ([]byte, error) {
+	prefix, data, ok := strings.Cut(strings.TrimSpace(blob), ":")
+	if !ok || prefix != scheme {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownScheme, prefix)
+	}
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("secretstore: decode: %w", err)
+	}
+	return b, nil
+}
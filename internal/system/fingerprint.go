@@ -0,0 +1,28 @@
+package system
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// HardwareFingerprint returns a stable, hashed identifier derived from machine
+// identifiers that survive an agent reinstall (machine GUID, board/BIOS data).
+// The raw values never leave the host; only the hash is sent at registration so
+// the server can recognize a reinstalled host. The hash is not secret and is
+// never accepted as re-enrollment proof on its own.
+func HardwareFingerprint() string {
+	parts := hardwareIdentifiers()
+	nonEmpty := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte("appcenter-hw-v1\n" + strings.Join(nonEmpty, "\n")))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package system
+
+import "os"
+
+func hardwareIdentifiers() []string {
+	var out []string
+	for _, p := range []string{
+		"/etc/machine-id",
+		"/sys/class/dmi/id/product_uuid",
+		"/sys/class/dmi/id/board_serial",
+	} {
+		if b, err := os.ReadFile(p); err == nil {
+			out = append(out, string(b))
+		}
+	}
+	return out
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package system
+
+import "golang.org/x/sys/windows/registry"
+
+func hardwareIdentifiers() []string {
+	var out []string
+	if k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Cryptography`, registry.QUERY_VALUE|registry.WOW64_64KEY); err == nil {
+		if v, _, err := k.GetStringValue("MachineGuid"); err == nil {
+			out = append(out, v)
+		}
+		k.Close()
+	}
+	if k, err := registry.OpenKey(registry.LOCAL_MACHINE, `HARDWARE\DESCRIPTION\System\BIOS`, registry.QUERY_VALUE); err == nil {
+		for _, name := range []string{"SystemManufacturer", "SystemProductName", "BaseBoardManufacturer", "BaseBoardProduct"} {
+			if v, _, err := k.GetStringValue(name); err == nil {
+				out = append(out, v)
+			}
+		}
+		k.Close()
+	}
+	return out
+}
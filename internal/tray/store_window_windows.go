@@ -244,17 +244,22 @@ func buildAppCard(parent *walk.Composite, app StoreApp, ipcClient IPCClient, for
 		walk.Size{Width: 90, Height: 26},
 	)
 
-	if app.Installed {
+	if app.Installed && !app.UpdateAvailable {
 		btn.SetText("✓ Yüklü")
 		btn.SetEnabled(false)
 	} else {
-		btn.SetText("Kur")
+		// An update is the same one-click store install of the latest version.
+		idleText, busyText := "Kur", "Kuruluyor…"
+		if app.UpdateAvailable {
+			idleText, busyText = "Güncelle", "Güncelleniyor…"
+		}
+		btn.SetText(idleText)
 		appID := app.ID
 		appName := app.DisplayName
 
 		btn.Clicked().Attach(func() {
 			btn.SetEnabled(false)
-			btn.SetText("Kuruluyor…")
+			btn.SetText(busyText)
 
 			go func() {
 				resp, err := ipcClient.Send(ipc.NewRequest("install_from_store", appID))
@@ -265,7 +270,7 @@ func buildAppCard(parent *walk.Composite, app StoreApp, ipcClient IPCClient, for
 							fmt.Sprintf("%s kurulamadı:\n%v", appName, err),
 							walk.MsgBoxIconError|walk.MsgBoxOK)
 						btn.SetEnabled(true)
-						btn.SetText("Kur")
+						btn.SetText(idleText)
 					case resp == nil || resp.Status != "ok":
 						msg := "Bilinmeyen hata"
 						if resp != nil && resp.Message != "" {
@@ -275,7 +280,7 @@ func buildAppCard(parent *walk.Composite, app StoreApp, ipcClient IPCClient, for
 							fmt.Sprintf("%s kurulamadı:\n%s", appName, msg),
 							walk.MsgBoxIconError|walk.MsgBoxOK)
 						btn.SetEnabled(true)
-						btn.SetText("Kur")
+						btn.SetText(idleText)
 					default:
 						queueStatus := readQueueStatus(resp.Data)
 						switch queueStatus {
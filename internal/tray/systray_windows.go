@@ -97,8 +97,10 @@ func (a *App) refreshStatus() {
 		return
 	}
 
-	serverOK, _ := CheckServerHealth()
-	if serverOK {
+	serverOK, _ := CheckServerHealth(s.activeServer())
+	if s.enrollmentFailed() {
+		a.setIconState("server_down")
+	} else if serverOK {
 		a.setIconState("ok")
 	} else {
 		a.setIconState("server_down")
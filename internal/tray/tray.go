@@ -2,15 +2,18 @@ package tray
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"appcenter-agent/internal/config"
 	"appcenter-agent/internal/ipc"
+	"appcenter-agent/internal/netproxy"
 )
 
 type IPCClient interface {
@@ -29,6 +32,34 @@ type StatusSnapshot struct {
 	PendingTasks int    `json:"pending_tasks"`
 	AgentVersion string `json:"agent_version"`
 	AgentUUID    string `json:"agent_uuid"`
+
+	Enrollment     *EnrollmentStatus     `json:"enrollment,omitempty"`
+	ServerEndpoint *ServerEndpointStatus `json:"server_endpoint,omitempty"`
+}
+
+// ServerEndpointStatus is the part of the service's endpoint state the tray
+// uses: the server it currently talks to, which may be a failover endpoint.
+type ServerEndpointStatus struct {
+	Active string `json:"active"`
+}
+
+type EnrollmentStatus struct {
+	State   string `json:"state"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// enrollmentFailed reports whether the service could not register with the server.
+func (s StatusSnapshot) enrollmentFailed() bool {
+	return s.Enrollment != nil && s.Enrollment.State == "failed"
+}
+
+// activeServer returns the endpoint the service is using, or "".
+func (s StatusSnapshot) activeServer() string {
+	if s.ServerEndpoint == nil {
+		return ""
+	}
+	return s.ServerEndpoint.Active
 }
 
 type StoreApp struct {
@@ -42,6 +73,7 @@ type StoreApp struct {
 	Installed        bool   `json:"installed"`
 	InstalledVersion string `json:"installed_version"`
 	CanUninstall     bool   `json:"can_uninstall"`
+	UpdateAvailable  bool   `json:"update_available"`
 }
 
 type StorePayload struct {
@@ -49,6 +81,13 @@ type StorePayload struct {
 }
 
 func statusTooltip(s StatusSnapshot) string {
+	if s.enrollmentFailed() {
+		detail := strings.TrimSpace(s.Enrollment.Message)
+		if detail == "" {
+			detail = s.Enrollment.Code
+		}
+		return fmt.Sprintf("AppCenter Agent - enrollment failed: %s", detail)
+	}
 	status := strings.TrimSpace(s.Service)
 	if status == "" {
 		status = "unknown"
@@ -65,7 +104,10 @@ func statusTitle(s StatusSnapshot) string {
 
 func appLabel(app StoreApp) string {
 	installedMark := ""
-	if app.Installed {
+	switch {
+	case app.UpdateAvailable:
+		installedMark = " [update available]"
+	case app.Installed:
 		installedMark = " [installed]"
 	}
 	if app.Version == "" {
@@ -78,17 +120,41 @@ func nowStamp() string {
 	return time.Now().UTC().Format(time.RFC3339)
 }
 
-func CheckServerHealth() (bool, string) {
+// ActiveServerURL asks the service, via get_status, which endpoint it is
+// using. It returns "" when the service cannot be reached.
+func ActiveServerURL(c IPCClient) string {
+	resp, err := c.Send(ipc.NewRequest("get_status", 0))
+	if err != nil || resp == nil || resp.Status != "ok" {
+		return ""
+	}
+	raw, err := json.Marshal(resp.Data)
+	if err != nil {
+		return ""
+	}
+	var s StatusSnapshot
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return ""
+	}
+	return s.activeServer()
+}
+
+// CheckServerHealth probes activeURL, the endpoint the service reports as
+// active, falling back to server.url when the service did not report one.
+func CheckServerHealth(activeURL string) (bool, string) {
 	cfgPath := resolveConfigPathForTray()
-	cfg, err := config.Load(cfgPath)
+	cfg, err := config.LoadWithoutSecrets(cfgPath)
 	if err != nil {
 		return false, fmt.Sprintf("config load failed: %v", err)
 	}
 
-	base := strings.TrimRight(cfg.Server.URL, "/")
+	base := strings.TrimRight(activeURL, "/")
+	if base == "" {
+		base = strings.TrimRight(cfg.Server.URL, "/")
+	}
 	if base == "" {
 		return false, "server.url is empty"
 	}
+	configureProxy(cfgPath, cfg)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -97,7 +163,8 @@ func CheckServerHealth() (bool, string) {
 	if err != nil {
 		return false, fmt.Sprintf("request build failed: %v", err)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	client := &http.Client{Transport: netproxy.Transport()}
+	resp, err := client.Do(req)
 	if err != nil {
 		return false, fmt.Sprintf("request failed: %v", err)
 	}
@@ -108,6 +175,31 @@ func CheckServerHealth() (bool, string) {
 	return true, "ok"
 }
 
+// proxyConfigured records the config file the process-wide proxy was built
+// from. Refreshes reuse that proxy, and with it WinHTTP's PAC cache, until
+// the file changes.
+var proxyConfigured struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	done    bool
+}
+
+func configureProxy(cfgPath string, cfg *config.Config) {
+	var modTime time.Time
+	if info, err := os.Stat(cfgPath); err == nil {
+		modTime = info.ModTime()
+	}
+	pc := &proxyConfigured
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.done && pc.path == cfgPath && pc.modTime.Equal(modTime) {
+		return
+	}
+	netproxy.Configure(*cfg, nil)
+	pc.path, pc.modTime, pc.done = cfgPath, modTime, true
+}
+
 func resolveConfigPathForTray() string {
 	if p := os.Getenv("APPCENTER_CONFIG"); p != "" {
 		return p
@@ -1,6 +1,22 @@
 package tray
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/ipc"
+	"appcenter-agent/internal/netproxy"
+)
+
+type fakeIPC struct {
+	resp *ipc.Response
+	err  error
+}
+
+func (f fakeIPC) Send(ipc.Request) (*ipc.Response, error) { return f.resp, f.err }
 
 func TestStatusTooltip(t *testing.T) {
 	s := StatusSnapshot{Service: "running", PendingTasks: 3}
@@ -19,3 +35,62 @@ func TestAppLabel(t *testing.T) {
 		t.Fatalf("label=%q want=%q", got, want)
 	}
 }
+
+func TestAppLabelUpdateAvailable(t *testing.T) {
+	app := StoreApp{ID: 7, DisplayName: "7-Zip", Version: "24.05", Installed: true, UpdateAvailable: true}
+	got := appLabel(app)
+	want := "7 - 7-Zip 24.05 [update available]"
+	if got != want {
+		t.Fatalf("label=%q want=%q", got, want)
+	}
+}
+
+func TestStatusTooltipEnrollmentFailed(t *testing.T) {
+	s := StatusSnapshot{
+		Service:    "running",
+		Enrollment: &EnrollmentStatus{State: "failed", Code: "enrollment_token_expired", Message: "enrollment token expired"},
+	}
+	got := statusTooltip(s)
+	want := "AppCenter Agent - enrollment failed: enrollment token expired"
+	if got != want {
+		t.Fatalf("tooltip=%q want=%q", got, want)
+	}
+}
+
+func TestActiveServerURLFromStatus(t *testing.T) {
+	status := map[string]any{
+		"service":         "running",
+		"server_endpoint": map[string]any{"active": "https://backup.example", "endpoints": []any{}},
+	}
+	if got := ActiveServerURL(fakeIPC{resp: &ipc.Response{Status: "ok", Data: status}}); got != "https://backup.example" {
+		t.Fatalf("active=%q, want the failover endpoint", got)
+	}
+	if got := ActiveServerURL(fakeIPC{err: os.ErrNotExist}); got != "" {
+		t.Fatalf("active=%q without a service, want empty", got)
+	}
+}
+
+func TestConfigureProxyOnlyWhenConfigChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("server: {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer netproxy.Configure(config.Config{}, nil)
+	cfg := &config.Config{Network: config.NetworkConfig{Proxy: config.ProxyConfig{URL: "http://proxy.corp:8080"}}}
+
+	configureProxy(path, cfg)
+	first := netproxy.Default()
+	configureProxy(path, cfg)
+	if netproxy.Default() != first {
+		t.Fatal("unchanged config rebuilt the proxy")
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	configureProxy(path, cfg)
+	if netproxy.Default() == first {
+		t.Fatal("changed config kept the old proxy")
+	}
+}
@@ -43,6 +43,11 @@ func loadStagedUpdate(path string) (StagedUpdate, error) {
 	return m, nil
 }
 
+// PendingUpdate returns the staged update metadata, if any.
+func PendingUpdate(cfg config.Config) (StagedUpdate, error) {
+	return loadStagedUpdate(pendingMetaPath(cfg))
+}
+
 func ApplyIfPending(
 	ctx context.Context,
 	cfg config.Config,
@@ -13,9 +13,12 @@ import (
 	"strings"
 	"time"
 
+	"appcenter-agent/internal/clock"
 	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/delta"
+	"appcenter-agent/internal/dlcache"
 	"appcenter-agent/internal/downloader"
-	"appcenter-agent/pkg/utils"
+	"appcenter-agent/internal/policy"
 )
 
 type StagedUpdate struct {
@@ -26,14 +29,22 @@ type StagedUpdate struct {
 	StagedAtUTC  string `json:"staged_at_utc"`
 	SourceURL    string `json:"source_url"`
 	AgentVersion string `json:"agent_version"`
+	// Delta is set when the file was rebuilt from the running executable
+	// and a binary patch instead of downloaded in full.
+	Delta bool `json:"delta,omitempty"`
 }
 
+// executablePath locates the running service binary that delta patches
+// apply to. Tests replace it.
+var executablePath = os.Executable
+
 var semverLikeRe = regexp.MustCompile(`\d+(?:\.\d+){0,2}`)
 
 func StageIfNeeded(
 	ctx context.Context,
 	cfg config.Config,
 	hbConfig map[string]any,
+	pol *policy.Policy,
 	logger *log.Logger,
 ) error {
 	latestVersion, _ := hbConfig["latest_agent_version"].(string)
@@ -53,38 +64,56 @@ func StageIfNeeded(
 	if !force && !isNewerVersion(latestVersion, cfg.Agent.Version) {
 		return nil
 	}
+	if err := pol.CheckSelfUpdate(force, isNewerVersion(cfg.Agent.Version, latestVersion)); err != nil {
+		return err
+	}
 
 	if err := os.MkdirAll(cfg.Download.TempDir, 0o755); err != nil {
 		return err
 	}
 
-	// Server may provide relative URLs; resolve against configured server.url.
-	resolvedURL := downloadURL
-	if strings.HasPrefix(resolvedURL, "/") {
-		resolvedURL = strings.TrimRight(cfg.Server.URL, "/") + resolvedURL
+	resolvedURL := resolveURL(cfg, downloadURL)
+	if err := pol.CheckDownloadURL(resolvedURL, cfg.Server.URL); err != nil {
+		return err
 	}
 
 	stagedPath := filepath.Join(cfg.Download.TempDir, fmt.Sprintf("agent-update-%s.exe", sanitizeVersion(latestVersion)))
 
-	_, err := downloader.DownloadFileWithMeta(
-		ctx,
-		resolvedURL,
-		stagedPath,
-		cfg.Download.BandwidthLimitKBs,
-		cfg.Agent.UUID,
-		cfg.Agent.SecretKey,
-	)
+	cache, err := dlcache.FromConfig(cfg)
 	if err != nil {
-		return fmt.Errorf("update download failed: %w", err)
+		return fmt.Errorf("download cache: %w", err)
 	}
-
-	valid, err := utils.VerifyFileHash(stagedPath, agentHash)
-	if err != nil {
-		return fmt.Errorf("update hash verify failed: %w", err)
+	sources := []string{resolvedURL}
+	if mirrors, ok := hbConfig["agent_download_mirrors"].([]any); ok {
+		for _, m := range mirrors {
+			s, ok := m.(string)
+			if !ok || strings.TrimSpace(s) == "" {
+				continue
+			}
+			s = strings.TrimSpace(s)
+			if err := pol.CheckSource(s, cfg.Server.URL); err != nil {
+				logger.Printf("self-update: mirror skipped by policy: %v", err)
+				continue
+			}
+			sources = append(sources, s)
+		}
+	}
+	opts := downloader.OptionsFromConfig(cfg)
+	entry, viaDelta := fetchDelta(ctx, cfg, cache, hbConfig, agentHash, opts, pol, logger)
+	if entry == nil {
+		entry, err = downloader.FetchSources(ctx, cache, sources, agentHash, opts)
+		if errors.Is(err, dlcache.ErrHashMismatch) {
+			return errors.New("update hash mismatch")
+		}
+		if err != nil {
+			return fmt.Errorf("update download failed: %w", err)
+		}
 	}
-	if !valid {
-		_ = os.Remove(stagedPath)
-		return errors.New("update hash mismatch")
+	// The staged copy must survive cache eviction until the helper applies it.
+	err = entry.Materialize(stagedPath)
+	entry.Release()
+	if err != nil {
+		return fmt.Errorf("stage update: %w", err)
 	}
 
 	meta := StagedUpdate{
@@ -92,9 +121,10 @@ func StageIfNeeded(
 		FilePath:     stagedPath,
 		Hash:         agentHash,
 		Force:        force,
-		StagedAtUTC:  time.Now().UTC().Format(time.RFC3339),
+		StagedAtUTC:  clock.Now().UTC().Format(time.RFC3339),
 		SourceURL:    resolvedURL,
 		AgentVersion: cfg.Agent.Version,
+		Delta:        viaDelta,
 	}
 	metaPath := filepath.Join(cfg.Download.TempDir, "pending_update.json")
 	b, _ := json.MarshalIndent(meta, "", "  ")
@@ -106,6 +136,97 @@ func StageIfNeeded(
 	return nil
 }
 
+// fetchDelta rebuilds the update from the running executable and the patch
+// the server offers in agent_delta_url for agent_delta_from_version. It
+// returns nil when no patch applies or anything fails, in which case the
+// caller downloads the full file; the rebuilt file must match agentHash.
+func fetchDelta(
+	ctx context.Context,
+	cfg config.Config,
+	cache *dlcache.Cache,
+	hbConfig map[string]any,
+	agentHash string,
+	opts downloader.Options,
+	pol *policy.Policy,
+	logger *log.Logger,
+) (*dlcache.Entry, bool) {
+	deltaURL, _ := hbConfig["agent_delta_url"].(string)
+	deltaHash, _ := hbConfig["agent_delta_hash"].(string)
+	deltaFrom, _ := hbConfig["agent_delta_from_version"].(string)
+	if strings.TrimSpace(deltaURL) == "" || strings.TrimSpace(deltaHash) == "" {
+		return nil, false
+	}
+	deltaURL = resolveURL(cfg, strings.TrimSpace(deltaURL))
+	if err := pol.CheckDownloadURL(deltaURL, cfg.Server.URL); err != nil {
+		logger.Printf("self-update: delta skipped by policy, downloading full file: %v", err)
+		return nil, false
+	}
+	if strings.TrimSpace(deltaFrom) != cfg.Agent.Version {
+		logger.Printf("self-update: delta is for %q, running %q; downloading full file", deltaFrom, cfg.Agent.Version)
+		return nil, false
+	}
+	if e, ok := cache.Acquire(agentHash); ok {
+		return e, false
+	}
+	exe, err := executablePath()
+	if err != nil {
+		logger.Printf("self-update: delta skipped: %v", err)
+		return nil, false
+	}
+	old, err := os.ReadFile(exe)
+	if err != nil {
+		logger.Printf("self-update: delta skipped: %v", err)
+		return nil, false
+	}
+
+	var patchSize int64
+	entry, err := cache.Fetch(agentHash, func(partialPath string) (string, error) {
+		patch, err := downloader.FetchSources(ctx, cache, []string{deltaURL}, deltaHash, opts)
+		if err != nil {
+			return "", fmt.Errorf("patch download: %w", err)
+		}
+		defer patch.Release()
+		patchSize = patch.Size
+		if err := applyPatch(old, patch.Path, partialPath); err != nil {
+			_ = os.Remove(partialPath)
+			return "", err
+		}
+		return filepath.Base(exe), nil
+	})
+	if err != nil {
+		logger.Printf("self-update: delta failed, downloading full file: %v", err)
+		return nil, false
+	}
+	logger.Printf("self-update: rebuilt %s from %d byte delta", cfg.Agent.Version, patchSize)
+	return entry, true
+}
+
+func applyPatch(old []byte, patchPath, outPath string) error {
+	in, err := os.Open(patchPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := delta.Apply(old, in, out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// resolveURL resolves the relative URLs the server may send against
+// server.url.
+func resolveURL(cfg config.Config, u string) string {
+	if strings.HasPrefix(u, "/") {
+		return strings.TrimRight(cfg.Server.URL, "/") + u
+	}
+	return u
+}
+
 func sanitizeVersion(v string) string {
 	r := strings.NewReplacer("/", "_", "\\", "_", ":", "_", " ", "_")
 	return r.Replace(v)
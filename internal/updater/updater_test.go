@@ -1,9 +1,12 @@
 package updater
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -12,6 +15,8 @@ import (
 	"testing"
 
 	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/delta"
+	"appcenter-agent/internal/policy"
 )
 
 func TestSanitizeVersion(t *testing.T) {
@@ -24,7 +29,7 @@ func TestSanitizeVersion(t *testing.T) {
 func TestStageIfNeededSkipsWithoutConfig(t *testing.T) {
 	cfg := config.Config{Agent: config.AgentConfig{Version: "1.0.0"}}
 	logger := log.New(os.Stdout, "", 0)
-	if err := StageIfNeeded(context.Background(), cfg, map[string]any{}, logger); err != nil {
+	if err := StageIfNeeded(context.Background(), cfg, map[string]any{}, nil, logger); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
@@ -62,7 +67,7 @@ func TestStageIfNeededDownloadsAndWritesMetadata(t *testing.T) {
 	}
 
 	logger := log.New(os.Stdout, "", 0)
-	if err := StageIfNeeded(context.Background(), cfg, hb, logger); err != nil {
+	if err := StageIfNeeded(context.Background(), cfg, hb, nil, logger); err != nil {
 		t.Fatalf("StageIfNeeded: %v", err)
 	}
 
@@ -99,10 +104,142 @@ func TestStageIfNeededForceAllowsSameVersion(t *testing.T) {
 	}
 
 	logger := log.New(os.Stdout, "", 0)
-	if err := StageIfNeeded(context.Background(), cfg, hb, logger); err != nil {
+	if err := StageIfNeeded(context.Background(), cfg, hb, nil, logger); err != nil {
 		t.Fatalf("StageIfNeeded force: %v", err)
 	}
 	if _, err := os.Stat(filepath.Join(tmp, "pending_update.json")); err != nil {
 		t.Fatalf("pending_update.json missing: %v", err)
 	}
 }
+
+func TestStageIfNeededPolicyRejectsForceDowngrade(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("download must not start when the policy rejects the update")
+	}))
+	defer srv.Close()
+
+	tmp := t.TempDir()
+	cfg := config.Config{
+		Server:   config.ServerConfig{URL: srv.URL},
+		Agent:    config.AgentConfig{Version: "2.0.0"},
+		Download: config.DownloadConfig{TempDir: tmp, BandwidthLimitKBs: 1024},
+	}
+	hb := map[string]any{
+		"latest_agent_version": "1.0.0",
+		"agent_download_url":   "/agent.exe",
+		"agent_hash":           "sha256:00",
+		"mode":                 "force",
+	}
+	pol := &policy.Policy{Update: policy.UpdateRules{DisableForceDowngrade: true}}
+
+	err := StageIfNeeded(context.Background(), cfg, hb, pol, log.New(io.Discard, "", 0))
+	var rej *policy.Rejection
+	if !errors.As(err, &rej) || rej.Rule != policy.RuleForceDowngrade {
+		t.Fatalf("expected force_downgrade rejection, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "pending_update.json")); !os.IsNotExist(err) {
+		t.Fatalf("pending_update.json must not exist: %v", err)
+	}
+}
+
+func TestStageIfNeededPolicyRejectsDownloadHost(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("download must not start from a host the policy does not allow")
+	}))
+	defer srv.Close()
+
+	tmp := t.TempDir()
+	cfg := config.Config{
+		Server:   config.ServerConfig{URL: "https://appcenter.example.com"},
+		Agent:    config.AgentConfig{Version: "1.0.0"},
+		Download: config.DownloadConfig{TempDir: tmp, BandwidthLimitKBs: 1024},
+	}
+	hb := map[string]any{
+		"latest_agent_version": "2.0.0",
+		"agent_download_url":   srv.URL + "/agent.exe",
+		"agent_hash":           "sha256:00",
+	}
+	pol := &policy.Policy{Download: policy.DownloadRules{AllowedHosts: []string{"cdn.example.com"}}}
+
+	err := StageIfNeeded(context.Background(), cfg, hb, pol, log.New(io.Discard, "", 0))
+	var rej *policy.Rejection
+	if !errors.As(err, &rej) || rej.Rule != policy.RuleDownloadHost {
+		t.Fatalf("expected download host rejection, got %v", err)
+	}
+}
+
+func TestStageIfNeededUsesDelta(t *testing.T) {
+	current := bytes.Repeat([]byte("agent-v1-code-section-"), 4096)
+	target := append(append([]byte{}, current...), []byte("v2 additions")...)
+	patch := delta.Create(current, target)
+	patchSum := sha256.Sum256(patch)
+	targetSum := sha256.Sum256(target)
+
+	tmp := t.TempDir()
+	exe := filepath.Join(tmp, "appcenter-service.exe")
+	if err := os.WriteFile(exe, current, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	prev := executablePath
+	executablePath = func() (string, error) { return exe, nil }
+	defer func() { executablePath = prev }()
+
+	var fullRequests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/agent.delta":
+			_, _ = w.Write(patch)
+		case "/agent.exe":
+			fullRequests++
+			_, _ = w.Write(target)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := config.Config{
+		Server:   config.ServerConfig{URL: srv.URL},
+		Agent:    config.AgentConfig{Version: "1.0.0", UUID: "u1", SecretKey: "s1"},
+		Download: config.DownloadConfig{TempDir: filepath.Join(tmp, "dl"), BandwidthLimitKBs: 1024},
+	}
+	hb := map[string]any{
+		"latest_agent_version":     "2.0.0",
+		"agent_download_url":       "/agent.exe",
+		"agent_hash":               fmt.Sprintf("sha256:%x", targetSum[:]),
+		"agent_delta_url":          "/agent.delta",
+		"agent_delta_hash":         fmt.Sprintf("sha256:%x", patchSum[:]),
+		"agent_delta_from_version": "1.0.0",
+	}
+	logger := log.New(io.Discard, "", 0)
+	if err := StageIfNeeded(context.Background(), cfg, hb, nil, logger); err != nil {
+		t.Fatalf("StageIfNeeded: %v", err)
+	}
+	if fullRequests != 0 {
+		t.Fatalf("full download requested %d time(s)", fullRequests)
+	}
+	meta, err := PendingUpdate(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Delta {
+		t.Fatal("pending update not marked as delta")
+	}
+	got, err := os.ReadFile(meta.FilePath)
+	if err != nil || !bytes.Equal(got, target) {
+		t.Fatalf("staged file differs from target (err=%v)", err)
+	}
+
+	// A patch for another build falls back to the full download.
+	if err := os.WriteFile(exe, []byte("locally patched binary"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Download.TempDir = filepath.Join(tmp, "dl2")
+	if err := StageIfNeeded(context.Background(), cfg, hb, nil, logger); err != nil {
+		t.Fatalf("StageIfNeeded fallback: %v", err)
+	}
+	if fullRequests != 1 {
+		t.Fatalf("full download requested %d time(s), want 1", fullRequests)
+	}
+	if meta, err := PendingUpdate(cfg); err != nil || meta.Delta {
+		t.Fatalf("fallback meta = %+v, err = %v", meta, err)
+	}
+}
@@ -0,0 +1,93 @@
+package urlguard
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IsShare reports whether src names a file share (UNC path or file:// URL)
+// rather than an HTTP source.
+func IsShare(src string) bool {
+	src = strings.TrimSpace(src)
+	return strings.HasPrefix(src, `\\`) || strings.HasPrefix(src, "//") ||
+		strings.HasPrefix(strings.ToLower(src), "file:")
+}
+
+// CheckShare resolves a file-share source to a local path. Shares are only
+// allowed below an entry of download.allowed_shares; there is no default.
+func (g *Guard) CheckShare(src string) (string, error) {
+	p, err := shareSlashPath(src)
+	if err != nil {
+		return "", err
+	}
+	if g != nil && !shareUnder(p, g.opts.AllowedShares) {
+		return "", fmt.Errorf("%w: share %q", ErrForbidden, p)
+	}
+	return filepath.FromSlash(p), nil
+}
+
+// ShareWithin reports whether the file-share source src lies below one of
+// roots, using the same matching as CheckShare.
+func ShareWithin(src string, roots []string) bool {
+	p, err := shareSlashPath(src)
+	return err == nil && shareUnder(p, roots)
+}
+
+func shareUnder(p string, roots []string) bool {
+	lp := strings.ToLower(p)
+	for _, entry := range roots {
+		root, err := shareSlashPath(entry)
+		if err != nil {
+			continue
+		}
+		root = strings.ToLower(strings.TrimRight(root, "/"))
+		if lp == root || strings.HasPrefix(lp, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// shareSlashPath converts "\\host\share\f", "//host/share/f",
+// "file://host/share/f" and "file:///mnt/f" to a cleaned slash path
+// ("//host/share/f" or "/mnt/f").
+func shareSlashPath(src string) (string, error) {
+	src = strings.TrimSpace(src)
+	if strings.HasPrefix(strings.ToLower(src), "file:") {
+		u, err := url.Parse(src)
+		if err != nil {
+			return "", err
+		}
+		src = u.Path
+		if len(src) > 1 && hasDriveLetter(src[1:]) {
+			// file:///C:/dir -> C:/dir
+			src = src[1:]
+		}
+		if u.Host != "" {
+			src = "//" + u.Host + u.Path
+		}
+	}
+	src = strings.ReplaceAll(src, `\`, "/")
+	unc := strings.HasPrefix(src, "//")
+	if !unc && !strings.HasPrefix(src, "/") && !hasDriveLetter(src) {
+		return "", fmt.Errorf("%w: share path must be absolute", ErrForbidden)
+	}
+	for _, part := range strings.Split(src, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%w: share path contains ..", ErrForbidden)
+		}
+	}
+	cleaned := path.Clean(src)
+	if unc {
+		cleaned = "/" + cleaned
+	}
+	return cleaned, nil
+}
+
+func hasDriveLetter(p string) bool {
+	return len(p) >= 3 && p[1] == ':' && p[2] == '/' &&
+		((p[0] >= 'a' && p[0] <= 'z') || (p[0] >= 'A' && p[0] <= 'Z'))
+}
@@ -0,0 +1,319 @@
+// Package urlguard is the central URL policy for content the agent fetches on
+// the server's instruction (package downloads, self-updates, runtime files).
+//
+// It restricts schemes and hosts (by default to the configured server
+// origin), limits redirects, never forwards agent credentials to another
+// origin and refuses to connect to loopback or link-local addresses unless
+// explicitly allowed. Address checks run at dial time on the resolved IP, so
+// DNS tricks cannot route a request to a blocked address.
+package urlguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"appcenter-agent/internal/config"
+	"appcenter-agent/internal/netproxy"
+	"appcenter-agent/internal/reqsign"
+)
+
+// DefaultMaxRedirects is used when download.max_redirects is not set.
+const DefaultMaxRedirects = 5
+
+// ErrForbidden is wrapped by every rejection.
+var ErrForbidden = errors.New("url not allowed")
+
+// Options configures a Guard.
+type Options struct {
+	// ServerURL is the trusted origin; credentials are only sent there.
+	ServerURL string
+	// AllowedHosts extends the server host. Entries are "host", "host:port"
+	// or "*.domain".
+	AllowedHosts []string
+	// AllowedSchemes defaults to https plus the server's scheme.
+	AllowedSchemes []string
+	MaxRedirects   int
+	AllowLoopback  bool
+	AllowLinkLocal bool
+	// AllowedShares lists UNC or local roots file-share sources may read
+	// from (see CheckShare).
+	AllowedShares []string
+}
+
+// Guard enforces Options. A nil *Guard allows everything and always sends
+// credentials, matching the behavior before the policy existed.
+type Guard struct {
+	opts    Options
+	origin  *url.URL
+	schemes map[string]bool
+}
+
+// New builds a Guard from opts.
+func New(opts Options) *Guard {
+	g := &Guard{opts: opts, schemes: map[string]bool{}}
+	if u, err := url.Parse(strings.TrimSpace(opts.ServerURL)); err == nil && u.Host != "" {
+		g.origin = u
+	}
+	for _, s := range opts.AllowedSchemes {
+		g.schemes[strings.ToLower(strings.TrimSpace(s))] = true
+	}
+	if len(g.schemes) == 0 {
+		g.schemes["https"] = true
+		if g.origin != nil {
+			g.schemes[strings.ToLower(g.origin.Scheme)] = true
+		}
+	}
+	if g.opts.MaxRedirects <= 0 {
+		g.opts.MaxRedirects = DefaultMaxRedirects
+	}
+	return g
+}
+
+// FromConfig builds the Guard described by cfg.Server and cfg.Download.
+func FromConfig(cfg config.Config) *Guard {
+	return New(Options{
+		ServerURL:      cfg.Server.URL,
+		AllowedHosts:   cfg.Download.AllowedHosts,
+		AllowedSchemes: cfg.Download.AllowedSchemes,
+		MaxRedirects:   cfg.Download.MaxRedirects,
+		AllowLoopback:  cfg.Download.AllowLoopback,
+		AllowLinkLocal: cfg.Download.AllowLinkLocal,
+		AllowedShares:  cfg.Download.AllowedShares,
+	})
+}
+
+// Check parses rawURL and rejects disallowed schemes and hosts.
+func (g *Guard) Check(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return nil, err
+	}
+	if g == nil {
+		return u, nil
+	}
+	return u, g.checkURL(u)
+}
+
+func (g *Guard) checkURL(u *url.URL) error {
+	if !g.schemes[strings.ToLower(u.Scheme)] {
+		return fmt.Errorf("%w: scheme %q", ErrForbidden, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%w: missing host", ErrForbidden)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: embedded credentials", ErrForbidden)
+	}
+	if !g.hostAllowed(u) {
+		return fmt.Errorf("%w: host %q", ErrForbidden, u.Host)
+	}
+	return nil
+}
+
+func (g *Guard) hostAllowed(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	if g.isServerHost(host) {
+		return true
+	}
+	hostPort := strings.ToLower(u.Host)
+	for _, entry := range g.opts.AllowedHosts {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.HasPrefix(entry, "*."):
+			if strings.HasSuffix(host, entry[1:]) {
+				return true
+			}
+		case strings.Contains(entry, ":"):
+			if entry == hostPort {
+				return true
+			}
+		case entry == host:
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Guard) isServerHost(host string) bool {
+	return g.origin != nil && strings.EqualFold(g.origin.Hostname(), host)
+}
+
+// SameOrigin reports whether u shares scheme, host and port with the server,
+// i.e. whether agent credentials may be attached.
+func (g *Guard) SameOrigin(u *url.URL) bool {
+	if g == nil {
+		return true
+	}
+	if g.origin == nil || u == nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, g.origin.Scheme) &&
+		strings.EqualFold(u.Hostname(), g.origin.Hostname()) &&
+		effectivePort(u) == effectivePort(g.origin)
+}
+
+func effectivePort(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	if strings.EqualFold(u.Scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+// CheckRedirect limits redirects, applies the URL policy to every hop and
+// strips agent credentials when a hop leaves the server origin.
+func (g *Guard) CheckRedirect(req *http.Request, via []*http.Request) error {
+	maxRedirects := DefaultMaxRedirects
+	if g != nil {
+		maxRedirects = g.opts.MaxRedirects
+	}
+	if len(via) > maxRedirects {
+		return fmt.Errorf("%w: stopped after %d redirects", ErrForbidden, maxRedirects)
+	}
+	if g == nil {
+		return nil
+	}
+	if err := g.checkURL(req.URL); err != nil {
+		return err
+	}
+	if !g.SameOrigin(req.URL) {
+		StripCredentials(req.Header)
+	}
+	return nil
+}
+
+// StripCredentials removes agent authentication headers.
+func StripCredentials(h http.Header) {
+	for _, k := range []string{
+		reqsign.HeaderUUID,
+		reqsign.HeaderSecret,
+		reqsign.HeaderTimestamp,
+		reqsign.HeaderNonce,
+		reqsign.HeaderContentHash,
+		reqsign.HeaderSignature,
+		"Authorization",
+	} {
+		h.Del(k)
+	}
+}
+
+// Client returns an HTTP client enforcing the guard on redirects and at dial
+// time. timeout 0 means no overall timeout (large downloads). Requests go
+// through the process-wide proxy (see netproxy); the target address is then
+// checked when the proxy is chosen, since the dial only reaches the proxy.
+func (g *Guard) Client(timeout time.Duration) *http.Client {
+	tr := netproxy.Transport()
+	if g != nil {
+		proxies := &proxyAddrs{addrs: map[string]bool{}}
+		tr.Proxy = g.proxyFunc(tr.Proxy, proxies)
+		tr.DialContext = g.dialContext(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}, proxies)
+	}
+	return &http.Client{Timeout: timeout, Transport: tr, CheckRedirect: g.CheckRedirect}
+}
+
+// proxyAddrs records the proxies a transport has been handed, so its dialer
+// can tell a connection to the proxy from one to a target.
+type proxyAddrs struct {
+	mu    sync.Mutex
+	addrs map[string]bool
+}
+
+func (p *proxyAddrs) add(addr string) {
+	p.mu.Lock()
+	p.addrs[addr] = true
+	p.mu.Unlock()
+}
+
+func (p *proxyAddrs) has(addr string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addrs[strings.ToLower(addr)]
+}
+
+func (g *Guard) proxyFunc(next func(*http.Request) (*url.URL, error), proxies *proxyAddrs) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		pu, err := next(req)
+		if err != nil || pu == nil {
+			return pu, err
+		}
+		if err := g.checkTarget(req.Context(), req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+		proxies.add(netproxy.HostPort(pu))
+		return pu, nil
+	}
+}
+
+// checkTarget applies the address policy to a host the proxy will connect
+// to. A host the agent cannot resolve itself is left to the proxy.
+func (g *Guard) checkTarget(ctx context.Context, host string) error {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if err := g.checkIP(host, ip.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Guard) dialContext(d *net.Dialer, proxies *proxyAddrs) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if proxies.has(addr) {
+			return d.DialContext(ctx, network, addr)
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var lastErr error
+		for _, ip := range ips {
+			if err := g.checkIP(host, ip.IP); err != nil {
+				lastErr = err
+				continue
+			}
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no addresses for %s", host)
+		}
+		return nil, lastErr
+	}
+}
+
+// checkIP rejects loopback, link-local and unspecified targets. The
+// configured server host is exempt so local/test servers keep working.
+func (g *Guard) checkIP(host string, ip net.IP) error {
+	if g.isServerHost(host) {
+		return nil
+	}
+	switch {
+	case ip.IsUnspecified():
+		return fmt.Errorf("%w: unspecified address %s", ErrForbidden, ip)
+	case ip.IsLoopback() && !g.opts.AllowLoopback:
+		return fmt.Errorf("%w: loopback address %s", ErrForbidden, ip)
+	case (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()) && !g.opts.AllowLinkLocal:
+		return fmt.Errorf("%w: link-local address %s", ErrForbidden, ip)
+	}
+	return nil
+}
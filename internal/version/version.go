@@ -0,0 +1,193 @@
+// Package version compares software version strings as reported by
+// installers and package managers.
+//
+// Versions are split into numeric and alphabetic segments at any other
+// character, so four-part Windows versions (10.0.19041.1), vendor schemes
+// (23.01, 2024.1.2 build 241) and package versions (1:2.3-4ubuntu1) all
+// compare segment by segment. Numeric segments compare as numbers and
+// missing ones count as zero (1.2 == 1.2.0.0). A leading "v" is ignored and
+// an "epoch:" prefix outranks everything after it. Pre-release words
+// (dev < alpha < beta < pre/preview < rc) and "~" sort before the release
+// they precede (1.2.0-rc.1 < 1.2.0, 1.2~beta < 1.2); any other word makes a
+// version newer than a zero but older than a higher number in its place
+// (1.1.1 < 1.1.1w < 1.1.1.1). The shorter version is padded with zeros
+// before segments are compared, so padding never changes a result.
+//
+// Segment order: ~ < pre-release word < 0 < other word < number > 0.
+package version
+
+import (
+	"strings"
+)
+
+type kind int
+
+const (
+	kindTilde kind = iota
+	kindAlpha
+	kindNumber
+)
+
+type segment struct {
+	kind kind
+	text string
+}
+
+// zero pads the shorter version.
+var zero = segment{kind: kindNumber, text: "0"}
+
+var preRelease = map[string]int{
+	"dev":     1,
+	"alpha":   2,
+	"beta":    3,
+	"pre":     4,
+	"preview": 4,
+	"rc":      5,
+	"cr":      5,
+}
+
+// Comparable reports whether v carries a version number at all.
+func Comparable(v string) bool {
+	return strings.ContainsAny(v, "0123456789")
+}
+
+// Compare returns -1, 0 or +1 as a is older than, equal to or newer than b.
+func Compare(a, b string) int {
+	ea, ra := splitEpoch(a)
+	eb, rb := splitEpoch(b)
+	if c := compareNumbers(ea, eb); c != 0 {
+		return c
+	}
+	sa, sb := segments(ra), segments(rb)
+	for i := 0; i < len(sa) || i < len(sb); i++ {
+		x, y := zero, zero
+		if i < len(sa) {
+			x = sa[i]
+		}
+		if i < len(sb) {
+			y = sb[i]
+		}
+		if c := compareSegments(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// Newer reports whether candidate is a newer version than installed. Versions
+// without a number are never considered newer.
+func Newer(candidate, installed string) bool {
+	return Comparable(candidate) && Comparable(installed) && Compare(candidate, installed) > 0
+}
+
+func splitEpoch(v string) (epoch, rest string) {
+	v = strings.TrimSpace(v)
+	if len(v) > 1 && (v[0] == 'v' || v[0] == 'V') && isDigit(v[1]) {
+		v = v[1:]
+	}
+	if i := strings.IndexByte(v, ':'); i > 0 && allDigits(v[:i]) {
+		return v[:i], v[i+1:]
+	}
+	return "0", v
+}
+
+func segments(v string) []segment {
+	var out []segment
+	for i := 0; i < len(v); {
+		c := v[i]
+		switch {
+		case c == '~':
+			out = append(out, segment{kind: kindTilde})
+			i++
+		case isDigit(c):
+			j := i
+			for j < len(v) && isDigit(v[j]) {
+				j++
+			}
+			out = append(out, segment{kind: kindNumber, text: v[i:j]})
+			i = j
+		case isLetter(c):
+			j := i
+			for j < len(v) && isLetter(v[j]) {
+				j++
+			}
+			out = append(out, segment{kind: kindAlpha, text: strings.ToLower(v[i:j])})
+			i = j
+		default:
+			i++
+		}
+	}
+	return out
+}
+
+func compareSegments(a, b segment) int {
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return sign(ra - rb)
+	}
+	switch a.kind {
+	case kindNumber:
+		return compareNumbers(a.text, b.text)
+	case kindAlpha:
+		if pa, pb := preRelease[a.text], preRelease[b.text]; pa != pb {
+			return sign(pa - pb)
+		}
+		return strings.Compare(a.text, b.text)
+	}
+	return 0
+}
+
+// Segment ranks, see the package comment.
+const (
+	rankTilde = iota
+	rankPreRelease
+	rankZero
+	rankWord
+	rankNumber
+)
+
+func rank(s segment) int {
+	switch s.kind {
+	case kindTilde:
+		return rankTilde
+	case kindAlpha:
+		if preRelease[s.text] > 0 {
+			return rankPreRelease
+		}
+		return rankWord
+	}
+	if compareNumbers(s.text, "0") == 0 {
+		return rankZero
+	}
+	return rankNumber
+}
+
+// compareNumbers compares digit strings of any length.
+func compareNumbers(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return sign(len(a) - len(b))
+	}
+	return strings.Compare(a, b)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+func isLetter(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,79 @@
+package version
+
+import "testing"
+
+func TestCompare(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2", "1.2.0.0", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"10.0.19041.1", "10.0.19041", 1},
+		{"124.0.6367.91", "124.0.6367.207", -1},
+		{"125.0.6422.60", "124.0.6367.207", 1},
+		{"23.01", "22.01", 1},
+		{"9.20", "9.3", 1},
+		{"1.2.0-rc.1", "1.2.0", -1},
+		{"1.2.0-beta.2", "1.2.0-rc.1", -1},
+		{"1.2.0-alpha", "1.2.0-beta", -1},
+		{"2.0.0-dev", "2.0.0-alpha", -1},
+		{"1.2~beta", "1.2", -1},
+		{"1.0~rc1", "1.0.a", -1},
+		{"1.1.1w", "1.1.1", 1},
+		{"1.1.1w", "1.1.1v", 1},
+		{"1.0.beta", "1.0.0", -1},
+		{"1:1.0", "2.0", 1},
+		{"2:8.2.3995-1ubuntu2", "2:8.2.3995-1ubuntu10", -1},
+		{"2024.1.2 build 241", "2024.1.2 build 233", 1},
+		{"3.0.20", "3.0.020", 0},
+		{"18446744073709551616.1", "18446744073709551615.9", 1},
+		// Padding with zeros never changes a result.
+		{"1.1.1w", "1.1.1.0", 1},
+		{"1.1.1w", "1.1.1.1", -1},
+		{"1.0a", "1.0.0", 1},
+		{"1.0a", "1.0.1", -1},
+		{"1.0.beta", "1.0", -1},
+		{"1.0.0.rc1", "1.0", -1},
+	}
+	for _, tc := range cases {
+		if got := Compare(tc.a, tc.b); got != tc.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+		if got := Compare(tc.b, tc.a); got != -tc.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tc.b, tc.a, got, -tc.want)
+		}
+	}
+}
+
+func TestCompareIsTransitive(t *testing.T) {
+	versions := []string{
+		"1.1.1", "1.1.1.0", "1.1.1w", "1.1.1v", "1.1.1.1", "1.1.1-rc1", "1.1.1~1",
+		"1.0", "1.0a", "1.0.a", "1.0.0", "1.0.1", "1.0.beta", "1.0-rc", "1.0~rc1",
+		"1.0.0.0.1", "1.0.0a", "1:0.1", "2.0-dev", "2.0-alpha", "2.0", "2.0.pre", "2.0.preview",
+	}
+	for _, a := range versions {
+		for _, b := range versions {
+			ab := Compare(a, b)
+			if ba := Compare(b, a); ab != -ba {
+				t.Errorf("Compare(%q, %q) = %d but Compare(%q, %q) = %d", a, b, ab, b, a, ba)
+			}
+			for _, c := range versions {
+				bc, ac := Compare(b, c), Compare(a, c)
+				if ab >= 0 && bc >= 0 && ac < 0 || ab <= 0 && bc <= 0 && ac > 0 {
+					t.Errorf("not transitive: %q vs %q = %d, %q vs %q = %d, %q vs %q = %d", a, b, ab, b, c, bc, a, c, ac)
+				}
+			}
+		}
+	}
+}
+
+func TestNewerRequiresNumbers(t *testing.T) {
+	if Newer("latest", "1.0") || Newer("2.0", "unknown") {
+		t.Fatal("versions without a number compared as newer")
+	}
+	if !Newer("2.0", "1.9.9.9") || Newer("1.0", "1.0.0") {
+		t.Fatal("Newer disagrees with Compare")
+	}
+}
@@ -12,6 +12,11 @@ import (
 	"sync"
 	"time"
 
+	"appcenter-agent/internal/clock"
+	"appcenter-agent/internal/netproxy"
+	"appcenter-agent/internal/reqsign"
+	"appcenter-agent/internal/resilience"
+
 	"github.com/coder/websocket"
 )
 
@@ -21,6 +26,8 @@ type Client struct {
 	wsURL     string
 	agentUUID string
 	secretKey string
+	credsFn   func() (string, string)
+	authMode  string
 	version   string
 	platform  string
 	arch      string
@@ -34,6 +41,9 @@ type Client struct {
 
 	callbacks Callbacks
 	logger    *log.Logger
+	breakers  *resilience.Breakers
+	deflate   bool
+	msgpack   bool
 
 	mu   sync.Mutex
 	conn *websocket.Conn
@@ -50,6 +60,13 @@ type Config struct {
 
 	AgentUUID string
 	SecretKey string
+	// Credentials, when set, is consulted on every (re)connect instead of the
+	// static AgentUUID/SecretKey so rotated secrets are picked up.
+	Credentials func() (agentUUID, secret string)
+	// AuthMode mirrors server.auth_mode: "legacy" sends the secret in agent.auth,
+	// "compat" sends it and also answers an HMAC challenge, "signed" only answers
+	// the challenge.
+	AuthMode  string
 	Version   string
 	Platform  string
 	Arch      string
@@ -63,6 +80,13 @@ type Config struct {
 
 	Callbacks Callbacks
 	Logger    *log.Logger
+	// Breakers delays reconnects while the server asks agents to back off
+	// (default: resilience.Default()).
+	Breakers *resilience.Breakers
+	// Deflate offers permessage-deflate; MsgPack offers the MessagePack
+	// subprotocol. Both only take effect when the server accepts them.
+	Deflate bool
+	MsgPack bool
 }
 
 func deriveWSURL(serverURL, wsURL string) string {
@@ -91,10 +115,16 @@ func NewClient(cfg Config) *Client {
 	if logger == nil {
 		logger = log.Default()
 	}
+	breakers := cfg.Breakers
+	if breakers == nil {
+		breakers = resilience.Default()
+	}
 	return &Client{
 		wsURL:        deriveWSURL(cfg.ServerURL, cfg.WSURL),
 		agentUUID:    cfg.AgentUUID,
 		secretKey:    cfg.SecretKey,
+		credsFn:      cfg.Credentials,
+		authMode:     reqsign.NormalizeMode(cfg.AuthMode),
 		version:      cfg.Version,
 		platform:     cfg.Platform,
 		arch:         cfg.Arch,
@@ -106,6 +136,9 @@ func NewClient(cfg Config) *Client {
 		reconnectMax: time.Duration(maxSec) * time.Second,
 		callbacks:    cfg.Callbacks,
 		logger:       logger,
+		breakers:     breakers,
+		deflate:      cfg.Deflate,
+		msgpack:      cfg.MsgPack,
 	}
 }
 
@@ -138,6 +171,10 @@ func (c *Client) Run(ctx context.Context) {
 
 		// Jitter: ±25%
 		jitter := time.Duration(float64(backoff) * (0.75 + 0.5*rand.Float64()))
+		if wait := c.breakers.Wait(resilience.ClassWS); wait > jitter {
+			c.logger.Printf("ws reconnect deferred %v by server backoff", wait.Round(time.Second))
+			jitter = wait
+		}
 		select {
 		case <-ctx.Done():
 			return
@@ -151,14 +188,44 @@ func (c *Client) Run(ctx context.Context) {
 }
 
 func (c *Client) connectAndServe(ctx context.Context) error {
-	c.logger.Printf("ws connecting to %s", c.wsURL)
+	c.mu.Lock()
+	wsURL := c.wsURL
+	c.mu.Unlock()
+	c.logger.Printf("ws connecting to %s", wsURL)
 
-	conn, _, err := websocket.Dial(ctx, c.wsURL, &websocket.DialOptions{
-		HTTPHeader: http.Header{},
-	})
+	c.mu.Lock()
+	authMode := c.authMode
+	c.mu.Unlock()
+	header, err := c.upgradeHeader(wsURL, authMode)
 	if err != nil {
+		return fmt.Errorf("sign upgrade: %w", err)
+	}
+	opts := &websocket.DialOptions{
+		HTTPClient: &http.Client{Transport: netproxy.Transport()},
+		HTTPHeader: header,
+	}
+	if c.deflate {
+		opts.CompressionMode = websocket.CompressionContextTakeover
+	}
+	if c.msgpack {
+		opts.Subprotocols = []string{SubprotocolMsgPack}
+	}
+	conn, resp, err := websocket.Dial(ctx, wsURL, opts)
+	if err != nil {
+		if ctx.Err() == nil {
+			status, retryAfter := 0, time.Duration(0)
+			if resp != nil {
+				status = resp.StatusCode
+				retryAfter = resilience.ParseRetryAfter(resp.Header.Get("Retry-After"), clock.Now())
+			}
+			c.breakers.Record(resilience.ClassWS, status, retryAfter)
+		}
 		return fmt.Errorf("dial: %w", err)
 	}
+	c.breakers.Record(resilience.ClassWS, resp.StatusCode, 0)
+	if conn.Subprotocol() == SubprotocolMsgPack {
+		c.logger.Printf("ws using %s envelopes", SubprotocolMsgPack)
+	}
 	defer func() {
 		c.mu.Lock()
 		c.conn = nil
@@ -174,19 +241,22 @@ func (c *Client) connectAndServe(ctx context.Context) error {
 	c.mu.Unlock()
 
 	// 1) Send agent.auth
-	authMsg := newMessage("agent.auth", map[string]any{
-		"uuid":   c.agentUUID,
-		"secret": c.secretKey,
-	})
+	authMsg := newMessage("agent.auth", c.authPayload(authMode))
 	if err := c.writeJSON(ctx, conn, authMsg); err != nil {
 		return fmt.Errorf("send auth: %w", err)
 	}
 
-	// 2) Read server.auth.ok
+	// 2) Read server.auth.ok (optionally preceded by an HMAC challenge)
 	authResp, err := c.readMessage(ctx, conn)
 	if err != nil {
 		return fmt.Errorf("read auth response: %w", err)
 	}
+	if authResp.Type == "server.auth.challenge" {
+		authResp, err = c.answerChallenge(ctx, conn, authResp, authMode)
+		if err != nil {
+			return err
+		}
+	}
 	if authResp.Type == "server.auth.result" {
 		if ok, _ := authResp.Payload["ok"].(bool); !ok {
 			errMsg, _ := authResp.Payload["error"].(string)
@@ -245,6 +315,70 @@ func (c *Client) connectAndServe(ctx context.Context) error {
 	return nil
 }
 
+func (c *Client) credentials() (string, string) {
+	if c.credsFn != nil {
+		return c.credsFn()
+	}
+	return c.agentUUID, c.secretKey
+}
+
+// upgradeHeader returns the headers for the upgrade request. The UUID
+// identifies the agent to a site relay for its reachability report;
+// authentication happens in agent.auth. In signed mode the upgrade is also
+// signed, which a relay with require_signed insists on: it shows the secret
+// stays out of agent.auth.
+func (c *Client) upgradeHeader(wsURL, authMode string) (http.Header, error) {
+	agentUUID, secret := c.credentials()
+	if authMode != reqsign.ModeSigned {
+		return http.Header{reqsign.HeaderUUID: []string{agentUUID}}, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, wsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	creds := reqsign.Credentials{AgentUUID: agentUUID, Secret: secret, Mode: authMode}
+	if err := creds.Sign(req, nil); err != nil {
+		return nil, err
+	}
+	return req.Header, nil
+}
+
+func (c *Client) authPayload(authMode string) map[string]any {
+	agentUUID, secret := c.credentials()
+	payload := map[string]any{"uuid": agentUUID}
+	if authMode != reqsign.ModeSigned {
+		payload["secret"] = secret
+	}
+	if authMode != reqsign.ModeLegacy {
+		payload["schemes"] = []string{reqsign.Scheme}
+	}
+	return payload
+}
+
+func (c *Client) answerChallenge(ctx context.Context, conn *websocket.Conn, challenge Message, authMode string) (Message, error) {
+	if authMode == reqsign.ModeLegacy {
+		return Message{}, fmt.Errorf("auth challenge received but auth_mode=legacy")
+	}
+	serverNonce, _ := challenge.Payload["nonce"].(string)
+	if serverNonce == "" {
+		return Message{}, fmt.Errorf("auth challenge without nonce")
+	}
+	agentUUID, secret := c.credentials()
+	creds := reqsign.Credentials{AgentUUID: agentUUID, Secret: secret, Mode: authMode}
+	payload, err := creds.ChallengeResponse(serverNonce)
+	if err != nil {
+		return Message{}, fmt.Errorf("sign auth challenge: %w", err)
+	}
+	if err := c.writeJSON(ctx, conn, newMessage("agent.auth.response", payload)); err != nil {
+		return Message{}, fmt.Errorf("send auth response: %w", err)
+	}
+	resp, err := c.readMessage(ctx, conn)
+	if err != nil {
+		return Message{}, fmt.Errorf("read auth result: %w", err)
+	}
+	return resp, nil
+}
+
 func (c *Client) messageLoop(ctx context.Context, conn *websocket.Conn) error {
 	for {
 		if ctx.Err() != nil {
@@ -312,6 +446,11 @@ func (c *Client) messageLoop(ctx context.Context, conn *websocket.Conn) error {
 				c.callbacks.OnBroadcastSelfUpdate(msg.Payload)
 			}
 
+		case "server.credential.rotate":
+			if c.callbacks.OnCredentialRotate != nil {
+				c.callbacks.OnCredentialRotate(msg.Payload)
+			}
+
 		case "server.announcement.push":
 			if c.callbacks.OnAnnouncementPush != nil {
 				c.callbacks.OnAnnouncementPush(msg.Payload)
@@ -323,7 +462,16 @@ func (c *Client) messageLoop(ctx context.Context, conn *websocket.Conn) error {
 	}
 }
 
+// writeJSON sends msg as a JSON text frame, or as a binary MessagePack frame
+// when the server selected SubprotocolMsgPack.
 func (c *Client) writeJSON(ctx context.Context, conn *websocket.Conn, msg Message) error {
+	if conn.Subprotocol() == SubprotocolMsgPack {
+		data, err := encodeMsgPack(msg)
+		if err != nil {
+			return err
+		}
+		return conn.Write(ctx, websocket.MessageBinary, data)
+	}
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
@@ -331,11 +479,20 @@ func (c *Client) writeJSON(ctx context.Context, conn *websocket.Conn, msg Messag
 	return conn.Write(ctx, websocket.MessageText, data)
 }
 
+// readMessage decodes one frame; binary frames carry MessagePack, text
+// frames JSON, so a server may fall back to JSON for individual messages.
 func (c *Client) readMessage(ctx context.Context, conn *websocket.Conn) (Message, error) {
-	_, data, err := conn.Read(ctx)
+	typ, data, err := conn.Read(ctx)
 	if err != nil {
 		return Message{}, err
 	}
+	if typ == websocket.MessageBinary {
+		msg, err := decodeMsgPack(data)
+		if err != nil {
+			return Message{}, fmt.Errorf("unmarshal: %w", err)
+		}
+		return msg, nil
+	}
 	var msg Message
 	if err := json.Unmarshal(data, &msg); err != nil {
 		return Message{}, fmt.Errorf("unmarshal: %w", err)
@@ -365,6 +522,37 @@ func (c *Client) SendEvent(ctx context.Context, msgType string, payload map[stri
 	return c.SendMessage(ctx, newMessage(msgType, payload))
 }
 
+// Reconnect drops the current connection so the next attempt re-authenticates
+// with the latest credentials.
+func (c *Client) Reconnect() {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		conn.Close(websocket.StatusNormalClosure, "credentials changed")
+	}
+}
+
+// SetEndpoint switches the client to another server (endpoint failover). An
+// open connection is closed so the next one goes to the new URL.
+func (c *Client) SetEndpoint(serverURL, wsURL string) {
+	c.mu.Lock()
+	c.wsURL = deriveWSURL(serverURL, wsURL)
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		conn.Close(websocket.StatusNormalClosure, "endpoint changed")
+	}
+}
+
+// SetAuthMode changes server.auth_mode from the next handshake on; the open
+// connection is already authenticated and stays up.
+func (c *Client) SetAuthMode(mode string) {
+	c.mu.Lock()
+	c.authMode = reqsign.NormalizeMode(mode)
+	c.mu.Unlock()
+}
+
 // IsConnected returns true if a WS connection is currently active.
 func (c *Client) IsConnected() bool {
 	c.mu.Lock()
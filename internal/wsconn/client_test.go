@@ -0,0 +1,31 @@
+package wsconn
+
+import (
+	"testing"
+
+	"appcenter-agent/internal/reqsign"
+)
+
+func TestUpgradeSignedOnlyInSignedMode(t *testing.T) {
+	c := NewClient(Config{ServerURL: "https://server.example", AgentUUID: "agent-1", SecretKey: "s1"})
+	wsURL := "wss://server.example/api/v1/agent/ws"
+
+	h, err := c.upgradeHeader(wsURL, reqsign.ModeSigned)
+	if err != nil {
+		t.Fatalf("upgradeHeader: %v", err)
+	}
+	if h.Get(reqsign.HeaderUUID) != "agent-1" || h.Get(reqsign.HeaderSignature) == "" || h.Get(reqsign.HeaderSecret) != "" {
+		t.Fatalf("signed upgrade headers = %v", h)
+	}
+	if _, ok := c.authPayload(reqsign.ModeSigned)["secret"]; ok {
+		t.Fatal("signed agent.auth carries the secret")
+	}
+
+	h, err = c.upgradeHeader(wsURL, reqsign.ModeCompat)
+	if err != nil {
+		t.Fatalf("upgradeHeader: %v", err)
+	}
+	if h.Get(reqsign.HeaderSignature) != "" || h.Get(reqsign.HeaderSecret) != "" {
+		t.Fatalf("compat upgrade headers = %v, want UUID only", h)
+	}
+}
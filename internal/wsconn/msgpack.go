@@ -0,0 +1,326 @@
+package wsconn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// SubprotocolMsgPack is offered when Config.MsgPack is set. A server that
+// selects it exchanges Message envelopes as binary MessagePack frames; any
+// other answer keeps JSON text frames.
+const SubprotocolMsgPack = "appcenter.msgpack.v1"
+
+// maxMsgPackDepth bounds nesting when decoding untrusted input.
+const maxMsgPackDepth = 64
+
+var errMsgPack = errors.New("msgpack: malformed input")
+
+// encodeMsgPack encodes msg as a MessagePack map with the JSON field names.
+// The payload is normalized through JSON first so struct tags and numeric
+// types come out exactly as in the JSON encoding.
+func encodeMsgPack(msg Message) ([]byte, error) {
+	var payload any
+	if msg.Payload != nil {
+		b, err := json.Marshal(msg.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &payload); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	writeMapHeader(&buf, 5)
+	writeString(&buf, "id")
+	writeString(&buf, msg.ID)
+	writeString(&buf, "type")
+	writeString(&buf, msg.Type)
+	writeString(&buf, "ts")
+	writeString(&buf, msg.TS)
+	writeString(&buf, "payload")
+	if err := writeValue(&buf, payload); err != nil {
+		return nil, err
+	}
+	writeString(&buf, "ack")
+	_ = writeValue(&buf, msg.Ack)
+	return buf.Bytes(), nil
+}
+
+// decodeMsgPack is the inverse of encodeMsgPack. Numbers decode to float64
+// as they do from JSON, so handlers need not care about the encoding.
+func decodeMsgPack(data []byte) (Message, error) {
+	d := &mpDecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return Message{}, err
+	}
+	if d.pos != len(d.data) {
+		return Message{}, fmt.Errorf("%w: trailing bytes", errMsgPack)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return Message{}, fmt.Errorf("%w: envelope is not a map", errMsgPack)
+	}
+	var msg Message
+	msg.ID, _ = m["id"].(string)
+	msg.Type, _ = m["type"].(string)
+	msg.TS, _ = m["ts"].(string)
+	msg.Payload, _ = m["payload"].(map[string]any)
+	msg.Ack, _ = m["ack"].(bool)
+	return msg, nil
+}
+
+func writeValue(buf *bytes.Buffer, v any) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if t {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case float64:
+		if t == math.Trunc(t) && t >= math.MinInt64 && t < math.MaxInt64 {
+			writeInt(buf, int64(t))
+		} else {
+			buf.WriteByte(0xcb)
+			_ = binary.Write(buf, binary.BigEndian, math.Float64bits(t))
+		}
+	case string:
+		writeString(buf, t)
+	case []any:
+		writeArrayHeader(buf, len(t))
+		for _, e := range t {
+			if err := writeValue(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		writeMapHeader(buf, len(t))
+		for k, e := range t {
+			writeString(buf, k)
+			if err := writeValue(buf, e); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+func writeInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		buf.WriteByte(byte(n))
+	case n < 0 && n >= -32:
+		buf.WriteByte(byte(int8(n)))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		buf.Write([]byte{0xd0, byte(int8(n))})
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		_ = binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		_ = binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		_ = binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteString(s)
+}
+
+func writeArrayHeader(buf *bytes.Buffer, n int) {
+	switch {
+	case n < 16:
+		buf.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xdc)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdd)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMapHeader(buf *bytes.Buffer, n int) {
+	switch {
+	case n < 16:
+		buf.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xde)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdf)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+type mpDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *mpDecoder) take(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, fmt.Errorf("%w: truncated", errMsgPack)
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *mpDecoder) uint(size int) (uint64, error) {
+	b, err := d.take(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func (d *mpDecoder) value(depth int) (any, error) {
+	if depth > maxMsgPackDepth {
+		return nil, fmt.Errorf("%w: nested too deeply", errMsgPack)
+	}
+	b, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return float64(c), nil
+	case c >= 0xe0:
+		return float64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.array(int(c&0x0f), depth)
+	case c&0xf0 == 0x80:
+		return d.mapping(int(c&0x0f), depth)
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (c - 0xcc))
+		return float64(n), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := 64 - 8*size
+		return float64(int64(n<<shift) >> shift), nil
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		// bin8/16/32 is returned as a string.
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapping(int(n), depth)
+	}
+	return nil, fmt.Errorf("%w: unsupported type byte 0x%02x", errMsgPack, c)
+}
+
+func (d *mpDecoder) str(n int) (any, error) {
+	b, err := d.take(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *mpDecoder) array(n, depth int) (any, error) {
+	// Every element takes at least one byte; reject impossible lengths
+	// before allocating.
+	if n > len(d.data)-d.pos {
+		return nil, fmt.Errorf("%w: truncated", errMsgPack)
+	}
+	out := make([]any, n)
+	for i := range out {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (d *mpDecoder) mapping(n, depth int) (any, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, fmt.Errorf("%w: truncated", errMsgPack)
+	}
+	out := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: map key is %T", errMsgPack, k)
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
@@ -0,0 +1,58 @@
+package wsconn
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMsgPackRoundTrip(t *testing.T) {
+	msg := Message{
+		ID:   "m-1",
+		Type: "server.task.available",
+		TS:   "2026-01-02T03:04:05Z",
+		Payload: map[string]any{
+			"task_id":  float64(42),
+			"negative": float64(-70000),
+			"ratio":    0.25,
+			"big":      float64(1 << 40),
+			"name":     strings.Repeat("x", 300),
+			"enabled":  true,
+			"none":     nil,
+			"tags":     []any{"a", float64(1), false},
+			"nested":   map[string]any{"deep": map[string]any{"k": "v"}},
+		},
+		Ack: true,
+	}
+	data, err := encodeMsgPack(msg)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	got, err := decodeMsgPack(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Fatalf("round trip mismatch:\n got %#v\nwant %#v", got, msg)
+	}
+}
+
+func TestMsgPackDecodeRejectsMalformed(t *testing.T) {
+	valid, err := encodeMsgPack(newMessage("agent.pong", map[string]any{"n": float64(1)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string][]byte{
+		"truncated":  valid[:len(valid)-1],
+		"trailing":   append(append([]byte(nil), valid...), 0xc0),
+		"not a map":  {0x93, 0x01, 0x02, 0x03},
+		"huge array": {0xdd, 0xff, 0xff, 0xff, 0xff},
+		"int key":    {0x81, 0x01, 0x02},
+	}
+	for name, data := range cases {
+		if _, err := decodeMsgPack(data); !errors.Is(err, errMsgPack) {
+			t.Errorf("%s: err = %v, want errMsgPack", name, err)
+		}
+	}
+}
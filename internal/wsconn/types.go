@@ -4,7 +4,8 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
-	"time"
+
+	"appcenter-agent/internal/clock"
 )
 
 // Message is the standard WS envelope matching the server's make_message format.
@@ -20,7 +21,7 @@ func newMessage(msgType string, payload map[string]any) Message {
 	return Message{
 		ID:      msgID(),
 		Type:    msgType,
-		TS:      time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		TS:      clock.Now().UTC().Format("2006-01-02T15:04:05Z"),
 		Payload: payload,
 		Ack:     false,
 	}
@@ -72,4 +73,7 @@ type Callbacks struct {
 
 	// OnAnnouncementPush is called when server pushes announcement notifications.
 	OnAnnouncementPush func(payload map[string]any)
+
+	// OnCredentialRotate is called when server issues a new agent secret.
+	OnCredentialRotate func(payload map[string]any)
 }
@@ -48,10 +48,15 @@ func (w *rotatingWriter) Write(p []byte) (int, error) {
 		}
 	}
 
-	if err := w.rotateIfNeeded(int64(len(p))); err != nil {
+	out := []byte(Redact(string(p)))
+	if err := w.rotateIfNeeded(int64(len(out))); err != nil {
 		return 0, err
 	}
-	return w.file.Write(p)
+	if _, err := w.file.Write(out); err != nil {
+		return 0, err
+	}
+	// Report the caller's length; redaction may change the written size.
+	return len(p), nil
 }
 
 func (w *rotatingWriter) Close() error {
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secret values in logs and diagnostics.
+const Redacted = "[REDACTED]"
+
+var (
+	redactMu      sync.RWMutex
+	redactSecrets = map[string]struct{}{}
+
+	// secretFieldRe matches key/value pairs whose value is a credential,
+	// in JSON ("secret_key":"x"), YAML (secret_key: x) and header (X-Agent-Secret: x) form.
+	secretFieldRe = regexp.MustCompile(`(?i)("?(?:secret_key|secret|x-agent-secret|enrollment_token|password)"?\s*[:=]\s*"?)([^"\s,}&]+)`)
+)
+
+// RegisterSecret makes Redact hide s wherever it appears. Short values are
+// ignored to avoid mangling unrelated text.
+func RegisterSecret(s string) {
+	if len(s) < 6 {
+		return
+	}
+	redactMu.Lock()
+	redactSecrets[s] = struct{}{}
+	redactMu.Unlock()
+}
+
+// Redact hides registered secrets and credential-looking fields in s.
+func Redact(s string) string {
+	redactMu.RLock()
+	for secret := range redactSecrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+	redactMu.RUnlock()
+	return secretFieldRe.ReplaceAllString(s, "${1}"+Redacted)
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	RegisterSecret("registered-value-123")
+
+	cases := map[string]string{
+		`token leaked registered-value-123 here`: `token leaked [REDACTED] here`,
+		`{"secret_key":"abc","uuid":"u1"}`:       `{"secret_key":"[REDACTED]","uuid":"u1"}`,
+		`X-Agent-Secret: abc`:                    `X-Agent-Secret: [REDACTED]`,
+		`secret_key: plain`:                      `secret_key: [REDACTED]`,
+		`nothing to hide`:                        `nothing to hide`,
+	}
+	for in, want := range cases {
+		if got := Redact(in); got != want {
+			t.Errorf("Redact(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestLoggerRedactsSecrets(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "agent.log")
+	logger, closer, err := NewLogger(logPath, 1, 1)
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+	RegisterSecret("logger-secret-xyz")
+	logger.Printf("register response: %s", "logger-secret-xyz")
+	_ = closer.Close()
+
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "logger-secret-xyz") || !strings.Contains(string(b), Redacted) {
+		t.Fatalf("secret not redacted: %q", b)
+	}
+}